@@ -2,4 +2,4 @@
 
 cd $GOPATH/src/github.com/kyokan/chaind
 make deps
-GOOS=linux GOARCH=amd64 go build -ldflags '-w -extldflags "-static"' -o ./target/chaind ./cmd/chaind/main.go
\ No newline at end of file
+GOOS=linux GOARCH=amd64 go build -ldflags "$LDFLAGS -w -extldflags \"-static\"" -o ./target/chaind ./cmd/chaind/main.go
\ No newline at end of file
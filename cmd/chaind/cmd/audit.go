@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kyokan/chaind/internal/audit"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/spf13/cobra"
+)
+
+const exportDateFormat = "2006-01-02"
+
+var exportFrom string
+var exportTo string
+var exportOut string
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "manages the audit log",
+}
+
+var auditExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "exports audit records for a compliance request",
+	Long: `Exports the audit records written between --from (inclusive) and --to
+(exclusive) as a gzipped tar archive. The archive holds the records, a
+manifest with their SHA-256, and the manifest's signature by the key in
+[log_auditor].signing_key_file. Dates are UTC days, e.g. 2018-06-01, or
+RFC 3339 times.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		from, err := parseExportTime("--from", exportFrom)
+		if err != nil {
+			return err
+		}
+		to, err := parseExportTime("--to", exportTo)
+		if err != nil {
+			return err
+		}
+		if !from.Before(to) {
+			return errors.New("--from must be before --to")
+		}
+		if exportOut == "" {
+			return errors.New("--out must be set")
+		}
+
+		cfg, err := config.ReadConfig(false)
+		if err != nil {
+			return err
+		}
+		auditCfg := cfg.LogAuditorConfig
+		if auditCfg == nil || auditCfg.LogFile == "" {
+			return errors.New("no [log_auditor] log file defined")
+		}
+		if auditCfg.SigningKeyFile == "" {
+			return errors.New("exports require a [log_auditor] signing_key_file")
+		}
+		key, err := audit.LoadSigningKey(auditCfg.SigningKeyFile)
+		if err != nil {
+			return err
+		}
+
+		out, err := os.OpenFile(exportOut, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		manifest, err := audit.Export(auditCfg.LogFile, from, to, key, out)
+		if err != nil {
+			out.Close()
+			os.Remove(exportOut)
+			return err
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+		fmt.Printf("exported %d records to %s (sha256 %s)\n", manifest.Records, exportOut, manifest.SHA256)
+		return nil
+	},
+}
+
+func parseExportTime(flag string, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, fmt.Errorf("%s must be set", flag)
+	}
+	if t, err := time.Parse(exportDateFormat, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s: %s", flag, value)
+	}
+	return t, nil
+}
+
+func init() {
+	auditExportCmd.Flags().StringVar(&exportFrom, "from", "", "start of the exported range")
+	auditExportCmd.Flags().StringVar(&exportTo, "to", "", "end of the exported range")
+	auditExportCmd.Flags().StringVar(&exportOut, "out", "", "file to write the archive to")
+	auditCmd.AddCommand(auditExportCmd)
+	rootCmd.AddCommand(auditCmd)
+}
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"errors"
+
+	"github.com/kyokan/chaind/internal"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/spf13/cobra"
+)
+
+var devETHURL string
+var devPort int
+
+var devCmd = &cobra.Command{
+	Use:   "dev",
+	Short: "runs chaind in front of a single backend, without a config file",
+	Long: `Runs a minimal chaind in front of a single Ethereum backend, for local
+development. No config file or Redis is needed: caching, auditing, the admin
+API and metrics are disabled, any origin may call the RPC endpoint, and logs
+are verbose.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if devETHURL == "" {
+			return errors.New("--eth must be set")
+		}
+
+		cfg := devConfig(devETHURL, devPort)
+		return internal.Start(&cfg)
+	},
+}
+
+func devConfig(ethURL string, port int) config.Config {
+	return config.Config{
+		ETHUrl:   "eth",
+		RPCPort:  port,
+		LogLevel: "debug",
+		CORSConfig: &config.CORSConfig{
+			AllowedOrigins: []string{"*"},
+		},
+		Backends: []config.Backend{
+			{
+				Type: pkg.EthBackend,
+				URL:  ethURL,
+				Name: "dev",
+				Main: true,
+			},
+		},
+	}
+}
+
+func init() {
+	devCmd.Flags().StringVar(&devETHURL, "eth", "", "URL of the Ethereum backend, e.g. http://localhost:8545")
+	devCmd.Flags().IntVar(&devPort, "port", 8080, "port to serve JSON-RPC on")
+	rootCmd.AddCommand(devCmd)
+}
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/version"
+	"github.com/spf13/cobra"
+)
+
+var versionJSON bool
+
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "prints the build chaind was built from",
+	Long: `Prints the version, git commit and build date chaind was built from. If
+a config file is found, the features it enables are printed too.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var features []string
+		cfg, cfgErr := config.ReadConfig(false)
+		if cfgErr == nil {
+			features = cfg.Features.Enabled()
+		}
+		info := version.Get(features)
+
+		if versionJSON {
+			return json.NewEncoder(os.Stdout).Encode(info)
+		}
+		fmt.Printf("version:    %s\n", info.Version)
+		fmt.Printf("commit:     %s\n", info.Commit)
+		fmt.Printf("build date: %s\n", info.BuildDate)
+		fmt.Printf("go version: %s\n", info.GoVersion)
+		if cfgErr == nil {
+			fmt.Printf("features:   %s\n", strings.Join(features, ", "))
+		}
+		return nil
+	},
+}
+
+func init() {
+	versionCmd.Flags().BoolVar(&versionJSON, "json", false, "print the build info as JSON")
+	rootCmd.AddCommand(versionCmd)
+}
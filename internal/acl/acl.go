@@ -0,0 +1,122 @@
+package acl
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/log"
+)
+
+// ACL allows or denies clients by the CIDR range of their address. Deny
+// rules take precedence; when allow rules are present, clients must match
+// one of them.
+type ACL struct {
+	allow  []*net.IPNet
+	deny   []*net.IPNet
+	logger log15.Logger
+}
+
+func New(rules *config.ACLRules) (*ACL, error) {
+	allow, err := ParseCIDRs(rules.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := ParseCIDRs(rules.Deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ACL{
+		allow:  allow,
+		deny:   deny,
+		logger: log.NewLog("acl"),
+	}, nil
+}
+
+func (a *ACL) Allowed(ip net.IP) bool {
+	if matches(a.deny, ip) {
+		return false
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+
+	return matches(a.allow, ip)
+}
+
+// Wrap rejects requests from disallowed clients with a 403 before they reach
+// next. Clients are identified by the connection's remote address, since
+// headers like X-Real-IP can be spoofed.
+func (a *ACL) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || !a.Allowed(ip) {
+			a.logger.Info("rejected request from disallowed address", "addr", host)
+			res.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(res, req)
+	})
+}
+
+// Wrap applies the rules to next, or returns next unchanged when rules is
+// nil.
+func Wrap(rules *config.ACLRules, next http.Handler) (http.Handler, error) {
+	if rules == nil {
+		return next, nil
+	}
+
+	a, err := New(rules)
+	if err != nil {
+		return nil, err
+	}
+	return a.Wrap(next), nil
+}
+
+// ParseCIDRs parses CIDR ranges. Bare IP addresses are treated as ranges
+// containing only that address.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address: %s", cidr)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range: %s", cidr)
+		}
+		out = append(out, ipNet)
+	}
+
+	return out, nil
+}
+
+func matches(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,55 @@
+package acl
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestACLAllowed(t *testing.T) {
+	a, err := New(&config.ACLRules{
+		Allow: []string{"10.0.0.0/8", "192.168.0.0/16"},
+		Deny:  []string{"10.6.6.0/24", "192.168.1.1"},
+	})
+	require.NoError(t, err)
+	require.True(t, a.Allowed(net.ParseIP("10.1.2.3")))
+	require.False(t, a.Allowed(net.ParseIP("10.6.6.6")))
+	require.False(t, a.Allowed(net.ParseIP("192.168.1.1")))
+	require.True(t, a.Allowed(net.ParseIP("192.168.1.2")))
+	require.False(t, a.Allowed(net.ParseIP("8.8.8.8")))
+
+	denyOnly, err := New(&config.ACLRules{
+		Deny: []string{"203.0.113.0/24"},
+	})
+	require.NoError(t, err)
+	require.True(t, denyOnly.Allowed(net.ParseIP("8.8.8.8")))
+	require.False(t, denyOnly.Allowed(net.ParseIP("203.0.113.7")))
+
+	_, err = New(&config.ACLRules{Allow: []string{"not-a-cidr"}})
+	require.Error(t, err)
+}
+
+func TestACLWrap(t *testing.T) {
+	h, err := Wrap(&config.ACLRules{
+		Allow: []string{"127.0.0.1"},
+	}, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusTeapot)
+	}))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	res := httptest.NewRecorder()
+	h.ServeHTTP(res, req)
+	require.Equal(t, http.StatusTeapot, res.Code)
+
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("x-real-ip", "127.0.0.1")
+	res = httptest.NewRecorder()
+	h.ServeHTTP(res, req)
+	require.Equal(t, http.StatusForbidden, res.Code)
+}
@@ -0,0 +1,153 @@
+package admin
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/kyokan/chaind/internal/proxy"
+	"github.com/kyokan/chaind/internal/quarantine"
+	"github.com/kyokan/chaind/pkg"
+)
+
+type backendRequest struct {
+	Backend string `json:"backend"`
+	Timeout string `json:"timeout"`
+}
+
+// RegisterQuarantine exposes the quarantine list. It must be called before
+// Start.
+func (s *Server) RegisterQuarantine(q *quarantine.List) {
+	s.Handle("/backends/quarantine", func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			res.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(res, http.StatusOK, q.Entries())
+	})
+	s.Handle("/backends/drain", func(res http.ResponseWriter, req *http.Request) {
+		name, ok := s.readBackendRequest(res, req)
+		if !ok {
+			return
+		}
+		if !s.hasBackend(name) {
+			writeError(res, http.StatusNotFound, "unknown backend")
+			return
+		}
+
+		q.Drain(name)
+		writeJSON(res, http.StatusOK, q.Entries())
+	})
+	s.Handle("/backends/release", func(res http.ResponseWriter, req *http.Request) {
+		name, ok := s.readBackendRequest(res, req)
+		if !ok {
+			return
+		}
+		if !q.Release(name) {
+			writeError(res, http.StatusNotFound, "backend is not quarantined")
+			return
+		}
+
+		writeJSON(res, http.StatusOK, q.Entries())
+	})
+}
+
+func (s *Server) readBackendRequest(res http.ResponseWriter, req *http.Request) (string, bool) {
+	body, ok := s.decodeBackendRequest(res, req)
+	if !ok {
+		return "", false
+	}
+
+	return body.Backend, true
+}
+
+func (s *Server) decodeBackendRequest(res http.ResponseWriter, req *http.Request) (*backendRequest, bool) {
+	if req.Method != http.MethodPost {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return nil, false
+	}
+
+	var body backendRequest
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxConfigSize)).Decode(&body); err != nil || body.Backend == "" {
+		writeError(res, http.StatusBadRequest, "request must specify a backend")
+		return nil, false
+	}
+
+	return &body, true
+}
+
+func (s *Server) hasBackend(name string) bool {
+	s.cfgMtx.Lock()
+	defer s.cfgMtx.Unlock()
+
+	for _, backend := range s.currentCfg.Backends {
+		if backend.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RegisterHealth exposes the backend health table. It must be called before
+// Start.
+func (s *Server) RegisterHealth(sw proxy.BackendSwitch) {
+	s.Handle("/backends/health", func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			res.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(res, http.StatusOK, sw.Health(pkg.EthBackend))
+	})
+	s.Handle("/backends/healthchecks", func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			res.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(res, http.StatusOK, sw.HealthcheckStats())
+	})
+}
+
+// RegisterFailover exposes graceful backend switches. It must be called
+// before Start.
+func (s *Server) RegisterFailover(d *proxy.Drainer) {
+	s.Handle("/backends/switch", func(res http.ResponseWriter, req *http.Request) {
+		body, ok := s.decodeBackendRequest(res, req)
+		if !ok {
+			return
+		}
+		var timeout time.Duration
+		if body.Timeout != "" {
+			parsed, err := time.ParseDuration(body.Timeout)
+			if err != nil || parsed < 0 {
+				writeError(res, http.StatusBadRequest, "invalid timeout")
+				return
+			}
+			timeout = parsed
+		}
+
+		report, err := d.SwitchTo(body.Backend, timeout)
+		if err != nil {
+			writeError(res, http.StatusConflict, err.Error())
+			return
+		}
+		writeJSON(res, http.StatusOK, report)
+	})
+}
+
+// RegisterWeights exposes the adaptive weights of the backends. It must be
+// called before Start.
+func (s *Server) RegisterWeights(tuner *proxy.WeightTuner) {
+	s.Handle("/backends/weights", func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			res.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(res, http.StatusOK, tuner.Weights())
+	})
+}
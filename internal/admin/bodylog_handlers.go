@@ -0,0 +1,53 @@
+package admin
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/kyokan/chaind/internal/bodylog"
+)
+
+type bodyLogRequest struct {
+	Method   string  `json:"method"`
+	Rate     float64 `json:"rate"`
+	Duration string  `json:"duration"`
+}
+
+// RegisterBodyLogging allows logging the bodies of a sample of a method's
+// requests for a limited time. It must be called before Start.
+func (s *Server) RegisterBodyLogging(sampler *bodylog.Sampler) {
+	s.Handle("/logging/bodies", func(res http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var body bodyLogRequest
+			if err := json.NewDecoder(io.LimitReader(req.Body, maxConfigSize)).Decode(&body); err != nil {
+				writeError(res, http.StatusBadRequest, "invalid request body")
+				return
+			}
+			window, err := time.ParseDuration(body.Duration)
+			if err != nil {
+				writeError(res, http.StatusBadRequest, "invalid duration")
+				return
+			}
+			if _, err := sampler.Enable(body.Method, body.Rate, window); err != nil {
+				writeError(res, http.StatusBadRequest, err.Error())
+				return
+			}
+		case http.MethodDelete:
+			method := req.URL.Query().Get("method")
+			if method == "" {
+				writeError(res, http.StatusBadRequest, "method must be set")
+				return
+			}
+			sampler.Disable(method)
+		default:
+			res.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(res, http.StatusOK, sampler.Rules())
+	})
+}
@@ -0,0 +1,107 @@
+package admin
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/kyokan/chaind/internal/cache"
+	"github.com/kyokan/chaind/pkg/events"
+)
+
+type purgeRequest struct {
+	// Tenant purges the keys from the named tenant's cache entries.
+	Tenant string   `json:"tenant,omitempty"`
+	Keys   []string `json:"keys"`
+}
+
+type purgeReport struct {
+	Purged []string `json:"purged"`
+	Errors []string `json:"errors"`
+}
+
+// RegisterCache exposes cache purging. It must be called before Start.
+func (s *Server) RegisterCache(cacher cache.Cacher) {
+	s.Handle("/cache/purge", func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			res.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var body purgeRequest
+		if err := json.NewDecoder(io.LimitReader(req.Body, maxConfigSize)).Decode(&body); err != nil || len(body.Keys) == 0 {
+			writeError(res, http.StatusBadRequest, "request must specify keys to purge")
+			return
+		}
+
+		// tenants' keys are purged through their cacher, so that their
+		// quota usage is updated as well
+		target := cacher
+		var prefix string
+		if body.Tenant != "" {
+			var tenant *cache.QuotaCacher
+			if s.tenants != nil {
+				tenant = s.tenants.Named(body.Tenant)
+			}
+			if tenant == nil {
+				writeError(res, http.StatusBadRequest, "unknown tenant "+body.Tenant)
+				return
+			}
+			target = tenant
+			prefix = tenant.Prefix()
+		}
+
+		report := &purgeReport{
+			Purged: []string{},
+		}
+		var invalidated []string
+		for _, key := range body.Keys {
+			if err := target.Del(key); err != nil {
+				s.logger.Error("failed to purge cache key", "key", key, "err", err)
+				report.Errors = append(report.Errors, key+": "+err.Error())
+				continue
+			}
+			report.Purged = append(report.Purged, key)
+			invalidated = append(invalidated, prefix+key)
+		}
+		s.logger.Info("purged cache keys", "tenant", body.Tenant, "count", len(report.Purged))
+		if len(invalidated) > 0 {
+			s.bus.Publish(events.CacheInvalidation, events.CacheInvalidationData{
+				Keys: invalidated,
+			})
+		}
+
+		status := http.StatusOK
+		if len(report.Errors) > 0 {
+			status = http.StatusInternalServerError
+		}
+		writeJSON(res, status, report)
+	})
+}
+
+// RegisterTenants exposes the cache usage of each tenant, and lets
+// /cache/purge purge tenants' keys. It must be called before Start.
+func (s *Server) RegisterTenants(tenants *cache.Tenants) {
+	s.tenants = tenants
+	s.Handle("/cache/tenants", func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			res.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(res, http.StatusOK, tenants.Usage())
+	})
+}
+
+// RegisterMemoryCache exposes the activity of the in-memory cache tier. It
+// must be called before Start.
+func (s *Server) RegisterMemoryCache(memCache *cache.MemoryCacher) {
+	s.Handle("/cache/memory", func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			res.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(res, http.StatusOK, memCache.Stats())
+	})
+}
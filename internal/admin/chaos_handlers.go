@@ -0,0 +1,93 @@
+package admin
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/kyokan/chaind/internal/chaos"
+	"github.com/kyokan/chaind/pkg/config"
+)
+
+type chaosFault struct {
+	Backend   string  `json:"backend,omitempty"`
+	Latency   string  `json:"latency,omitempty"`
+	DropRate  float64 `json:"drop_rate,omitempty"`
+	Unhealthy bool    `json:"unhealthy,omitempty"`
+}
+
+type chaosRequest struct {
+	Faults []chaosFault `json:"faults"`
+}
+
+// RegisterChaos exposes the active injected faults, and allows replacing
+// them. It must be called before Start.
+func (s *Server) RegisterChaos(faults *chaos.Injector) {
+	s.Handle("/chaos", func(res http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var body chaosRequest
+			if err := json.NewDecoder(io.LimitReader(req.Body, maxConfigSize)).Decode(&body); err != nil {
+				writeError(res, http.StatusBadRequest, "invalid request body")
+				return
+			}
+			next, err := toConfigFaults(body.Faults)
+			if err != nil {
+				writeError(res, http.StatusBadRequest, err.Error())
+				return
+			}
+
+			faults.Set(next)
+			s.logger.Warn("updated injected faults", "count", len(next))
+		default:
+			res.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(res, http.StatusOK, fromConfigFaults(faults.Faults()))
+	})
+}
+
+func toConfigFaults(faults []chaosFault) ([]config.ChaosFault, error) {
+	out := make([]config.ChaosFault, 0, len(faults))
+	for _, fault := range faults {
+		var latency time.Duration
+		if fault.Latency != "" {
+			parsed, err := time.ParseDuration(fault.Latency)
+			if err != nil {
+				return nil, err
+			}
+			latency = parsed
+		}
+		out = append(out, config.ChaosFault{
+			Backend:   fault.Backend,
+			Latency:   latency,
+			DropRate:  fault.DropRate,
+			Unhealthy: fault.Unhealthy,
+		})
+	}
+
+	return out, config.ValidateChaosFaults(out)
+}
+
+func fromConfigFaults(faults []config.ChaosFault) *chaosRequest {
+	out := &chaosRequest{
+		Faults: []chaosFault{},
+	}
+	for _, fault := range faults {
+		var latency string
+		if fault.Latency > 0 {
+			latency = fault.Latency.String()
+		}
+		out.Faults = append(out.Faults, chaosFault{
+			Backend:   fault.Backend,
+			Latency:   latency,
+			DropRate:  fault.DropRate,
+			Unhealthy: fault.Unhealthy,
+		})
+	}
+
+	return out
+}
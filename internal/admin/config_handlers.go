@@ -0,0 +1,213 @@
+package admin
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/events"
+)
+
+const maxConfigSize = 1 << 20
+
+// ApplyFunc hot-applies the reloadable parts of a validated config to the
+// running subsystems.
+type ApplyFunc func(cfg *config.Config) error
+
+// settings under these keys can be applied without a restart
+var reloadableKeys = []string{
+	"log_level",
+	"log_format",
+	"rate_limit.",
+}
+
+type ConfigReport struct {
+	Valid           bool            `json:"valid"`
+	Errors          []string        `json:"errors"`
+	Warnings        []string        `json:"warnings"`
+	Changes         []config.Change `json:"changes"`
+	RestartRequired []string        `json:"restart_required"`
+	// Reloadable lists the settings that can be applied without a restart:
+	// keys, and stanzas whose keys can all be reloaded.
+	Reloadable []string `json:"reloadable"`
+	// Saved reports whether an applied config was written to disk, and
+	// SaveError why it wasn't. Applied configs that weren't saved are lost
+	// on restart.
+	Saved     *bool  `json:"saved,omitempty"`
+	SaveError string `json:"save_error,omitempty"`
+}
+
+func (s *Server) handleGetConfig(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.cfgMtx.Lock()
+	flat := config.Flatten(s.currentCfg)
+	s.cfgMtx.Unlock()
+	writeJSON(res, http.StatusOK, flat)
+}
+
+func (s *Server) handleDiffConfig(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, _, report, err := s.readCandidate(req)
+	if err != nil {
+		writeError(res, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	writeJSON(res, http.StatusOK, report)
+}
+
+func (s *Server) handleApplyConfig(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.cfgMtx.Lock()
+	defer s.cfgMtx.Unlock()
+
+	raw, candidate, report, err := s.readCandidateLocked(req)
+	if err != nil {
+		writeError(res, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !report.Valid {
+		writeJSON(res, http.StatusBadRequest, report)
+		return
+	}
+	if len(report.RestartRequired) > 0 {
+		writeJSON(res, http.StatusConflict, report)
+		return
+	}
+	if len(report.Changes) == 0 {
+		writeJSON(res, http.StatusOK, report)
+		return
+	}
+
+	// stage the new file first so that a failed apply leaves both the
+	// running config and the config on disk untouched. Configs that can't
+	// be staged, e.g. in a read-only directory, are still applied, and
+	// reported unsaved.
+	tmp, saveErr := stageConfig(s.cfgPath, raw)
+	if tmp != "" {
+		defer os.Remove(tmp)
+	}
+
+	if err := s.applyFunc(candidate); err != nil {
+		s.logger.Error("failed to apply config", "err", err)
+		writeError(res, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if saveErr == nil {
+		saveErr = os.Rename(tmp, s.cfgPath)
+	}
+	saved := saveErr == nil
+	report.Saved = &saved
+	if saveErr != nil {
+		s.logger.Error("applied config but failed to persist it", "path", s.cfgPath, "err", saveErr)
+		report.SaveError = saveErr.Error()
+	}
+
+	s.currentCfg = candidate
+	s.logger.Info("applied new config", "changes", len(report.Changes))
+	changes := make([]string, 0, len(report.Changes))
+	for _, change := range report.Changes {
+		changes = append(changes, change.Key)
+	}
+	s.bus.Publish(events.ConfigReload, events.ConfigReloadData{
+		Changes: changes,
+		Config:  candidate,
+	})
+	writeJSON(res, http.StatusOK, report)
+}
+
+// stageConfig writes the config to a temporary file next to path, and
+// returns the file's name. The name is also returned if writing failed, so
+// that the file can be removed.
+func stageConfig(path string, raw []byte) (string, error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".chaind.toml-")
+	if err != nil {
+		return "", err
+	}
+	_, err = tmp.Write(raw)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	return tmp.Name(), err
+}
+
+func (s *Server) readCandidate(req *http.Request) ([]byte, *config.Config, *ConfigReport, error) {
+	s.cfgMtx.Lock()
+	defer s.cfgMtx.Unlock()
+	return s.readCandidateLocked(req)
+}
+
+func (s *Server) readCandidateLocked(req *http.Request) ([]byte, *config.Config, *ConfigReport, error) {
+	raw, err := ioutil.ReadAll(http.MaxBytesReader(nil, req.Body, maxConfigSize))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	candidate, err := config.ParseConfig(bytes.NewReader(raw))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	report := &ConfigReport{
+		Valid:   true,
+		Changes: config.Diff(s.currentCfg, &candidate),
+	}
+	validation := config.Validate(&candidate)
+	report.Errors = validation.Errors
+	report.Warnings = validation.Warnings
+	if candidate.LogLevel != "" {
+		if _, err := log15.LvlFromString(candidate.LogLevel); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		}
+	}
+	report.Valid = len(report.Errors) == 0
+	report.RestartRequired = restartRequired(s.currentCfg, &candidate, report.Changes)
+	for _, key := range reloadableKeys {
+		report.Reloadable = append(report.Reloadable, strings.TrimSuffix(key, "."))
+	}
+	return raw, &candidate, report, nil
+}
+
+func restartRequired(old *config.Config, new *config.Config, changes []config.Change) []string {
+	// the rate limiter can only be reconfigured, not switched on or off
+	rateLimitToggled := (old.RateLimitConfig == nil) != (new.RateLimitConfig == nil)
+
+	var out []string
+	for _, change := range changes {
+		if rateLimitToggled && strings.HasPrefix(change.Key, "rate_limit.") {
+			out = append(out, change.Key)
+			continue
+		}
+		if !isReloadable(change.Key) {
+			out = append(out, change.Key)
+		}
+	}
+
+	return out
+}
+
+func isReloadable(key string) bool {
+	for _, prefix := range reloadableKeys {
+		if key == prefix || (strings.HasSuffix(prefix, ".") && strings.HasPrefix(key, prefix)) {
+			return true
+		}
+	}
+
+	return false
+}
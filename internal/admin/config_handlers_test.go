@@ -0,0 +1,101 @@
+package admin
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kyokan/chaind/internal/stats"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/events"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestartRequired(t *testing.T) {
+	old := &config.Config{
+		LogLevel: "info",
+		RPCPort:  8080,
+	}
+	new := &config.Config{
+		LogLevel: "debug",
+		RPCPort:  8080,
+	}
+	require.Empty(t, restartRequired(old, new, config.Diff(old, new)))
+
+	new.RPCPort = 9090
+	require.Equal(t, []string{"rpc_port"}, restartRequired(old, new, config.Diff(old, new)))
+
+	new.RPCPort = 8080
+	new.RateLimitConfig = &config.RateLimitConfig{
+		RateLimitPolicy: config.RateLimitPolicy{
+			Rate: 10,
+		},
+	}
+	require.Equal(t, []string{"rate_limit.rate"}, restartRequired(old, new, config.Diff(old, new)))
+
+	old.RateLimitConfig = &config.RateLimitConfig{
+		RateLimitPolicy: config.RateLimitPolicy{
+			Rate: 5,
+		},
+	}
+	require.Empty(t, restartRequired(old, new, config.Diff(old, new)))
+}
+
+func TestIsReloadable(t *testing.T) {
+	require.True(t, isReloadable("log_level"))
+	require.True(t, isReloadable("rate_limit.key.0.burst"))
+	require.False(t, isReloadable("log_level_extra"))
+	require.False(t, isReloadable("backend.0.url"))
+}
+
+func TestApplyConfigReportsUnsavedConfigs(t *testing.T) {
+	const cfgFile = `
+[features]
+cache = false
+auditor = false
+
+[[backend]]
+type = "ETH"
+name = "local"
+url = "http://localhost:8545"
+main = true
+`
+	current, err := config.ParseConfig(strings.NewReader("log_level = \"info\"\n" + cfgFile))
+	require.NoError(t, err)
+	var applied *config.Config
+	s := NewServer(&current, stats.NewStore(), events.NewBus(), func(cfg *config.Config) error {
+		applied = cfg
+		return nil
+	})
+	// the directory doesn't exist, so the config can't be staged
+	s.cfgPath = filepath.Join(t.TempDir(), "missing", "chaind.toml")
+
+	req := httptest.NewRequest(http.MethodPost, "/config/apply", strings.NewReader("log_level = \"debug\"\n"+cfgFile))
+	res := httptest.NewRecorder()
+	s.handleApplyConfig(res, req)
+	require.Equal(t, http.StatusOK, res.Code, res.Body.String())
+	var report ConfigReport
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &report))
+	require.Equal(t, []string{"log_level", "log_format", "rate_limit"}, report.Reloadable)
+	require.False(t, *report.Saved)
+	require.NotEmpty(t, report.SaveError)
+	require.Equal(t, "debug", applied.LogLevel)
+	require.Equal(t, "debug", s.currentCfg.LogLevel)
+
+	// configs are saved where they can be
+	s.cfgPath = filepath.Join(t.TempDir(), "chaind.toml")
+	req = httptest.NewRequest(http.MethodPost, "/config/apply", strings.NewReader("log_level = \"warn\"\n"+cfgFile))
+	res = httptest.NewRecorder()
+	s.handleApplyConfig(res, req)
+	require.Equal(t, http.StatusOK, res.Code, res.Body.String())
+	report = ConfigReport{}
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &report))
+	require.True(t, *report.Saved)
+	saved, err := ioutil.ReadFile(s.cfgPath)
+	require.NoError(t, err)
+	require.Contains(t, string(saved), `log_level = "warn"`)
+}
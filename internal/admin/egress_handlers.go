@@ -0,0 +1,20 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/kyokan/chaind/internal/egress"
+)
+
+// RegisterEgress exposes the response bytes served to each client today.
+// It must be called before Start.
+func (s *Server) RegisterEgress(meter *egress.Meter) {
+	s.Handle("/egress", func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			res.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(res, http.StatusOK, meter.Usage())
+	})
+}
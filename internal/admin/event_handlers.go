@@ -0,0 +1,58 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/kyokan/chaind/pkg/events"
+)
+
+// handleEvents streams events from the bus as server-sent events. The types
+// query parameter optionally restricts the stream to a comma-separated list
+// of event types.
+func (s *Server) handleEvents(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := res.(http.Flusher)
+	if !ok || s.bus == nil {
+		writeError(res, http.StatusNotImplemented, "event streaming is not supported")
+		return
+	}
+
+	var types []events.Type
+	if param := req.URL.Query().Get("types"); param != "" {
+		for _, t := range strings.Split(param, ",") {
+			types = append(types, events.Type(t))
+		}
+	}
+	sub := s.bus.Subscribe(types...)
+	defer sub.Close()
+
+	res.Header().Set("content-type", "text/event-stream")
+	res.Header().Set("cache-control", "no-cache")
+	res.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case ev := <-sub.Events():
+			data, err := json.Marshal(ev)
+			if err != nil {
+				s.logger.Error("failed to marshal event", "type", ev.Type, "err", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(res, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		case <-s.shutdown:
+			return
+		}
+	}
+}
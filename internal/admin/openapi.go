@@ -0,0 +1,249 @@
+package admin
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/kyokan/chaind/internal/bodylog"
+	"github.com/kyokan/chaind/internal/cache"
+	"github.com/kyokan/chaind/internal/egress"
+	"github.com/kyokan/chaind/internal/proxy"
+	"github.com/kyokan/chaind/internal/quarantine"
+	"github.com/kyokan/chaind/internal/stats"
+	"github.com/kyokan/chaind/internal/txtrack"
+	"github.com/kyokan/chaind/pkg/events"
+	"github.com/kyokan/chaind/pkg/version"
+)
+
+// OpenAPIVersion is the version of chaind's HTTP API described by the spec.
+const OpenAPIVersion = "1.0.0"
+
+// apiRoute describes an endpoint for the OpenAPI spec. Request and response
+// are example values of the bodies' Go types, from which JSON schemas are
+// generated.
+type apiRoute struct {
+	path        string
+	method      string
+	summary     string
+	params      []string
+	contentType string
+	request     interface{}
+	response    interface{}
+	// rpc marks endpoints served on the RPC listener rather than the admin
+	// listener
+	rpc bool
+}
+
+var apiRoutes = []apiRoute{
+	{path: "/config", method: http.MethodGet, summary: "Returns the running config, keyed by dotted path. Secrets are masked.", response: map[string]string{}},
+	{path: "/config/diff", method: http.MethodPost, summary: "Validates a candidate chaind.toml and reports how it differs from the running config.", contentType: "application/toml", response: ConfigReport{}},
+	{path: "/config/apply", method: http.MethodPost, summary: "Applies a candidate chaind.toml, if it only changes reloadable settings.", contentType: "application/toml", response: ConfigReport{}},
+	{path: "/stats/tags", method: http.MethodGet, summary: "Returns request stats per X-Chaind-Tag.", response: map[string]*stats.TagStats{}},
+	{path: "/stats/tiers", method: http.MethodGet, summary: "Returns the seconds traffic was routed to each backend cost tier.", response: map[string]float64{}},
+	{path: "/stats/query", method: http.MethodGet, summary: "Aggregates the hourly request history.", params: []string{"since", "from", "to", "client", "method", "backend", "group_by", "sort", "limit"}, response: []stats.QueryRow{}},
+	{path: "/events", method: http.MethodGet, summary: "Streams internal events as server-sent events.", params: []string{"types"}, contentType: "text/event-stream"},
+	{path: "/backends/health", method: http.MethodGet, summary: "Returns the health table of the backends.", response: []proxy.BackendHealth{}},
+	{path: "/backends/healthchecks", method: http.MethodGet, summary: "Returns instrumentation of the healthcheck rounds.", response: proxy.HealthcheckStats{}},
+	{path: "/backends/weights", method: http.MethodGet, summary: "Returns the adaptive weights of the backends.", response: []proxy.BackendWeight{}},
+	{path: "/backends/switch", method: http.MethodPost, summary: "Gracefully switches traffic to another backend.", request: backendRequest{}, response: proxy.SwitchReport{}},
+	{path: "/backends/quarantine", method: http.MethodGet, summary: "Returns the quarantined backends.", response: []quarantine.Entry{}},
+	{path: "/backends/drain", method: http.MethodPost, summary: "Quarantines a backend until it is released.", request: backendRequest{}, response: []quarantine.Entry{}},
+	{path: "/backends/release", method: http.MethodPost, summary: "Releases a backend from quarantine.", request: backendRequest{}, response: []quarantine.Entry{}},
+	{path: "/cache/purge", method: http.MethodPost, summary: "Evicts cache keys.", request: purgeRequest{}, response: purgeReport{}},
+	{path: "/cache/memory", method: http.MethodGet, summary: "Returns the activity of the in-memory cache tier.", response: cache.MemoryStats{}},
+	{path: "/cache/tenants", method: http.MethodGet, summary: "Returns the approximate cache usage of each tenant.", response: []cache.TenantUsage{}},
+	{path: "/transactions", method: http.MethodGet, summary: "Returns the status of the transactions submitted through chaind.", params: []string{"hash", "client", "status"}, response: []txtrack.Tx{}},
+	{path: "/egress", method: http.MethodGet, summary: "Returns the response bytes served to each client today.", response: []egress.Usage{}},
+	{path: "/logging/bodies", method: http.MethodGet, summary: "Returns the active body logging rules.", response: []bodylog.Rule{}},
+	{path: "/logging/bodies", method: http.MethodPost, summary: "Logs the bodies of a sample of a method's requests for a limited time.", request: bodyLogRequest{}, response: []bodylog.Rule{}},
+	{path: "/logging/bodies", method: http.MethodDelete, summary: "Stops logging a method's bodies.", params: []string{"method"}, response: []bodylog.Rule{}},
+	{path: "/chaos", method: http.MethodGet, summary: "Returns the injected faults.", response: chaosRequest{}},
+	{path: "/chaos", method: http.MethodPost, summary: "Replaces the injected faults.", request: chaosRequest{}, response: chaosRequest{}},
+	{path: "/state", method: http.MethodGet, summary: "Exports the routing state for a blue/green cutover.", response: RoutingState{}},
+	{path: "/state", method: http.MethodPost, summary: "Imports routing state exported by another instance.", request: RoutingState{}, response: StateReport{}},
+	{path: "/ui", method: http.MethodGet, summary: "Serves a web UI showing backend health, recent failovers and top methods, with a request tester.", contentType: "text/html"},
+	{path: "/ui/events", method: http.MethodGet, summary: "Returns the most recent failovers and backend health changes, most recent first.", response: []events.Event{}},
+	{path: "/ui/rpc", method: http.MethodPost, summary: "Relays a JSON-RPC request to the RPC listener.", contentType: "application/json", response: map[string]interface{}{}},
+	{path: "/openapi.json", method: http.MethodGet, summary: "Returns this spec.", response: map[string]interface{}{}},
+	{path: "/health", method: http.MethodGet, summary: "Returns 200 when a backend is available to serve requests, and 503 otherwise.", rpc: true},
+	{path: "/summary", method: http.MethodGet, summary: "Returns the chain summary also served by chaind_chainSummary.", response: proxy.ChainSummary{}, rpc: true},
+	{path: "/version", method: http.MethodGet, summary: "Returns the build chaind was built from and the features it runs with.", response: version.Info{}, rpc: true},
+}
+
+func (s *Server) handleOpenAPI(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(res, http.StatusOK, openAPISpec(s.routes))
+}
+
+// openAPISpec generates an OpenAPI 3 spec of the given admin routes and the
+// RPC listener's HTTP endpoints. Endpoints registered only under some
+// configurations, e.g. /chaos, are left out when they're not registered.
+func openAPISpec(registered []string) map[string]interface{} {
+	isRegistered := make(map[string]bool)
+	for _, pattern := range registered {
+		isRegistered[pattern] = true
+	}
+
+	paths := make(map[string]map[string]interface{})
+	for _, route := range apiRoutes {
+		if !route.rpc && !isRegistered[route.path] {
+			continue
+		}
+
+		op := map[string]interface{}{
+			"summary":   route.summary,
+			"responses": openAPIResponses(route),
+		}
+		if len(route.params) > 0 {
+			var params []interface{}
+			for _, name := range route.params {
+				params = append(params, map[string]interface{}{
+					"name":   name,
+					"in":     "query",
+					"schema": map[string]string{"type": "string"},
+				})
+			}
+			op["parameters"] = params
+		}
+		if route.request != nil {
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": jsonSchema(reflect.TypeOf(route.request)),
+					},
+				},
+			}
+		} else if route.method == http.MethodPost && route.contentType != "" {
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					route.contentType: map[string]interface{}{
+						"schema": map[string]string{"type": "string"},
+					},
+				},
+			}
+		}
+		if route.rpc {
+			op["servers"] = []map[string]string{
+				{"url": "/", "description": "RPC listener"},
+			}
+		}
+
+		if paths[route.path] == nil {
+			paths[route.path] = make(map[string]interface{})
+		}
+		paths[route.path][strings.ToLower(route.method)] = op
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]string{
+			"title":   "chaind",
+			"version": OpenAPIVersion,
+		},
+		"paths": paths,
+	}
+}
+
+func openAPIResponses(route apiRoute) map[string]interface{} {
+	ok := map[string]interface{}{
+		"description": "OK",
+	}
+	if route.response != nil {
+		ok["content"] = map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": jsonSchema(reflect.TypeOf(route.response)),
+			},
+		}
+	} else if route.method == http.MethodGet && route.contentType != "" {
+		ok["content"] = map[string]interface{}{
+			route.contentType: map[string]interface{}{
+				"schema": map[string]string{"type": "string"},
+			},
+		}
+	}
+
+	responses := map[string]interface{}{
+		"200": ok,
+	}
+	if route.rpc {
+		responses["503"] = map[string]string{"description": "No backend is available"}
+	} else {
+		responses["400"] = map[string]interface{}{
+			"description": "Invalid request",
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": jsonSchema(reflect.TypeOf(map[string]string{})),
+				},
+			},
+		}
+	}
+
+	return responses
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// jsonSchema generates the JSON schema of a type as encoded by
+// encoding/json.
+func jsonSchema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		addStructProperties(t, props)
+		return map[string]interface{}{"type": "object", "properties": props}
+	default:
+		// interfaces may hold anything
+		return map[string]interface{}{}
+	}
+}
+
+func addStructProperties(t reflect.Type, props map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if field.Anonymous && name == "" {
+			addStructProperties(field.Type, props)
+			continue
+		}
+		// unexported fields aren't encoded
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		props[name] = jsonSchema(field.Type)
+	}
+}
@@ -0,0 +1,53 @@
+package admin
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/kyokan/chaind/internal/stats"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenAPISpecCoversRoutes(t *testing.T) {
+	s := NewServer(&config.Config{}, stats.NewStore(), nil, nil)
+	s.RegisterQuarantine(nil)
+	s.RegisterFailover(nil)
+	s.RegisterHealth(nil)
+	s.RegisterWeights(nil)
+	s.RegisterCache(nil)
+	s.RegisterTenants(nil)
+	s.RegisterMemoryCache(nil)
+	s.RegisterUI(http.NotFoundHandler())
+	s.RegisterChaos(nil)
+	s.RegisterTransactions(nil)
+	s.RegisterEgress(nil)
+	s.RegisterBodyLogging(nil)
+	s.RegisterState(nil, nil, nil, nil)
+
+	paths := openAPISpec(s.routes)["paths"].(map[string]map[string]interface{})
+	for _, route := range s.routes {
+		require.Contains(t, paths, route)
+	}
+	require.Contains(t, paths, "/health")
+	require.Contains(t, paths, "/summary")
+	require.Contains(t, paths, "/version")
+	require.Len(t, paths["/chaos"], 2)
+	require.Len(t, paths["/logging/bodies"], 3)
+
+	paths = openAPISpec(NewServer(&config.Config{}, stats.NewStore(), nil, nil).routes)["paths"].(map[string]map[string]interface{})
+	require.NotContains(t, paths, "/chaos")
+}
+
+func TestJSONSchema(t *testing.T) {
+	schema := jsonSchema(reflect.TypeOf(map[string]*stats.TagStats{}))
+	props := schema["additionalProperties"].(map[string]interface{})["properties"].(map[string]interface{})
+	require.Equal(t, map[string]interface{}{"type": "integer"}, props["requests"])
+	require.Equal(t, "object", props["methods"].(map[string]interface{})["type"])
+
+	schema = jsonSchema(reflect.TypeOf(stats.QueryRow{}))
+	props = schema["properties"].(map[string]interface{})
+	require.Equal(t, map[string]interface{}{"type": "string", "format": "date-time"}, props["hour"])
+	require.NotContains(t, props, "latencies")
+}
@@ -0,0 +1,151 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/internal/acl"
+	"github.com/kyokan/chaind/internal/cache"
+	"github.com/kyokan/chaind/internal/stats"
+	"github.com/kyokan/chaind/internal/tlsutil"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/events"
+	"github.com/kyokan/chaind/pkg/log"
+)
+
+const DefaultAddr = "127.0.0.1:8081"
+
+type Server struct {
+	addr     string
+	mux      *http.ServeMux
+	srv      *http.Server
+	logger   log15.Logger
+	quitChan chan bool
+	errChan  chan error
+	// shutdown is closed when the server shuts down, to end event streams
+	shutdown chan struct{}
+
+	// routes holds the registered patterns, for the OpenAPI spec
+	routes []string
+
+	stats *stats.Store
+	bus   *events.Bus
+	// tenants are purged by /cache/purge, if registered
+	tenants *cache.Tenants
+	// rpc serves the requests sent from the UI
+	rpc http.Handler
+
+	cfgMtx     sync.Mutex
+	currentCfg *config.Config
+	applyFunc  ApplyFunc
+	cfgPath    string
+}
+
+func NewServer(cfg *config.Config, statsStore *stats.Store, bus *events.Bus, apply ApplyFunc) *Server {
+	addr := DefaultAddr
+	if cfg.AdminConfig != nil && cfg.AdminConfig.Addr != "" {
+		addr = cfg.AdminConfig.Addr
+	}
+
+	s := &Server{
+		addr:       addr,
+		mux:        http.NewServeMux(),
+		logger:     log.NewLog("admin"),
+		quitChan:   make(chan bool),
+		shutdown:   make(chan struct{}),
+		errChan:    make(chan error),
+		stats:      statsStore,
+		bus:        bus,
+		currentCfg: cfg,
+		applyFunc:  apply,
+		cfgPath:    config.ConfigFilePath(),
+	}
+	s.Handle("/config", s.handleGetConfig)
+	s.Handle("/config/diff", s.handleDiffConfig)
+	s.Handle("/config/apply", s.handleApplyConfig)
+	s.Handle("/stats/tags", s.handleTagStats)
+	s.Handle("/stats/tiers", s.handleTierStats)
+	s.Handle("/stats/query", s.handleQueryStats)
+	s.Handle("/events", s.handleEvents)
+	s.Handle("/openapi.json", s.handleOpenAPI)
+	return s
+}
+
+// Handle registers an additional admin endpoint. It must be called before
+// Start.
+func (s *Server) Handle(pattern string, handler http.HandlerFunc) {
+	s.routes = append(s.routes, pattern)
+	s.mux.HandleFunc(pattern, handler)
+}
+
+func (s *Server) Start() error {
+	var rules *config.ACLRules
+	if s.currentCfg.ACLConfig != nil {
+		rules = s.currentCfg.ACLConfig.Admin
+	}
+	handler, err := acl.Wrap(rules, s.mux)
+	if err != nil {
+		return err
+	}
+	s.srv = &http.Server{
+		Addr:    s.addr,
+		Handler: handler,
+	}
+	s.srv.RegisterOnShutdown(func() {
+		close(s.shutdown)
+	})
+	serve := s.srv.ListenAndServe
+	if s.currentCfg.AdminConfig != nil && s.currentCfg.AdminConfig.TLS != nil {
+		tlsCfg, err := tlsutil.ServerConfig(s.currentCfg.AdminConfig.TLS)
+		if err != nil {
+			return err
+		}
+		s.srv.TLSConfig = tlsCfg
+		serve = func() error {
+			return s.srv.ListenAndServeTLS("", "")
+		}
+	}
+
+	go func() {
+		if err := serve(); err != nil && err != http.ErrServerClosed {
+			s.logger.Error("admin server error", "addr", s.addr, "err", err)
+		}
+	}()
+
+	go func() {
+		<-s.quitChan
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.errChan <- s.srv.Shutdown(ctx)
+	}()
+
+	s.logger.Info("started", "addr", s.addr)
+	return nil
+}
+
+func (s *Server) Stop() error {
+	s.quitChan <- true
+	return <-s.errChan
+}
+
+func writeJSON(res http.ResponseWriter, status int, body interface{}) {
+	out, err := json.Marshal(body)
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("content-type", "application/json")
+	res.WriteHeader(status)
+	res.Write(out)
+}
+
+func writeError(res http.ResponseWriter, status int, msg string) {
+	writeJSON(res, status, map[string]string{
+		"error": msg,
+	})
+}
@@ -0,0 +1,96 @@
+package admin
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/kyokan/chaind/internal/egress"
+	"github.com/kyokan/chaind/internal/proxy"
+	"github.com/kyokan/chaind/internal/quarantine"
+	"github.com/kyokan/chaind/internal/ratelimit"
+	"github.com/kyokan/chaind/pkg"
+)
+
+// StateVersion is the version of the exported state's format. Imports of
+// other versions are rejected.
+const StateVersion = 1
+
+// maxStateSize bounds imported state, which holds a bucket per client.
+const maxStateSize = 32 << 20
+
+// RoutingState is the operational state handed over from one instance to
+// another during a blue/green cutover, so that the new fleet doesn't start
+// from zero. Sections of subsystems that aren't enabled are omitted.
+type RoutingState struct {
+	Version    int                     `json:"version"`
+	ExportedAt time.Time               `json:"exported_at"`
+	Backends   []proxy.BackendHealth   `json:"backends"`
+	Quarantine []quarantine.Entry      `json:"quarantine,omitempty"`
+	RateLimits []ratelimit.BucketState `json:"rate_limits,omitempty"`
+	Egress     *egress.Snapshot        `json:"egress,omitempty"`
+}
+
+// StateReport counts the entries restored from an imported state.
+type StateReport struct {
+	Backends   int `json:"backends"`
+	Quarantine int `json:"quarantine"`
+	RateLimits int `json:"rate_limits"`
+	Egress     int `json:"egress"`
+}
+
+// RegisterState allows exporting the routing state and importing it into
+// another instance. q, limiter and meter may be nil. It must be called
+// before Start.
+func (s *Server) RegisterState(sw proxy.BackendSwitch, q *quarantine.List, limiter *ratelimit.Limiter, meter *egress.Meter) {
+	s.Handle("/state", func(res http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			state := &RoutingState{
+				Version:    StateVersion,
+				ExportedAt: time.Now().UTC(),
+				Backends:   sw.Health(pkg.EthBackend),
+			}
+			if q != nil {
+				state.Quarantine = q.Entries()
+			}
+			if limiter != nil {
+				state.RateLimits = limiter.Buckets()
+			}
+			if meter != nil {
+				snap := meter.Snapshot()
+				state.Egress = &snap
+			}
+			writeJSON(res, http.StatusOK, state)
+		case http.MethodPost:
+			var state RoutingState
+			if err := json.NewDecoder(io.LimitReader(req.Body, maxStateSize)).Decode(&state); err != nil {
+				writeError(res, http.StatusBadRequest, "invalid request body")
+				return
+			}
+			if state.Version != StateVersion {
+				writeError(res, http.StatusBadRequest, "unsupported state version")
+				return
+			}
+
+			// quarantine entries go first, so that the restored current
+			// backend is only selected if it isn't quarantined
+			var report StateReport
+			if q != nil {
+				report.Quarantine = q.Restore(state.Quarantine)
+			}
+			report.Backends = sw.RestoreHealth(pkg.EthBackend, state.Backends)
+			if limiter != nil {
+				report.RateLimits = limiter.Restore(state.RateLimits)
+			}
+			if meter != nil && state.Egress != nil {
+				report.Egress = meter.Restore(*state.Egress)
+			}
+			s.logger.Warn("imported routing state", "exported_at", state.ExportedAt, "backends", report.Backends, "rate_limits", report.RateLimits)
+			writeJSON(res, http.StatusOK, report)
+		default:
+			res.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package admin
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kyokan/chaind/internal/stats"
+)
+
+func (s *Server) handleTagStats(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(res, http.StatusOK, s.stats.Tags())
+}
+
+// handleTierStats reports the seconds traffic was routed to each backend cost
+// tier.
+func (s *Server) handleTierStats(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	out := make(map[string]float64)
+	for tier, d := range s.stats.TierTimes() {
+		out[strconv.Itoa(tier)] = d.Seconds()
+	}
+	writeJSON(res, http.StatusOK, out)
+}
+
+// handleQueryStats aggregates the hourly request history. The range is given
+// either by since (a duration, e.g. 24h) or by from and to (RFC 3339).
+func (s *Server) handleQueryStats(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	q, err := parseQuery(req)
+	if err != nil {
+		writeError(res, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := q.Validate(); err != nil {
+		writeError(res, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rows := s.stats.Query(q)
+	if rows == nil {
+		rows = []*stats.QueryRow{}
+	}
+	writeJSON(res, http.StatusOK, rows)
+}
+
+func parseQuery(req *http.Request) (*stats.Query, error) {
+	params := req.URL.Query()
+	q := &stats.Query{
+		Client:  params.Get("client"),
+		Method:  params.Get("method"),
+		Backend: params.Get("backend"),
+		SortBy:  params.Get("sort"),
+	}
+	if groupBy := params.Get("group_by"); groupBy != "" {
+		q.GroupBy = strings.Split(groupBy, ",")
+	}
+
+	if since := params.Get("since"); since != "" {
+		d, err := time.ParseDuration(since)
+		if err != nil {
+			return nil, err
+		}
+		q.From = time.Now().Add(-d)
+	}
+	if from := params.Get("from"); from != "" {
+		t, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			return nil, err
+		}
+		q.From = t
+	}
+	if to := params.Get("to"); to != "" {
+		t, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			return nil, err
+		}
+		q.To = t
+	}
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			return nil, err
+		}
+		q.Limit = n
+	}
+
+	return q, nil
+}
@@ -0,0 +1,31 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/kyokan/chaind/internal/txtrack"
+)
+
+// RegisterTransactions exposes the status of the transactions submitted
+// through chaind. It must be called before Start.
+func (s *Server) RegisterTransactions(tracker *txtrack.Tracker) {
+	s.Handle("/transactions", func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			res.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		params := req.URL.Query()
+		if hash := params.Get("hash"); hash != "" {
+			tx := tracker.Get(hash)
+			if tx == nil {
+				writeError(res, http.StatusNotFound, "transaction not tracked")
+				return
+			}
+			writeJSON(res, http.StatusOK, []txtrack.Tx{*tx})
+			return
+		}
+
+		writeJSON(res, http.StatusOK, tracker.List(params.Get("client"), txtrack.Status(params.Get("status"))))
+	})
+}
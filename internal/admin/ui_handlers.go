@@ -0,0 +1,164 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/events"
+	"github.com/kyokan/chaind/pkg/version"
+)
+
+// maxRecentEvents is the number of failovers and health changes the UI
+// shows.
+const maxRecentEvents = 50
+
+// UITag is the X-Chaind-Tag of requests sent from the UI's request tester,
+// unless the tester sets another.
+const UITag = "admin-ui"
+
+const uiRPCTimeout = 30 * time.Second
+
+// eventLog keeps the most recent events of a subscription.
+type eventLog struct {
+	events []events.Event
+	mtx    sync.Mutex
+}
+
+func (l *eventLog) follow(sub *events.Subscription, shutdown <-chan struct{}) {
+	defer sub.Close()
+	for {
+		select {
+		case ev, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+			l.add(ev)
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+func (l *eventLog) add(ev events.Event) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.events = append(l.events, ev)
+	if len(l.events) > maxRecentEvents {
+		l.events = l.events[len(l.events)-maxRecentEvents:]
+	}
+}
+
+// Events returns the events, most recent first.
+func (l *eventLog) Events() []events.Event {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	out := make([]events.Event, len(l.events))
+	for i, ev := range l.events {
+		out[len(out)-1-i] = ev
+	}
+	return out
+}
+
+// RegisterUI serves a web UI on /ui showing backend health, recent
+// failovers and top methods, with a form to send JSON-RPC requests to rpc,
+// the RPC listener's handler. It must be called before Start.
+func (s *Server) RegisterUI(rpc http.Handler) {
+	s.rpc = rpc
+	build := version.Get(nil)
+	page := strings.Replace(uiPage, "{{version}}", html.EscapeString(build.Version+" ("+build.Commit+")"), 1)
+	recent := &eventLog{}
+	if s.bus != nil {
+		go recent.follow(s.bus.Subscribe(events.Failover, events.BackendHealth), s.shutdown)
+	}
+
+	s.Handle("/ui", func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			res.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		res.Header().Set("content-type", "text/html; charset=utf-8")
+		io.WriteString(res, page)
+	})
+	s.Handle("/ui/events", func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			res.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(res, http.StatusOK, recent.Events())
+	})
+	s.Handle("/ui/rpc", s.handleUIRPC)
+}
+
+// handleUIRPC hands a JSON-RPC request to the RPC listener's handler
+// in-process, with the UI user's address, so that it goes through the same
+// ACLs, authentication and rate limits as any other request. Requests from
+// other origins are rejected, so that other sites can't send requests with
+// the UI user's access to the admin listener.
+func (s *Server) handleUIRPC(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(req) {
+		writeError(res, http.StatusForbidden, "cross-origin requests are not allowed")
+		return
+	}
+	// browsers preflight cross-origin JSON requests, which aren't answered
+	if mediaType, _, err := mime.ParseMediaType(req.Header.Get("content-type")); err != nil || mediaType != "application/json" {
+		writeError(res, http.StatusUnsupportedMediaType, "request must be sent as application/json")
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(res, req.Body, maxConfigSize))
+	if err != nil || len(body) == 0 {
+		writeError(res, http.StatusBadRequest, "request must be a JSON-RPC request")
+		return
+	}
+
+	s.cfgMtx.Lock()
+	cfg := s.currentCfg
+	s.cfgMtx.Unlock()
+	ctx, cancel := context.WithTimeout(req.Context(), uiRPCTimeout)
+	defer cancel()
+	rpcReq, err := http.NewRequest(http.MethodPost, fmt.Sprintf("/%s", cfg.ETHUrl), bytes.NewReader(body))
+	if err != nil {
+		writeError(res, http.StatusInternalServerError, err.Error())
+		return
+	}
+	rpcReq = rpcReq.WithContext(ctx)
+	rpcReq.RemoteAddr = req.RemoteAddr
+	rpcReq.Header.Set("content-type", "application/json")
+	for _, header := range []string{pkg.APIKeyHeader, "Authorization", pkg.TagHeader, pkg.DebugHeader, pkg.DecodeHeader, pkg.FieldsHeader} {
+		if val := req.Header.Get(header); val != "" {
+			rpcReq.Header.Set(header, val)
+		}
+	}
+	if rpcReq.Header.Get(pkg.TagHeader) == "" {
+		rpcReq.Header.Set(pkg.TagHeader, UITag)
+	}
+
+	s.rpc.ServeHTTP(res, rpcReq)
+}
+
+// sameOrigin reports whether a request was sent by a page served by the
+// admin listener, or by a client that isn't a browser.
+func sameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == req.Host
+}
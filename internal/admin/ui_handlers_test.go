@@ -0,0 +1,78 @@
+package admin
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/internal/stats"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/events"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUIRelaysRequests(t *testing.T) {
+	var relayed *http.Request
+	var relayedBody []byte
+	rpc := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		relayed = r
+		relayedBody, _ = ioutil.ReadAll(r.Body)
+		w.Header().Set(pkg.CacheStatusHeader, pkg.CacheHit)
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x10"}`))
+	})
+
+	s := NewServer(&config.Config{ETHUrl: "eth"}, stats.NewStore(), nil, nil)
+	s.RegisterUI(rpc)
+
+	send := func(origin string, contentType string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/ui/rpc", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}`))
+		req.RemoteAddr = "192.0.2.7:4321"
+		req.Header.Set(pkg.APIKeyHeader, "secret")
+		req.Header.Set("content-type", contentType)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		res := httptest.NewRecorder()
+		s.mux.ServeHTTP(res, req)
+		return res
+	}
+
+	// requests are handed over with the UI user's address
+	res := send("http://example.com", "application/json")
+	require.Equal(t, http.StatusOK, res.Code)
+	require.Equal(t, `{"jsonrpc":"2.0","id":1,"result":"0x10"}`, res.Body.String())
+	require.Equal(t, pkg.CacheHit, res.Header().Get(pkg.CacheStatusHeader))
+	require.Equal(t, "/eth", relayed.URL.Path)
+	require.Equal(t, "192.0.2.7:4321", relayed.RemoteAddr)
+	require.Equal(t, "secret", relayed.Header.Get(pkg.APIKeyHeader))
+	require.Equal(t, UITag, relayed.Header.Get(pkg.TagHeader))
+	require.Equal(t, `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}`, string(relayedBody))
+
+	// but not if they come from other sites
+	relayed = nil
+	res = send("http://evil.example", "application/json")
+	require.Equal(t, http.StatusForbidden, res.Code)
+	res = send("", "text/plain")
+	require.Equal(t, http.StatusUnsupportedMediaType, res.Code)
+	require.Nil(t, relayed)
+
+	res = httptest.NewRecorder()
+	s.mux.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/ui", nil))
+	require.Equal(t, http.StatusOK, res.Code)
+	require.Contains(t, res.Body.String(), "dev (unknown)")
+}
+
+func TestEventLog(t *testing.T) {
+	l := &eventLog{}
+	for i := 0; i < maxRecentEvents+5; i++ {
+		l.add(events.Event{Type: events.Failover, Time: time.Unix(int64(i), 0)})
+	}
+	recent := l.Events()
+	require.Len(t, recent, maxRecentEvents)
+	require.Equal(t, time.Unix(maxRecentEvents+4, 0), recent[0].Time)
+	require.Equal(t, time.Unix(5, 0), recent[maxRecentEvents-1].Time)
+}
@@ -0,0 +1,164 @@
+package admin
+
+// uiPage is the web UI served on /ui. It polls the admin API, so it only
+// shows the sections whose endpoints are enabled. {{version}} is replaced
+// with the running version.
+const uiPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>chaind</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.1em; margin-top: 2em; }
+table { border-collapse: collapse; }
+th, td { text-align: left; padding: 0.3em 1em 0.3em 0; border-bottom: 1px solid #ddd; }
+.healthy { color: #080; }
+.unhealthy, .error { color: #c00; }
+.muted { color: #888; }
+textarea, input { font-family: monospace; }
+pre { background: #f4f4f4; padding: 1em; overflow: auto; }
+</style>
+</head>
+<body>
+<h1>chaind <span class="muted">{{version}}</span></h1>
+
+<h2>Backends</h2>
+<table id="backends"><tr><td class="muted">loading</td></tr></table>
+
+<h2>Recent failovers and health changes</h2>
+<table id="events"><tr><td class="muted">loading</td></tr></table>
+
+<h2>Top methods</h2>
+<table id="methods"><tr><td class="muted">loading</td></tr></table>
+
+<h2>Request tester</h2>
+<form id="tester">
+<p><input id="method" size="40" value="eth_blockNumber"> method</p>
+<p><textarea id="params" rows="4" cols="80">[]</textarea><br>params</p>
+<p><input id="apikey" size="40"> API key (optional)</p>
+<p><label><input id="debug" type="checkbox"> debug trace</label></p>
+<p><button type="submit">Send</button></p>
+</form>
+<p id="status" class="muted"></p>
+<pre id="response"></pre>
+
+<script>
+function esc(s) {
+  return String(s).replace(/[&<>"]/g, function (c) {
+    return {'&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;'}[c];
+  });
+}
+
+function row(cells, cls) {
+  return '<tr' + (cls ? ' class="' + cls + '"' : '') + '>' + cells.map(function (c) {
+    return '<td>' + esc(c) + '</td>';
+  }).join('') + '</tr>';
+}
+
+function header(cells) {
+  return '<tr>' + cells.map(function (c) { return '<th>' + esc(c) + '</th>'; }).join('') + '</tr>';
+}
+
+function load(path, render, id) {
+  fetch(path).then(function (res) {
+    if (res.status === 404) {
+      document.getElementById(id).innerHTML = row(['not enabled'], 'muted');
+      return;
+    }
+    return res.json().then(render);
+  }).catch(function (err) {
+    document.getElementById(id).innerHTML = row([err], 'error');
+  });
+}
+
+function refresh() {
+  load('/backends/health', function (backends) {
+    var html = header(['name', 'tier', 'state', 'current', 'failures', 'last error']);
+    (backends || []).forEach(function (b) {
+      html += row([b.name, b.tier, b.state, b.current ? 'yes' : '', b.consecutive_failures, b.last_error || ''], b.state);
+    });
+    document.getElementById('backends').innerHTML = html;
+  }, 'backends');
+
+  load('/ui/events', function (events) {
+    var html = header(['time', 'event', 'details']);
+    (events || []).forEach(function (ev) {
+      var details = ev.type === 'failover' ? ev.data.from + ' → ' + ev.data.to :
+        ev.data.backend + (ev.data.healthy ? ' healthy' : ' unhealthy') + (ev.data.behind ? ' (behind)' : '');
+      html += row([new Date(ev.time).toLocaleString(), ev.type, details]);
+    });
+    if (!events || events.length === 0) {
+      html += row(['none since startup'], 'muted');
+    }
+    document.getElementById('events').innerHTML = html;
+  }, 'events');
+
+  load('/stats/tags', function (tags) {
+    var methods = {};
+    Object.keys(tags || {}).forEach(function (tag) {
+      Object.keys(tags[tag].methods || {}).forEach(function (m) {
+        var s = tags[tag].methods[m];
+        var t = methods[m] || (methods[m] = {requests: 0, errors: 0, latency: 0});
+        t.requests += s.requests;
+        t.errors += s.errors;
+        t.latency += s.total_latency_ns;
+      });
+    });
+    var names = Object.keys(methods).sort(function (a, b) { return methods[b].requests - methods[a].requests; });
+    var html = header(['method', 'requests', 'errors', 'mean latency']);
+    names.slice(0, 20).forEach(function (m) {
+      var t = methods[m];
+      html += row([m, t.requests, t.errors, (t.latency / t.requests / 1e6).toFixed(1) + ' ms']);
+    });
+    document.getElementById('methods').innerHTML = html;
+  }, 'methods');
+}
+
+document.getElementById('tester').addEventListener('submit', function (e) {
+  e.preventDefault();
+  var params;
+  try {
+    params = JSON.parse(document.getElementById('params').value || '[]');
+  } catch (err) {
+    document.getElementById('status').textContent = 'invalid params: ' + err;
+    return;
+  }
+  var headers = {'content-type': 'application/json'};
+  var key = document.getElementById('apikey').value;
+  if (key) {
+    headers['X-Api-Key'] = key;
+  }
+  if (document.getElementById('debug').checked) {
+    headers['X-Chaind-Debug'] = 'true';
+  }
+  var body = JSON.stringify({jsonrpc: '2.0', id: 1, method: document.getElementById('method').value, params: params});
+  var start = Date.now();
+  document.getElementById('status').textContent = 'sending';
+  fetch('/ui/rpc', {method: 'POST', headers: headers, body: body}).then(function (res) {
+    return res.text().then(function (text) {
+      var status = res.status + ' in ' + (Date.now() - start) + ' ms';
+      ['X-Chaind-Cache', 'X-Chaind-Verified', 'X-Chaind-Debug-Info'].forEach(function (h) {
+        if (res.headers.get(h)) {
+          status += ', ' + h + ': ' + res.headers.get(h);
+        }
+      });
+      document.getElementById('status').textContent = status;
+      try {
+        text = JSON.stringify(JSON.parse(text), null, 2);
+      } catch (err) {
+      }
+      document.getElementById('response').textContent = text;
+    });
+  }).catch(function (err) {
+    document.getElementById('status').textContent = String(err);
+  });
+});
+
+refresh();
+setInterval(refresh, 5000);
+</script>
+</body>
+</html>
+`
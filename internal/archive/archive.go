@@ -0,0 +1,12 @@
+package archive
+
+import (
+	"github.com/kyokan/chaind/pkg"
+)
+
+type Archive interface {
+	pkg.Service
+	Get(key string) ([]byte, error)
+	Put(key string, data []byte) error
+	Has(key string) (bool, error)
+}
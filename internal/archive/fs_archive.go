@@ -0,0 +1,140 @@
+package archive
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/log"
+)
+
+// FSArchive stores immutable chain data on the local filesystem. Objects are
+// addressed by the SHA-256 of their contents, so identical payloads are only
+// stored once. A separate index maps lookup keys (e.g. "block:123:true") to
+// object hashes.
+type FSArchive struct {
+	dir    string
+	logger log15.Logger
+}
+
+func NewFSArchive(cfg *config.ArchiveConfig) (*FSArchive, error) {
+	if cfg == nil {
+		return nil, errors.New("no archive config defined")
+	}
+	if cfg.Dir == "" {
+		return nil, errors.New("archive directory must be defined")
+	}
+
+	return &FSArchive{
+		dir:    cfg.Dir,
+		logger: log.NewLog("archive"),
+	}, nil
+}
+
+func (a *FSArchive) Start() error {
+	for _, dir := range []string{a.objectsDir(), a.indexDir()} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	a.logger.Info("started", "dir", a.dir)
+	return nil
+}
+
+func (a *FSArchive) Stop() error {
+	return nil
+}
+
+func (a *FSArchive) Get(key string) ([]byte, error) {
+	hash, err := ioutil.ReadFile(a.indexPath(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(a.objectPath(string(hash)))
+	if os.IsNotExist(err) {
+		a.logger.Warn("archive index points to missing object", "key", key, "hash", string(hash))
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (a *FSArchive) Has(key string) (bool, error) {
+	_, err := os.Stat(a.indexPath(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (a *FSArchive) Put(key string, data []byte) error {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	objPath := a.objectPath(hash)
+	if _, err := os.Stat(objPath); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(objPath), 0755); err != nil {
+			return err
+		}
+		if err := writeAtomic(objPath, data); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	return writeAtomic(a.indexPath(key), []byte(hash))
+}
+
+func (a *FSArchive) objectsDir() string {
+	return filepath.Join(a.dir, "objects")
+}
+
+func (a *FSArchive) indexDir() string {
+	return filepath.Join(a.dir, "index")
+}
+
+func (a *FSArchive) objectPath(hash string) string {
+	return filepath.Join(a.objectsDir(), hash[:2], hash)
+}
+
+func (a *FSArchive) indexPath(key string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(key)))
+	return filepath.Join(a.indexDir(), hex.EncodeToString(sum[:]))
+}
+
+func writeAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,55 @@
+package archive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFSArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chaind-archive")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	a, err := NewFSArchive(&config.ArchiveConfig{
+		Dir: dir,
+	})
+	require.NoError(t, err)
+	require.NoError(t, a.Start())
+
+	data, err := a.Get("block:1:false")
+	require.NoError(t, err)
+	require.Nil(t, data)
+
+	body := []byte("{\"number\":\"0x1\"}")
+	require.NoError(t, a.Put("block:1:false", body))
+	require.NoError(t, a.Put("block:1:false", body))
+	require.NoError(t, a.Put("BLOCK:0X1", body))
+
+	has, err := a.Has("block:1:false")
+	require.NoError(t, err)
+	require.True(t, has)
+
+	data, err = a.Get("block:1:false")
+	require.NoError(t, err)
+	require.Equal(t, body, data)
+
+	data, err = a.Get("block:0x1")
+	require.NoError(t, err)
+	require.Equal(t, body, data)
+
+	objects, err := filepath.Glob(filepath.Join(dir, "objects", "*", "*"))
+	require.NoError(t, err)
+	require.Len(t, objects, 1)
+}
+
+func TestNewFSArchiveRequiresDir(t *testing.T) {
+	_, err := NewFSArchive(&config.ArchiveConfig{})
+	require.Error(t, err)
+	_, err = NewFSArchive(nil)
+	require.Error(t, err)
+}
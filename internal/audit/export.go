@@ -0,0 +1,188 @@
+package audit
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ExportRecordsFile   = "records.log"
+	ExportManifestFile  = "manifest.json"
+	ExportSignatureFile = "manifest.sig"
+)
+
+// Manifest describes the records in a compliance export. Its signature
+// covers the SHA-256 of the records, so that neither can be altered.
+type Manifest struct {
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	CreatedAt time.Time `json:"created_at"`
+	Records   int       `json:"records"`
+	SHA256    string    `json:"sha256"`
+	Sources   []string  `json:"sources"`
+}
+
+// LoadSigningKey reads a PEM-encoded ECDSA private key, in SEC 1 or PKCS #8
+// form.
+func LoadSigningKey(file string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found in signing key file")
+	}
+	if block.Type == "EC PRIVATE KEY" {
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("signing key must be an ECDSA key")
+	}
+	return ecKey, nil
+}
+
+// Export writes the audit records written in [from, to) to w, as a gzipped
+// tar archive of the records, their manifest and the manifest's ASN.1 ECDSA
+// signature. Records are read from the audit log and its rotated files;
+// soft-deleted records are not exported.
+func Export(logFile string, from time.Time, to time.Time, key *ecdsa.PrivateKey, w io.Writer) (*Manifest, error) {
+	rotated, err := rotatedFiles(logFile)
+	if err != nil {
+		return nil, err
+	}
+	sources := append(rotated, logFile)
+
+	type record struct {
+		t    time.Time
+		line string
+	}
+	var records []record
+	for _, source := range sources {
+		err := readRecords(source, func(line string) {
+			t, ok := recordTime(line)
+			if ok && !t.Before(from) && t.Before(to) {
+				records = append(records, record{t, line})
+			}
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s", source)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].t.Before(records[j].t)
+	})
+
+	var buf bytes.Buffer
+	for _, r := range records {
+		buf.WriteString(r.line)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	manifest := &Manifest{
+		From:      from,
+		To:        to,
+		CreatedAt: time.Now().UTC(),
+		Records:   len(records),
+		SHA256:    hex.EncodeToString(sum[:]),
+		Sources:   sources,
+	}
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(manifestJSON)
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{ExportRecordsFile, buf.Bytes()},
+		{ExportManifestFile, manifestJSON},
+		{ExportSignatureFile, []byte(base64.StdEncoding.EncodeToString(sig) + "\n")},
+	}
+	for _, file := range files {
+		hdr := &tar.Header{
+			Name:    file.name,
+			Mode:    0644,
+			Size:    int64(len(file.data)),
+			ModTime: manifest.CreatedAt,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(file.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, gz.Close()
+}
+
+// readRecords calls fn with each line of an audit log file, which may be
+// gzipped by logrotate.
+func readRecords(file string, fn func(line string)) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var src io.Reader = f
+	if strings.HasSuffix(file, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		src = gz
+	}
+
+	r := bufio.NewReader(src)
+	for {
+		line, err := r.ReadString('\n')
+		if line != "" {
+			if !strings.HasSuffix(line, "\n") {
+				line += "\n"
+			}
+			fn(line)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package audit
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chaind-audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	logFile := filepath.Join(dir, "audit.log")
+
+	from := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(24 * time.Hour)
+	first := auditLine(from.Add(time.Hour), "eth_blockNumber")
+	second := auditLine(from.Add(2*time.Hour), "eth_chainId")
+	var rotated bytes.Buffer
+	gz := gzip.NewWriter(&rotated)
+	gz.Write([]byte(auditLine(from.Add(-time.Hour), "eth_gasPrice") + first))
+	require.NoError(t, gz.Close())
+	require.NoError(t, ioutil.WriteFile(logFile+".1.gz", rotated.Bytes(), 0644))
+	require.NoError(t, ioutil.WriteFile(logFile, []byte(second+auditLine(to, "eth_call")), 0644))
+	require.NoError(t, ioutil.WriteFile(logFile+deletedSuffix, []byte(first), 0644))
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	var out bytes.Buffer
+	manifest, err := Export(logFile, from, to, key, &out)
+	require.NoError(t, err)
+	require.Equal(t, 2, manifest.Records)
+
+	files := make(map[string][]byte)
+	gzr, err := gzip.NewReader(&out)
+	require.NoError(t, err)
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		data, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		files[hdr.Name] = data
+	}
+	require.Equal(t, first+second, string(files[ExportRecordsFile]))
+
+	var exported Manifest
+	require.NoError(t, json.Unmarshal(files[ExportManifestFile], &exported))
+	sum := sha256.Sum256(files[ExportRecordsFile])
+	require.Equal(t, hex.EncodeToString(sum[:]), exported.SHA256)
+	sigDER, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(files[ExportSignatureFile])))
+	require.NoError(t, err)
+	var sig struct {
+		R, S *big.Int
+	}
+	_, err = asn1.Unmarshal(sigDER, &sig)
+	require.NoError(t, err)
+	digest := sha256.Sum256(files[ExportManifestFile])
+	require.True(t, ecdsa.Verify(&key.PublicKey, digest[:], sig.R, sig.S))
+}
@@ -9,10 +9,13 @@ import (
 	"net/http"
 	"github.com/kyokan/chaind/pkg/jsonrpc"
 	"github.com/kyokan/chaind/pkg/log"
+	"os"
+	"sync"
 )
 
 type LogAuditor struct {
 	logger log15.Logger
+	file   *reopenableFile
 }
 
 func NewLogAuditor(cfg *config.LogAuditorConfig) (Auditor, error) {
@@ -20,18 +23,26 @@ func NewLogAuditor(cfg *config.LogAuditorConfig) (Auditor, error) {
 		return nil, errors.New("no log auditor config defined")
 	}
 
-	logger := log15.New()
-	hdlr, err := log15.FileHandler(cfg.LogFile, log15.LogfmtFormat())
+	file, err := openReopenableFile(cfg.LogFile)
 	if err != nil {
 		return nil, err
 	}
-	logger.SetHandler(hdlr)
+	logger := log15.New()
+	logger.SetHandler(log15.StreamHandler(file, log15.LogfmtFormat()))
 
 	return &LogAuditor{
 		logger: logger,
+		file:   file,
 	}, nil
 }
 
+// Reopen reopens the audit log file, e.g. after logrotate moved it away.
+// Records are never lost: they are written to the old file until the new
+// one is open.
+func (l *LogAuditor) Reopen() error {
+	return l.file.Reopen()
+}
+
 func (l *LogAuditor) RecordRequest(req *http.Request, body []byte, reqType pkg.BackendType) error {
 	if reqType == pkg.EthBackend {
 		return l.recordETHRequest(req, body)
@@ -62,12 +73,54 @@ func (l *LogAuditor) recordETHRequest(req *http.Request, body []byte) error {
 	return nil
 }
 
+type reopenableFile struct {
+	path string
+	f    *os.File
+	mtx  sync.Mutex
+}
+
+func openReopenableFile(path string) (*reopenableFile, error) {
+	f, err := openLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &reopenableFile{
+		path: path,
+		f:    f,
+	}, nil
+}
+
+func openLogFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+}
+
+func (r *reopenableFile) Write(p []byte) (int, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.f.Write(p)
+}
+
+func (r *reopenableFile) Reopen() error {
+	f, err := openLogFile(r.path)
+	if err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	old := r.f
+	r.f = f
+	r.mtx.Unlock()
+	return old.Close()
+}
+
 func mergeLogKeys(req *http.Request, keys ... interface{}) []interface{} {
 	defaults := []interface{}{
 		"remote_addr",
 		remoteAddr(req),
 		"user_agent",
 		req.Header.Get("user-agent"),
+		"tag",
+		req.Context().Value(log.TagKey),
 	}
 
 	return log.WithRequestID(req.Context(), append(defaults, keys...)...)
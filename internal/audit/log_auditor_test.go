@@ -0,0 +1,47 @@
+package audit
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogAuditorReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chaind-audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	logFile := filepath.Join(dir, "audit.log")
+
+	auditor, err := NewLogAuditor(&config.LogAuditorConfig{
+		LogFile: logFile,
+	})
+	require.NoError(t, err)
+	record := func(method string) {
+		body := []byte(`{"jsonrpc":"2.0","id":1,"method":"` + method + `","params":[]}`)
+		require.NoError(t, auditor.RecordRequest(httptest.NewRequest(http.MethodPost, "/eth", nil), body, pkg.EthBackend))
+	}
+
+	// records are written to the rotated file until the auditor reopens
+	record("eth_blockNumber")
+	require.NoError(t, os.Rename(logFile, logFile+".1"))
+	record("eth_chainId")
+	require.NoError(t, auditor.(*LogAuditor).Reopen())
+	record("eth_gasPrice")
+
+	rotated, err := ioutil.ReadFile(logFile + ".1")
+	require.NoError(t, err)
+	require.Equal(t, 2, strings.Count(string(rotated), "\n"))
+	require.Contains(t, string(rotated), "rpc_method=eth_chainId")
+	current, err := ioutil.ReadFile(logFile)
+	require.NoError(t, err)
+	require.Equal(t, 1, strings.Count(string(current), "\n"))
+	require.Contains(t, string(current), "rpc_method=eth_gasPrice")
+}
@@ -0,0 +1,18 @@
+package audit
+
+import (
+	"net/http"
+
+	"github.com/kyokan/chaind/pkg"
+)
+
+// NopAuditor discards all requests. It is used when auditing is disabled.
+type NopAuditor struct{}
+
+func NewNopAuditor() Auditor {
+	return &NopAuditor{}
+}
+
+func (n *NopAuditor) RecordRequest(req *http.Request, body []byte, reqType pkg.BackendType) error {
+	return nil
+}
@@ -0,0 +1,241 @@
+package audit
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/pkg/log"
+)
+
+// recordTimeFormat is the format log15 writes the time of records in.
+const recordTimeFormat = "2006-01-02T15:04:05-0700"
+
+// deletedSuffix marks soft-deleted audit data. It is kept until the next
+// pruning run, so that records pruned by mistake can still be recovered.
+const deletedSuffix = ".deleted"
+
+const pruneInterval = 24 * time.Hour
+
+// recordTime returns the time an audit record was written at.
+func recordTime(line string) (time.Time, bool) {
+	if !strings.HasPrefix(line, "t=") {
+		return time.Time{}, false
+	}
+	value := strings.TrimPrefix(line, "t=")
+	if i := strings.IndexByte(value, ' '); i != -1 {
+		value = value[:i]
+	}
+	if t, err := time.Parse(recordTimeFormat, value); err == nil {
+		return t, true
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// rotatedFiles returns the files logrotate moved the audit log to, e.g.
+// audit.log.1 or audit.log.2.gz.
+func rotatedFiles(logFile string) ([]string, error) {
+	matches, err := filepath.Glob(logFile + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, match := range matches {
+		if !strings.HasSuffix(match, deletedSuffix) {
+			files = append(files, match)
+		}
+	}
+	return files, nil
+}
+
+// Prune soft-deletes the audit records written before cutoff: they are
+// moved from the audit log to audit.log.deleted, and rotated files last
+// written to before cutoff are renamed with a .deleted suffix. Data
+// soft-deleted by the previous call is removed for good. It returns the
+// number of records and rotated files that were soft-deleted.
+func (l *LogAuditor) Prune(cutoff time.Time) (int, int, error) {
+	logFile := l.file.path
+	deleted, err := filepath.Glob(logFile + ".*" + deletedSuffix)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, file := range append(deleted, logFile+deletedSuffix) {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return 0, 0, err
+		}
+	}
+
+	rotated, err := rotatedFiles(logFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	var files int
+	for _, file := range rotated {
+		info, err := os.Stat(file)
+		if err != nil {
+			return 0, files, err
+		}
+		if !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := os.Rename(file, file+deletedSuffix); err != nil {
+			return 0, files, err
+		}
+		files++
+	}
+
+	records, err := l.pruneLog(cutoff)
+	return records, files, err
+}
+
+// pruneLog moves the records written before cutoff from the audit log to
+// audit.log.deleted. The log is split without blocking writes; they are only
+// blocked while the records appended in the meantime are copied over and the
+// pruned log replaces the audit log.
+func (l *LogAuditor) pruneLog(cutoff time.Time) (int, error) {
+	logFile := l.file.path
+	src, err := os.Open(logFile)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	kept, err := ioutil.TempFile(filepath.Dir(logFile), ".chaind-audit")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(kept.Name())
+	defer kept.Close()
+	expired, err := os.OpenFile(logFile+deletedSuffix, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer expired.Close()
+
+	var count int
+	var offset int64
+	r := bufio.NewReader(src)
+	for {
+		line, err := r.ReadString('\n')
+		// a record that's still being written is copied with the rest
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		dst := io.Writer(kept)
+		if t, ok := recordTime(line); ok && t.Before(cutoff) {
+			dst = expired
+			count++
+		}
+		if _, err := io.WriteString(dst, line); err != nil {
+			return 0, err
+		}
+		offset += int64(len(line))
+	}
+	if count == 0 {
+		return 0, nil
+	}
+
+	l.file.mtx.Lock()
+	defer l.file.mtx.Unlock()
+
+	// the log may have been reopened after being rotated in the meantime, in
+	// which case the next run prunes the new one
+	srcInfo, err := src.Stat()
+	if err != nil {
+		return 0, err
+	}
+	currInfo, err := os.Stat(logFile)
+	if err != nil {
+		return 0, err
+	}
+	if !os.SameFile(srcInfo, currInfo) {
+		return 0, nil
+	}
+	if _, err := src.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := io.Copy(kept, src); err != nil {
+		return 0, err
+	}
+
+	if err := kept.Chmod(0644); err != nil {
+		return 0, err
+	}
+	if err := kept.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(kept.Name(), logFile); err != nil {
+		return 0, err
+	}
+	f, err := openLogFile(logFile)
+	if err != nil {
+		return 0, err
+	}
+	old := l.file.f
+	l.file.f = f
+	return count, old.Close()
+}
+
+// Pruner prunes the audit log daily, keeping the records of the last
+// retention days.
+type Pruner struct {
+	auditor   *LogAuditor
+	retention time.Duration
+	quitChan  chan bool
+	logger    log15.Logger
+	now       func() time.Time
+}
+
+func NewPruner(auditor *LogAuditor, retentionDays int) *Pruner {
+	return &Pruner{
+		auditor:   auditor,
+		retention: time.Duration(retentionDays) * 24 * time.Hour,
+		quitChan:  make(chan bool),
+		logger:    log.NewLog("audit/pruner"),
+		now:       time.Now,
+	}
+}
+
+func (p *Pruner) Start() error {
+	go func() {
+		ticker := time.NewTicker(pruneInterval)
+		defer ticker.Stop()
+		p.prune()
+		for {
+			select {
+			case <-ticker.C:
+				p.prune()
+			case <-p.quitChan:
+				return
+			}
+		}
+	}()
+
+	p.logger.Info("started", "retention", p.retention)
+	return nil
+}
+
+func (p *Pruner) Stop() error {
+	p.quitChan <- true
+	return nil
+}
+
+func (p *Pruner) prune() {
+	cutoff := p.now().Add(-p.retention)
+	records, files, err := p.auditor.Prune(cutoff)
+	if err != nil {
+		p.logger.Error("failed to prune audit log", "err", err)
+		return
+	}
+	p.logger.Info("pruned audit log", "cutoff", cutoff, "records", records, "files", files)
+}
@@ -0,0 +1,89 @@
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func auditLine(t time.Time, method string) string {
+	return "t=" + t.Format(recordTimeFormat) + " lvl=info msg=\"received JSON-RPC request\" rpc_method=" + method + "\n"
+}
+
+func TestLogAuditorPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chaind-audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	logFile := filepath.Join(dir, "audit.log")
+
+	now := time.Now()
+	cutoff := now.Add(-24 * time.Hour)
+	old := auditLine(now.Add(-48*time.Hour), "eth_blockNumber")
+	recent := auditLine(now.Add(-time.Hour), "eth_chainId")
+	require.NoError(t, ioutil.WriteFile(logFile, []byte(old+recent), 0644))
+	require.NoError(t, ioutil.WriteFile(logFile+".1", []byte(old), 0644))
+	require.NoError(t, os.Chtimes(logFile+".1", now.Add(-48*time.Hour), now.Add(-48*time.Hour)))
+	require.NoError(t, ioutil.WriteFile(logFile+".2", []byte(recent), 0644))
+
+	auditor, err := NewLogAuditor(&config.LogAuditorConfig{
+		LogFile: logFile,
+	})
+	require.NoError(t, err)
+	records, files, err := auditor.(*LogAuditor).Prune(cutoff)
+	require.NoError(t, err)
+	require.Equal(t, 1, records)
+	require.Equal(t, 1, files)
+
+	// pruned records are soft-deleted, and records keep being appended to
+	// the pruned log
+	deleted, err := ioutil.ReadFile(logFile + deletedSuffix)
+	require.NoError(t, err)
+	require.Equal(t, old, string(deleted))
+	_, err = os.Stat(logFile + ".1" + deletedSuffix)
+	require.NoError(t, err)
+	_, err = os.Stat(logFile + ".2")
+	require.NoError(t, err)
+	_, err = auditor.(*LogAuditor).file.Write([]byte(recent))
+	require.NoError(t, err)
+	current, err := ioutil.ReadFile(logFile)
+	require.NoError(t, err)
+	require.Equal(t, recent+recent, string(current))
+
+	// the next run removes them for good
+	records, files, err = auditor.(*LogAuditor).Prune(cutoff)
+	require.NoError(t, err)
+	require.Equal(t, 0, records)
+	require.Equal(t, 0, files)
+	_, err = os.Stat(logFile + ".1" + deletedSuffix)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestLogAuditorPruneKeepsPartialRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chaind-audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	logFile := filepath.Join(dir, "audit.log")
+
+	now := time.Now()
+	old := auditLine(now.Add(-48*time.Hour), "eth_blockNumber")
+	recent := auditLine(now.Add(-time.Hour), "eth_chainId")
+	// the last record is still being written
+	partial := recent[:len(recent)/2]
+	require.NoError(t, ioutil.WriteFile(logFile, []byte(old+recent+partial), 0644))
+
+	auditor, err := NewLogAuditor(&config.LogAuditorConfig{
+		LogFile: logFile,
+	})
+	require.NoError(t, err)
+	records, err := auditor.(*LogAuditor).pruneLog(now.Add(-24 * time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 1, records)
+	current, err := ioutil.ReadFile(logFile)
+	require.NoError(t, err)
+	require.Equal(t, recent+partial, string(current))
+}
@@ -0,0 +1,253 @@
+package blockindex
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/events"
+	"github.com/kyokan/chaind/pkg/jsonrpc"
+	"github.com/kyokan/chaind/pkg/log"
+)
+
+// DefaultDepth is the number of recent blocks indexed by default.
+const DefaultDepth = 32
+
+type block struct {
+	number     uint64
+	hash       string
+	parentHash string
+	// full and hashes are the block's JSON with full transactions and with
+	// transaction hashes only
+	full   json.RawMessage
+	hashes json.RawMessage
+	txs    map[string]json.RawMessage
+}
+
+// Index keeps the most recent blocks and their transactions in memory, so
+// that lookups of very recent data can be answered without an upstream
+// call. It is fed by the new heads published on the bus, and only holds
+// blocks that link to each other through their parent hashes, so that
+// reorged blocks are dropped.
+type Index struct {
+	rpc      jsonrpc.Executor
+	bus      *events.Bus
+	depth    int
+	blocks   map[uint64]*block
+	byHash   map[string]*block
+	txs      map[string]*block
+	head     uint64
+	mtx      sync.RWMutex
+	sub      *events.Subscription
+	quitChan chan bool
+	logger   log15.Logger
+}
+
+func NewIndex(cfg *config.BlockIndexConfig, rpc jsonrpc.Executor, bus *events.Bus) *Index {
+	depth := cfg.Depth
+	if depth == 0 {
+		depth = DefaultDepth
+	}
+
+	return &Index{
+		rpc:      rpc,
+		bus:      bus,
+		depth:    depth,
+		blocks:   make(map[uint64]*block),
+		byHash:   make(map[string]*block),
+		txs:      make(map[string]*block),
+		quitChan: make(chan bool),
+		logger:   log.NewLog("blockindex"),
+	}
+}
+
+func (i *Index) Start() error {
+	i.sub = i.bus.Subscribe(events.NewHead)
+
+	go func() {
+		for {
+			select {
+			case ev := <-i.sub.Events():
+				if data, ok := ev.Data.(events.NewHeadData); ok {
+					i.advance(data.Number)
+				}
+			case <-i.quitChan:
+				i.sub.Close()
+				return
+			}
+		}
+	}()
+
+	i.logger.Info("started", "depth", i.depth)
+	return nil
+}
+
+func (i *Index) Stop() error {
+	i.quitChan <- true
+	return nil
+}
+
+// Block returns the JSON of the block with the given hash, with full
+// transactions or only their hashes, or nil if the block isn't indexed.
+func (i *Index) Block(hash string, full bool) json.RawMessage {
+	i.mtx.RLock()
+	defer i.mtx.RUnlock()
+	b, ok := i.byHash[strings.ToLower(hash)]
+	if !ok {
+		return nil
+	}
+	if full {
+		return b.full
+	}
+	return b.hashes
+}
+
+// Transaction returns the JSON of the transaction with the given hash, or
+// nil if it isn't in an indexed block.
+func (i *Index) Transaction(hash string) json.RawMessage {
+	hash = strings.ToLower(hash)
+	i.mtx.RLock()
+	defer i.mtx.RUnlock()
+	b, ok := i.txs[hash]
+	if !ok {
+		return nil
+	}
+	return b.txs[hash]
+}
+
+// Len returns the number of indexed blocks.
+func (i *Index) Len() int {
+	i.mtx.RLock()
+	defer i.mtx.RUnlock()
+	return len(i.blocks)
+}
+
+// advance indexes the blocks up to the new head, skipping blocks older
+// than the index depth.
+func (i *Index) advance(head uint64) {
+	i.mtx.RLock()
+	next := i.head + 1
+	i.mtx.RUnlock()
+	if next+uint64(i.depth) <= head || i.head == 0 {
+		next = head - uint64(i.depth) + 1
+		if head < uint64(i.depth) {
+			next = 0
+		}
+	}
+
+	for num := next; num <= head; num++ {
+		b, err := i.fetch(num)
+		if err != nil {
+			i.logger.Warn("failed to fetch block", "number", num, "err", err)
+			return
+		}
+		i.add(b)
+	}
+}
+
+func (i *Index) fetch(number uint64) (*block, error) {
+	res, err := i.rpc.Execute("eth_getBlockByNumber", []interface{}{jsonrpc.Uint642Hex(number), true})
+	if err != nil {
+		return nil, err
+	}
+	if res.Error != nil {
+		return nil, fmt.Errorf("eth_getBlockByNumber returned error %d: %s", res.Error.Code, res.Error.Message)
+	}
+	return parseBlock(res.Result)
+}
+
+func parseBlock(data json.RawMessage) (*block, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	var header struct {
+		Number       string            `json:"number"`
+		Hash         string            `json:"hash"`
+		ParentHash   string            `json:"parentHash"`
+		Transactions []json.RawMessage `json:"transactions"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, err
+	}
+	if header.Number == "" || header.Hash == "" {
+		return nil, errors.New("block not found")
+	}
+	number, err := jsonrpc.Hex2Uint64(header.Number)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &block{
+		number:     number,
+		hash:       strings.ToLower(header.Hash),
+		parentHash: strings.ToLower(header.ParentHash),
+		full:       data,
+		txs:        make(map[string]json.RawMessage, len(header.Transactions)),
+	}
+	hashes := make([]string, 0, len(header.Transactions))
+	for _, raw := range header.Transactions {
+		var tx struct {
+			Hash string `json:"hash"`
+		}
+		if err := json.Unmarshal(raw, &tx); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, tx.Hash)
+		b.txs[strings.ToLower(tx.Hash)] = raw
+	}
+	if fields["transactions"], err = json.Marshal(hashes); err != nil {
+		return nil, err
+	}
+	if b.hashes, err = json.Marshal(fields); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (i *Index) add(b *block) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	// a block replaces any indexed block at or above its height, and blocks
+	// below it that it doesn't link to were reorged away
+	for num := range i.blocks {
+		if num >= b.number {
+			i.removeLocked(num)
+		}
+	}
+	if parent, ok := i.blocks[b.number-1]; ok && parent.hash != b.parentHash {
+		for num := range i.blocks {
+			i.removeLocked(num)
+		}
+	}
+
+	i.blocks[b.number] = b
+	i.byHash[b.hash] = b
+	for hash := range b.txs {
+		i.txs[hash] = b
+	}
+	i.head = b.number
+	if b.number >= uint64(i.depth) {
+		for num := range i.blocks {
+			if num <= b.number-uint64(i.depth) {
+				i.removeLocked(num)
+			}
+		}
+	}
+}
+
+func (i *Index) removeLocked(num uint64) {
+	b := i.blocks[num]
+	delete(i.blocks, num)
+	delete(i.byHash, b.hash)
+	for hash := range b.txs {
+		if i.txs[hash] == b {
+			delete(i.txs, hash)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package blockindex
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/jsonrpc"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeRPC struct {
+	blocks  map[uint64]string
+	fetches int
+}
+
+func (f *fakeRPC) Execute(method string, params interface{}) (*jsonrpc.Response, error) {
+	f.fetches++
+	number, _ := jsonrpc.Hex2Uint64(params.([]interface{})[0].(string))
+	block, ok := f.blocks[number]
+	if !ok {
+		return &jsonrpc.Response{Result: json.RawMessage("null")}, nil
+	}
+	return &jsonrpc.Response{Result: json.RawMessage(block)}, nil
+}
+
+func (f *fakeRPC) setBlock(number uint64, fork string, parentFork string) {
+	f.blocks[number] = fmt.Sprintf(`{"number":"%s","hash":"%s","parentHash":"%s","transactions":[{"hash":"%s","nonce":"0x1"}]}`,
+		jsonrpc.Uint642Hex(number), hash(number, fork), hash(number-1, parentFork), hash(number, "f"+fork))
+}
+
+func hash(n uint64, fork string) string {
+	return fmt.Sprintf("0x%s%062x", fork, n)
+}
+
+func TestIndex(t *testing.T) {
+	rpc := &fakeRPC{blocks: make(map[uint64]string)}
+	for n := uint64(1); n <= 10; n++ {
+		rpc.setBlock(n, "a", "a")
+	}
+	idx := NewIndex(&config.BlockIndexConfig{Depth: 4}, rpc, nil)
+
+	// the first head indexes the most recent blocks only
+	idx.advance(10)
+	require.Equal(t, 4, idx.Len())
+	require.Equal(t, 4, rpc.fetches)
+	require.Nil(t, idx.Block(hash(6, "a"), false))
+	require.Equal(t, rpc.blocks[9], string(idx.Block(hash(9, "a"), true)))
+	require.Equal(t,
+		fmt.Sprintf(`{"hash":"%s","number":"0x9","parentHash":"%s","transactions":["%s"]}`, hash(9, "a"), hash(8, "a"), hash(9, "fa")),
+		string(idx.Block(hash(9, "a"), false)))
+	require.Equal(t, fmt.Sprintf(`{"hash":"%s","nonce":"0x1"}`, hash(10, "fa")), string(idx.Transaction(hash(10, "fa"))))
+
+	// a block that doesn't link to the indexed chain means the chain was
+	// reorged, so the indexed blocks are dropped
+	rpc.setBlock(10, "b", "a")
+	rpc.setBlock(11, "b", "b")
+	idx.advance(11)
+	require.Equal(t, 1, idx.Len())
+	require.Nil(t, idx.Block(hash(9, "a"), true))
+	require.Nil(t, idx.Transaction(hash(10, "fa")))
+	require.NotNil(t, idx.Transaction(hash(11, "fb")))
+
+	// a block at an indexed height replaces the blocks at and above it
+	rpc.setBlock(12, "b", "b")
+	idx.advance(12)
+	rpc.setBlock(12, "c", "b")
+	idx.head = 11
+	idx.advance(12)
+	require.Equal(t, 2, idx.Len())
+	require.Nil(t, idx.Block(hash(12, "b"), true))
+	require.NotNil(t, idx.Block(hash(12, "c"), true))
+}
@@ -0,0 +1,117 @@
+package bodylog
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/pkg/log"
+)
+
+// MaxWindow bounds how long body logging can be enabled for at once, so
+// that a forgotten rule can't log bodies indefinitely.
+const MaxWindow = 24 * time.Hour
+
+// Rule enables logging the request and response bodies of a sample of a
+// method's requests until it expires.
+type Rule struct {
+	Method string    `json:"method"`
+	Rate   float64   `json:"rate"`
+	Until  time.Time `json:"until"`
+}
+
+// Sampler decides which requests have their bodies logged. Rules are
+// dropped once they expire, reverting to the configured log level.
+type Sampler struct {
+	rules  map[string]Rule
+	mtx    sync.Mutex
+	rand   func() float64
+	now    func() time.Time
+	logger log15.Logger
+}
+
+func NewSampler() *Sampler {
+	return &Sampler{
+		rules:  make(map[string]Rule),
+		rand:   rand.Float64,
+		now:    time.Now,
+		logger: log.NewLog("bodylog"),
+	}
+}
+
+// Enable logs the bodies of the given share of the method's requests for
+// window, replacing any rule for the method.
+func (s *Sampler) Enable(method string, rate float64, window time.Duration) (Rule, error) {
+	if method == "" {
+		return Rule{}, errors.New("method must be set")
+	}
+	if rate <= 0 || rate > 1 {
+		return Rule{}, errors.New("rate must be greater than 0 and at most 1")
+	}
+	if window <= 0 || window > MaxWindow {
+		return Rule{}, errors.New("duration must be positive and at most 24h")
+	}
+
+	rule := Rule{
+		Method: method,
+		Rate:   rate,
+		Until:  s.now().Add(window),
+	}
+	s.mtx.Lock()
+	s.rules[method] = rule
+	s.mtx.Unlock()
+	s.logger.Info("enabled body logging", "method", method, "rate", rate, "until", rule.Until)
+	return rule, nil
+}
+
+// Disable stops logging the method's bodies.
+func (s *Sampler) Disable(method string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.rules[method]; ok {
+		delete(s.rules, method)
+		s.logger.Info("disabled body logging", "method", method)
+	}
+}
+
+// Rules returns the active rules, sorted by method.
+func (s *Sampler) Rules() []Rule {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	out := make([]Rule, 0, len(s.rules))
+	for method := range s.rules {
+		if rule, ok := s.ruleLocked(method); ok {
+			out = append(out, rule)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Method < out[j].Method
+	})
+	return out
+}
+
+// Sample returns whether to log the bodies of a request to the method.
+func (s *Sampler) Sample(method string) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	rule, ok := s.ruleLocked(method)
+	return ok && s.rand() < rule.Rate
+}
+
+func (s *Sampler) ruleLocked(method string) (Rule, bool) {
+	rule, ok := s.rules[method]
+	if !ok {
+		return Rule{}, false
+	}
+	if !s.now().Before(rule.Until) {
+		delete(s.rules, method)
+		s.logger.Info("body logging window ended", "method", method)
+		return Rule{}, false
+	}
+	return rule, true
+}
@@ -0,0 +1,41 @@
+package bodylog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSampler(t *testing.T) {
+	s := NewSampler()
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	s.rand = func() float64 { return 0.005 }
+
+	require.False(t, s.Sample("eth_call"))
+	_, err := s.Enable("eth_call", 0, time.Minute)
+	require.Error(t, err)
+	_, err = s.Enable("eth_call", 0.01, 48*time.Hour)
+	require.Error(t, err)
+
+	rule, err := s.Enable("eth_call", 0.01, 10*time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, now.Add(10*time.Minute), rule.Until)
+	require.True(t, s.Sample("eth_call"))
+	require.False(t, s.Sample("eth_getLogs"))
+	s.rand = func() float64 { return 0.5 }
+	require.False(t, s.Sample("eth_call"))
+	require.Equal(t, []Rule{rule}, s.Rules())
+
+	// rules revert once their window ends
+	now = now.Add(10 * time.Minute)
+	s.rand = func() float64 { return 0 }
+	require.False(t, s.Sample("eth_call"))
+	require.Empty(t, s.Rules())
+
+	_, err = s.Enable("eth_call", 1, time.Minute)
+	require.NoError(t, err)
+	s.Disable("eth_call")
+	require.False(t, s.Sample("eth_call"))
+}
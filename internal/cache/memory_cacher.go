@@ -0,0 +1,294 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/log"
+)
+
+const DefaultCompactionInterval = time.Minute
+
+// evictionSample is the number of least recently used entries eviction
+// chooses from: the largest of them is evicted first, so that a single large
+// response frees room for many small ones.
+const evictionSample = 4
+
+// MemoryStats reports the activity of the in-memory cache tier. Counters
+// are totals since startup.
+type MemoryStats struct {
+	Bytes    int64  `json:"bytes"`
+	MaxBytes int64  `json:"max_bytes"`
+	Entries  int    `json:"entries"`
+	Hits     uint64 `json:"hits"`
+	Misses   uint64 `json:"misses"`
+	// Evictions counts the entries removed to stay within the budget, and
+	// Expired the entries removed because they expired.
+	Evictions uint64 `json:"evictions"`
+	Expired   uint64 `json:"expired"`
+	// Rejected counts the entries that were too large to be held in memory,
+	// and so were only written to the backing cacher.
+	Rejected       uint64    `json:"rejected"`
+	Compactions    uint64    `json:"compactions"`
+	LastCompaction time.Time `json:"last_compaction"`
+}
+
+type memoryEntry struct {
+	key       string
+	value     []byte
+	fields    CacheableMap
+	size      int64
+	expiresAt time.Time
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+// MemoryCacher keeps the entries written through it in memory, in front of
+// another cacher, so that hot entries are served without a round trip to
+// Redis. Writes go through to the backing cacher, and entries only read from
+// it are not held in memory, since their expiration isn't known. The sizes of
+// keys and values are kept within a byte budget: when a write would exceed
+// it, the least recently used entries are evicted, largest first.
+type MemoryCacher struct {
+	cacher   Cacher
+	cfg      config.MemoryCacheConfig
+	entries  map[string]*list.Element
+	order    *list.List
+	stats    MemoryStats
+	mtx      sync.Mutex
+	quitChan chan bool
+	logger   log15.Logger
+	now      func() time.Time
+}
+
+func NewMemoryCacher(cacher Cacher, cfg *config.MemoryCacheConfig) *MemoryCacher {
+	tuned := *cfg
+	if tuned.CompactionInterval == 0 {
+		tuned.CompactionInterval = DefaultCompactionInterval
+	}
+	if tuned.MaxEntryBytes == 0 {
+		tuned.MaxEntryBytes = tuned.MaxBytes
+	}
+
+	return &MemoryCacher{
+		cacher:   cacher,
+		cfg:      tuned,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		quitChan: make(chan bool),
+		logger:   log.NewLog("cache/memory"),
+		now:      time.Now,
+	}
+}
+
+func (m *MemoryCacher) Start() error {
+	if err := m.cacher.Start(); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(m.cfg.CompactionInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				m.compact()
+			case <-m.quitChan:
+				return
+			}
+		}
+	}()
+
+	m.logger.Info("started", "max_bytes", m.cfg.MaxBytes, "max_entry_bytes", m.cfg.MaxEntryBytes, "compaction_interval", m.cfg.CompactionInterval)
+	return nil
+}
+
+func (m *MemoryCacher) Stop() error {
+	m.quitChan <- true
+	return m.cacher.Stop()
+}
+
+func (m *MemoryCacher) Get(key string) ([]byte, error) {
+	if entry := m.lookup(key); entry != nil && entry.fields == nil {
+		return entry.value, nil
+	}
+	return m.cacher.Get(key)
+}
+
+func (m *MemoryCacher) Set(key string, value []byte) error {
+	if err := m.cacher.Set(key, value); err != nil {
+		m.forget(key)
+		return err
+	}
+	m.store(&memoryEntry{key: key, value: append([]byte(nil), value...)}, 0)
+	return nil
+}
+
+func (m *MemoryCacher) SetEx(key string, value []byte, expiration time.Duration) error {
+	if err := m.cacher.SetEx(key, value, expiration); err != nil {
+		m.forget(key)
+		return err
+	}
+	m.store(&memoryEntry{key: key, value: append([]byte(nil), value...)}, expiration)
+	return nil
+}
+
+func (m *MemoryCacher) Has(key string) (bool, error) {
+	if m.lookup(key) != nil {
+		return true, nil
+	}
+	return m.cacher.Has(key)
+}
+
+func (m *MemoryCacher) MapGet(key string, field string) ([]byte, error) {
+	if entry := m.lookup(key); entry != nil && entry.fields != nil {
+		return entry.fields[field], nil
+	}
+	return m.cacher.MapGet(key, field)
+}
+
+func (m *MemoryCacher) MapSetEx(key string, vals CacheableMap, expiration time.Duration) error {
+	if err := m.cacher.MapSetEx(key, vals, expiration); err != nil {
+		m.forget(key)
+		return err
+	}
+	// Redis merges the fields into the existing hash, so a hash that is
+	// written to twice is left to Redis. Fields missing from a hash held in
+	// memory are cache misses, e.g. if another instance wrote them.
+	m.mtx.Lock()
+	el, ok := m.entries[key]
+	m.mtx.Unlock()
+	if ok && el.Value.(*memoryEntry).fields != nil {
+		m.forget(key)
+		return nil
+	}
+
+	fields := make(CacheableMap, len(vals))
+	for field, val := range vals {
+		fields[field] = append([]byte(nil), val...)
+	}
+	m.store(&memoryEntry{key: key, fields: fields}, expiration)
+	return nil
+}
+
+func (m *MemoryCacher) Del(key string) error {
+	m.forget(key)
+	return m.cacher.Del(key)
+}
+
+func (m *MemoryCacher) forget(key string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if el, ok := m.entries[key]; ok {
+		m.removeLocked(el)
+	}
+}
+
+func (m *MemoryCacher) Stats() MemoryStats {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	out := m.stats
+	out.MaxBytes = m.cfg.MaxBytes
+	out.Entries = len(m.entries)
+	return out
+}
+
+// lookup returns the unexpired entry for key, if it is held in memory.
+func (m *MemoryCacher) lookup(key string) *memoryEntry {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	el, ok := m.entries[key]
+	if !ok {
+		m.stats.Misses++
+		return nil
+	}
+	entry := el.Value.(*memoryEntry)
+	if entry.expired(m.now()) {
+		m.removeLocked(el)
+		m.stats.Expired++
+		m.stats.Misses++
+		return nil
+	}
+	m.order.MoveToBack(el)
+	m.stats.Hits++
+	return entry
+}
+
+func (m *MemoryCacher) store(entry *memoryEntry, expiration time.Duration) {
+	entry.size = int64(len(entry.key) + len(entry.value))
+	for field, val := range entry.fields {
+		entry.size += int64(len(field) + len(val))
+	}
+	if expiration > 0 {
+		entry.expiresAt = m.now().Add(expiration)
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if el, ok := m.entries[entry.key]; ok {
+		m.removeLocked(el)
+	}
+	if entry.size > m.cfg.MaxEntryBytes {
+		m.stats.Rejected++
+		return
+	}
+	for m.stats.Bytes+entry.size > m.cfg.MaxBytes {
+		m.evictLocked()
+	}
+	m.entries[entry.key] = m.order.PushBack(entry)
+	m.stats.Bytes += entry.size
+}
+
+// evictLocked evicts the largest of the least recently used entries.
+func (m *MemoryCacher) evictLocked() {
+	victim := m.order.Front()
+	el := victim
+	for i := 0; i < evictionSample && el != nil; i++ {
+		if el.Value.(*memoryEntry).size > victim.Value.(*memoryEntry).size {
+			victim = el
+		}
+		el = el.Next()
+	}
+	m.removeLocked(victim)
+	m.stats.Evictions++
+}
+
+func (m *MemoryCacher) removeLocked(el *list.Element) {
+	entry := el.Value.(*memoryEntry)
+	m.stats.Bytes -= entry.size
+	m.order.Remove(el)
+	delete(m.entries, entry.key)
+}
+
+// compact removes the expired entries, which would otherwise hold on to
+// their memory until they are evicted or read.
+func (m *MemoryCacher) compact() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	now := m.now()
+	var removed int
+	var freed int64
+	for el := m.order.Front(); el != nil; {
+		next := el.Next()
+		if entry := el.Value.(*memoryEntry); entry.expired(now) {
+			freed += entry.size
+			m.removeLocked(el)
+			removed++
+		}
+		el = next
+	}
+	m.stats.Expired += uint64(removed)
+	m.stats.Compactions++
+	m.stats.LastCompaction = now
+	m.logger.Debug("compacted", "removed", removed, "freed", freed, "bytes", m.stats.Bytes)
+}
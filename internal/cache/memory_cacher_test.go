@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryCacher(t *testing.T) {
+	backing := &mapCacher{vals: make(map[string][]byte)}
+	m := NewMemoryCacher(backing, &config.MemoryCacheConfig{MaxBytes: 40, MaxEntryBytes: 30})
+	now := time.Now()
+	m.now = func() time.Time {
+		return now
+	}
+
+	// writes go through, and are then served from memory
+	require.NoError(t, m.SetEx("a", []byte("012345678"), time.Minute))
+	require.Equal(t, []byte("012345678"), backing.vals["a"])
+	delete(backing.vals, "a")
+	val, err := m.Get("a")
+	require.NoError(t, err)
+	require.Equal(t, []byte("012345678"), val)
+
+	// entries larger than max_entry_bytes are only written through
+	require.NoError(t, m.SetEx("big", make([]byte, 30), time.Minute))
+	require.Contains(t, backing.vals, "big")
+	delete(backing.vals, "big")
+	val, err = m.Get("big")
+	require.NoError(t, err)
+	require.Nil(t, val)
+
+	// going over budget evicts the largest of the least recently used
+	// entries
+	require.NoError(t, m.SetEx("b", []byte("0123"), time.Minute))
+	require.NoError(t, m.SetEx("c", []byte("0123456789"), time.Minute))
+	_, err = m.Get("a")
+	require.NoError(t, err)
+	require.NoError(t, m.SetEx("d", []byte("012345678901234"), time.Minute))
+	has, err := m.Has("c")
+	require.NoError(t, err)
+	require.False(t, has)
+	has, err = m.Has("b")
+	require.NoError(t, err)
+	require.True(t, has)
+
+	// the janitor compacts expired entries away
+	require.NoError(t, m.SetEx("e", []byte("0"), time.Second))
+	now = now.Add(2 * time.Second)
+	m.compact()
+	stats := m.Stats()
+	require.Equal(t, int64(31), stats.Bytes)
+	require.Equal(t, 3, stats.Entries)
+	require.Equal(t, uint64(1), stats.Evictions)
+	require.Equal(t, uint64(1), stats.Expired)
+	require.Equal(t, uint64(1), stats.Rejected)
+	require.Equal(t, uint64(1), stats.Compactions)
+	require.Equal(t, now, stats.LastCompaction)
+
+	require.NoError(t, m.Del("a"))
+	require.Equal(t, int64(21), m.Stats().Bytes)
+}
+
+func TestMemoryCacherMaps(t *testing.T) {
+	m := NewMemoryCacher(NewNopCacher(), &config.MemoryCacheConfig{MaxBytes: 100})
+	require.NoError(t, m.MapSetEx("receipts", CacheableMap{"0x1": []byte("r1")}, time.Minute))
+	val, err := m.MapGet("receipts", "0x1")
+	require.NoError(t, err)
+	require.Equal(t, []byte("r1"), val)
+
+	// a second write merges into the hash in Redis, so it is dropped from
+	// memory
+	require.NoError(t, m.MapSetEx("receipts", CacheableMap{"0x2": []byte("r2")}, time.Minute))
+	require.Equal(t, 0, m.Stats().Entries)
+}
@@ -0,0 +1,47 @@
+package cache
+
+import "time"
+
+// NopCacher never stores anything, so every lookup is a cache miss. It is
+// used when caching is disabled.
+type NopCacher struct{}
+
+func NewNopCacher() *NopCacher {
+	return &NopCacher{}
+}
+
+func (n *NopCacher) Start() error {
+	return nil
+}
+
+func (n *NopCacher) Stop() error {
+	return nil
+}
+
+func (n *NopCacher) Get(key string) ([]byte, error) {
+	return nil, nil
+}
+
+func (n *NopCacher) Set(key string, value []byte) error {
+	return nil
+}
+
+func (n *NopCacher) SetEx(key string, value []byte, expiration time.Duration) error {
+	return nil
+}
+
+func (n *NopCacher) Has(key string) (bool, error) {
+	return false, nil
+}
+
+func (n *NopCacher) MapGet(key string, field string) ([]byte, error) {
+	return nil, nil
+}
+
+func (n *NopCacher) MapSetEx(key string, vals CacheableMap, expiration time.Duration) error {
+	return nil
+}
+
+func (n *NopCacher) Del(key string) error {
+	return nil
+}
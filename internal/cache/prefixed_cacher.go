@@ -0,0 +1,56 @@
+package cache
+
+import (
+	"time"
+)
+
+// PrefixedCacher prefixes the keys of another cacher, so that chaind
+// deployments serving different networks can share a Redis instance
+// without their keys colliding.
+type PrefixedCacher struct {
+	cacher Cacher
+	prefix string
+}
+
+func NewPrefixedCacher(cacher Cacher, prefix string) *PrefixedCacher {
+	return &PrefixedCacher{
+		cacher: cacher,
+		prefix: prefix,
+	}
+}
+
+func (p *PrefixedCacher) Start() error {
+	return p.cacher.Start()
+}
+
+func (p *PrefixedCacher) Stop() error {
+	return p.cacher.Stop()
+}
+
+func (p *PrefixedCacher) Get(key string) ([]byte, error) {
+	return p.cacher.Get(p.prefix + key)
+}
+
+func (p *PrefixedCacher) Set(key string, value []byte) error {
+	return p.cacher.Set(p.prefix+key, value)
+}
+
+func (p *PrefixedCacher) SetEx(key string, value []byte, expiration time.Duration) error {
+	return p.cacher.SetEx(p.prefix+key, value, expiration)
+}
+
+func (p *PrefixedCacher) Has(key string) (bool, error) {
+	return p.cacher.Has(p.prefix + key)
+}
+
+func (p *PrefixedCacher) MapGet(key string, field string) ([]byte, error) {
+	return p.cacher.MapGet(p.prefix+key, field)
+}
+
+func (p *PrefixedCacher) MapSetEx(key string, vals CacheableMap, expiration time.Duration) error {
+	return p.cacher.MapSetEx(p.prefix+key, vals, expiration)
+}
+
+func (p *PrefixedCacher) Del(key string) error {
+	return p.cacher.Del(p.prefix + key)
+}
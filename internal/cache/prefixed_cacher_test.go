@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type mapCacher struct {
+	NopCacher
+	vals map[string][]byte
+}
+
+func (m *mapCacher) Get(key string) ([]byte, error) {
+	return m.vals[key], nil
+}
+
+func (m *mapCacher) SetEx(key string, value []byte, expiration time.Duration) error {
+	m.vals[key] = value
+	return nil
+}
+
+func (m *mapCacher) Del(key string) error {
+	delete(m.vals, key)
+	return nil
+}
+
+func TestPrefixedCacher(t *testing.T) {
+	shared := &mapCacher{vals: make(map[string][]byte)}
+	mainnet := NewPrefixedCacher(shared, "ethereum:mainnet:")
+	sepolia := NewPrefixedCacher(shared, "ethereum:sepolia:")
+
+	require.NoError(t, mainnet.SetEx("block:1:false", []byte("mainnet"), time.Minute))
+	require.NoError(t, sepolia.SetEx("block:1:false", []byte("sepolia"), time.Minute))
+	require.Equal(t, []byte("mainnet"), shared.vals["ethereum:mainnet:block:1:false"])
+
+	val, err := sepolia.Get("block:1:false")
+	require.NoError(t, err)
+	require.Equal(t, []byte("sepolia"), val)
+
+	require.NoError(t, mainnet.Del("block:1:false"))
+	val, err = mainnet.Get("block:1:false")
+	require.NoError(t, err)
+	require.Nil(t, val)
+	val, err = sepolia.Get("block:1:false")
+	require.NoError(t, err)
+	require.Equal(t, []byte("sepolia"), val)
+}
@@ -6,18 +6,46 @@ import (
 	"github.com/kyokan/chaind/pkg/config"
 )
 
+// failoverRetries is the number of times commands are retried when Redis
+// is unreachable, so that they survive a Sentinel failover or a cluster
+// resharding.
+const failoverRetries = 3
+
 type RedisCacher struct {
-	client *redis.Client
+	client redis.UniversalClient
 }
 
 func NewRedisCacher(cfg *config.RedisConfig) *RedisCacher {
 	return &RedisCacher{
-		client: redis.NewClient(&redis.Options{
-			Addr:     cfg.URL,
-			Password: cfg.Password,
-			DB:       cfg.DB,
-		}),
+		client: newRedisClient(cfg),
+	}
+}
+
+func newRedisClient(cfg *config.RedisConfig) redis.UniversalClient {
+	if len(cfg.ClusterAddrs) > 0 {
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:      cfg.ClusterAddrs,
+			Password:   cfg.Password,
+			MaxRetries: failoverRetries,
+		})
 	}
+	if cfg.MasterName != "" {
+		// the failover client asks the sentinels for the current master,
+		// and again whenever the master changes
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    cfg.MasterName,
+			SentinelAddrs: cfg.SentinelAddrs,
+			Password:      cfg.Password,
+			DB:            cfg.DB,
+			MaxRetries:    failoverRetries,
+		})
+	}
+
+	return redis.NewClient(&redis.Options{
+		Addr:     cfg.URL,
+		Password: cfg.Password,
+		DB:       cfg.DB,
+	})
 }
 
 func (r *RedisCacher) Start() error {
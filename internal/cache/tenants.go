@@ -0,0 +1,212 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/kyokan/chaind/pkg/config"
+)
+
+// TenantUsage reports the approximate cache usage of a tenant.
+type TenantUsage struct {
+	Tenant  string `json:"tenant"`
+	Prefix  string `json:"prefix"`
+	Bytes   int64  `json:"bytes"`
+	Quota   int64  `json:"quota,omitempty"`
+	Entries int    `json:"entries"`
+	// Evictions counts the entries removed to stay within the quota.
+	Evictions uint64 `json:"evictions"`
+	// Skipped counts the values that were larger than the whole quota, and
+	// so were not cached.
+	Skipped uint64 `json:"skipped"`
+}
+
+// Tenants namespaces the cache entries of each tenant of a multi-tenant
+// deployment, and keeps each tenant within its cache quota.
+type Tenants struct {
+	byKey   map[string]*QuotaCacher
+	byName  map[string]*QuotaCacher
+	cachers []*QuotaCacher
+}
+
+func NewTenants(cacher Cacher, cfgs []config.TenantConfig) *Tenants {
+	t := &Tenants{
+		byKey:  make(map[string]*QuotaCacher),
+		byName: make(map[string]*QuotaCacher),
+	}
+	for _, cfg := range cfgs {
+		qc := NewQuotaCacher(NewPrefixedCacher(cacher, cfg.TenantPrefix()), cfg.CacheQuota)
+		qc.tenant = cfg.Name
+		qc.prefix = cfg.TenantPrefix()
+		for _, key := range cfg.Keys {
+			t.byKey[key] = qc
+		}
+		t.byName[cfg.Name] = qc
+		t.cachers = append(t.cachers, qc)
+	}
+	return t
+}
+
+// For returns the cacher of the tenant the client key belongs to, or nil if
+// it doesn't belong to one.
+func (t *Tenants) For(key string) Cacher {
+	if qc, ok := t.byKey[key]; ok {
+		return qc
+	}
+	return nil
+}
+
+// Named returns the cacher of the named tenant, or nil if there is no such
+// tenant.
+func (t *Tenants) Named(name string) *QuotaCacher {
+	return t.byName[name]
+}
+
+// Namespaced returns the client key prefixed with its tenant's prefix, e.g.
+// to keep rate limit buckets apart, or the key as is if it doesn't belong to
+// a tenant.
+func (t *Tenants) Namespaced(key string) string {
+	if qc, ok := t.byKey[key]; ok {
+		return qc.prefix + key
+	}
+	return key
+}
+
+func (t *Tenants) Usage() []TenantUsage {
+	out := make([]TenantUsage, 0, len(t.cachers))
+	for _, qc := range t.cachers {
+		out = append(out, qc.Usage())
+	}
+	return out
+}
+
+type quotaEntry struct {
+	key  string
+	size int64
+}
+
+// QuotaCacher keeps the entries written through it within about quota
+// bytes, counting the sizes of keys and values: when a write would exceed
+// the quota, the oldest entries are deleted first. Sizes are tracked in
+// memory, so entries that expired in Redis count until they are evicted, and
+// entries written by other chaind instances are not counted at all. Zero
+// quotas are unlimited, and not tracked.
+type QuotaCacher struct {
+	Cacher
+	tenant    string
+	prefix    string
+	quota     int64
+	used      int64
+	entries   map[string]*list.Element
+	order     *list.List
+	evictions uint64
+	skipped   uint64
+	mtx       sync.Mutex
+}
+
+func NewQuotaCacher(cacher Cacher, quota int64) *QuotaCacher {
+	return &QuotaCacher{
+		Cacher:  cacher,
+		quota:   quota,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (q *QuotaCacher) Set(key string, value []byte) error {
+	if !q.reserve(key, int64(len(key)+len(value))) {
+		return nil
+	}
+	return q.Cacher.Set(key, value)
+}
+
+func (q *QuotaCacher) SetEx(key string, value []byte, expiration time.Duration) error {
+	if !q.reserve(key, int64(len(key)+len(value))) {
+		return nil
+	}
+	return q.Cacher.SetEx(key, value, expiration)
+}
+
+func (q *QuotaCacher) MapSetEx(key string, vals CacheableMap, expiration time.Duration) error {
+	size := int64(len(key))
+	for field, val := range vals {
+		size += int64(len(field) + len(val))
+	}
+	if !q.reserve(key, size) {
+		return nil
+	}
+	return q.Cacher.MapSetEx(key, vals, expiration)
+}
+
+func (q *QuotaCacher) Del(key string) error {
+	q.mtx.Lock()
+	q.forgetLocked(key)
+	q.mtx.Unlock()
+	return q.Cacher.Del(key)
+}
+
+// Prefix returns the prefix the tenant's keys are stored under.
+func (q *QuotaCacher) Prefix() string {
+	return q.prefix
+}
+
+func (q *QuotaCacher) Usage() TenantUsage {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	return TenantUsage{
+		Tenant:    q.tenant,
+		Prefix:    q.prefix,
+		Bytes:     q.used,
+		Quota:     q.quota,
+		Entries:   len(q.entries),
+		Evictions: q.evictions,
+		Skipped:   q.skipped,
+	}
+}
+
+// reserve accounts for an entry of the given size, evicting the oldest
+// entries until it fits. It returns false if the entry is larger than the
+// quota, in which case it must not be written.
+func (q *QuotaCacher) reserve(key string, size int64) bool {
+	if q.quota == 0 {
+		return true
+	}
+
+	q.mtx.Lock()
+	q.forgetLocked(key)
+	if size > q.quota {
+		q.skipped++
+		q.mtx.Unlock()
+		return false
+	}
+
+	var evicted []string
+	for q.used+size > q.quota {
+		oldest := q.order.Front().Value.(*quotaEntry)
+		q.forgetLocked(oldest.key)
+		evicted = append(evicted, oldest.key)
+		q.evictions++
+	}
+	q.entries[key] = q.order.PushBack(&quotaEntry{key: key, size: size})
+	q.used += size
+	q.mtx.Unlock()
+
+	// deletes are best effort, an entry that fails to be deleted expires
+	// eventually
+	for _, k := range evicted {
+		q.Cacher.Del(k)
+	}
+	return true
+}
+
+func (q *QuotaCacher) forgetLocked(key string) {
+	el, ok := q.entries[key]
+	if !ok {
+		return
+	}
+	q.used -= el.Value.(*quotaEntry).size
+	q.order.Remove(el)
+	delete(q.entries, key)
+}
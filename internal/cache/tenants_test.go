@@ -0,0 +1,50 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTenants(t *testing.T) {
+	shared := &mapCacher{vals: make(map[string][]byte)}
+	tenants := NewTenants(shared, []config.TenantConfig{
+		{Name: "acme", Keys: []string{"acme-1", "acme-2"}, CacheQuota: 40},
+		{Name: "globex", Keys: []string{"globex-1"}, Prefix: "gx:"},
+	})
+	require.Nil(t, tenants.For("other"))
+	require.Equal(t, tenants.For("acme-1"), tenants.For("acme-2"))
+	require.Equal(t, tenants.For("globex-1"), tenants.Named("globex"))
+	require.Nil(t, tenants.Named("other"))
+	require.Equal(t, "tenant:acme:acme-1", tenants.Namespaced("acme-1"))
+	require.Equal(t, "gx:globex-1", tenants.Namespaced("globex-1"))
+	require.Equal(t, "other", tenants.Namespaced("other"))
+
+	acme := tenants.For("acme-1")
+	globex := tenants.For("globex-1")
+	require.NoError(t, acme.SetEx("block:1", []byte("0123456789"), time.Minute))
+	require.NoError(t, globex.SetEx("block:1", []byte("globex"), time.Minute))
+	require.Equal(t, []byte("0123456789"), shared.vals["tenant:acme:block:1"])
+	require.Equal(t, []byte("globex"), shared.vals["gx:block:1"])
+
+	// acme's second entry still fits, its third evicts the oldest one
+	require.NoError(t, acme.SetEx("block:2", []byte("0123456789"), time.Minute))
+	require.NoError(t, acme.SetEx("block:3", []byte("0123456789"), time.Minute))
+	require.NotContains(t, shared.vals, "tenant:acme:block:1")
+	require.Contains(t, shared.vals, "tenant:acme:block:2")
+	require.Contains(t, shared.vals, "tenant:acme:block:3")
+
+	// values larger than the whole quota are not cached, and other tenants
+	// are never evicted
+	require.NoError(t, acme.SetEx("logs", make([]byte, 100), time.Minute))
+	require.NotContains(t, shared.vals, "tenant:acme:logs")
+	require.Contains(t, shared.vals, "gx:block:1")
+
+	require.NoError(t, acme.Del("block:2"))
+	require.Equal(t, []TenantUsage{
+		{Tenant: "acme", Prefix: "tenant:acme:", Bytes: 17, Quota: 40, Entries: 1, Evictions: 1, Skipped: 1},
+		{Tenant: "globex", Prefix: "gx:"},
+	}, tenants.Usage())
+}
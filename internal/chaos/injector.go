@@ -0,0 +1,77 @@
+package chaos
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/kyokan/chaind/pkg/config"
+)
+
+// Injector injects faults into requests to backends and into their
+// healthchecks, for rehearsing failover. It must never be enabled in
+// production.
+type Injector struct {
+	faults []config.ChaosFault
+	mtx    sync.RWMutex
+	rand   func() float64
+}
+
+func NewInjector(cfg *config.ChaosConfig) *Injector {
+	return &Injector{
+		faults: cfg.Faults,
+		rand:   rand.Float64,
+	}
+}
+
+// Set replaces the active faults.
+func (i *Injector) Set(faults []config.ChaosFault) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	i.faults = faults
+}
+
+func (i *Injector) Faults() []config.ChaosFault {
+	i.mtx.RLock()
+	defer i.mtx.RUnlock()
+	return append([]config.ChaosFault{}, i.faults...)
+}
+
+// Latency returns a random delay of up to the fault's latency to add to a
+// request to the backend.
+func (i *Injector) Latency(backend string) time.Duration {
+	fault := i.faultFor(backend)
+	if fault == nil || fault.Latency <= 0 {
+		return 0
+	}
+
+	return time.Duration(i.rand() * float64(fault.Latency))
+}
+
+// Drop returns whether to drop the backend's response to a request.
+func (i *Injector) Drop(backend string) bool {
+	fault := i.faultFor(backend)
+	return fault != nil && i.rand() < fault.DropRate
+}
+
+// Unhealthy returns whether the backend's healthchecks should fail.
+func (i *Injector) Unhealthy(backend string) bool {
+	fault := i.faultFor(backend)
+	return fault != nil && fault.Unhealthy
+}
+
+// faultFor returns the first fault matching the backend. Faults without a
+// backend match all backends.
+func (i *Injector) faultFor(backend string) *config.ChaosFault {
+	i.mtx.RLock()
+	defer i.mtx.RUnlock()
+
+	for j := range i.faults {
+		if i.faults[j].Backend == "" || i.faults[j].Backend == backend {
+			fault := i.faults[j]
+			return &fault
+		}
+	}
+
+	return nil
+}
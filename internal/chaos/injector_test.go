@@ -0,0 +1,31 @@
+package chaos
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInjector(t *testing.T) {
+	i := NewInjector(&config.ChaosConfig{
+		Faults: []config.ChaosFault{
+			{Backend: "local", Unhealthy: true},
+			{Latency: time.Second, DropRate: 0.5},
+		},
+	})
+	i.rand = func() float64 { return 0.25 }
+
+	require.True(t, i.Unhealthy("local"))
+	require.Equal(t, time.Duration(0), i.Latency("local"))
+	require.False(t, i.Drop("local"))
+
+	require.False(t, i.Unhealthy("infura"))
+	require.Equal(t, 250*time.Millisecond, i.Latency("infura"))
+	require.True(t, i.Drop("infura"))
+
+	i.Set(nil)
+	require.False(t, i.Drop("infura"))
+	require.Empty(t, i.Faults())
+}
@@ -0,0 +1,116 @@
+package consul
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ServiceEntry is an entry of Consul's /v1/health/service response.
+type ServiceEntry struct {
+	Node struct {
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		ID      string            `json:"ID"`
+		Address string            `json:"Address"`
+		Port    int               `json:"Port"`
+		Meta    map[string]string `json:"Meta"`
+	} `json:"Service"`
+}
+
+type Registration struct {
+	ID      string             `json:"ID"`
+	Name    string             `json:"Name"`
+	Address string             `json:"Address,omitempty"`
+	Port    int                `json:"Port"`
+	Check   *RegistrationCheck `json:"Check,omitempty"`
+}
+
+type RegistrationCheck struct {
+	HTTP                           string `json:"HTTP,omitempty"`
+	TCP                            string `json:"TCP,omitempty"`
+	TLSSkipVerify                  bool   `json:"TLSSkipVerify,omitempty"`
+	Interval                       string `json:"Interval"`
+	DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter,omitempty"`
+}
+
+const DefaultAddr = "http://127.0.0.1:8500"
+
+// Client is a minimal client for the parts of the Consul HTTP API chaind
+// uses.
+type Client struct {
+	addr   string
+	token  string
+	client *http.Client
+}
+
+func NewClient(addr string, token string) *Client {
+	if addr == "" {
+		addr = DefaultAddr
+	}
+	return &Client{
+		addr:  strings.TrimRight(addr, "/"),
+		token: token,
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+// HealthyService returns the instances of a service. When passingOnly is
+// set, instances failing their Consul health checks are omitted.
+func (c *Client) HealthyService(name string, passingOnly bool) ([]ServiceEntry, error) {
+	path := "/v1/health/service/" + url.PathEscape(name)
+	if passingOnly {
+		path += "?passing=true"
+	}
+
+	var entries []ServiceEntry
+	if err := c.do(http.MethodGet, path, nil, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (c *Client) Register(reg *Registration) error {
+	return c.do(http.MethodPut, "/v1/agent/service/register", reg, nil)
+}
+
+func (c *Client) Deregister(id string) error {
+	return c.do(http.MethodPut, "/v1/agent/service/deregister/"+url.PathEscape(id), nil, nil)
+}
+
+func (c *Client) do(method string, path string, in interface{}, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, c.addr+path, &body)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("consul returned status %d for %s", res.StatusCode, path)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
@@ -0,0 +1,126 @@
+package consul
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/log"
+)
+
+const DefaultInterval = 10 * time.Second
+
+// TierMetaKey is the Consul service meta key holding a backend's cost tier.
+const TierMetaKey = "chaind_tier"
+
+type Updater interface {
+	UpdateBackends(t pkg.BackendType, backends []config.Backend)
+}
+
+// Discovery periodically reads backends from a Consul service and merges
+// them with the statically configured backends.
+type Discovery struct {
+	cfg      *config.ConsulConfig
+	client   *Client
+	static   []config.Backend
+	updater  Updater
+	last     []config.Backend
+	quitChan chan bool
+	logger   log15.Logger
+}
+
+func NewDiscovery(cfg *config.ConsulConfig, static []config.Backend, updater Updater) *Discovery {
+	return &Discovery{
+		cfg:      cfg,
+		client:   NewClient(cfg.Addr, cfg.Token),
+		static:   static,
+		updater:  updater,
+		quitChan: make(chan bool),
+		logger:   log.NewLog("consul"),
+	}
+}
+
+func (d *Discovery) Start() error {
+	if err := d.refresh(); err != nil {
+		return err
+	}
+
+	interval := d.cfg.Interval
+	if interval == 0 {
+		interval = DefaultInterval
+	}
+	go func() {
+		tick := time.NewTicker(interval)
+
+		for {
+			select {
+			case <-tick.C:
+				if err := d.refresh(); err != nil {
+					d.logger.Error("failed to refresh backends from consul, keeping previous backends", "err", err)
+				}
+			case <-d.quitChan:
+				tick.Stop()
+				return
+			}
+		}
+	}()
+
+	d.logger.Info("started backend discovery", "service", d.cfg.Service, "interval", interval)
+	return nil
+}
+
+func (d *Discovery) Stop() error {
+	d.quitChan <- true
+	return nil
+}
+
+func (d *Discovery) refresh() error {
+	entries, err := d.client.HealthyService(d.cfg.Service, d.cfg.HonorHealth)
+	if err != nil {
+		return err
+	}
+
+	backends := append([]config.Backend{}, d.static...)
+	for _, entry := range entries {
+		backends = append(backends, d.toBackend(entry))
+	}
+	if reflect.DeepEqual(backends, d.last) {
+		return nil
+	}
+
+	d.last = backends
+	d.updater.UpdateBackends(pkg.EthBackend, backends)
+	return nil
+}
+
+func (d *Discovery) toBackend(entry ServiceEntry) config.Backend {
+	addr := entry.Service.Address
+	if addr == "" {
+		addr = entry.Node.Address
+	}
+	scheme := d.cfg.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	var tier int
+	if tierStr, ok := entry.Service.Meta[TierMetaKey]; ok {
+		parsed, err := strconv.Atoi(tierStr)
+		if err != nil {
+			d.logger.Warn("ignoring invalid tier in service meta", "id", entry.Service.ID, "tier", tierStr)
+		} else {
+			tier = parsed
+		}
+	}
+
+	return config.Backend{
+		Type: pkg.EthBackend,
+		Name: "consul:" + entry.Service.ID,
+		URL:  fmt.Sprintf("%s://%s:%d%s", scheme, addr, entry.Service.Port, d.cfg.Path),
+		Tier: tier,
+	}
+}
@@ -0,0 +1,56 @@
+package consul
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingUpdater struct {
+	updates [][]config.Backend
+}
+
+func (r *recordingUpdater) UpdateBackends(t pkg.BackendType, backends []config.Backend) {
+	r.updates = append(r.updates, backends)
+}
+
+func TestDiscoveryRefresh(t *testing.T) {
+	var query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/health/service/geth", r.URL.Path)
+		require.Equal(t, "secret", r.Header.Get("X-Consul-Token"))
+		query = r.URL.RawQuery
+		w.Write([]byte(`[
+			{"Node": {"Address": "10.0.0.1"}, "Service": {"ID": "geth-1", "Address": "", "Port": 8545, "Meta": {"chaind_tier": "0"}}},
+			{"Node": {"Address": "10.0.0.2"}, "Service": {"ID": "geth-2", "Address": "10.0.1.2", "Port": 8545, "Meta": {}}}
+		]`))
+	}))
+	defer srv.Close()
+
+	static := []config.Backend{
+		{Type: pkg.EthBackend, Name: "infura", URL: "https://mainnet.infura.io", Tier: 1},
+	}
+	updater := new(recordingUpdater)
+	d := NewDiscovery(&config.ConsulConfig{
+		Addr:        srv.URL,
+		Token:       "secret",
+		Service:     "geth",
+		HonorHealth: true,
+	}, static, updater)
+
+	require.NoError(t, d.refresh())
+	require.Equal(t, "passing=true", query)
+	require.Equal(t, [][]config.Backend{{
+		static[0],
+		{Type: pkg.EthBackend, Name: "consul:geth-1", URL: "http://10.0.0.1:8545"},
+		{Type: pkg.EthBackend, Name: "consul:geth-2", URL: "http://10.0.1.2:8545"},
+	}}, updater.updates)
+
+	// unchanged backends don't trigger an update
+	require.NoError(t, d.refresh())
+	require.Len(t, updater.updates, 1)
+}
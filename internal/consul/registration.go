@@ -0,0 +1,75 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/log"
+)
+
+// SelfRegistration registers chaind itself as a Consul service, with a check
+// against the proxy's health endpoint.
+type SelfRegistration struct {
+	client *Client
+	reg    *Registration
+	logger log15.Logger
+}
+
+// NewSelfRegistration registers the proxy listening on rpcPort. The check
+// uses HTTPS when the proxy serves TLS, and falls back to a TCP check when
+// the proxy requires client certificates, which Consul can't present.
+func NewSelfRegistration(cfg *config.ConsulConfig, rpcPort int, tlsCfg *config.TLSConfig) *SelfRegistration {
+	hostname, _ := os.Hostname()
+	name := cfg.RegisterName
+	addr := cfg.RegisterAddress
+	checkHost := addr
+	if checkHost == "" {
+		checkHost = "127.0.0.1"
+	}
+
+	return &SelfRegistration{
+		client: NewClient(cfg.Addr, cfg.Token),
+		reg: &Registration{
+			ID:      fmt.Sprintf("%s-%s-%d", name, hostname, rpcPort),
+			Name:    name,
+			Address: addr,
+			Port:    rpcPort,
+			Check:   healthCheck(checkHost, rpcPort, tlsCfg),
+		},
+		logger: log.NewLog("consul"),
+	}
+}
+
+func healthCheck(host string, port int, tlsCfg *config.TLSConfig) *RegistrationCheck {
+	check := &RegistrationCheck{
+		Interval:                       "10s",
+		DeregisterCriticalServiceAfter: "10m",
+	}
+	switch {
+	case tlsCfg == nil:
+		check.HTTP = fmt.Sprintf("http://%s:%d/health", host, port)
+	case tlsCfg.RequireClientCert:
+		check.TCP = fmt.Sprintf("%s:%d", host, port)
+	default:
+		// the certificate is unlikely to be issued for the check address
+		check.HTTP = fmt.Sprintf("https://%s:%d/health", host, port)
+		check.TLSSkipVerify = true
+	}
+
+	return check
+}
+
+func (s *SelfRegistration) Start() error {
+	if err := s.client.Register(s.reg); err != nil {
+		return err
+	}
+
+	s.logger.Info("registered with consul", "id", s.reg.ID, "name", s.reg.Name)
+	return nil
+}
+
+func (s *SelfRegistration) Stop() error {
+	return s.client.Deregister(s.reg.ID)
+}
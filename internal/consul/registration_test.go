@@ -0,0 +1,26 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelfRegistrationCheck(t *testing.T) {
+	cfg := &config.ConsulConfig{
+		RegisterName:    "chaind",
+		RegisterAddress: "10.0.0.5",
+	}
+
+	check := NewSelfRegistration(cfg, 8080, nil).reg.Check
+	require.Equal(t, "http://10.0.0.5:8080/health", check.HTTP)
+
+	check = NewSelfRegistration(cfg, 8080, &config.TLSConfig{}).reg.Check
+	require.Equal(t, "https://10.0.0.5:8080/health", check.HTTP)
+	require.True(t, check.TLSSkipVerify)
+
+	check = NewSelfRegistration(cfg, 8080, &config.TLSConfig{RequireClientCert: true}).reg.Check
+	require.Empty(t, check.HTTP)
+	require.Equal(t, "10.0.0.5:8080", check.TCP)
+}
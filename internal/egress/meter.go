@@ -0,0 +1,285 @@
+package egress
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/log"
+)
+
+// DefaultWarnRatio is the share of its daily limit a client can use before
+// it is warned.
+const DefaultWarnRatio = 0.8
+
+const (
+	AlertWarning  = "warning"
+	AlertExceeded = "exceeded"
+)
+
+// alertBuffer bounds the alerts waiting for the webhook; further alerts are
+// dropped until it catches up.
+const alertBuffer = 64
+
+// Usage is a client's egress on the current UTC day.
+type Usage struct {
+	Key   string `json:"key"`
+	Bytes int64  `json:"bytes"`
+	// Limit is the client's daily limit, or 0 if it is unlimited
+	Limit    int64 `json:"limit"`
+	Warned   bool  `json:"warned"`
+	Exceeded bool  `json:"exceeded"`
+}
+
+// Alert is POSTed to the webhook when a client crosses its warning
+// threshold or its daily limit.
+type Alert struct {
+	Key   string `json:"key"`
+	Level string `json:"level"`
+	Bytes int64  `json:"bytes"`
+	Limit int64  `json:"limit"`
+	Day   string `json:"day"`
+}
+
+// Meter tracks the response bytes served to each client per UTC day, and
+// enforces their daily limits.
+type Meter struct {
+	cfg       *config.EgressConfig
+	limits    map[string]int64
+	warnRatio float64
+	day       string
+	usage     map[string]*Usage
+	mtx       sync.Mutex
+	alerts    chan Alert
+	client    *http.Client
+	quitChan  chan bool
+	logger    log15.Logger
+	now       func() time.Time
+}
+
+func NewMeter(cfg *config.EgressConfig) *Meter {
+	m := &Meter{
+		cfg:       cfg,
+		limits:    make(map[string]int64),
+		warnRatio: cfg.WarnRatio,
+		usage:     make(map[string]*Usage),
+		alerts:    make(chan Alert, alertBuffer),
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		quitChan: make(chan bool),
+		logger:   log.NewLog("egress"),
+		now:      time.Now,
+	}
+	if m.warnRatio == 0 {
+		m.warnRatio = DefaultWarnRatio
+	}
+	for _, key := range cfg.Keys {
+		m.limits[key.Key] = key.DailyBytes
+	}
+	return m
+}
+
+func (m *Meter) Start() error {
+	go func() {
+		for {
+			select {
+			case alert := <-m.alerts:
+				m.notify(&alert)
+			case <-m.quitChan:
+				return
+			}
+		}
+	}()
+
+	m.logger.Info("started", "daily_bytes", m.cfg.DailyBytes, "webhook_url", m.cfg.WebhookURL)
+	return nil
+}
+
+func (m *Meter) Stop() error {
+	m.quitChan <- true
+	return nil
+}
+
+// Check returns the key's usage. Clients whose usage is Exceeded must not
+// be served until the next UTC day.
+func (m *Meter) Check(key string) Usage {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	// keys are only tracked once they're served, so that checks of keys
+	// that never get a response don't grow the table
+	m.rolloverLocked()
+	if usage, ok := m.usage[key]; ok {
+		return *usage
+	}
+	return Usage{
+		Key:   key,
+		Limit: m.limitFor(key),
+	}
+}
+
+// Record adds the bytes of a response to the key's usage.
+func (m *Meter) Record(key string, n int64) {
+	if n <= 0 {
+		return
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	usage := m.usageLocked(key)
+	usage.Bytes += n
+	if usage.Limit == 0 {
+		return
+	}
+	if !usage.Warned && float64(usage.Bytes) >= m.warnRatio*float64(usage.Limit) {
+		usage.Warned = true
+		m.alert(usage, AlertWarning)
+	}
+	if !usage.Exceeded && usage.Bytes >= usage.Limit {
+		usage.Exceeded = true
+		m.alert(usage, AlertExceeded)
+	}
+}
+
+// Usage returns the usage of every client served today, heaviest first.
+func (m *Meter) Usage() []Usage {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.rolloverLocked()
+	out := make([]Usage, 0, len(m.usage))
+	for _, usage := range m.usage {
+		out = append(out, *usage)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Bytes != out[j].Bytes {
+			return out[i].Bytes > out[j].Bytes
+		}
+		return out[i].Key < out[j].Key
+	})
+	return out
+}
+
+// Snapshot is a day's usage, as exported for handing it over to another
+// instance.
+type Snapshot struct {
+	Day   string  `json:"day"`
+	Usage []Usage `json:"usage"`
+}
+
+// Snapshot returns today's usage.
+func (m *Meter) Snapshot() Snapshot {
+	usage := m.Usage()
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return Snapshot{
+		Day:   m.day,
+		Usage: usage,
+	}
+}
+
+// Restore adds the usage exported by another instance, unless it is from
+// another day. Clients keep the higher of the two counts, and no alerts are
+// sent for thresholds crossed on the other instance. It returns the number
+// of clients restored.
+func (m *Meter) Restore(snap Snapshot) int {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.rolloverLocked()
+	if snap.Day != m.day {
+		m.logger.Warn("ignoring egress usage of another day", "day", snap.Day)
+		return 0
+	}
+	for _, imported := range snap.Usage {
+		usage := m.usageLocked(imported.Key)
+		if imported.Bytes > usage.Bytes {
+			usage.Bytes = imported.Bytes
+		}
+		usage.Warned = usage.Warned || imported.Warned
+		usage.Exceeded = usage.Exceeded || imported.Exceeded
+		if usage.Limit > 0 && usage.Bytes >= usage.Limit {
+			usage.Exceeded = true
+		}
+	}
+	m.logger.Info("restored egress usage", "clients", len(snap.Usage))
+	return len(snap.Usage)
+}
+
+// ResetIn returns the time until usage is reset at the next UTC midnight.
+func (m *Meter) ResetIn() time.Duration {
+	now := m.now().UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	return midnight.Sub(now)
+}
+
+func (m *Meter) usageLocked(key string) *Usage {
+	m.rolloverLocked()
+	usage, ok := m.usage[key]
+	if !ok {
+		usage = &Usage{
+			Key:   key,
+			Limit: m.limitFor(key),
+		}
+		m.usage[key] = usage
+	}
+	return usage
+}
+
+func (m *Meter) limitFor(key string) int64 {
+	if limit, ok := m.limits[key]; ok {
+		return limit
+	}
+	return m.cfg.DailyBytes
+}
+
+func (m *Meter) rolloverLocked() {
+	day := m.now().UTC().Format("2006-01-02")
+	if day != m.day {
+		m.day = day
+		m.usage = make(map[string]*Usage)
+	}
+}
+
+func (m *Meter) alert(usage *Usage, level string) {
+	m.logger.Warn("client crossed its egress threshold", "key", usage.Key, "level", level, "bytes", usage.Bytes, "limit", usage.Limit)
+	if m.cfg.WebhookURL == "" {
+		return
+	}
+
+	alert := Alert{
+		Key:   usage.Key,
+		Level: level,
+		Bytes: usage.Bytes,
+		Limit: usage.Limit,
+		Day:   m.day,
+	}
+	select {
+	case m.alerts <- alert:
+	default:
+		m.logger.Error("dropped egress alert, webhook is backed up", "key", usage.Key, "level", level)
+	}
+}
+
+func (m *Meter) notify(alert *Alert) {
+	data, err := json.Marshal(alert)
+	if err != nil {
+		m.logger.Error("failed to marshal alert", "err", err)
+		return
+	}
+	res, err := m.client.Post(m.cfg.WebhookURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		m.logger.Error("failed to call webhook", "webhook_url", m.cfg.WebhookURL, "err", err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		m.logger.Error("webhook returned an error", "webhook_url", m.cfg.WebhookURL, "status", res.StatusCode)
+	}
+}
@@ -0,0 +1,89 @@
+package egress
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMeter(t *testing.T) {
+	alerts := make(chan Alert, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert Alert
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&alert))
+		alerts <- alert
+	}))
+	defer srv.Close()
+
+	m := NewMeter(&config.EgressConfig{
+		DailyBytes: 1000,
+		WebhookURL: srv.URL,
+		Keys: []config.EgressKey{
+			{Key: "indexer", DailyBytes: 0},
+		},
+	})
+	now := time.Date(2018, 10, 1, 23, 0, 0, 0, time.UTC)
+	m.now = func() time.Time {
+		return now
+	}
+	require.NoError(t, m.Start())
+	defer m.Stop()
+
+	m.Record("bot", 700)
+	require.False(t, m.Check("bot").Warned)
+	m.Record("bot", 100)
+	require.True(t, m.Check("bot").Warned)
+	require.Equal(t, Alert{Key: "bot", Level: AlertWarning, Bytes: 800, Limit: 1000, Day: "2018-10-01"}, <-alerts)
+	m.Record("bot", 300)
+	require.True(t, m.Check("bot").Exceeded)
+	require.Equal(t, AlertExceeded, (<-alerts).Level)
+
+	// keys can be exempted from the default limit
+	m.Record("indexer", 5000)
+	require.False(t, m.Check("indexer").Exceeded)
+	require.Equal(t, []Usage{
+		{Key: "indexer", Bytes: 5000},
+		{Key: "bot", Bytes: 1100, Limit: 1000, Warned: true, Exceeded: true},
+	}, m.Usage())
+	require.Equal(t, time.Hour, m.ResetIn())
+
+	// usage resets at UTC midnight
+	now = now.Add(time.Hour)
+	require.Equal(t, Usage{Key: "bot", Limit: 1000}, m.Check("bot"))
+
+	// keys are only tracked once they're served
+	m.Check("scanner")
+	m.Record("scanner", 0)
+	require.Empty(t, m.Usage())
+}
+
+func TestMeterRestore(t *testing.T) {
+	cfg := &config.EgressConfig{DailyBytes: 1000}
+	now := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	blue := NewMeter(cfg)
+	blue.now = func() time.Time {
+		return now
+	}
+	blue.Record("bot", 900)
+	blue.Record("indexer", 100)
+	snap := blue.Snapshot()
+	require.Equal(t, "2018-10-01", snap.Day)
+
+	green := NewMeter(cfg)
+	green.now = blue.now
+	green.Record("indexer", 200)
+	require.Equal(t, 2, green.Restore(snap))
+	require.Equal(t, int64(900), green.Check("bot").Bytes)
+	require.True(t, green.Check("bot").Warned)
+	require.Equal(t, int64(200), green.Check("indexer").Bytes)
+
+	// usage of another day is ignored
+	now = now.Add(24 * time.Hour)
+	require.Equal(t, 0, green.Restore(snap))
+	require.Equal(t, int64(0), green.Check("bot").Bytes)
+}
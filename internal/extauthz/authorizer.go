@@ -0,0 +1,220 @@
+package extauthz
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/jsonrpc"
+	"github.com/kyokan/chaind/pkg/log"
+)
+
+const (
+	DefaultTimeout  = 200 * time.Millisecond
+	DefaultCacheTTL = 5 * time.Second
+	// maxCachedDecisions bounds the decision cache; decisions aren't cached
+	// while it's full of unexpired ones.
+	maxCachedDecisions = 10000
+)
+
+// Call is a JSON-RPC call of the request being authorized. Params are only
+// sent when the config includes them.
+type Call struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// CheckRequest is POSTed to the policy service for each request.
+type CheckRequest struct {
+	Key        string `json:"key"`
+	RemoteAddr string `json:"remote_addr"`
+	Tag        string `json:"tag,omitempty"`
+	Calls      []Call `json:"calls"`
+}
+
+// Decision is the policy service's response. RateTier names the rate limit
+// key whose policy applies to the client, instead of its own.
+type Decision struct {
+	Allow    bool   `json:"allow"`
+	Reason   string `json:"reason,omitempty"`
+	RateTier string `json:"rate_tier,omitempty"`
+}
+
+// Authorizer asks an external policy service whether to serve requests, in
+// the spirit of Envoy's ext_authz, so that policy can change without
+// redeploying chaind.
+type Authorizer struct {
+	cfg    *config.ExtAuthzConfig
+	client *http.Client
+	ttl    time.Duration
+	logger log15.Logger
+
+	mtx       sync.Mutex
+	decisions map[string]cachedDecision
+}
+
+type cachedDecision struct {
+	decision *Decision
+	expires  time.Time
+}
+
+func NewAuthorizer(cfg *config.ExtAuthzConfig) *Authorizer {
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+
+	ttl := cfg.CacheTTL
+	if ttl == 0 {
+		ttl = DefaultCacheTTL
+	}
+
+	return &Authorizer{
+		cfg: cfg,
+		client: &http.Client{
+			Timeout: timeout,
+		},
+		ttl:       ttl,
+		logger:    log.NewLog("extauthz"),
+		decisions: make(map[string]cachedDecision),
+	}
+}
+
+// Calls returns the calls of a single or batch request body.
+func (a *Authorizer) Calls(body []byte) ([]Call, error) {
+	var reqs []jsonrpc.Request
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		batch, err := jsonrpc.ParseBatch(body)
+		if err != nil {
+			return nil, err
+		}
+		reqs = batch
+	} else {
+		req, err := jsonrpc.ParseRequest(body)
+		if err != nil {
+			return nil, err
+		}
+		reqs = []jsonrpc.Request{req}
+	}
+
+	calls := make([]Call, 0, len(reqs))
+	for _, req := range reqs {
+		call := Call{
+			Method: req.Method,
+		}
+		if a.cfg.IncludeParams {
+			call.Params = req.Params
+		}
+		calls = append(calls, call)
+	}
+	return calls, nil
+}
+
+// Check asks the policy service for a decision on the request, unless it
+// decided on the same calls by the same client recently. While the service
+// is unreachable or failing, requests are allowed if the config fails open,
+// and denied otherwise.
+func (a *Authorizer) Check(ctx context.Context, check *CheckRequest) *Decision {
+	cacheKey := decisionKey(check)
+	now := time.Now()
+	if decision, ok := a.cached(cacheKey, now); ok {
+		return decision
+	}
+
+	decision, err := a.check(ctx, check)
+	if err == nil {
+		a.store(cacheKey, decision, now)
+		return decision
+	}
+
+	a.logger.Warn("policy service failed", log.WithRequestID(ctx, "url", a.cfg.URL, "err", err)...)
+	if a.cfg.FailOpen {
+		return &Decision{Allow: true}
+	}
+	return &Decision{Reason: "authorization service unavailable"}
+}
+
+func (a *Authorizer) check(ctx context.Context, check *CheckRequest) (*Decision, error) {
+	data, err := json.Marshal(check)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, a.cfg.URL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("content-type", "application/json")
+	res, err := a.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("policy service returned status %d", res.StatusCode)
+	}
+
+	var decision Decision
+	if err := json.NewDecoder(res.Body).Decode(&decision); err != nil {
+		return nil, err
+	}
+	return &decision, nil
+}
+
+// decisionKey identifies the requests the policy service can be expected to
+// make the same decision on.
+func decisionKey(check *CheckRequest) string {
+	host, _, err := net.SplitHostPort(check.RemoteAddr)
+	if err != nil {
+		host = check.RemoteAddr
+	}
+	var b strings.Builder
+	b.WriteString(check.Key)
+	b.WriteByte(0)
+	b.WriteString(host)
+	b.WriteByte(0)
+	b.WriteString(check.Tag)
+	for _, call := range check.Calls {
+		b.WriteByte(0)
+		b.WriteString(call.Method)
+		b.WriteByte(0)
+		b.Write(call.Params)
+	}
+	return b.String()
+}
+
+func (a *Authorizer) cached(cacheKey string, now time.Time) (*Decision, bool) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	cached, ok := a.decisions[cacheKey]
+	if !ok || !now.Before(cached.expires) {
+		return nil, false
+	}
+	return cached.decision, true
+}
+
+func (a *Authorizer) store(cacheKey string, decision *Decision, now time.Time) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if len(a.decisions) >= maxCachedDecisions {
+		for k, cached := range a.decisions {
+			if !now.Before(cached.expires) {
+				delete(a.decisions, k)
+			}
+		}
+		if len(a.decisions) >= maxCachedDecisions {
+			return
+		}
+	}
+	a.decisions[cacheKey] = cachedDecision{
+		decision: decision,
+		expires:  now.Add(a.ttl),
+	}
+}
@@ -0,0 +1,93 @@
+package extauthz
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthorizerCheck(t *testing.T) {
+	var got CheckRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		decision := Decision{Allow: got.Key == "alice", RateTier: "gold"}
+		if !decision.Allow {
+			decision.Reason = "unknown key"
+		}
+		json.NewEncoder(w).Encode(decision)
+	}))
+	defer srv.Close()
+
+	a := NewAuthorizer(&config.ExtAuthzConfig{URL: srv.URL, IncludeParams: true})
+	calls, err := a.Calls([]byte(` [{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[{"to":"0x1"},"latest"]},{"jsonrpc":"2.0","id":2,"method":"eth_blockNumber"}]`))
+	require.NoError(t, err)
+	require.Len(t, calls, 2)
+
+	decision := a.Check(context.Background(), &CheckRequest{Key: "alice", Calls: calls})
+	require.True(t, decision.Allow)
+	require.Equal(t, "gold", decision.RateTier)
+	require.Equal(t, "eth_call", got.Calls[0].Method)
+	require.Equal(t, `[{"to":"0x1"},"latest"]`, string(got.Calls[0].Params))
+	require.Equal(t, "eth_blockNumber", got.Calls[1].Method)
+
+	decision = a.Check(context.Background(), &CheckRequest{Key: "mallory"})
+	require.False(t, decision.Allow)
+	require.Equal(t, "unknown key", decision.Reason)
+}
+
+func TestAuthorizerOmitsParams(t *testing.T) {
+	a := NewAuthorizer(&config.ExtAuthzConfig{URL: "http://localhost"})
+	calls, err := a.Calls([]byte(`{"jsonrpc":"2.0","id":1,"method":"eth_getBalance","params":["0x1","latest"]}`))
+	require.NoError(t, err)
+	require.Equal(t, []Call{{Method: "eth_getBalance"}}, calls)
+}
+
+func TestAuthorizerFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	closed := NewAuthorizer(&config.ExtAuthzConfig{URL: srv.URL, Timeout: 10 * time.Millisecond})
+	require.False(t, closed.Check(context.Background(), &CheckRequest{Key: "alice"}).Allow)
+	// failures aren't cached
+	require.Empty(t, closed.decisions)
+
+	open := NewAuthorizer(&config.ExtAuthzConfig{URL: srv.URL, Timeout: 10 * time.Millisecond, FailOpen: true})
+	require.True(t, open.Check(context.Background(), &CheckRequest{Key: "alice"}).Allow)
+}
+
+func TestAuthorizerCachesDecisions(t *testing.T) {
+	var checks int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&checks, 1)
+		json.NewEncoder(w).Encode(Decision{Allow: true})
+	}))
+	defer srv.Close()
+
+	a := NewAuthorizer(&config.ExtAuthzConfig{URL: srv.URL, CacheTTL: 50 * time.Millisecond})
+	check := func(key, method string) {
+		require.True(t, a.Check(context.Background(), &CheckRequest{
+			Key:        key,
+			RemoteAddr: "10.0.0.1:1234",
+			Calls:      []Call{{Method: method}},
+		}).Allow)
+	}
+	check("alice", "eth_call")
+	check("alice", "eth_call")
+	require.EqualValues(t, 1, atomic.LoadInt32(&checks))
+	check("alice", "eth_blockNumber")
+	check("bob", "eth_call")
+	require.EqualValues(t, 3, atomic.LoadInt32(&checks))
+
+	time.Sleep(60 * time.Millisecond)
+	check("alice", "eth_call")
+	require.EqualValues(t, 4, atomic.LoadInt32(&checks))
+}
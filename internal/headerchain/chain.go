@@ -0,0 +1,189 @@
+package headerchain
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/jsonrpc"
+	"github.com/kyokan/chaind/pkg/log"
+)
+
+// maxSyncBatch bounds the headers fetched per sync, so that catching up
+// from an old checkpoint doesn't hammer the source backend.
+const maxSyncBatch = 256
+
+// retain is the number of recent headers kept for verification.
+const retain = 8192
+
+type Result int
+
+const (
+	// Unknown means the block is outside the verified header chain, e.g.
+	// because it's too recent or too old.
+	Unknown Result = iota
+	Match
+	Mismatch
+)
+
+type header struct {
+	Number     string `json:"number"`
+	Hash       string `json:"hash"`
+	ParentHash string `json:"parentHash"`
+}
+
+// Chain maintains a header chain anchored at a trusted checkpoint. Headers
+// are fetched from the source backend and only accepted if they link back
+// to the checkpoint through their parent hashes, so that block hashes
+// returned by other backends can be checked against the source's chain.
+// Header hashes are taken as reported rather than recomputed, so the chain
+// is only as trustworthy as the source backend: it detects backends that
+// disagree with the source, not a source lying about its headers.
+type Chain struct {
+	rpc        jsonrpc.Executor
+	checkpoint uint64
+	head       uint64
+	hashes     map[uint64]string
+	mtx        sync.RWMutex
+	quitChan   chan bool
+	logger     log15.Logger
+}
+
+func NewChain(cfg *config.HeaderVerificationConfig, rpc jsonrpc.Executor) *Chain {
+	return &Chain{
+		rpc:        rpc,
+		checkpoint: cfg.CheckpointNumber,
+		head:       cfg.CheckpointNumber,
+		hashes: map[uint64]string{
+			cfg.CheckpointNumber: strings.ToLower(cfg.CheckpointHash),
+		},
+		quitChan: make(chan bool),
+		logger:   log.NewLog("headerchain"),
+	}
+}
+
+func (c *Chain) Start() error {
+	go func() {
+		tick := time.NewTicker(time.Second)
+
+		for {
+			select {
+			case <-tick.C:
+				if err := c.sync(); err != nil {
+					c.logger.Warn("failed to sync headers", "err", err)
+				}
+			case <-c.quitChan:
+				tick.Stop()
+				return
+			}
+		}
+	}()
+
+	c.logger.Info("started", "checkpoint", c.checkpoint)
+	return nil
+}
+
+func (c *Chain) Stop() error {
+	c.quitChan <- true
+	return nil
+}
+
+// Head returns the number of the most recent verified header.
+func (c *Chain) Head() uint64 {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.head
+}
+
+// Verify checks a block hash against the header chain. A Match means the
+// hash agrees with the source backend, see Chain.
+func (c *Chain) Verify(number uint64, hash string) Result {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	verified, ok := c.hashes[number]
+	if !ok {
+		return Unknown
+	}
+	if verified != strings.ToLower(hash) {
+		return Mismatch
+	}
+	return Match
+}
+
+func (c *Chain) sync() error {
+	latest, err := c.fetch("latest")
+	if err != nil {
+		return err
+	}
+	latestNum, err := jsonrpc.Hex2Uint64(latest.Number)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < maxSyncBatch; i++ {
+		c.mtx.RLock()
+		next := c.head + 1
+		c.mtx.RUnlock()
+		if next > latestNum {
+			return nil
+		}
+
+		h, err := c.fetch(jsonrpc.Uint642Hex(next))
+		if err != nil {
+			return err
+		}
+		if err := c.append(next, h); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// append adds the header at number to the chain if it links to its parent,
+// and otherwise rolls back the parent so that it's refetched, following a
+// reorg.
+func (c *Chain) append(number uint64, h *header) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	parent := c.hashes[number-1]
+	if strings.ToLower(h.ParentHash) != parent {
+		if number-1 == c.checkpoint {
+			return fmt.Errorf("header %d doesn't descend from the checkpoint", number)
+		}
+		c.logger.Info("header doesn't link to its parent, rolling back", "number", number)
+		delete(c.hashes, number-1)
+		c.head = number - 2
+		return nil
+	}
+
+	c.hashes[number] = strings.ToLower(h.Hash)
+	c.head = number
+	if number > c.checkpoint+retain {
+		delete(c.hashes, number-retain)
+	}
+	return nil
+}
+
+func (c *Chain) fetch(number string) (*header, error) {
+	res, err := c.rpc.Execute("eth_getBlockByNumber", []interface{}{number, false})
+	if err != nil {
+		return nil, err
+	}
+	if res.Error != nil {
+		return nil, fmt.Errorf("eth_getBlockByNumber returned error %d: %s", res.Error.Code, res.Error.Message)
+	}
+	var h header
+	if err := json.Unmarshal(res.Result, &h); err != nil {
+		return nil, err
+	}
+	if h.Number == "" || h.Hash == "" {
+		return nil, fmt.Errorf("block %s not found", number)
+	}
+	return &h, nil
+}
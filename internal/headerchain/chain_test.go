@@ -0,0 +1,84 @@
+package headerchain
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/jsonrpc"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeRPC struct {
+	blocks map[uint64]header
+	latest uint64
+}
+
+func (f *fakeRPC) Execute(method string, params interface{}) (*jsonrpc.Response, error) {
+	tag := params.([]interface{})[0].(string)
+	number := f.latest
+	if tag != "latest" {
+		number, _ = jsonrpc.Hex2Uint64(tag)
+	}
+	block, ok := f.blocks[number]
+	if !ok {
+		return &jsonrpc.Response{Result: json.RawMessage("null")}, nil
+	}
+	data, _ := json.Marshal(block)
+	return &jsonrpc.Response{Result: data}, nil
+}
+
+func (f *fakeRPC) setBlock(number uint64, hash string, parent string) {
+	f.blocks[number] = header{
+		Number:     jsonrpc.Uint642Hex(number),
+		Hash:       hash,
+		ParentHash: parent,
+	}
+	if number > f.latest {
+		f.latest = number
+	}
+}
+
+func hash(n uint64, fork string) string {
+	return fmt.Sprintf("0x%s%063x", fork, n)
+}
+
+func TestChainSyncsFromCheckpoint(t *testing.T) {
+	rpc := &fakeRPC{blocks: make(map[uint64]header)}
+	for n := uint64(10); n <= 15; n++ {
+		rpc.setBlock(n, hash(n, "a"), hash(n-1, "a"))
+	}
+	chain := NewChain(&config.HeaderVerificationConfig{
+		CheckpointNumber: 10,
+		CheckpointHash:   hash(10, "a"),
+	}, rpc)
+
+	require.NoError(t, chain.sync())
+	require.Equal(t, uint64(15), chain.Head())
+	require.Equal(t, Match, chain.Verify(12, hash(12, "a")))
+	require.Equal(t, Mismatch, chain.Verify(12, hash(12, "b")))
+	require.Equal(t, Unknown, chain.Verify(16, hash(16, "a")))
+	require.Equal(t, Unknown, chain.Verify(9, hash(9, "a")))
+
+	// blocks 14 and 15 are reorged out
+	rpc.setBlock(14, hash(14, "b"), hash(13, "a"))
+	rpc.setBlock(15, hash(15, "b"), hash(14, "b"))
+	rpc.setBlock(16, hash(16, "b"), hash(15, "b"))
+	require.NoError(t, chain.sync())
+	require.Equal(t, uint64(16), chain.Head())
+	require.Equal(t, Match, chain.Verify(15, hash(15, "b")))
+	require.Equal(t, Match, chain.Verify(13, hash(13, "a")))
+}
+
+func TestChainRejectsForeignChain(t *testing.T) {
+	rpc := &fakeRPC{blocks: make(map[uint64]header)}
+	rpc.setBlock(11, hash(11, "b"), hash(10, "b"))
+	chain := NewChain(&config.HeaderVerificationConfig{
+		CheckpointNumber: 10,
+		CheckpointHash:   hash(10, "a"),
+	}, rpc)
+
+	require.Error(t, chain.sync())
+	require.Equal(t, uint64(10), chain.Head())
+}
@@ -0,0 +1,462 @@
+package jwtauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/log"
+)
+
+const (
+	DefaultRefreshInterval = time.Hour
+	// KeyPrefix prefixes the client keys of tokens, so that they can't
+	// collide with API keys.
+	KeyPrefix = "jwt:"
+	// clockSkew is the leeway given to the exp and nbf claims.
+	clockSkew = time.Minute
+	// minRefetchInterval bounds how often an unknown key ID triggers a JWKS
+	// refetch, so that forged tokens can't hammer the provider.
+	minRefetchInterval = time.Minute
+)
+
+var (
+	ErrMalformed        = errors.New("malformed token")
+	ErrUnsupportedAlg   = errors.New("unsupported signing algorithm")
+	ErrUnknownKey       = errors.New("unknown signing key")
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrExpired          = errors.New("token is expired")
+	ErrNotYetValid      = errors.New("token is not valid yet")
+	ErrInvalidIssuer    = errors.New("invalid issuer")
+	ErrInvalidAudience  = errors.New("invalid audience")
+	ErrMissingSubject   = errors.New("token has no subject")
+)
+
+// Identity is the client identified by a verified token, or the policy for
+// requests without one.
+type Identity struct {
+	// Key is the client key used for rate limiting, stats and cache control.
+	// It's empty for requests without a token.
+	Key string
+	// Tier names the rate limit key whose policy applies to the client, if
+	// a rule assigned one.
+	Tier string
+	// Methods lists the methods the client may call. Empty allows every
+	// method.
+	Methods []string
+}
+
+// Allows returns whether the identity may call the method. Methods ending
+// in * match every method with the preceding prefix.
+func (i *Identity) Allows(method string) bool {
+	if len(i.Methods) == 0 {
+		return true
+	}
+	for _, allowed := range i.Methods {
+		if allowed == method || (strings.HasSuffix(allowed, "*") && strings.HasPrefix(method, allowed[:len(allowed)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// Verifier verifies bearer JWTs against the JWKS of an OIDC provider, and
+// maps their claims to client identities.
+type Verifier struct {
+	cfg       *config.JWTConfig
+	interval  time.Duration
+	client    *http.Client
+	keys      map[string]crypto.PublicKey
+	lastFetch time.Time
+	mtx       sync.RWMutex
+	fetchMtx  sync.Mutex
+	quitChan  chan bool
+	logger    log15.Logger
+	now       func() time.Time
+}
+
+func NewVerifier(cfg *config.JWTConfig) *Verifier {
+	interval := cfg.RefreshInterval
+	if interval == 0 {
+		interval = DefaultRefreshInterval
+	}
+
+	return &Verifier{
+		cfg:      cfg,
+		interval: interval,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		keys:     make(map[string]crypto.PublicKey),
+		quitChan: make(chan bool),
+		logger:   log.NewLog("jwtauth"),
+		now:      time.Now,
+	}
+}
+
+func (v *Verifier) Start() error {
+	// the provider being down shouldn't keep chaind from starting; tokens
+	// fail to verify until the keys are fetched
+	if err := v.refresh(); err != nil {
+		v.logger.Error("failed to fetch jwks", "url", v.cfg.JWKSURL, "err", err)
+	}
+
+	go func() {
+		tick := time.NewTicker(v.interval)
+
+		for {
+			select {
+			case <-tick.C:
+				if err := v.refresh(); err != nil {
+					v.logger.Error("failed to refresh jwks", "url", v.cfg.JWKSURL, "err", err)
+				}
+			case <-v.quitChan:
+				tick.Stop()
+				return
+			}
+		}
+	}()
+
+	v.logger.Info("started", "issuer", v.cfg.Issuer, "refresh_interval", v.interval)
+	return nil
+}
+
+func (v *Verifier) Stop() error {
+	v.quitChan <- true
+	return nil
+}
+
+// Authenticate verifies the request's bearer token. It returns a nil
+// identity without an error if the request carries no token.
+func (v *Verifier) Authenticate(req *http.Request) (*Identity, error) {
+	auth := req.Header.Get("Authorization")
+	if auth == "" {
+		return nil, nil
+	}
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return nil, ErrMalformed
+	}
+
+	claims, err := v.Verify(strings.TrimSpace(auth[7:]))
+	if err != nil {
+		return nil, err
+	}
+	return v.identity(claims), nil
+}
+
+// Anonymous returns the identity of requests without a token, which may call
+// the configured default methods.
+func (v *Verifier) Anonymous() *Identity {
+	return &Identity{
+		Methods: v.cfg.DefaultMethods,
+	}
+}
+
+// Verify checks the token's signature and its iss, aud, sub, exp and nbf claims,
+// and returns its claims.
+func (v *Verifier) Verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrMalformed
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrMalformed
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *Verifier) checkClaims(claims map[string]interface{}) error {
+	// tokens are identified by their subject, so tokens without one would
+	// all share a client key
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return ErrMissingSubject
+	}
+	now := v.now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(clockSkew)) {
+		return ErrExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return ErrNotYetValid
+	}
+	if iss, _ := claims["iss"].(string); iss != v.cfg.Issuer {
+		return ErrInvalidIssuer
+	}
+	if !claimContains(claims["aud"], v.cfg.Audience) {
+		return ErrInvalidAudience
+	}
+	return nil
+}
+
+// identity maps the claims to an identity keyed on the token's subject,
+// with the tier and methods of the first matching rule. Tokens sharing a
+// rule don't share a key, so that each is limited on its own.
+func (v *Verifier) identity(claims map[string]interface{}) *Identity {
+	for _, rule := range v.cfg.Rules {
+		if !claimContains(claims[rule.Claim], rule.Value) {
+			continue
+		}
+		return &Identity{
+			Key:     subjectKey(claims),
+			Tier:    rule.Tier,
+			Methods: rule.Methods,
+		}
+	}
+
+	return &Identity{
+		Key: subjectKey(claims),
+	}
+}
+
+func subjectKey(claims map[string]interface{}) string {
+	sub, _ := claims["sub"].(string)
+	return KeyPrefix + sub
+}
+
+// claimContains returns whether a string claim equals value, or a list
+// claim contains it.
+func claimContains(claim interface{}, value string) bool {
+	switch c := claim.(type) {
+	case string:
+		return c == value
+	case []interface{}:
+		for _, item := range c {
+			if s, ok := item.(string); ok && s == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// key returns the public key with the given ID, refetching the JWKS if the
+// ID is unknown, e.g. because the provider rotated its keys.
+func (v *Verifier) key(kid string) (crypto.PublicKey, error) {
+	v.mtx.RLock()
+	key, ok := v.keys[kid]
+	v.mtx.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	if err := v.refetch(); err != nil {
+		v.logger.Warn("failed to refetch jwks for unknown key", "kid", kid, "err", err)
+	}
+	v.mtx.RLock()
+	defer v.mtx.RUnlock()
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+func (v *Verifier) refresh() error {
+	v.fetchMtx.Lock()
+	defer v.fetchMtx.Unlock()
+	return v.fetch()
+}
+
+// refetch fetches the JWKS unless it was fetched less than
+// minRefetchInterval ago.
+func (v *Verifier) refetch() error {
+	v.fetchMtx.Lock()
+	defer v.fetchMtx.Unlock()
+
+	v.mtx.RLock()
+	recent := v.now().Sub(v.lastFetch) < minRefetchInterval
+	v.mtx.RUnlock()
+	if recent {
+		return nil
+	}
+	return v.fetch()
+}
+
+func (v *Verifier) fetch() error {
+	v.mtx.Lock()
+	v.lastFetch = v.now()
+	v.mtx.Unlock()
+
+	res, err := v.client.Get(v.cfg.JWKSURL)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("jwks returned status %d", res.StatusCode)
+	}
+	var set jwks
+	if err := json.NewDecoder(res.Body).Decode(&set); err != nil {
+		return err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			v.logger.Warn("skipping invalid jwk", "kid", k.Kid, "err", err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+
+	v.mtx.Lock()
+	v.keys = keys
+	v.mtx.Unlock()
+	v.logger.Debug("fetched jwks", "keys", len(keys))
+	return nil
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// verifySignature checks a JWS signature. Only asymmetric algorithms are
+// supported, since chaind never holds the provider's secrets.
+func verifySignature(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return ErrUnsupportedAlg
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg[0] != 'R' {
+			return ErrUnsupportedAlg
+		}
+		if rsa.VerifyPKCS1v15(k, hash, digest, sig) != nil {
+			return ErrInvalidSignature
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[0] != 'E' || len(sig) != 2*size {
+			return ErrInvalidSignature
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return ErrInvalidSignature
+		}
+	default:
+		return ErrUnsupportedAlg
+	}
+	return nil
+}
+
+func decodeSegment(seg string, out interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
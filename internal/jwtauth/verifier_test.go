@@ -0,0 +1,215 @@
+package jwtauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func sign(t *testing.T, key crypto.Signer, alg string, kid string, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		require.NoError(t, err)
+		sig = make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(sig[32-len(rb):], rb)
+		copy(sig[64-len(sb):], sb)
+	}
+	return signed + "." + b64(sig)
+}
+
+type testProvider struct {
+	srv     *httptest.Server
+	rsaKey  *rsa.PrivateKey
+	ecKey   *ecdsa.PrivateKey
+	fetches int32
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	p := &testProvider{
+		rsaKey: rsaKey,
+		ecKey:  ecKey,
+	}
+	p.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&p.fetches, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{
+				{
+					"kty": "RSA",
+					"kid": "rsa",
+					"use": "sig",
+					"n":   b64(rsaKey.N.Bytes()),
+					"e":   b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+				},
+				{
+					"kty": "EC",
+					"kid": "ec",
+					"crv": "P-256",
+					"x":   b64(ecKey.X.Bytes()),
+					"y":   b64(ecKey.Y.Bytes()),
+				},
+			},
+		})
+	}))
+	return p
+}
+
+func newTestVerifier(p *testProvider, rules ...config.JWTRule) *Verifier {
+	v := NewVerifier(&config.JWTConfig{
+		Issuer:   "https://idp.example.com",
+		Audience: "chaind",
+		JWKSURL:  p.srv.URL,
+		Rules:    rules,
+	})
+	now := time.Unix(1000000, 0)
+	v.now = func() time.Time {
+		return now
+	}
+	return v
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss": "https://idp.example.com",
+		"aud": []string{"other", "chaind"},
+		"sub": "indexer",
+		"exp": 1000000 + 3600,
+	}
+}
+
+func TestVerifierVerify(t *testing.T) {
+	p := newTestProvider(t)
+	defer p.srv.Close()
+	v := newTestVerifier(p)
+	require.NoError(t, v.refresh())
+
+	claims, err := v.Verify(sign(t, p.rsaKey, "RS256", "rsa", validClaims()))
+	require.NoError(t, err)
+	require.Equal(t, "indexer", claims["sub"])
+	_, err = v.Verify(sign(t, p.ecKey, "ES256", "ec", validClaims()))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		modify func(claims map[string]interface{})
+		err    error
+	}{
+		{"expired", func(c map[string]interface{}) { c["exp"] = 1000000 - 120 }, ErrExpired},
+		{"no expiry", func(c map[string]interface{}) { delete(c, "exp") }, ErrExpired},
+		{"not yet valid", func(c map[string]interface{}) { c["nbf"] = 1000000 + 120 }, ErrNotYetValid},
+		{"wrong issuer", func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }, ErrInvalidIssuer},
+		{"wrong audience", func(c map[string]interface{}) { c["aud"] = "other" }, ErrInvalidAudience},
+		{"no subject", func(c map[string]interface{}) { delete(c, "sub") }, ErrMissingSubject},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := validClaims()
+			tt.modify(claims)
+			_, err := v.Verify(sign(t, p.rsaKey, "RS256", "rsa", claims))
+			require.Equal(t, tt.err, err)
+		})
+	}
+
+	token := sign(t, p.rsaKey, "RS256", "rsa", validClaims())
+	_, err = v.Verify(token[:len(token)-4] + "AAAA")
+	require.Equal(t, ErrInvalidSignature, err)
+	_, err = v.Verify(sign(t, p.rsaKey, "ES256", "rsa", validClaims()))
+	require.Equal(t, ErrUnsupportedAlg, err)
+	_, err = v.Verify("not.a-token")
+	require.Equal(t, ErrMalformed, err)
+}
+
+func TestVerifierRefetchesUnknownKeys(t *testing.T) {
+	p := newTestProvider(t)
+	defer p.srv.Close()
+	v := newTestVerifier(p)
+
+	// the first use of a key fetches the JWKS
+	_, err := v.Verify(sign(t, p.rsaKey, "RS256", "rsa", validClaims()))
+	require.NoError(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&p.fetches))
+
+	// unknown keys only trigger a refetch once per interval
+	_, err = v.Verify(sign(t, p.rsaKey, "RS256", "rotated", validClaims()))
+	require.Equal(t, ErrUnknownKey, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&p.fetches))
+}
+
+func TestVerifierAuthenticate(t *testing.T) {
+	p := newTestProvider(t)
+	defer p.srv.Close()
+	v := newTestVerifier(p, config.JWTRule{
+		Claim:   "groups",
+		Value:   "readers",
+		Tier:    "readers",
+		Methods: []string{"eth_call", "eth_get*"},
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/eth", nil)
+	id, err := v.Authenticate(req)
+	require.NoError(t, err)
+	require.Nil(t, id)
+
+	req.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+	_, err = v.Authenticate(req)
+	require.Equal(t, ErrMalformed, err)
+
+	req.Header.Set("Authorization", "Bearer "+sign(t, p.rsaKey, "RS256", "rsa", validClaims()))
+	id, err = v.Authenticate(req)
+	require.NoError(t, err)
+	require.Equal(t, "jwt:indexer", id.Key)
+	require.Empty(t, id.Tier)
+	require.True(t, id.Allows("eth_sendRawTransaction"))
+
+	claims := validClaims()
+	claims["groups"] = []string{"writers", "readers"}
+	req.Header.Set("Authorization", "bearer "+sign(t, p.rsaKey, "RS256", "rsa", claims))
+	id, err = v.Authenticate(req)
+	require.NoError(t, err)
+	require.Equal(t, "jwt:indexer", id.Key)
+	require.Equal(t, "readers", id.Tier)
+	require.True(t, id.Allows("eth_call"))
+	require.True(t, id.Allows("eth_getBalance"))
+	require.False(t, id.Allows("eth_sendRawTransaction"))
+
+	v.cfg.DefaultMethods = []string{"eth_blockNumber"}
+	id = v.Anonymous()
+	require.Empty(t, id.Key)
+	require.True(t, id.Allows("eth_blockNumber"))
+	require.False(t, id.Allows("eth_call"))
+}
@@ -0,0 +1,234 @@
+package logfilter
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Filter is the filter object of an eth_subscribe("logs") request. An empty
+// address list or topic position matches anything.
+type Filter struct {
+	Addresses []string
+	Topics    [][]string
+}
+
+// Log holds the fields of a log event that filters match on.
+type Log struct {
+	Address string   `json:"address"`
+	Topics  []string `json:"topics"`
+}
+
+type rawFilter struct {
+	Address json.RawMessage   `json:"address"`
+	Topics  []json.RawMessage `json:"topics"`
+}
+
+// ParseFilter parses and normalizes a filter object. Addresses and topics may
+// each be a single value or a list, and topics may be null.
+func ParseFilter(data []byte) (Filter, error) {
+	var raw rawFilter
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return Filter{}, err
+		}
+	}
+
+	var f Filter
+	addrs, err := parseOneOrMany(raw.Address)
+	if err != nil {
+		return Filter{}, errors.New("invalid address")
+	}
+	f.Addresses = addrs
+	for _, t := range raw.Topics {
+		topics, err := parseOneOrMany(t)
+		if err != nil {
+			return Filter{}, errors.New("invalid topics")
+		}
+		f.Topics = append(f.Topics, topics)
+	}
+
+	return normalize(f), nil
+}
+
+func parseOneOrMany(data json.RawMessage) ([]string, error) {
+	if len(data) == 0 || string(data) == "null" {
+		return nil, nil
+	}
+
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		return []string{one}, nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return nil, err
+	}
+	return many, nil
+}
+
+// MarshalJSON encodes the filter for an upstream eth_subscribe request.
+func (f Filter) MarshalJSON() ([]byte, error) {
+	out := make(map[string]interface{})
+	if len(f.Addresses) > 0 {
+		out["address"] = f.Addresses
+	}
+	if len(f.Topics) > 0 {
+		topics := make([]interface{}, len(f.Topics))
+		for i, t := range f.Topics {
+			if len(t) > 0 {
+				topics[i] = t
+			}
+		}
+		out["topics"] = topics
+	}
+	return json.Marshal(out)
+}
+
+// Key uniquely identifies a normalized filter.
+func (f Filter) Key() string {
+	parts := []string{strings.Join(f.Addresses, ",")}
+	for _, t := range f.Topics {
+		parts = append(parts, strings.Join(t, ","))
+	}
+	return strings.Join(parts, "|")
+}
+
+// Matches returns whether the log satisfies the filter.
+func (f Filter) Matches(l *Log) bool {
+	if len(f.Addresses) > 0 && !contains(f.Addresses, strings.ToLower(l.Address)) {
+		return false
+	}
+	for i, t := range f.Topics {
+		if len(t) == 0 {
+			continue
+		}
+		if i >= len(l.Topics) || !contains(t, strings.ToLower(l.Topics[i])) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Covers returns whether every log matching other also matches f.
+func (f Filter) Covers(other Filter) bool {
+	if !isSubset(other.Addresses, f.Addresses) {
+		return false
+	}
+	for i, t := range f.Topics {
+		if len(t) == 0 {
+			continue
+		}
+		if i >= len(other.Topics) || !isSubset(other.Topics[i], t) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Cover computes a small set of filters that together match every log
+// matched by any of the given filters: filters covered by another filter are
+// dropped, and filters on the same topics are merged into one filter on the
+// union of their addresses.
+func Cover(filters []Filter) []Filter {
+	var kept []Filter
+	for i, f := range filters {
+		covered := false
+		for j, other := range filters {
+			if i == j || !other.Covers(f) {
+				continue
+			}
+			// of two equal filters, keep the first
+			if !f.Covers(other) || j < i {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			kept = append(kept, f)
+		}
+	}
+
+	var out []Filter
+	byTopics := make(map[string]int)
+	for _, f := range kept {
+		key := Filter{Topics: f.Topics}.Key()
+		if idx, ok := byTopics[key]; ok {
+			out[idx].Addresses = union(out[idx].Addresses, f.Addresses)
+			continue
+		}
+		byTopics[key] = len(out)
+		out = append(out, Filter{
+			Addresses: append([]string(nil), f.Addresses...),
+			Topics:    f.Topics,
+		})
+	}
+
+	return out
+}
+
+func normalize(f Filter) Filter {
+	f.Addresses = normalizeSet(f.Addresses)
+	for i := range f.Topics {
+		f.Topics[i] = normalizeSet(f.Topics[i])
+	}
+	// trailing wildcards don't restrict anything
+	for len(f.Topics) > 0 && len(f.Topics[len(f.Topics)-1]) == 0 {
+		f.Topics = f.Topics[:len(f.Topics)-1]
+	}
+	return f
+}
+
+func normalizeSet(vals []string) []string {
+	if len(vals) == 0 {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	var out []string
+	for _, v := range vals {
+		v = strings.ToLower(v)
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// isSubset returns whether sub is a subset of set, where an empty set
+// matches anything.
+func isSubset(sub []string, set []string) bool {
+	if len(set) == 0 {
+		return true
+	}
+	if len(sub) == 0 {
+		return false
+	}
+	for _, v := range sub {
+		if !contains(set, v) {
+			return false
+		}
+	}
+	return true
+}
+
+func union(a []string, b []string) []string {
+	if len(a) == 0 || len(b) == 0 {
+		return nil
+	}
+	return normalizeSet(append(append([]string{}, a...), b...))
+}
+
+func contains(vals []string, v string) bool {
+	for _, val := range vals {
+		if val == v {
+			return true
+		}
+	}
+	return false
+}
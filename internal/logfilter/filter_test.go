@@ -0,0 +1,63 @@
+package logfilter
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	addrA    = "0x00000000000000000000000000000000000000aa"
+	addrB    = "0x00000000000000000000000000000000000000bb"
+	transfer = "0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef"
+	approval = "0x8c5be1e5ebec7d5bd14f71427d1e84f3dd0314c0f7b2291e5b200ac8c7c3b925"
+)
+
+func mustParse(t *testing.T, data string) Filter {
+	f, err := ParseFilter([]byte(data))
+	require.NoError(t, err)
+	return f
+}
+
+func TestParseFilter(t *testing.T) {
+	f := mustParse(t, `{"address":"0x00000000000000000000000000000000000000AA","topics":[["`+transfer+`","`+approval+`"],null,null]}`)
+	require.Equal(t, []string{addrA}, f.Addresses)
+	require.Equal(t, [][]string{{approval, transfer}}, f.Topics)
+
+	out, err := json.Marshal(f)
+	require.NoError(t, err)
+	require.Equal(t, f, mustParse(t, string(out)))
+
+	_, err = ParseFilter([]byte(`{"address":1}`))
+	require.Error(t, err)
+}
+
+func TestFilterMatches(t *testing.T) {
+	f := mustParse(t, `{"address":["`+addrA+`"],"topics":[null,"0x01"]}`)
+	require.True(t, f.Matches(&Log{Address: addrA, Topics: []string{transfer, "0x01"}}))
+	require.False(t, f.Matches(&Log{Address: addrB, Topics: []string{transfer, "0x01"}}))
+	require.False(t, f.Matches(&Log{Address: addrA, Topics: []string{transfer}}))
+}
+
+func TestCover(t *testing.T) {
+	transfersOfA := mustParse(t, `{"address":"`+addrA+`","topics":["`+transfer+`"]}`)
+	transfersOfB := mustParse(t, `{"address":"`+addrB+`","topics":["`+transfer+`"]}`)
+	allOfA := mustParse(t, `{"address":"`+addrA+`"}`)
+	approvals := mustParse(t, `{"topics":["`+approval+`"]}`)
+
+	require.True(t, allOfA.Covers(transfersOfA))
+	require.False(t, transfersOfA.Covers(allOfA))
+
+	// transfers of A are covered by all of A, and the remaining transfer
+	// filter stays separate from the approvals filter
+	cover := Cover([]Filter{transfersOfA, transfersOfB, allOfA, approvals, approvals})
+	require.Len(t, cover, 3)
+	require.Contains(t, cover, allOfA)
+	require.Contains(t, cover, transfersOfB)
+	require.Contains(t, cover, approvals)
+
+	// filters on the same topics are merged
+	cover = Cover([]Filter{transfersOfA, transfersOfB})
+	require.Equal(t, []Filter{{Addresses: []string{addrA, addrB}, Topics: [][]string{{transfer}}}}, cover)
+}
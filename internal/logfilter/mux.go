@@ -0,0 +1,95 @@
+package logfilter
+
+import (
+	"sync"
+)
+
+// Plan lists the upstream subscriptions to open and close after a change to
+// the client subscriptions.
+type Plan struct {
+	Subscribe   []Filter
+	Unsubscribe []Filter
+}
+
+// Mux fans the log subscriptions of many clients in to a covering set of
+// upstream subscriptions, and demultiplexes upstream logs back to the
+// clients whose own filters match them. It doesn't talk to the backend
+// itself; callers apply the returned plans.
+type Mux struct {
+	clients  map[string]Filter
+	upstream map[string]Filter
+	mtx      sync.Mutex
+}
+
+func NewMux() *Mux {
+	return &Mux{
+		clients:  make(map[string]Filter),
+		upstream: make(map[string]Filter),
+	}
+}
+
+// Subscribe registers the client subscription with the given ID.
+func (m *Mux) Subscribe(id string, f Filter) Plan {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.clients[id] = f
+	return m.replan()
+}
+
+// Unsubscribe removes the client subscription with the given ID.
+func (m *Mux) Unsubscribe(id string) Plan {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	delete(m.clients, id)
+	return m.replan()
+}
+
+// Upstream returns the current upstream subscriptions.
+func (m *Mux) Upstream() []Filter {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	var out []Filter
+	for _, f := range m.upstream {
+		out = append(out, f)
+	}
+	return out
+}
+
+// Dispatch returns the IDs of the client subscriptions matching the log.
+func (m *Mux) Dispatch(l *Log) []string {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	var out []string
+	for id, f := range m.clients {
+		if f.Matches(l) {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+func (m *Mux) replan() Plan {
+	filters := make([]Filter, 0, len(m.clients))
+	for _, f := range m.clients {
+		filters = append(filters, f)
+	}
+
+	next := make(map[string]Filter)
+	for _, f := range Cover(filters) {
+		next[f.Key()] = f
+	}
+
+	var plan Plan
+	for key, f := range next {
+		if _, ok := m.upstream[key]; !ok {
+			plan.Subscribe = append(plan.Subscribe, f)
+		}
+	}
+	for key, f := range m.upstream {
+		if _, ok := next[key]; !ok {
+			plan.Unsubscribe = append(plan.Unsubscribe, f)
+		}
+	}
+	m.upstream = next
+	return plan
+}
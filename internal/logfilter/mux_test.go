@@ -0,0 +1,45 @@
+package logfilter
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMux(t *testing.T) {
+	m := NewMux()
+	transfersOfA := mustParse(t, `{"address":"`+addrA+`","topics":["`+transfer+`"]}`)
+	transfersOfB := mustParse(t, `{"address":"`+addrB+`","topics":["`+transfer+`"]}`)
+
+	plan := m.Subscribe("1", transfersOfA)
+	require.Equal(t, []Filter{transfersOfA}, plan.Subscribe)
+	require.Empty(t, plan.Unsubscribe)
+
+	// a second client on the same topics replaces the upstream subscription
+	// with a merged one
+	plan = m.Subscribe("2", transfersOfB)
+	merged := Filter{Addresses: []string{addrA, addrB}, Topics: [][]string{{transfer}}}
+	require.Equal(t, []Filter{merged}, plan.Subscribe)
+	require.Equal(t, []Filter{transfersOfA}, plan.Unsubscribe)
+
+	// a duplicate subscription doesn't need a new upstream subscription
+	plan = m.Subscribe("3", transfersOfA)
+	require.Empty(t, plan.Subscribe)
+	require.Empty(t, plan.Unsubscribe)
+	require.Len(t, m.Upstream(), 1)
+
+	// events from the merged subscription only go to matching clients
+	ids := m.Dispatch(&Log{Address: addrB, Topics: []string{transfer}})
+	require.Equal(t, []string{"2"}, ids)
+	ids = m.Dispatch(&Log{Address: addrA, Topics: []string{transfer}})
+	sort.Strings(ids)
+	require.Equal(t, []string{"1", "3"}, ids)
+
+	m.Unsubscribe("2")
+	m.Unsubscribe("3")
+	plan = m.Unsubscribe("1")
+	require.Empty(t, plan.Subscribe)
+	require.Equal(t, []Filter{transfersOfA}, plan.Unsubscribe)
+	require.Empty(t, m.Upstream())
+}
@@ -0,0 +1,291 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/internal/cache"
+	"github.com/kyokan/chaind/internal/stats"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/log"
+	"github.com/kyokan/chaind/pkg/version"
+)
+
+const DefaultInterval = time.Minute
+
+// Snapshot holds the traffic seen during one snapshot interval.
+type Snapshot struct {
+	Time     time.Time         `json:"time"`
+	Interval float64           `json:"interval_s"`
+	RPS      float64           `json:"rps"`
+	Requests uint64            `json:"requests"`
+	Errors   uint64            `json:"errors"`
+	Methods  map[string]uint64 `json:"methods"`
+	Backends map[string]uint64 `json:"backends"`
+	// MethodLatency and BackendLatency are the mean latencies of the
+	// interval's requests, in milliseconds.
+	MethodLatency  map[string]float64 `json:"method_latency_ms"`
+	BackendLatency map[string]float64 `json:"backend_latency_ms"`
+	// TierSeconds is the time traffic was routed to each backend cost tier.
+	TierSeconds map[string]float64 `json:"tier_seconds"`
+	// Build identifies the binary and feature set that took the snapshot.
+	Build *version.Info `json:"build,omitempty"`
+	// MemoryCache is the activity of the in-memory cache tier. Its counters
+	// are those of the interval.
+	MemoryCache *cache.MemoryStats `json:"memory_cache,omitempty"`
+}
+
+type totals struct {
+	requests         uint64
+	errors           uint64
+	methods          map[string]uint64
+	backends         map[string]uint64
+	methodLatencies  map[string]time.Duration
+	backendLatencies map[string]time.Duration
+	tierTimes        map[int]time.Duration
+}
+
+// Snapshotter periodically diffs the stats store against its previous
+// snapshot and appends the result as a JSON line to a file, POSTs it to a
+// remote endpoint and/or sends it to StatsD.
+type Snapshotter struct {
+	cfg      *config.MetricsConfig
+	store    *stats.Store
+	interval time.Duration
+	file     *os.File
+	statsd   *statsdSink
+	client   *http.Client
+	prev     *totals
+	prevTime time.Time
+	quitChan chan bool
+	logger   log15.Logger
+	now      func() time.Time
+	build    *version.Info
+	memory   func() cache.MemoryStats
+	prevMem  cache.MemoryStats
+}
+
+func NewSnapshotter(cfg *config.MetricsConfig, store *stats.Store) *Snapshotter {
+	interval := cfg.Interval
+	if interval == 0 {
+		interval = DefaultInterval
+	}
+
+	return &Snapshotter{
+		cfg:      cfg,
+		store:    store,
+		interval: interval,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		quitChan: make(chan bool),
+		logger:   log.NewLog("metrics"),
+		now:      time.Now,
+	}
+}
+
+// UseBuildInfo adds the build info to each snapshot, and reports it to StatsD
+// as a build_info gauge.
+func (s *Snapshotter) UseBuildInfo(info version.Info) {
+	s.build = &info
+}
+
+// UseMemoryCache adds the activity of the in-memory cache tier to each
+// snapshot.
+func (s *Snapshotter) UseMemoryCache(stats func() cache.MemoryStats) {
+	s.memory = stats
+}
+
+func (s *Snapshotter) Start() error {
+	if s.cfg.File != "" {
+		f, err := os.OpenFile(s.cfg.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		s.file = f
+	}
+	if s.cfg.StatsD != nil {
+		sink, err := newStatsDSink(s.cfg.StatsD)
+		if err != nil {
+			return err
+		}
+		s.statsd = sink
+	}
+	s.prev = s.totals()
+	s.prevTime = s.now()
+	if s.memory != nil {
+		s.prevMem = s.memory()
+	}
+
+	go func() {
+		tick := time.NewTicker(s.interval)
+
+		for {
+			select {
+			case <-tick.C:
+				s.snapshot()
+			case <-s.quitChan:
+				tick.Stop()
+				return
+			}
+		}
+	}()
+
+	var statsdAddr string
+	if s.cfg.StatsD != nil {
+		statsdAddr = s.cfg.StatsD.Addr
+	}
+	s.logger.Info("started", "interval", s.interval, "file", s.cfg.File, "remote_url", s.cfg.RemoteURL, "statsd", statsdAddr)
+	return nil
+}
+
+func (s *Snapshotter) Stop() error {
+	s.quitChan <- true
+	// flush the partial interval so short-lived processes still leave a record
+	s.snapshot()
+	if s.statsd != nil {
+		s.statsd.Close()
+	}
+	if s.file != nil {
+		return s.file.Close()
+	}
+
+	return nil
+}
+
+func (s *Snapshotter) snapshot() {
+	snap := s.take()
+	data, err := json.Marshal(snap)
+	if err != nil {
+		s.logger.Error("failed to marshal snapshot", "err", err)
+		return
+	}
+
+	if s.file != nil {
+		if _, err := s.file.Write(append(data, '\n')); err != nil {
+			s.logger.Error("failed to write snapshot", "file", s.cfg.File, "err", err)
+		}
+	}
+	if s.cfg.RemoteURL != "" {
+		if err := s.push(data); err != nil {
+			s.logger.Error("failed to push snapshot", "remote_url", s.cfg.RemoteURL, "err", err)
+		}
+	}
+	if s.statsd != nil {
+		if err := s.statsd.send(snap); err != nil {
+			s.logger.Error("failed to send snapshot to statsd", "addr", s.cfg.StatsD.Addr, "err", err)
+		}
+	}
+}
+
+func (s *Snapshotter) take() *Snapshot {
+	now := s.now()
+	curr := s.totals()
+	elapsed := now.Sub(s.prevTime).Seconds()
+
+	snap := &Snapshot{
+		Time:        now,
+		Interval:    elapsed,
+		Requests:    curr.requests - s.prev.requests,
+		Errors:      curr.errors - s.prev.errors,
+		Methods:     diffCounts(curr.methods, s.prev.methods),
+		Backends:    diffCounts(curr.backends, s.prev.backends),
+		TierSeconds: make(map[string]float64),
+		Build:       s.build,
+	}
+	snap.MethodLatency = meanLatencies(snap.Methods, curr.methodLatencies, s.prev.methodLatencies)
+	snap.BackendLatency = meanLatencies(snap.Backends, curr.backendLatencies, s.prev.backendLatencies)
+	for tier, d := range curr.tierTimes {
+		if delta := d - s.prev.tierTimes[tier]; delta > 0 {
+			snap.TierSeconds[strconv.Itoa(tier)] = delta.Seconds()
+		}
+	}
+	if elapsed > 0 {
+		snap.RPS = float64(snap.Requests) / elapsed
+	}
+	if s.memory != nil {
+		mem := s.memory()
+		snap.MemoryCache = &cache.MemoryStats{
+			Bytes:          mem.Bytes,
+			MaxBytes:       mem.MaxBytes,
+			Entries:        mem.Entries,
+			Hits:           mem.Hits - s.prevMem.Hits,
+			Misses:         mem.Misses - s.prevMem.Misses,
+			Evictions:      mem.Evictions - s.prevMem.Evictions,
+			Expired:        mem.Expired - s.prevMem.Expired,
+			Rejected:       mem.Rejected - s.prevMem.Rejected,
+			Compactions:    mem.Compactions - s.prevMem.Compactions,
+			LastCompaction: mem.LastCompaction,
+		}
+		s.prevMem = mem
+	}
+
+	s.prev = curr
+	s.prevTime = now
+	return snap
+}
+
+func (s *Snapshotter) totals() *totals {
+	t := &totals{
+		methods:          make(map[string]uint64),
+		backends:         make(map[string]uint64),
+		methodLatencies:  make(map[string]time.Duration),
+		backendLatencies: make(map[string]time.Duration),
+	}
+	for _, ts := range s.store.Tags() {
+		t.requests += ts.Requests
+		t.errors += ts.Errors
+		for method, ms := range ts.Methods {
+			t.methods[method] += ms.Requests
+			t.methodLatencies[method] += ms.TotalLatency
+		}
+	}
+	for name, bs := range s.store.Backends() {
+		t.backends[name] = bs.Requests
+		t.backendLatencies[name] = bs.TotalLatency
+	}
+	t.tierTimes = s.store.TierTimes()
+
+	return t
+}
+
+func (s *Snapshotter) push(data []byte) error {
+	res, err := s.client.Post(s.cfg.RemoteURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("remote returned status %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+func diffCounts(curr map[string]uint64, prev map[string]uint64) map[string]uint64 {
+	out := make(map[string]uint64)
+	for k, v := range curr {
+		if d := v - prev[k]; d > 0 {
+			out[k] = d
+		}
+	}
+
+	return out
+}
+
+// meanLatencies returns the mean latency in milliseconds of the requests
+// counted in the interval.
+func meanLatencies(counts map[string]uint64, curr map[string]time.Duration, prev map[string]time.Duration) map[string]float64 {
+	out := make(map[string]float64)
+	for k, n := range counts {
+		out[k] = float64(curr[k]-prev[k]) / float64(n) / float64(time.Millisecond)
+	}
+
+	return out
+}
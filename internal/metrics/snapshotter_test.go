@@ -0,0 +1,119 @@
+package metrics
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/internal/cache"
+	"github.com/kyokan/chaind/internal/stats"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/version"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chaind-metrics")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	pushed := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		pushed <- body
+	}))
+	defer srv.Close()
+
+	store := stats.NewStore()
+	store.Record(&stats.Event{Method: "eth_call", Backend: "infura"})
+
+	file := path.Join(dir, "metrics.jsonl")
+	s := NewSnapshotter(&config.MetricsConfig{
+		File:      file,
+		RemoteURL: srv.URL,
+		Interval:  time.Hour,
+	}, store)
+	now := time.Unix(1000, 0)
+	s.now = func() time.Time {
+		return now
+	}
+	mem := cache.MemoryStats{Bytes: 100, MaxBytes: 1000, Entries: 2, Hits: 5, Evictions: 1}
+	s.UseMemoryCache(func() cache.MemoryStats {
+		return mem
+	})
+	require.NoError(t, s.Start())
+	mem.Hits, mem.Evictions = 8, 3
+
+	store.Record(&stats.Event{Method: "eth_call", Backend: "infura"})
+	store.Record(&stats.Event{Method: "eth_call", Backend: "alchemy", Failed: true})
+	store.Record(&stats.Event{Tag: "indexer", Method: "eth_blockNumber"})
+	store.Record(&stats.Event{Method: "eth_getLogs", Backend: "infura"})
+	now = now.Add(2 * time.Second)
+	require.NoError(t, s.Stop())
+
+	data, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 1)
+
+	var snap Snapshot
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &snap))
+	require.Equal(t, uint64(4), snap.Requests)
+	require.Equal(t, uint64(1), snap.Errors)
+	require.Equal(t, 2.0, snap.RPS)
+	require.Equal(t, map[string]uint64{"eth_call": 2, "eth_blockNumber": 1, "eth_getLogs": 1}, snap.Methods)
+	require.Equal(t, map[string]uint64{"infura": 2, "alchemy": 1}, snap.Backends)
+	require.Equal(t, &cache.MemoryStats{Bytes: 100, MaxBytes: 1000, Entries: 2, Hits: 3, Evictions: 2}, snap.MemoryCache)
+	require.Equal(t, lines[0], string(<-pushed))
+}
+
+func TestSnapshotterSendsToStatsD(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	for _, dog := range []bool{false, true} {
+		store := stats.NewStore()
+		cfg := &config.StatsDConfig{
+			Addr:      conn.LocalAddr().String(),
+			Prefix:    "chaind.",
+			DogStatsD: dog,
+		}
+		if dog {
+			cfg.Tags = []string{"env:staging"}
+		}
+		s := NewSnapshotter(&config.MetricsConfig{
+			Interval: time.Hour,
+			StatsD:   cfg,
+		}, store)
+		s.UseBuildInfo(version.Info{Version: "v1.2.0"})
+		require.NoError(t, s.Start())
+		store.Record(&stats.Event{Method: "eth_call", Backend: "infura", Elapsed: 10 * time.Millisecond})
+		store.Record(&stats.Event{Method: "eth_call", Backend: "infura", Elapsed: 30 * time.Millisecond})
+		require.NoError(t, s.Stop())
+
+		buf := make([]byte, maxPacketSize)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+		lines := strings.Split(string(buf[:n]), "\n")
+		if dog {
+			require.Contains(t, lines, "chaind.requests:2|c|#env:staging")
+			require.Contains(t, lines, "chaind.method.requests:2|c|#env:staging,method:eth_call")
+			require.Contains(t, lines, "chaind.backend.latency:20|ms|#env:staging,backend:infura")
+			require.Contains(t, lines, "chaind.version.build_info:1|g|#env:staging,version:v1.2.0")
+		} else {
+			require.Contains(t, lines, "chaind.requests:2|c")
+			require.Contains(t, lines, "chaind.method.eth_call.requests:2|c")
+			require.Contains(t, lines, "chaind.backend.infura.latency:20|ms")
+			require.Contains(t, lines, "chaind.version.v1_2_0.build_info:1|g")
+		}
+	}
+}
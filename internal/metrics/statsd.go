@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kyokan/chaind/pkg/config"
+)
+
+// maxPacketSize keeps StatsD datagrams below the usual Ethernet MTU.
+const maxPacketSize = 1432
+
+// statsdSink emits snapshots as StatsD metrics over UDP. DogStatsD gets
+// methods, backends and tiers as tags; plain StatsD gets them in the metric
+// names instead.
+type statsdSink struct {
+	cfg  *config.StatsDConfig
+	conn net.Conn
+}
+
+func newStatsDSink(cfg *config.StatsDConfig) (*statsdSink, error) {
+	conn, err := net.Dial("udp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdSink{
+		cfg:  cfg,
+		conn: conn,
+	}, nil
+}
+
+func (s *statsdSink) send(snap *Snapshot) error {
+	var lines []string
+	add := func(name string, value string, kind string, dimension string, key string) {
+		if dimension != "" && !s.cfg.DogStatsD {
+			name = fmt.Sprintf("%s.%s.%s", dimension, sanitizeStatsDName(key), name)
+		} else if dimension != "" {
+			name = dimension + "." + name
+		}
+		line := fmt.Sprintf("%s%s:%s|%s", s.cfg.Prefix, name, value, kind)
+		tags := append([]string{}, s.cfg.Tags...)
+		if dimension != "" && s.cfg.DogStatsD {
+			tags = append(tags, dimension+":"+key)
+		}
+		if len(tags) > 0 && s.cfg.DogStatsD {
+			line += "|#" + strings.Join(tags, ",")
+		}
+		lines = append(lines, line)
+	}
+	formatFloat := func(f float64) string {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+
+	add("requests", strconv.FormatUint(snap.Requests, 10), "c", "", "")
+	add("errors", strconv.FormatUint(snap.Errors, 10), "c", "", "")
+	add("rps", formatFloat(snap.RPS), "g", "", "")
+	for _, method := range sortedKeys(snap.Methods) {
+		add("requests", strconv.FormatUint(snap.Methods[method], 10), "c", "method", method)
+		if latency, ok := snap.MethodLatency[method]; ok {
+			add("latency", formatFloat(latency), "ms", "method", method)
+		}
+	}
+	for _, backend := range sortedKeys(snap.Backends) {
+		add("requests", strconv.FormatUint(snap.Backends[backend], 10), "c", "backend", backend)
+		if latency, ok := snap.BackendLatency[backend]; ok {
+			add("latency", formatFloat(latency), "ms", "backend", backend)
+		}
+	}
+	tiers := make([]string, 0, len(snap.TierSeconds))
+	for tier := range snap.TierSeconds {
+		tiers = append(tiers, tier)
+	}
+	sort.Strings(tiers)
+	for _, tier := range tiers {
+		add("seconds", formatFloat(snap.TierSeconds[tier]), "c", "tier", tier)
+	}
+	if mem := snap.MemoryCache; mem != nil {
+		add("memory_cache.bytes", strconv.FormatInt(mem.Bytes, 10), "g", "", "")
+		add("memory_cache.entries", strconv.Itoa(mem.Entries), "g", "", "")
+		add("memory_cache.hits", strconv.FormatUint(mem.Hits, 10), "c", "", "")
+		add("memory_cache.misses", strconv.FormatUint(mem.Misses, 10), "c", "", "")
+		add("memory_cache.evictions", strconv.FormatUint(mem.Evictions, 10), "c", "", "")
+		add("memory_cache.expired", strconv.FormatUint(mem.Expired, 10), "c", "", "")
+		add("memory_cache.rejected", strconv.FormatUint(mem.Rejected, 10), "c", "", "")
+	}
+	if snap.Build != nil {
+		add("build_info", "1", "g", "version", snap.Build.Version)
+	}
+
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > maxPacketSize {
+			if _, err := s.conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		if _, err := s.conn.Write(packet.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *statsdSink) Close() error {
+	return s.conn.Close()
+}
+
+// sanitizeStatsDName makes a method or backend name usable as a StatsD
+// metric name segment.
+func sanitizeStatsDName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ':', '|', '@', '#', ' ':
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kyokan/chaind/internal/tlsutil"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/jsonrpc"
+)
+
+// tlsTransports caches the transports of backends with TLS settings, so
+// that certificates are loaded once and connections are reused, by proxied
+// requests and healthchecks alike.
+var tlsTransports = struct {
+	transports map[string]*http.Transport
+	mtx        sync.Mutex
+}{
+	transports: make(map[string]*http.Transport),
+}
+
+// backendClient returns an HTTP client for requests to the backend. Backends
+// without TLS settings use the given default client.
+func backendClient(backend *config.Backend, def *http.Client) (*http.Client, error) {
+	if backend.CAFile == "" && backend.CertFile == "" {
+		return def, nil
+	}
+
+	// the idle pool is sized like the default client's, which is larger
+	// when connections are prewarmed
+	var idlePerHost int
+	if t, ok := def.Transport.(*http.Transport); ok {
+		idlePerHost = t.MaxIdleConnsPerHost
+	}
+	key := fmt.Sprintf("%s|%s|%s|%d", backend.CAFile, backend.CertFile, backend.KeyFile, idlePerHost)
+	tlsTransports.mtx.Lock()
+	defer tlsTransports.mtx.Unlock()
+	transport, ok := tlsTransports.transports[key]
+	if !ok {
+		tlsCfg, err := tlsutil.ClientConfig(backend)
+		if err != nil {
+			return nil, err
+		}
+		transport = &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     tlsCfg,
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: idlePerHost,
+		}
+		tlsTransports.transports[key] = transport
+	}
+
+	return &http.Client{
+		Timeout:   def.Timeout,
+		Transport: transport,
+	}, nil
+}
+
+// newUpstreamRequest creates a JSON-RPC request to the backend. Proxied
+// requests, healthchecks and prewarming all use it, so that they reach the
+// backend the same way.
+func newUpstreamRequest(ctx context.Context, backend *config.Backend, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodPost, backend.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("content-type", "application/json")
+	return req.WithContext(ctx), nil
+}
+
+// SwitchClient executes JSON-RPC calls against the current ETH backend, or
+// against a named one.
+type SwitchClient struct {
+	sw     BackendSwitch
+	name   string
+	client *http.Client
+}
+
+func NewSwitchClient(sw BackendSwitch) *SwitchClient {
+	return &SwitchClient{
+		sw: sw,
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+// NewSwitchClientFor creates a client for the named backend, or for the
+// current backend if name is empty.
+func NewSwitchClientFor(sw BackendSwitch, name string) *SwitchClient {
+	c := NewSwitchClient(sw)
+	c.name = name
+	return c
+}
+
+func (s *SwitchClient) Execute(method string, params interface{}) (*jsonrpc.Response, error) {
+	backend, err := s.backend()
+	if err != nil {
+		return nil, err
+	}
+	httpClient, err := backendClient(backend, s.client)
+	if err != nil {
+		return nil, err
+	}
+	return jsonrpc.NewClientWithHTTP(backend.URL, httpClient).Execute(method, params)
+}
+
+func (s *SwitchClient) backend() (*config.Backend, error) {
+	if s.name == "" {
+		return s.sw.BackendFor(pkg.EthBackend)
+	}
+
+	for _, backend := range s.sw.Backends(pkg.EthBackend) {
+		if backend.Name == s.name {
+			return &backend, nil
+		}
+	}
+	return nil, fmt.Errorf("no backend named %s", s.name)
+}
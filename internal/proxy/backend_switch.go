@@ -8,28 +8,124 @@ import (
 	"fmt"
 	"net/http"
 	"errors"
-	"strings"
+	"context"
 		"sync/atomic"
 	"encoding/json"
 	"github.com/kyokan/chaind/pkg/config"
 	"sync"
+	"github.com/kyokan/chaind/internal/quarantine"
+	"github.com/kyokan/chaind/internal/stats"
+	"github.com/kyokan/chaind/internal/chaos"
+	"github.com/kyokan/chaind/pkg/events"
 )
 
 const ethCheckBody = "{\"jsonrpc\":\"2.0\",\"method\":\"eth_syncing\",\"params\":[],\"id\":%d}"
 
+// HealthcheckTimeout bounds each healthcheck attempt, and so each round of
+// healthchecks.
+const HealthcheckTimeout = 2 * time.Second
+
+var errHealthcheckTimeout = errors.New("healthcheck timed out")
+
+// ErrBackendSyncing fails the healthchecks of backends that are syncing or
+// have fallen behind.
+var ErrBackendSyncing = errors.New("backend is syncing")
+
 type BackendSwitch interface {
 	pkg.Service
 	BackendFor(t pkg.BackendType) (*config.Backend, error)
+	Backends(t pkg.BackendType) []config.Backend
+	SwitchTo(t pkg.BackendType, name string) error
+	UpdateBackends(t pkg.BackendType, backends []config.Backend)
+	Health(t pkg.BackendType) []BackendHealth
+	// Manual reports whether the current backend was selected by an
+	// operator with SwitchTo, rather than by healthchecks.
+	Manual(t pkg.BackendType) bool
+	// RestoreHealth seeds the health table with a table exported by another
+	// instance, e.g. during a blue/green cutover. It returns the number of
+	// entries restored.
+	RestoreHealth(t pkg.BackendType, health []BackendHealth) int
+	HealthcheckStats() HealthcheckStats
+	// UseWarmer sets a function that is called with the backend traffic is
+	// about to fail over to, before it is selected. It must be called
+	// before Start.
+	UseWarmer(warm func(backend *config.Backend))
+	// UseClient sets the client healthchecks are sent with, so that they
+	// reach backends through the same transport as proxied requests. It
+	// must be called before Start.
+	UseClient(client *http.Client)
+	// UseCheck adds a check backends must pass on top of their healthcheck,
+	// e.g. that their WebSocket subscriptions deliver events. It must be
+	// called before Start.
+	UseCheck(check func(backend *config.Backend) error)
+}
+
+// HealthcheckStats instruments the rounds of healthchecks the switch runs
+// every second.
+type HealthcheckStats struct {
+	Rounds   uint64 `json:"rounds"`
+	Attempts uint64 `json:"attempts"`
+	Timeouts uint64 `json:"timeouts"`
+	// LastRoundAttempts is the number of backends checked in the last round.
+	LastRoundAttempts int     `json:"last_round_attempts"`
+	LastRoundMS       float64 `json:"last_round_ms"`
+	MaxRoundMS        float64 `json:"max_round_ms"`
+}
+
+const (
+	HealthUnknown     = "unknown"
+	HealthHealthy     = "healthy"
+	HealthUnhealthy   = "unhealthy"
+	HealthQuarantined = "quarantined"
+)
+
+// BackendHealth is a backend's entry in the health table.
+type BackendHealth struct {
+	Name    string `json:"name"`
+	Tier    int    `json:"tier"`
+	State   string `json:"state"`
+	Current bool   `json:"current"`
+	// LastError is the error of the last failed healthcheck.
+	LastError           string    `json:"last_error,omitempty"`
+	LastSuccess         time.Time `json:"last_success,omitempty"`
+	LastFailure         time.Time `json:"last_failure,omitempty"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
 }
 
 type BackendSwitchImpl struct {
+	// ethBackends is replaced rather than modified when backends change, and
+	// is guarded by backendsMtx together with currEth
 	ethBackends []config.Backend
 	currEth     int32
+	backendsMtx sync.RWMutex
+	quarantine  *quarantine.List
+	stats       *stats.Store
+	faults      *chaos.Injector
+	bus         *events.Bus
+	// health is the health table, keyed by backend name
+	health      map[string]*BackendHealth
+	healthMtx   sync.Mutex
+	checkStats  HealthcheckStats
+	// checkTimeout bounds each healthcheck attempt
+	checkTimeout time.Duration
+	warm        func(backend *config.Backend)
+	client      *http.Client
+	checks      []func(backend *config.Backend) error
+	lastCheck   time.Time
+	// manual is set to 1 while an operator-selected backend is in use, which
+	// suspends tier failback until that backend fails
+	manual      int32
+	switchMtx   sync.Mutex
 	quitChan    chan bool
 	logger      log15.Logger
 }
 
-func NewBackendSwitch(backendCfg []config.Backend) BackendSwitch {
+// NewBackendSwitch creates a BackendSwitch. Backends on the quarantine list
+// are skipped, and backends failing healthchecks are added to it. Time spent
+// on each cost tier is recorded in the stats store. Healthchecks fail for
+// backends the fault injector marks unhealthy. Failovers and backend health
+// changes are published on the bus. All four may be nil.
+func NewBackendSwitch(backendCfg []config.Backend, q *quarantine.List, statsStore *stats.Store, faults *chaos.Injector, bus *events.Bus) BackendSwitch {
 	var ethBackends []config.Backend
 	var currEth int32
 
@@ -42,10 +138,20 @@ func NewBackendSwitch(backendCfg []config.Backend) BackendSwitch {
 			currEth = int32(i)
 		}
 	}
+	if len(ethBackends) == 0 {
+		currEth = -1
+	}
 
 	return &BackendSwitchImpl{
 		ethBackends: ethBackends,
 		currEth:     currEth,
+		quarantine:  q,
+		stats:       statsStore,
+		faults:      faults,
+		bus:         bus,
+		health:      make(map[string]*BackendHealth),
+		checkTimeout: HealthcheckTimeout,
+		client:      &http.Client{},
 		quitChan:    make(chan bool),
 		logger:      log.NewLog("proxy/backend_switch"),
 	}
@@ -78,6 +184,8 @@ func (h *BackendSwitchImpl) Stop() error {
 
 func (h *BackendSwitchImpl) BackendFor(t pkg.BackendType) (*config.Backend, error) {
 	var idx int32
+	h.backendsMtx.RLock()
+	defer h.backendsMtx.RUnlock()
 
 	if t == pkg.EthBackend {
 		idx = atomic.LoadInt32(&h.currEth)
@@ -92,57 +200,512 @@ func (h *BackendSwitchImpl) BackendFor(t pkg.BackendType) (*config.Backend, erro
 	return &h.ethBackends[idx], nil
 }
 
+// Backends returns all configured backends of the given type, healthy or not.
+func (h *BackendSwitchImpl) Backends(t pkg.BackendType) []config.Backend {
+	if t != pkg.EthBackend {
+		return nil
+	}
+
+	h.backendsMtx.RLock()
+	defer h.backendsMtx.RUnlock()
+	return h.ethBackends
+}
+
+// UpdateBackends replaces the backends of the given type, e.g. when they are
+// discovered dynamically. The current backend stays selected if it's still
+// present.
+func (h *BackendSwitchImpl) UpdateBackends(t pkg.BackendType, backends []config.Backend) {
+	if t != pkg.EthBackend {
+		return
+	}
+
+	h.switchMtx.Lock()
+	defer h.switchMtx.Unlock()
+	h.backendsMtx.Lock()
+	defer h.backendsMtx.Unlock()
+
+	var curr string
+	if idx := atomic.LoadInt32(&h.currEth); idx != -1 {
+		curr = h.ethBackends[idx].Name
+	}
+	var ethBackends []config.Backend
+	newIdx := int32(-1)
+	for _, backend := range backends {
+		if backend.Type != pkg.EthBackend {
+			continue
+		}
+		if backend.Name == curr {
+			newIdx = int32(len(ethBackends))
+		}
+		ethBackends = append(ethBackends, backend)
+	}
+	if newIdx == -1 {
+		atomic.StoreInt32(&h.manual, 0)
+		if len(ethBackends) > 0 {
+			newIdx = 0
+		}
+	}
+
+	h.healthMtx.Lock()
+	for name := range h.health {
+		if !hasBackendNamed(ethBackends, name) {
+			delete(h.health, name)
+		}
+	}
+	h.healthMtx.Unlock()
+
+	h.logger.Info("updated backends", "type", t, "count", len(ethBackends))
+	h.ethBackends = ethBackends
+	atomic.StoreInt32(&h.currEth, newIdx)
+	if next := h.nameAt(newIdx); next != curr {
+		h.publishFailover(curr, next)
+	}
+}
+
+func hasBackendNamed(backends []config.Backend, name string) bool {
+	for _, backend := range backends {
+		if backend.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// performAllHealthchecks checks every backend that isn't quarantined, so the
+// health table stays current for backends that aren't in use, then selects
+// the backend to route traffic to.
 func (h *BackendSwitchImpl) performAllHealthchecks() {
-	// use waitgroup so we can add btc checks later
-	var wg sync.WaitGroup
-	if h.currEth != -1 {
-		wg.Add(1)
-		go func() {
-			idx := h.doHealthcheck(atomic.LoadInt32(&h.currEth), h.ethBackends)
-			atomic.StoreInt32(&h.currEth, idx)
-			wg.Done()
-		}()
+	h.switchMtx.Lock()
+	defer h.switchMtx.Unlock()
+	h.recordTierTime()
+
+	// ethBackends only changes while switchMtx is held
+	list := h.ethBackends
+	var toCheck []config.Backend
+	skipped := make([]bool, len(list))
+	for i := range list {
+		if h.quarantine != nil && h.quarantine.IsQuarantined(list[i].Name) {
+			logger.Debug("skipping quarantined backend", "type", list[i].Type, "name", list[i].Name)
+			skipped[i] = true
+			continue
+		}
+		toCheck = append(toCheck, list[i])
 	}
-	wg.Wait()
+
+	start := time.Now()
+	errs, timeouts := h.checkAll(toCheck)
+	h.recordRound(len(errs), timeouts, time.Since(start))
+
+	for i := range list {
+		if skipped[i] {
+			h.setQuarantined(list[i].Name)
+			continue
+		}
+		h.recordResult(&list[i], errs[list[i].Name])
+	}
+	h.ejectFailing(list)
+
+	curr := atomic.LoadInt32(&h.currEth)
+	if curr != -1 && !h.isAvailable(list[curr].Name) {
+		atomic.StoreInt32(&h.manual, 0)
+	}
+	h.setCurrent(h.selectBackend(curr, list))
+}
+
+// SwitchTo routes traffic to the named backend after checking that it's
+// healthy. The backend stays selected until it fails a healthcheck.
+func (h *BackendSwitchImpl) SwitchTo(t pkg.BackendType, name string) error {
+	if t != pkg.EthBackend {
+		return errors.New("only Ethereum backends are supported")
+	}
+
+	h.switchMtx.Lock()
+	defer h.switchMtx.Unlock()
+	for i := range h.ethBackends {
+		backend := h.ethBackends[i]
+		if backend.Name != name {
+			continue
+		}
+		if h.quarantine != nil && h.quarantine.IsQuarantined(name) {
+			return errors.New("backend is quarantined")
+		}
+		errs, _ := h.checkAll([]config.Backend{backend})
+		err := errs[backend.Name]
+		h.recordResult(&backend, err)
+		if err != nil {
+			return errors.New("backend is unhealthy")
+		}
+
+		h.logger.Info("switching backend", "type", backend.Type, "name", backend.Name)
+		h.setCurrent(int32(i))
+		atomic.StoreInt32(&h.manual, 1)
+		return nil
+	}
+
+	return errors.New("unknown backend")
+}
+
+func (h *BackendSwitchImpl) Manual(t pkg.BackendType) bool {
+	return atomic.LoadInt32(&h.manual) == 1
 }
 
-func (h *BackendSwitchImpl) doHealthcheck(idx int32, list []config.Backend) int32 {
+// Health returns a snapshot of the health table, in config order.
+func (h *BackendSwitchImpl) Health(t pkg.BackendType) []BackendHealth {
+	if t != pkg.EthBackend {
+		return nil
+	}
+
+	h.backendsMtx.RLock()
+	list := h.ethBackends
+	curr := atomic.LoadInt32(&h.currEth)
+	h.backendsMtx.RUnlock()
+
+	h.healthMtx.Lock()
+	defer h.healthMtx.Unlock()
+	out := make([]BackendHealth, 0, len(list))
+	for i, backend := range list {
+		entry := BackendHealth{
+			State: HealthUnknown,
+		}
+		if existing, ok := h.health[backend.Name]; ok {
+			entry = *existing
+		}
+		entry.Name = backend.Name
+		entry.Tier = backend.Tier
+		entry.Current = int32(i) == curr
+		out = append(out, entry)
+	}
+
+	return out
+}
+
+// RestoreHealth restores the entries of known backends, and routes traffic
+// to the backend that was current in the exported table while it's
+// available. Healthchecks keep running, so restored entries are replaced as
+// soon as the backends are checked again.
+func (h *BackendSwitchImpl) RestoreHealth(t pkg.BackendType, health []BackendHealth) int {
+	if t != pkg.EthBackend {
+		return 0
+	}
+
+	h.switchMtx.Lock()
+	defer h.switchMtx.Unlock()
+	list := h.ethBackends
+	index := make(map[string]int32)
+	for i := range list {
+		index[list[i].Name] = int32(i)
+	}
+
+	var restored int
+	current := int32(-1)
+	h.healthMtx.Lock()
+	for _, entry := range health {
+		i, ok := index[entry.Name]
+		if !ok {
+			continue
+		}
+		if entry.Current {
+			current = i
+		}
+		restoredEntry := entry
+		restoredEntry.Tier = list[i].Tier
+		restoredEntry.Current = false
+		h.health[entry.Name] = &restoredEntry
+		restored++
+	}
+	h.healthMtx.Unlock()
+
+	quarantined := current != -1 && h.quarantine != nil && h.quarantine.IsQuarantined(list[current].Name)
+	if current != -1 && !quarantined && h.isAvailable(list[current].Name) {
+		h.setCurrent(current)
+	} else {
+		h.setCurrent(h.selectBackend(atomic.LoadInt32(&h.currEth), list))
+	}
+	h.logger.Info("restored health table", "backends", restored, "current", h.nameAt(atomic.LoadInt32(&h.currEth)))
+	return restored
+}
+
+// selectBackend picks the backend to route traffic to. The current backend
+// is kept while it's available, unless it was selected automatically and an
+// available backend in a cheaper tier exists. Otherwise the cheapest
+// available backend is picked, preferring the backends following the
+// current one in config order. It must be called with switchMtx held.
+func (h *BackendSwitchImpl) selectBackend(curr int32, list []config.Backend) int32 {
+	currAvailable := curr != -1 && h.isAvailable(list[curr].Name)
+	if currAvailable && atomic.LoadInt32(&h.manual) == 1 {
+		return curr
+	}
+
+	best := int32(-1)
+	n := int32(len(list))
+	for j := int32(0); j < n; j++ {
+		i := (curr + 1 + j) % n
+		if !h.isAvailable(list[i].Name) {
+			continue
+		}
+		if best == -1 || list[i].Tier < list[best].Tier {
+			best = i
+		}
+	}
+
+	if currAvailable && (best == -1 || list[curr].Tier <= list[best].Tier) {
+		return curr
+	}
+	if best != -1 && currAvailable {
+		h.logger.Info("failing back to cheaper backend", "type", list[best].Type, "name", list[best].Name, "tier", list[best].Tier)
+	} else if best == -1 && curr != -1 {
+		h.logger.Error("no more backends to try", "type", list[curr].Type)
+	}
+	return best
+}
+
+// isAvailable returns whether traffic may be routed to the backend. Backends
+// are assumed to be available until they are checked.
+func (h *BackendSwitchImpl) isAvailable(name string) bool {
+	h.healthMtx.Lock()
+	defer h.healthMtx.Unlock()
+
+	entry, ok := h.health[name]
+	return !ok || entry.State == HealthHealthy || entry.State == HealthUnknown
+}
+
+func (h *BackendSwitchImpl) recordTierTime() {
+	now := time.Now()
+	last := h.lastCheck
+	h.lastCheck = now
+	if h.stats == nil || last.IsZero() {
+		return
+	}
+
+	idx := atomic.LoadInt32(&h.currEth)
 	if idx == -1 {
-		return -1
+		return
+	}
+	h.stats.AddTierTime(h.ethBackends[idx].Tier, now.Sub(last))
+}
+
+// setCurrent selects the backend at idx. It must be called with switchMtx
+// held.
+func (h *BackendSwitchImpl) setCurrent(idx int32) {
+	if h.warm != nil && idx != -1 && idx != atomic.LoadInt32(&h.currEth) {
+		h.warm(&h.ethBackends[idx])
+	}
+	prev := atomic.SwapInt32(&h.currEth, idx)
+	if prev != idx {
+		h.publishFailover(h.nameAt(prev), h.nameAt(idx))
+	}
+}
+
+func (h *BackendSwitchImpl) nameAt(idx int32) string {
+	if idx == -1 {
+		return ""
+	}
+
+	return h.ethBackends[idx].Name
+}
+
+func (h *BackendSwitchImpl) publishFailover(from string, to string) {
+	h.bus.Publish(events.Failover, events.FailoverData{
+		BackendType: string(pkg.EthBackend),
+		From:        from,
+		To:          to,
+	})
+}
+
+// checkAll checks the backends concurrently and returns their results keyed
+// by name, along with the number of checks that timed out. Each backend is
+// checked once even if it's listed twice, and checks that don't finish
+// within checkTimeout fail, so that a hanging backend can't stall a round.
+func (h *BackendSwitchImpl) checkAll(backends []config.Backend) (map[string]error, int) {
+	type result struct {
+		name string
+		err  error
+	}
+
+	visited := make(map[string]bool)
+	// buffered, so that checks finishing after the timeout don't leak
+	results := make(chan result, len(backends))
+	for i := range backends {
+		if visited[backends[i].Name] {
+			continue
+		}
+		visited[backends[i].Name] = true
+
+		go func(backend config.Backend) {
+			results <- result{name: backend.Name, err: h.check(&backend)}
+		}(backends[i])
+	}
+
+	errs := make(map[string]error, len(visited))
+	timer := time.NewTimer(h.checkTimeout)
+	defer timer.Stop()
+	for len(errs) < len(visited) {
+		select {
+		case res := <-results:
+			errs[res.name] = res.err
+		case <-timer.C:
+			timeouts := 0
+			for name := range visited {
+				if _, ok := errs[name]; !ok {
+					errs[name] = errHealthcheckTimeout
+					timeouts++
+				}
+			}
+			return errs, timeouts
+		}
+	}
+
+	return errs, 0
+}
+
+func (h *BackendSwitchImpl) recordRound(attempts int, timeouts int, elapsed time.Duration) {
+	h.healthMtx.Lock()
+	defer h.healthMtx.Unlock()
+
+	stats := &h.checkStats
+	stats.Rounds++
+	stats.Attempts += uint64(attempts)
+	stats.Timeouts += uint64(timeouts)
+	stats.LastRoundAttempts = attempts
+	stats.LastRoundMS = float64(elapsed) / float64(time.Millisecond)
+	if stats.LastRoundMS > stats.MaxRoundMS {
+		stats.MaxRoundMS = stats.LastRoundMS
+	}
+	if timeouts > 0 {
+		h.logger.Warn("healthchecks timed out", "timeouts", timeouts, "attempts", attempts)
+	}
+}
+
+func (h *BackendSwitchImpl) UseClient(client *http.Client) {
+	h.client = client
+}
+
+func (h *BackendSwitchImpl) UseCheck(check func(backend *config.Backend) error) {
+	h.checks = append(h.checks, check)
+}
+
+func (h *BackendSwitchImpl) UseWarmer(warm func(backend *config.Backend)) {
+	h.warm = warm
+}
+
+// HealthcheckStats returns a snapshot of the healthcheck instrumentation.
+func (h *BackendSwitchImpl) HealthcheckStats() HealthcheckStats {
+	h.healthMtx.Lock()
+	defer h.healthMtx.Unlock()
+	return h.checkStats
+}
+
+func (h *BackendSwitchImpl) check(backend *config.Backend) error {
+	if h.faults != nil && h.faults.Unhealthy(backend.Name) {
+		h.logger.Debug("failing healthcheck, injected fault", "type", backend.Type, "name", backend.Name)
+		return errors.New("injected fault")
 	}
 
-	backend := list[idx]
 	logger.Debug("performing healthcheck", "type", backend.Type, "name", backend.Name, "url", backend.URL)
-	checker := NewChecker(&backend)
-	ok := checker.Check()
+	if err := NewChecker(backend, h.client).Check(); err != nil {
+		return err
+	}
+	for _, check := range h.checks {
+		if err := check(backend); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	if !ok {
-		logger.Warn("backend is unhealthy, trying another", "type", backend.Type, "name", backend.Name, "url", backend.URL)
-		return h.doHealthcheck(h.nextBackend(idx, list))
+// recordResult updates the health table with a healthcheck result, and
+// publishes an event when the backend's health changed.
+func (h *BackendSwitchImpl) recordResult(backend *config.Backend, err error) {
+	h.healthMtx.Lock()
+	defer h.healthMtx.Unlock()
+
+	entry := h.entryLocked(backend.Name)
+	// backends are assumed healthy until they are checked
+	wasHealthy := entry.State != HealthUnhealthy
+	now := time.Now()
+	if err == nil {
+		logger.Debug("backend is ok", "type", backend.Type, "name", backend.Name, "url", backend.URL)
+		entry.State = HealthHealthy
+		entry.LastSuccess = now
+		entry.ConsecutiveFailures = 0
+	} else {
+		logger.Warn("backend is unhealthy", "type", backend.Type, "name", backend.Name, "url", backend.URL, "err", err)
+		entry.State = HealthUnhealthy
+		entry.LastError = err.Error()
+		entry.LastFailure = now
+		entry.ConsecutiveFailures++
 	}
 
-	logger.Debug("backend is ok", "type", backend.Type, "name", backend.Name, "url", backend.URL)
-	return idx
+	if healthy := err == nil; healthy != wasHealthy {
+		h.bus.Publish(events.BackendHealth, events.BackendHealthData{
+			Backend: backend.Name,
+			Healthy: healthy,
+			Behind:  err == ErrBackendSyncing,
+		})
+	}
 }
 
-func (h *BackendSwitchImpl) nextBackend(idx int32, list []config.Backend) (int32, []config.Backend) {
-	backend := list[idx]
-	if len(list) == 1 || idx == int32(len(list) - 1) {
-		h.logger.Error("no more backends to try", "type", backend.Type)
-		return -1, list
+// ejectFailing quarantines the backends that failed the configured number of
+// consecutive healthchecks, as long as another backend is available to take
+// their traffic. It must be called with switchMtx held.
+func (h *BackendSwitchImpl) ejectFailing(list []config.Backend) {
+	if h.quarantine == nil {
+		return
+	}
+
+	h.healthMtx.Lock()
+	var failing []string
+	available := 0
+	for i := range list {
+		entry, ok := h.health[list[i].Name]
+		if !ok || entry.State == HealthHealthy || entry.State == HealthUnknown {
+			available++
+			continue
+		}
+		if entry.State == HealthUnhealthy && entry.ConsecutiveFailures >= h.quarantine.Failures() {
+			failing = append(failing, list[i].Name)
+		}
 	}
+	h.healthMtx.Unlock()
 
-	if idx < int32(len(list)-1) {
-		return idx + 1, list
+	if available == 0 {
+		if len(failing) > 0 {
+			h.logger.Warn("not ejecting failing backends, no other backend is available", "backends", failing)
+		}
+		return
+	}
+	for _, name := range failing {
+		h.quarantine.Eject(name, quarantine.ReasonHealthcheck)
 	}
+}
 
-	return 0, list
+func (h *BackendSwitchImpl) setQuarantined(name string) {
+	h.healthMtx.Lock()
+	defer h.healthMtx.Unlock()
+	h.entryLocked(name).State = HealthQuarantined
 }
 
-func NewChecker(backend *config.Backend) Checker {
+func (h *BackendSwitchImpl) entryLocked(name string) *BackendHealth {
+	entry, ok := h.health[name]
+	if !ok {
+		entry = &BackendHealth{
+			Name:  name,
+			State: HealthUnknown,
+		}
+		h.health[name] = entry
+	}
+
+	return entry
+}
+
+// NewChecker creates a Checker for the backend, which sends its probes with
+// the given client.
+func NewChecker(backend *config.Backend, client *http.Client) Checker {
 	if backend.Type == pkg.EthBackend {
 		return &ETHChecker{
 			backend: backend,
+			client:  client,
 			logger:  log.NewLog("proxy/eth_checker"),
 		}
 	}
@@ -150,36 +713,46 @@ func NewChecker(backend *config.Backend) Checker {
 	return nil
 }
 
+// Checker performs a healthcheck, returning why the backend is unhealthy.
 type Checker interface {
-	Check() bool
+	Check() error
 }
 
 type ETHChecker struct {
 	backend *config.Backend
+	client  *http.Client
 	logger  log15.Logger
 }
 
-func (e *ETHChecker) Check() bool {
+func (e *ETHChecker) Check() error {
 	id := time.Now().Unix()
 	data := fmt.Sprintf(ethCheckBody, id)
-	client := &http.Client{
-		Timeout: time.Duration(2 * time.Second),
+	client, err := backendClient(e.backend, e.client)
+	if err != nil {
+		e.logger.Warn("failed to configure backend client", "name", e.backend.Name, "err", err)
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), HealthcheckTimeout)
+	defer cancel()
+	req, err := newUpstreamRequest(ctx, e.backend, []byte(data))
+	if err != nil {
+		return err
 	}
-	res, err := client.Post(e.backend.URL, "application/json", strings.NewReader(data))
+	res, err := client.Do(req)
 	if err != nil {
-		e.logger.Warn("backend returned non-200 response", "name", e.backend.Name, "url", e.backend.URL)
-		return false
+		e.logger.Warn("healthcheck request failed", "name", e.backend.Name, "url", e.backend.URL)
+		return err
 	}
 	defer res.Body.Close()
 	var dec map[string]interface{}
 	err = json.NewDecoder(res.Body).Decode(&dec)
 	if err != nil {
 		logger.Warn("backend returned invalid JSON", "name", e.backend.Name, "url", e.backend.URL)
-		return false
+		return fmt.Errorf("invalid JSON response with status %d", res.StatusCode)
 	}
 	if _, ok := dec["result"].(bool); !ok {
 		logger.Warn("backend is either completing initial sync or has fallen behind", "name", e.backend.Name, "url", e.backend.URL)
-		return false
+		return ErrBackendSyncing
 	}
-	return true
+	return nil
 }
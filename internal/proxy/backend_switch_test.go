@@ -9,6 +9,13 @@ import (
 	"github.com/stretchr/testify/suite"
 	"github.com/stretchr/testify/require"
 	"time"
+	"io/ioutil"
+	"os"
+	"path"
+	"github.com/kyokan/chaind/internal/quarantine"
+	"github.com/kyokan/chaind/internal/stats"
+	"sync/atomic"
+	"github.com/kyokan/chaind/pkg/events"
 )
 
 type BackendSwitchSuite struct {
@@ -53,7 +60,7 @@ func (b *BackendSwitchSuite) SetupSuite() {
 			URL:  b.srv2.URL,
 			Type: pkg.EthBackend,
 		},
-	})
+	}, nil, nil, nil, nil)
 
 	require.NoError(b.T(), b.sw.Start())
 }
@@ -89,3 +96,338 @@ func (b *BackendSwitchSuite) TestBackendFor_C_NoMoreBackends() {
 func TestBackendSwitchSuite(t *testing.T) {
 	suite.Run(t, new(BackendSwitchSuite))
 }
+
+func TestBackendSwitchSkipsQuarantined(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{\"jsonrpc\":\"2.0\",\"result\":false,\"id\":1}"))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "chaind-quarantine")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	q, err := quarantine.NewList(&config.QuarantineConfig{
+		File: path.Join(dir, "quarantine.json"),
+	})
+	require.NoError(t, err)
+	q.Drain("test-1")
+
+	sw := NewBackendSwitch([]config.Backend{
+		{Name: "test-1", URL: srv.URL, Type: pkg.EthBackend, Main: true},
+		{Name: "test-2", URL: srv.URL, Type: pkg.EthBackend},
+	}, q, nil, nil, nil)
+	require.NoError(t, sw.Start())
+	defer sw.Stop()
+
+	backend, err := sw.BackendFor(pkg.EthBackend)
+	require.NoError(t, err)
+	require.Equal(t, "test-2", backend.Name)
+}
+
+func TestBackendSwitchFailsBackToCheaperTier(t *testing.T) {
+	var selfHostedDown int32 = 1
+	selfHosted := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&selfHostedDown) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("{\"jsonrpc\":\"2.0\",\"result\":false,\"id\":1}"))
+	}))
+	defer selfHosted.Close()
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{\"jsonrpc\":\"2.0\",\"result\":false,\"id\":1}"))
+	}))
+	defer provider.Close()
+
+	statsStore := stats.NewStore()
+	sw := NewBackendSwitch([]config.Backend{
+		{Name: "provider", URL: provider.URL, Type: pkg.EthBackend, Tier: 1},
+		{Name: "self-hosted", URL: selfHosted.URL, Type: pkg.EthBackend, Tier: 0},
+	}, nil, statsStore, nil, nil)
+	require.NoError(t, sw.Start())
+	defer sw.Stop()
+
+	backend, err := sw.BackendFor(pkg.EthBackend)
+	require.NoError(t, err)
+	require.Equal(t, "provider", backend.Name)
+
+	atomic.StoreInt32(&selfHostedDown, 0)
+	time.Sleep(1100 * time.Millisecond)
+	backend, err = sw.BackendFor(pkg.EthBackend)
+	require.NoError(t, err)
+	require.Equal(t, "self-hosted", backend.Name)
+	require.True(t, statsStore.TierTimes()[1] > 0)
+}
+
+func TestBackendSwitchUpdateBackends(t *testing.T) {
+	sw := NewBackendSwitch(nil, nil, nil, nil, nil)
+	_, err := sw.BackendFor(pkg.EthBackend)
+	require.Error(t, err)
+
+	sw.UpdateBackends(pkg.EthBackend, []config.Backend{
+		{Name: "a", URL: "http://a", Type: pkg.EthBackend},
+		{Name: "b", URL: "http://b", Type: pkg.EthBackend},
+	})
+	backend, err := sw.BackendFor(pkg.EthBackend)
+	require.NoError(t, err)
+	require.Equal(t, "a", backend.Name)
+
+	impl := sw.(*BackendSwitchImpl)
+	atomic.StoreInt32(&impl.currEth, 1)
+	sw.UpdateBackends(pkg.EthBackend, []config.Backend{
+		{Name: "c", URL: "http://c", Type: pkg.EthBackend},
+		{Name: "b", URL: "http://b", Type: pkg.EthBackend},
+	})
+	backend, err = sw.BackendFor(pkg.EthBackend)
+	require.NoError(t, err)
+	require.Equal(t, "b", backend.Name)
+	require.Len(t, sw.Backends(pkg.EthBackend), 2)
+}
+
+func TestBackendSwitchPublishesEvents(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{\"jsonrpc\":\"2.0\",\"result\":false,\"id\":1}"))
+	}))
+	defer healthy.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer down.Close()
+
+	bus := events.NewBus()
+	sub := bus.Subscribe(events.Failover, events.BackendHealth)
+	sw := NewBackendSwitch([]config.Backend{
+		{Name: "test-1", URL: down.URL, Type: pkg.EthBackend, Main: true},
+		{Name: "test-2", URL: healthy.URL, Type: pkg.EthBackend},
+	}, nil, nil, nil, bus)
+	sw.(*BackendSwitchImpl).performAllHealthchecks()
+
+	ev := <-sub.Events()
+	require.Equal(t, events.BackendHealthData{Backend: "test-1", Healthy: false}, ev.Data)
+	ev = <-sub.Events()
+	require.Equal(t, events.FailoverData{BackendType: "ETH", From: "test-1", To: "test-2"}, ev.Data)
+
+	// unchanged health isn't republished
+	sw.(*BackendSwitchImpl).performAllHealthchecks()
+	require.Len(t, sub.Events(), 0)
+}
+
+func TestBackendSwitchHealthTable(t *testing.T) {
+	var down [3]int32
+	var srvs []*httptest.Server
+	for i := range down {
+		i := i
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.LoadInt32(&down[i]) == 1 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte("{\"jsonrpc\":\"2.0\",\"result\":false,\"id\":1}"))
+		}))
+		defer srv.Close()
+		srvs = append(srvs, srv)
+	}
+
+	sw := NewBackendSwitch([]config.Backend{
+		{Name: "test-1", URL: srvs[0].URL, Type: pkg.EthBackend},
+		{Name: "test-2", URL: srvs[1].URL, Type: pkg.EthBackend},
+		{Name: "test-3", URL: srvs[2].URL, Type: pkg.EthBackend},
+	}, nil, nil, nil, nil)
+	impl := sw.(*BackendSwitchImpl)
+	for i := range down {
+		atomic.StoreInt32(&down[i], 1)
+	}
+	impl.performAllHealthchecks()
+	impl.performAllHealthchecks()
+	_, err := sw.BackendFor(pkg.EthBackend)
+	require.Error(t, err)
+
+	health := sw.Health(pkg.EthBackend)
+	require.Len(t, health, 3)
+	require.Equal(t, HealthUnhealthy, health[0].State)
+	require.Equal(t, 2, health[0].ConsecutiveFailures)
+	require.NotEmpty(t, health[0].LastError)
+
+	// the last backend recovering first is picked up even though the
+	// backends before it are still down
+	atomic.StoreInt32(&down[2], 0)
+	impl.performAllHealthchecks()
+	backend, err := sw.BackendFor(pkg.EthBackend)
+	require.NoError(t, err)
+	require.Equal(t, "test-3", backend.Name)
+
+	health = sw.Health(pkg.EthBackend)
+	require.Equal(t, HealthHealthy, health[2].State)
+	require.True(t, health[2].Current)
+	require.Equal(t, 0, health[2].ConsecutiveFailures)
+	require.False(t, health[2].LastSuccess.IsZero())
+	require.False(t, health[0].Current)
+}
+
+func TestBackendSwitchBoundsHealthcheckRounds(t *testing.T) {
+	hang := make(chan struct{})
+	var hits int32
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		<-hang
+	}))
+	defer hanging.Close()
+	// released before closing the server, which waits for the handler
+	defer close(hang)
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{\"jsonrpc\":\"2.0\",\"result\":false,\"id\":1}"))
+	}))
+	defer healthy.Close()
+
+	sw := NewBackendSwitch([]config.Backend{
+		{Name: "test-1", URL: hanging.URL, Type: pkg.EthBackend, Main: true},
+		{Name: "test-1", URL: hanging.URL, Type: pkg.EthBackend},
+		{Name: "test-2", URL: healthy.URL, Type: pkg.EthBackend},
+	}, nil, nil, nil, nil)
+	impl := sw.(*BackendSwitchImpl)
+	impl.checkTimeout = 50 * time.Millisecond
+
+	start := time.Now()
+	impl.performAllHealthchecks()
+	require.True(t, time.Since(start) < time.Second)
+
+	backend, err := sw.BackendFor(pkg.EthBackend)
+	require.NoError(t, err)
+	require.Equal(t, "test-2", backend.Name)
+	require.Equal(t, "healthcheck timed out", sw.Health(pkg.EthBackend)[0].LastError)
+
+	// duplicate backends are only checked once per round
+	checks := sw.HealthcheckStats()
+	require.Equal(t, uint64(1), checks.Rounds)
+	require.Equal(t, uint64(2), checks.Attempts)
+	require.Equal(t, uint64(1), checks.Timeouts)
+	require.Equal(t, 2, checks.LastRoundAttempts)
+	require.True(t, checks.MaxRoundMS >= 50)
+	require.Equal(t, int32(1), atomic.LoadInt32(&hits))
+}
+
+func TestBackendSwitchWarmsBeforeFailover(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{\"jsonrpc\":\"2.0\",\"result\":false,\"id\":1}"))
+	}))
+	defer healthy.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer down.Close()
+
+	sw := NewBackendSwitch([]config.Backend{
+		{Name: "test-1", URL: down.URL, Type: pkg.EthBackend, Main: true},
+		{Name: "test-2", URL: healthy.URL, Type: pkg.EthBackend},
+	}, nil, nil, nil, nil)
+	var warmed []string
+	sw.UseWarmer(func(backend *config.Backend) {
+		// traffic still goes to the previous backend while warming
+		curr, err := sw.BackendFor(pkg.EthBackend)
+		require.NoError(t, err)
+		require.Equal(t, "test-1", curr.Name)
+		warmed = append(warmed, backend.Name)
+	})
+
+	sw.(*BackendSwitchImpl).performAllHealthchecks()
+	sw.(*BackendSwitchImpl).performAllHealthchecks()
+	require.Equal(t, []string{"test-2"}, warmed)
+	backend, err := sw.BackendFor(pkg.EthBackend)
+	require.NoError(t, err)
+	require.Equal(t, "test-2", backend.Name)
+}
+
+type countingTransport struct {
+	count int32
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&c.count, 1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestBackendSwitchChecksThroughUpstreamClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("content-type") != "application/json" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		w.Write([]byte("{\"jsonrpc\":\"2.0\",\"result\":false,\"id\":1}"))
+	}))
+	defer srv.Close()
+
+	sw := NewBackendSwitch([]config.Backend{
+		{Name: "test-1", URL: srv.URL, Type: pkg.EthBackend, Main: true},
+	}, nil, nil, nil, nil)
+	transport := &countingTransport{}
+	sw.UseClient(&http.Client{Transport: transport})
+
+	sw.(*BackendSwitchImpl).performAllHealthchecks()
+	require.Equal(t, int32(1), atomic.LoadInt32(&transport.count))
+	_, err := sw.BackendFor(pkg.EthBackend)
+	require.NoError(t, err)
+}
+
+func TestBackendSwitchRestoresHealth(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{\"jsonrpc\":\"2.0\",\"result\":false,\"id\":1}"))
+	}))
+	defer srv.Close()
+
+	sw := NewBackendSwitch([]config.Backend{
+		{Name: "test-1", URL: srv.URL, Type: pkg.EthBackend, Main: true},
+		{Name: "test-2", URL: srv.URL, Type: pkg.EthBackend},
+	}, nil, nil, nil, nil)
+	restored := sw.RestoreHealth(pkg.EthBackend, []BackendHealth{
+		{Name: "test-1", State: HealthUnhealthy, ConsecutiveFailures: 3},
+		{Name: "test-2", State: HealthHealthy, Current: true},
+		{Name: "unknown", State: HealthHealthy},
+	})
+	require.Equal(t, 2, restored)
+
+	backend, err := sw.BackendFor(pkg.EthBackend)
+	require.NoError(t, err)
+	require.Equal(t, "test-2", backend.Name)
+	health := sw.Health(pkg.EthBackend)
+	require.Equal(t, HealthUnhealthy, health[0].State)
+	require.Equal(t, 3, health[0].ConsecutiveFailures)
+	require.True(t, health[1].Current)
+}
+
+func TestBackendSwitchEjectsAfterConsecutiveFailures(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{\"jsonrpc\":\"2.0\",\"result\":false,\"id\":1}"))
+	}))
+	defer up.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer down.Close()
+
+	dir, err := ioutil.TempDir("", "chaind-quarantine")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	q, err := quarantine.NewList(&config.QuarantineConfig{
+		File:     path.Join(dir, "quarantine.json"),
+		Failures: 2,
+	})
+	require.NoError(t, err)
+
+	sw := NewBackendSwitch([]config.Backend{
+		{Name: "down", URL: down.URL, Type: pkg.EthBackend},
+		{Name: "up", URL: up.URL, Type: pkg.EthBackend},
+	}, q, nil, nil, nil).(*BackendSwitchImpl)
+	sw.performAllHealthchecks()
+	require.False(t, q.IsQuarantined("down"))
+	sw.performAllHealthchecks()
+	require.True(t, q.IsQuarantined("down"))
+
+	// the last available backend is never ejected
+	only := NewBackendSwitch([]config.Backend{
+		{Name: "only", URL: down.URL, Type: pkg.EthBackend},
+	}, q, nil, nil, nil).(*BackendSwitchImpl)
+	for i := 0; i < 3; i++ {
+		only.performAllHealthchecks()
+	}
+	require.False(t, q.IsQuarantined("only"))
+}
@@ -9,6 +9,7 @@ import (
 	"encoding/json"
 	"sync/atomic"
 	"github.com/kyokan/chaind/pkg/jsonrpc"
+	"github.com/kyokan/chaind/pkg/events"
 	)
 
 const FinalityDepth = 7
@@ -19,11 +20,15 @@ type BlockHeightWatcher struct {
 	quitChan    chan bool
 	logger      log15.Logger
 	client      *http.Client
+	bus         *events.Bus
 }
 
-func NewBlockHeightWatcher(sw BackendSwitch) *BlockHeightWatcher {
+// NewBlockHeightWatcher creates a BlockHeightWatcher, which publishes new
+// heads on the bus. The bus may be nil.
+func NewBlockHeightWatcher(sw BackendSwitch, bus *events.Bus) *BlockHeightWatcher {
 	return &BlockHeightWatcher{
 		sw:       sw,
+		bus:      bus,
 		quitChan: make(chan bool),
 		logger:   log.NewLog("proxy/block_number_watcher"),
 		client: &http.Client{
@@ -69,9 +74,15 @@ func (b *BlockHeightWatcher) updateBlockHeight() {
 	backend, err := b.sw.BackendFor(pkg.EthBackend)
 	if err != nil {
 		b.logger.Error("no backend available", "err", err)
+		return
 	}
 
-	client := jsonrpc.NewClient(backend.URL, time.Second)
+	httpClient, err := backendClient(backend, b.client)
+	if err != nil {
+		b.logger.Error("failed to configure backend client", "err", err)
+		return
+	}
+	client := jsonrpc.NewClientWithHTTP(backend.URL, httpClient)
 	res, err := client.Execute("eth_blockNumber", nil)
 	if err != nil {
 		b.logger.Error("failed to fetch block height", "err", err)
@@ -89,6 +100,12 @@ func (b *BlockHeightWatcher) updateBlockHeight() {
 		return
 	}
 
-	b.logger.Debug("updated block height", "from", atomic.LoadUint64(&b.blockNumber), "to", heightBig.Uint64())
-	atomic.StoreUint64(&b.blockNumber, heightBig.Uint64())
+	height := heightBig.Uint64()
+	prev := atomic.SwapUint64(&b.blockNumber, height)
+	b.logger.Debug("updated block height", "from", prev, "to", height)
+	if height > prev {
+		b.bus.Publish(events.NewHead, events.NewHeadData{
+			Number: height,
+		})
+	}
 }
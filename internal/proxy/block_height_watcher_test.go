@@ -42,6 +42,43 @@ func (m *MockBackendSwitch) BackendFor(t pkg.BackendType) (*config.Backend, erro
 	}, nil
 }
 
+func (m *MockBackendSwitch) Backends(t pkg.BackendType) []config.Backend {
+	backend, _ := m.BackendFor(t)
+	return []config.Backend{*backend}
+}
+
+func (m *MockBackendSwitch) SwitchTo(t pkg.BackendType, name string) error {
+	return nil
+}
+
+func (m *MockBackendSwitch) UpdateBackends(t pkg.BackendType, backends []config.Backend) {
+}
+
+func (m *MockBackendSwitch) Manual(t pkg.BackendType) bool {
+	return false
+}
+
+func (m *MockBackendSwitch) RestoreHealth(t pkg.BackendType, health []BackendHealth) int {
+	return 0
+}
+
+func (m *MockBackendSwitch) UseClient(client *http.Client) {
+}
+
+func (m *MockBackendSwitch) UseCheck(check func(backend *config.Backend) error) {
+}
+
+func (m *MockBackendSwitch) UseWarmer(warm func(backend *config.Backend)) {
+}
+
+func (m *MockBackendSwitch) HealthcheckStats() HealthcheckStats {
+	return HealthcheckStats{}
+}
+
+func (m *MockBackendSwitch) Health(t pkg.BackendType) []BackendHealth {
+	return nil
+}
+
 type BlockHeightWatcherSuite struct {
 	suite.Suite
 	sw *MockBackendSwitch
@@ -52,7 +89,7 @@ func (s *BlockHeightWatcherSuite) SetupSuite() {
 	s.sw = new(MockBackendSwitch)
 	s.sw.SetBody([]byte("{\"jsonrpc\":\"2.0\",\"result\":\"0x123\",\"id\":1}"))
 	require.NoError(s.T(), s.sw.Start())
-	s.watcher = NewBlockHeightWatcher(s.sw)
+	s.watcher = NewBlockHeightWatcher(s.sw, nil)
 	require.NoError(s.T(), s.watcher.Start())
 }
 
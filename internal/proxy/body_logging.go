@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+
+	"github.com/kyokan/chaind/pkg/jsonrpc"
+	"github.com/kyokan/chaind/pkg/log"
+)
+
+// bodyLogWriter copies the response written to it, so that sampled
+// requests can be logged along with their response.
+type bodyLogWriter struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (b *bodyLogWriter) Write(p []byte) (int, error) {
+	b.body.Write(p)
+	return b.ResponseWriter.Write(p)
+}
+
+// logBodies logs the bodies of a request sampled for body logging.
+func (h *EthHandler) logBodies(ctx context.Context, rpcReq *jsonrpc.Request, reqBody []byte, w *bodyLogWriter) {
+	h.logger.Info(
+		"sampled request bodies",
+		log.WithRequestID(ctx, "method", rpcReq.Method, "request", string(reqBody), "response", w.body.String())...,
+	)
+}
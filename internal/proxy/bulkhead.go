@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/kyokan/chaind/pkg/config"
+)
+
+const (
+	ClassReads  = "reads"
+	ClassLogs   = "logs"
+	ClassTraces = "traces"
+	ClassSends  = "sends"
+)
+
+// Bulkhead limits the upstream requests in flight per method class, so that
+// e.g. expensive log queries can't starve transaction submission.
+type Bulkhead struct {
+	slots   map[string]chan struct{}
+	maxWait time.Duration
+}
+
+func NewBulkhead(cfg *config.BulkheadConfig) *Bulkhead {
+	b := &Bulkhead{
+		slots:   make(map[string]chan struct{}),
+		maxWait: cfg.MaxWait,
+	}
+	limits := map[string]int{
+		ClassReads:  cfg.Reads,
+		ClassLogs:   cfg.Logs,
+		ClassTraces: cfg.Traces,
+		ClassSends:  cfg.Sends,
+	}
+	for class, limit := range limits {
+		// classes without a limit are unrestricted
+		if limit > 0 {
+			b.slots[class] = make(chan struct{}, limit)
+		}
+	}
+
+	return b
+}
+
+// Acquire takes a slot in the method's class, waiting up to the configured
+// maximum wait for one to free up. It returns false if the class is busy.
+// Successful calls must be followed by a call to the returned release func.
+func (b *Bulkhead) Acquire(ctx context.Context, method string) (func(), bool) {
+	slots, ok := b.slots[MethodClass(method)]
+	if !ok {
+		return func() {}, true
+	}
+	release := func() {
+		<-slots
+	}
+
+	select {
+	case slots <- struct{}{}:
+		return release, true
+	default:
+	}
+	if b.maxWait == 0 {
+		return nil, false
+	}
+
+	timer := time.NewTimer(b.maxWait)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return release, true
+	case <-timer.C:
+		return nil, false
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+// MethodClass returns the bulkhead class of a JSON-RPC method.
+func MethodClass(method string) string {
+	switch {
+	case method == "eth_sendRawTransaction" || method == "eth_sendTransaction":
+		return ClassSends
+	case method == "eth_getLogs" || method == "eth_getFilterLogs" || method == "eth_getFilterChanges":
+		return ClassLogs
+	case strings.HasPrefix(method, "erigon_getLogs") || strings.HasPrefix(method, "ots_search"):
+		return ClassLogs
+	case strings.HasPrefix(method, "trace_") || strings.HasPrefix(method, "debug_trace"):
+		return ClassTraces
+	case method == "ots_traceTransaction" || method == "ots_getInternalOperations" || method == "ots_getTransactionError":
+		return ClassTraces
+	default:
+		return ClassReads
+	}
+}
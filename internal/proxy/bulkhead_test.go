@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/internal/stats"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/config"
+	chainderrors "github.com/kyokan/chaind/pkg/errors"
+	"github.com/kyokan/chaind/pkg/jsonrpc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBulkheadIsolatesClasses(t *testing.T) {
+	b := NewBulkhead(&config.BulkheadConfig{
+		Logs:  1,
+		Sends: 1,
+	})
+	ctx := context.Background()
+
+	release, ok := b.Acquire(ctx, "eth_getLogs")
+	require.True(t, ok)
+	_, ok = b.Acquire(ctx, "eth_getFilterLogs")
+	require.False(t, ok)
+
+	// other classes are unaffected by saturated logs
+	releaseSend, ok := b.Acquire(ctx, "eth_sendRawTransaction")
+	require.True(t, ok)
+	releaseSend()
+	for i := 0; i < 10; i++ {
+		_, ok = b.Acquire(ctx, "eth_call")
+		require.True(t, ok)
+	}
+
+	release()
+	_, ok = b.Acquire(ctx, "eth_getLogs")
+	require.True(t, ok)
+}
+
+func TestBulkheadWaitsForSlot(t *testing.T) {
+	b := NewBulkhead(&config.BulkheadConfig{
+		Traces:  1,
+		MaxWait: time.Second,
+	})
+	ctx := context.Background()
+
+	release, ok := b.Acquire(ctx, "trace_transaction")
+	require.True(t, ok)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		release()
+	}()
+	_, ok = b.Acquire(ctx, "debug_traceTransaction")
+	require.True(t, ok)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, ok = b.Acquire(cancelled, "trace_block")
+	require.False(t, ok)
+}
+
+func TestMethodClass(t *testing.T) {
+	require.Equal(t, ClassSends, MethodClass("eth_sendRawTransaction"))
+	require.Equal(t, ClassLogs, MethodClass("eth_getLogs"))
+	require.Equal(t, ClassTraces, MethodClass("trace_transaction"))
+	require.Equal(t, ClassTraces, MethodClass("debug_traceTransaction"))
+	require.Equal(t, ClassTraces, MethodClass("ots_traceTransaction"))
+	require.Equal(t, ClassLogs, MethodClass("ots_searchTransactionsBefore"))
+	require.Equal(t, ClassLogs, MethodClass("erigon_getLogsByHash"))
+	require.Equal(t, ClassReads, MethodClass("ots_getBlockDetails"))
+	require.Equal(t, ClassReads, MethodClass("eth_call"))
+}
+
+func TestEthHandlerRejectsCallsOverBulkhead(t *testing.T) {
+	h := NewEthHandler(nil, nil, nil, &nopAuditor{}, nil, stats.NewStore(), nil, nil, nil, nil)
+	h.bulkhead = NewBulkhead(&config.BulkheadConfig{Logs: 1})
+	release, ok := h.bulkhead.Acquire(context.Background(), "eth_getLogs")
+	require.True(t, ok)
+	defer release()
+
+	req := httptest.NewRequest(http.MethodPost, "/eth", strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getLogs","params":[{}],"id":1}`))
+	res := httptest.NewRecorder()
+	h.Handle(res, req, &config.Backend{Name: "test", URL: "http://127.0.0.1:0", Type: pkg.EthBackend})
+	var rpcRes jsonrpc.ErrorResponse
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &rpcRes))
+	require.Equal(t, chainderrors.Busy, rpcRes.Error.Code)
+	require.Equal(t, map[string]interface{}{
+		"chaind_error": "busy",
+		"class":        "logs",
+	}, rpcRes.Error.Data)
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const DefaultCoalesceWait = time.Second
+
+type coalescedCall struct {
+	done chan struct{}
+	body []byte
+	err  error
+}
+
+// Coalescer collapses concurrent upstream fetches for the same key into a
+// single fetch, so that an expiring hot cache key doesn't send a burst of
+// identical requests to the backend.
+type Coalescer struct {
+	maxWait time.Duration
+	calls   map[string]*coalescedCall
+	mtx     sync.Mutex
+}
+
+func NewCoalescer(maxWait time.Duration) *Coalescer {
+	if maxWait == 0 {
+		maxWait = DefaultCoalesceWait
+	}
+
+	return &Coalescer{
+		maxWait: maxWait,
+		calls:   make(map[string]*coalescedCall),
+	}
+}
+
+// Do calls fetch unless a fetch for key is already in flight, in which case
+// it waits for that fetch and returns its result. Waiters give up after the
+// max wait or the context's deadline, whichever comes first, and fetch on
+// their own instead; they do the same if the shared fetch was cancelled.
+// shared reports whether the result came from another caller's fetch.
+func (c *Coalescer) Do(ctx context.Context, key string, fetch func() ([]byte, error)) (body []byte, shared bool, err error) {
+	c.mtx.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.mtx.Unlock()
+		return c.wait(ctx, call, fetch)
+	}
+	call := &coalescedCall{
+		done: make(chan struct{}),
+	}
+	c.calls[key] = call
+	c.mtx.Unlock()
+
+	call.body, call.err = fetch()
+	c.mtx.Lock()
+	delete(c.calls, key)
+	c.mtx.Unlock()
+	close(call.done)
+	return call.body, false, call.err
+}
+
+func (c *Coalescer) wait(ctx context.Context, call *coalescedCall, fetch func() ([]byte, error)) ([]byte, bool, error) {
+	wait := c.maxWait
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := time.Until(deadline); remaining < wait {
+			wait = remaining
+		}
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-call.done:
+		if call.err == context.Canceled || call.err == context.DeadlineExceeded {
+			break
+		}
+		return call.body, true, call.err
+	case <-timer.C:
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+
+	body, err := fetch()
+	return body, false, err
+}
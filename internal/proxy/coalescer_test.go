@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoalescerSharesFetch(t *testing.T) {
+	c := NewCoalescer(time.Second)
+	var fetches int32
+	release := make(chan struct{})
+	fetch := func() ([]byte, error) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		return []byte("result"), nil
+	}
+
+	var wg sync.WaitGroup
+	var sharedCount int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body, shared, err := c.Do(context.Background(), "key", fetch)
+			require.NoError(t, err)
+			require.Equal(t, []byte("result"), body)
+			if shared {
+				atomic.AddInt32(&sharedCount, 1)
+			}
+		}()
+	}
+	for atomic.LoadInt32(&fetches) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+	require.Equal(t, int32(9), sharedCount)
+}
+
+func TestCoalescerFallsBackAfterMaxWait(t *testing.T) {
+	c := NewCoalescer(10 * time.Millisecond)
+	release := make(chan struct{})
+	defer close(release)
+	go c.Do(context.Background(), "key", func() ([]byte, error) {
+		<-release
+		return []byte("slow"), nil
+	})
+	for {
+		c.mtx.Lock()
+		n := len(c.calls)
+		c.mtx.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	body, shared, err := c.Do(context.Background(), "key", func() ([]byte, error) {
+		return []byte("direct"), nil
+	})
+	require.NoError(t, err)
+	require.False(t, shared)
+	require.Equal(t, []byte("direct"), body)
+}
+
+func TestCoalescerRefetchesAfterCancelledFetch(t *testing.T) {
+	c := NewCoalescer(time.Second)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go c.Do(context.Background(), "key", func() ([]byte, error) {
+		close(started)
+		<-release
+		return nil, context.Canceled
+	})
+	<-started
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+	}()
+	body, shared, err := c.Do(context.Background(), "key", func() ([]byte, error) {
+		return []byte("direct"), nil
+	})
+	require.NoError(t, err)
+	require.False(t, shared)
+	require.Equal(t, []byte("direct"), body)
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"sync"
+
+	"github.com/kyokan/chaind/pkg/config"
+)
+
+// ConcurrencyLimiter caps the requests handled at once, in total and per
+// client key, so that a flood of requests can't exhaust the proxy's memory
+// or goroutines. Unlike the bulkhead, it never waits for a slot.
+type ConcurrencyLimiter struct {
+	global chan struct{}
+	perKey int
+	limits map[string]int
+	counts map[string]int
+	mtx    sync.Mutex
+}
+
+func NewConcurrencyLimiter(cfg *config.ConcurrencyConfig) *ConcurrencyLimiter {
+	c := &ConcurrencyLimiter{
+		perKey: cfg.MaxPerKey,
+		limits: make(map[string]int),
+		counts: make(map[string]int),
+	}
+	if cfg.MaxRequests > 0 {
+		c.global = make(chan struct{}, cfg.MaxRequests)
+	}
+	for _, key := range cfg.Keys {
+		c.limits[key.Key] = key.MaxRequests
+	}
+	return c
+}
+
+// Acquire takes a slot for a request from the key. It returns false if the
+// listener or the key is at its cap. Successful calls must be followed by a
+// call to the returned release func.
+func (c *ConcurrencyLimiter) Acquire(key string) (func(), bool) {
+	if c.global != nil {
+		select {
+		case c.global <- struct{}{}:
+		default:
+			return nil, false
+		}
+	}
+
+	limit, ok := c.limits[key]
+	if !ok {
+		limit = c.perKey
+	}
+	c.mtx.Lock()
+	if limit > 0 && c.counts[key] >= limit {
+		c.mtx.Unlock()
+		c.releaseGlobal()
+		return nil, false
+	}
+	c.counts[key]++
+	c.mtx.Unlock()
+
+	return func() {
+		c.mtx.Lock()
+		// idle keys are dropped, so that the map doesn't grow with every
+		// client ever seen
+		if c.counts[key]--; c.counts[key] == 0 {
+			delete(c.counts, key)
+		}
+		c.mtx.Unlock()
+		c.releaseGlobal()
+	}, true
+}
+
+func (c *ConcurrencyLimiter) releaseGlobal() {
+	if c.global != nil {
+		<-c.global
+	}
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	c := NewConcurrencyLimiter(&config.ConcurrencyConfig{
+		MaxRequests: 3,
+		MaxPerKey:   1,
+		Keys: []config.ConcurrencyKey{
+			{Key: "indexer", MaxRequests: 2},
+		},
+	})
+
+	releaseA, ok := c.Acquire("a")
+	require.True(t, ok)
+	_, ok = c.Acquire("a")
+	require.False(t, ok)
+	release1, ok := c.Acquire("indexer")
+	require.True(t, ok)
+	_, ok = c.Acquire("indexer")
+	require.True(t, ok)
+
+	// the listener is at its cap, even for keys below theirs
+	_, ok = c.Acquire("b")
+	require.False(t, ok)
+
+	releaseA()
+	release1()
+	_, ok = c.Acquire("b")
+	require.True(t, ok)
+	_, ok = c.Acquire("a")
+	require.True(t, ok)
+	require.Len(t, c.counts, 3)
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/config"
+)
+
+var corsAllowedHeaders = strings.Join([]string{
+	"Content-Type",
+	"Cache-Control",
+	"Authorization",
+	pkg.APIKeyHeader,
+	pkg.RequestIDHeader,
+	pkg.TagHeader,
+	pkg.DecodeHeader,
+	pkg.FieldsHeader,
+	pkg.DebugHeader,
+}, ", ")
+
+var corsExposedHeaders = strings.Join([]string{
+	pkg.RequestIDHeader,
+	pkg.CacheStatusHeader,
+	pkg.VerifiedHeader,
+	pkg.DebugInfoHeader,
+	pkg.RateLimitLimitHeader,
+	pkg.RateLimitRemainingHeader,
+	pkg.RateLimitResetHeader,
+	pkg.RetryAfterHeader,
+}, ", ")
+
+// withCORS adds CORS headers to responses to allowed origins, and answers
+// preflight requests without passing them to next.
+func withCORS(cfg *config.CORSConfig, next http.Handler) http.Handler {
+	if cfg == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		origin := req.Header.Get("Origin")
+		if origin == "" || !originAllowed(cfg.AllowedOrigins, origin) {
+			next.ServeHTTP(res, req)
+			return
+		}
+
+		res.Header().Set("Access-Control-Allow-Origin", origin)
+		res.Header().Add("Vary", "Origin")
+		res.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		if req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != "" {
+			res.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
+			res.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+			res.Header().Set("Access-Control-Max-Age", "600")
+			res.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(res, req)
+	})
+}
+
+func originAllowed(allowed []string, origin string) bool {
+	for _, o := range allowed {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
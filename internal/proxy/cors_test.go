@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithCORS(t *testing.T) {
+	var called int
+	next := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		called++
+	})
+	h := withCORS(&config.CORSConfig{AllowedOrigins: []string{"https://app.example.com"}}, next)
+
+	req := httptest.NewRequest("OPTIONS", "/eth", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	res := httptest.NewRecorder()
+	h.ServeHTTP(res, req)
+	require.Equal(t, http.StatusNoContent, res.Code)
+	require.Equal(t, "https://app.example.com", res.Header().Get("Access-Control-Allow-Origin"))
+	require.Contains(t, res.Header().Get("Access-Control-Allow-Headers"), "X-Api-Key")
+	require.Equal(t, 0, called)
+
+	req = httptest.NewRequest("POST", "/eth", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	res = httptest.NewRecorder()
+	h.ServeHTTP(res, req)
+	require.Equal(t, "", res.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(t, 1, called)
+
+	h = withCORS(&config.CORSConfig{AllowedOrigins: []string{"*"}}, next)
+	req = httptest.NewRequest("POST", "/eth", nil)
+	req.Header.Set("Origin", "http://localhost:3000")
+	res = httptest.NewRecorder()
+	h.ServeHTTP(res, req)
+	require.Equal(t, "http://localhost:3000", res.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(t, 2, called)
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/kyokan/chaind/pkg/jsonrpc"
+)
+
+// EstimateCostMethod is the extension method clients call to find out what a
+// request would be charged, without sending it.
+const EstimateCostMethod = "chaind_estimateCost"
+
+// CostEstimate is the result of chaind_estimateCost.
+type CostEstimate struct {
+	Cost int `json:"cost"`
+	// Quota is omitted when rate limiting is disabled.
+	Quota *Quota `json:"quota,omitempty"`
+}
+
+type Quota struct {
+	Limit     int `json:"limit"`
+	Remaining int `json:"remaining"`
+	// Reset is the number of seconds until the full quota is available.
+	Reset int `json:"reset"`
+}
+
+// requestMethods returns the methods called by a single or batch request
+// body. Malformed bodies yield no methods.
+func requestMethods(body []byte) []string {
+	if sniffed, ok := jsonrpc.Sniff(body); ok {
+		return []string{string(sniffed.Method)}
+	}
+	if sniffed, ok := jsonrpc.SniffBatch(body); ok {
+		methods := make([]string, 0, len(sniffed))
+		for _, req := range sniffed {
+			methods = append(methods, string(req.Method))
+		}
+		return methods
+	}
+
+	// fall back to a full parse for requests the sniffer can't handle
+	var reqs []struct {
+		Method string `json:"method"`
+	}
+	if err := json.Unmarshal(body, &reqs); err != nil {
+		var single struct {
+			Method string `json:"method"`
+		}
+		if err := json.Unmarshal(body, &single); err != nil {
+			return nil
+		}
+		return []string{single.Method}
+	}
+
+	methods := make([]string, 0, len(reqs))
+	for _, req := range reqs {
+		methods = append(methods, req.Method)
+	}
+	return methods
+}
+
+// handleEstimateCost answers chaind_estimateCost with the cost of the
+// request given as its only param and the client's remaining quota. It is
+// not charged itself.
+func (p *Proxy) handleEstimateCost(res http.ResponseWriter, body []byte, key string) {
+	var rpcReq jsonrpc.Request
+	if err := json.Unmarshal(body, &rpcReq); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var params []json.RawMessage
+	if err := json.Unmarshal(rpcReq.Params, &params); err != nil || len(params) != 1 {
+		failRequest(res, rpcReq.Id, -32602, "expected the request to estimate as the only param")
+		return
+	}
+	methods := requestMethods(params[0])
+	if len(methods) == 0 {
+		failRequest(res, rpcReq.Id, -32602, "invalid request to estimate")
+		return
+	}
+
+	estimate := &CostEstimate{
+		Cost: 1,
+	}
+	if p.limiter != nil {
+		estimate.Cost = p.limiter.Cost(methods)
+		dec := p.limiter.PeekAs(p.rateLimitKeys(key))
+		estimate.Quota = &Quota{
+			Limit:     dec.Limit,
+			Remaining: dec.Remaining,
+			Reset:     ceilSeconds(dec.Reset),
+		}
+	}
+
+	out, err := json.Marshal(estimate)
+	if err != nil {
+		failWithInternalError(res, rpcReq.Id, err)
+		return
+	}
+	if err := writeResponse(res, rpcReq.Id, out); err != nil {
+		logger.Error("failed to write cost estimate", "err", err)
+	}
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/log"
+)
+
+const DefaultDrainTimeout = 30 * time.Second
+
+// InFlight counts the requests currently being proxied to each backend.
+type InFlight struct {
+	counts map[string]int64
+	cond   *sync.Cond
+	mtx    sync.Mutex
+}
+
+func NewInFlight() *InFlight {
+	f := &InFlight{
+		counts: make(map[string]int64),
+	}
+	f.cond = sync.NewCond(&f.mtx)
+	return f
+}
+
+func (f *InFlight) Inc(backend string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.counts[backend]++
+}
+
+func (f *InFlight) Dec(backend string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.counts[backend]--
+	if f.counts[backend] == 0 {
+		delete(f.counts, backend)
+		f.cond.Broadcast()
+	}
+}
+
+func (f *InFlight) Count(backend string) int64 {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.counts[backend]
+}
+
+// Wait blocks until no requests are in flight to the backend, or the timeout
+// expires. It returns the number of requests still in flight.
+func (f *InFlight) Wait(backend string, timeout time.Duration) int64 {
+	timer := time.AfterFunc(timeout, func() {
+		f.mtx.Lock()
+		defer f.mtx.Unlock()
+		f.cond.Broadcast()
+	})
+	defer timer.Stop()
+
+	deadline := time.Now().Add(timeout)
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for f.counts[backend] > 0 && time.Now().Before(deadline) {
+		f.cond.Wait()
+	}
+
+	return f.counts[backend]
+}
+
+type SwitchReport struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Remaining is the number of requests still in flight to the previous
+	// backend when the drain timeout expired.
+	Remaining int64 `json:"remaining"`
+	Drained   bool  `json:"drained"`
+}
+
+// Drainer switches backends gracefully: new requests go to the new backend
+// right away, and the switch completes once the requests in flight to the
+// previous backend have finished. Only HTTP requests are drained: the
+// WebSocket hub moves client subscriptions to the new backend by itself.
+type Drainer struct {
+	sw       BackendSwitch
+	inFlight *InFlight
+	logger   log15.Logger
+}
+
+func NewDrainer(sw BackendSwitch, inFlight *InFlight) *Drainer {
+	return &Drainer{
+		sw:       sw,
+		inFlight: inFlight,
+		logger:   log.NewLog("proxy/drainer"),
+	}
+}
+
+func (d *Drainer) SwitchTo(name string, timeout time.Duration) (*SwitchReport, error) {
+	if timeout == 0 {
+		timeout = DefaultDrainTimeout
+	}
+
+	report := &SwitchReport{
+		To: name,
+	}
+	if old, err := d.sw.BackendFor(pkg.EthBackend); err == nil {
+		report.From = old.Name
+	}
+	if err := d.sw.SwitchTo(pkg.EthBackend, name); err != nil {
+		return nil, err
+	}
+
+	if report.From != "" && report.From != name {
+		d.logger.Info("draining backend", "name", report.From, "timeout", timeout)
+		report.Remaining = d.inFlight.Wait(report.From, timeout)
+	}
+	report.Drained = report.Remaining == 0
+	if !report.Drained {
+		d.logger.Warn("drain timed out", "name", report.From, "remaining", report.Remaining)
+	}
+
+	return report, nil
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+type switchingSwitch struct {
+	staticSwitch
+	curr string
+}
+
+func (s *switchingSwitch) BackendFor(t pkg.BackendType) (*config.Backend, error) {
+	return &config.Backend{Name: s.curr}, nil
+}
+
+func (s *switchingSwitch) SwitchTo(t pkg.BackendType, name string) error {
+	s.curr = name
+	return nil
+}
+
+func TestDrainerWaitsForInFlight(t *testing.T) {
+	inFlight := NewInFlight()
+	inFlight.Inc("old")
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		inFlight.Dec("old")
+	}()
+
+	sw := &switchingSwitch{curr: "old"}
+	report, err := NewDrainer(sw, inFlight).SwitchTo("new", time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "new", sw.curr)
+	require.Equal(t, &SwitchReport{From: "old", To: "new", Drained: true}, report)
+}
+
+func TestDrainerTimesOut(t *testing.T) {
+	inFlight := NewInFlight()
+	inFlight.Inc("old")
+
+	report, err := NewDrainer(&switchingSwitch{curr: "old"}, inFlight).SwitchTo("new", 10*time.Millisecond)
+	require.NoError(t, err)
+	require.False(t, report.Drained)
+	require.Equal(t, int64(1), report.Remaining)
+}
@@ -9,7 +9,6 @@ import (
 	"github.com/kyokan/chaind/pkg/log"
 	"time"
 	"io/ioutil"
-	"bytes"
 	"fmt"
 	"strconv"
 	"github.com/pkg/errors"
@@ -18,6 +17,17 @@ import (
 	"github.com/kyokan/chaind/pkg/config"
 	"encoding/binary"
 	"strings"
+	"github.com/kyokan/chaind/internal/archive"
+	"github.com/kyokan/chaind/internal/blockindex"
+	"github.com/kyokan/chaind/internal/stats"
+	"github.com/kyokan/chaind/internal/chaos"
+	"github.com/kyokan/chaind/internal/bodylog"
+	"github.com/kyokan/chaind/internal/txtrack"
+	"github.com/kyokan/chaind/internal/headerchain"
+	"context"
+	"math"
+	chainderrors "github.com/kyokan/chaind/pkg/errors"
+	"github.com/kyokan/chaind/internal/wsproxy"
 )
 
 type beforeFunc func(res http.ResponseWriter, req *http.Request, rpcReq *jsonrpc.Request) bool
@@ -28,25 +38,69 @@ type handler struct {
 	after  afterFunc
 }
 
+var errBadUpstreamResponse = errors.New("bad upstream response")
+
 type EthHandler struct {
+	sw       BackendSwitch
 	cacher   cache.Cacher
+	// tenants namespaces the cache entries of multi-tenant deployments
+	tenants  *cache.Tenants
+	archive  archive.Archive
 	auditor  audit.Auditor
 	hWatcher *BlockHeightWatcher
+	stats    *stats.Store
 	handlers map[string]*handler
 	logger   log15.Logger
 	client   *http.Client
+	gasCfg   *config.EstimateGasConfig
+	pins     *PinStore
+	// filters remembers the backend that created each filter
+	filters  *PinStore
+	inFlight *InFlight
+	bulkhead *Bulkhead
+	faults   *chaos.Injector
+	coalescer *Coalescer
+	txTracker *txtrack.Tracker
+	headers   *headerchain.Chain
+	retrier   *Retrier
+	mempool   *config.MempoolConfig
+	prewarmCfg *config.PrewarmConfig
+	blocks    *blockindex.Index
+	bodies    *bodylog.Sampler
+	summaries *chainSummarizer
+	// rejectMismatches fails responses that don't match the verified header
+	// chain, instead of only flagging them
+	rejectMismatches bool
 }
 
-func NewEthHandler(cacher cache.Cacher, auditor audit.Auditor, hWatcher *BlockHeightWatcher) *EthHandler {
+func NewEthHandler(sw BackendSwitch, cacher cache.Cacher, arch archive.Archive, auditor audit.Auditor, hWatcher *BlockHeightWatcher, statsStore *stats.Store, gasCfg *config.EstimateGasConfig, rawCfg *config.ReadAfterWriteConfig, bhCfg *config.BulkheadConfig, coCfg *config.CoalesceConfig) *EthHandler {
 	h := &EthHandler{
+		sw:       sw,
 		cacher:   cacher,
+		archive:  arch,
 		auditor:  auditor,
 		hWatcher: hWatcher,
+		stats:    statsStore,
 		logger:   log.NewLog("proxy/eth_handler"),
 		client: &http.Client{
 			Timeout: time.Second,
 		},
+		gasCfg:   gasCfg,
+		filters:  NewPinStore(filterWindow),
+		inFlight: NewInFlight(),
+	}
+	if rawCfg != nil {
+		h.pins = NewPinStore(rawCfg.Window)
+	}
+	if bhCfg != nil {
+		h.bulkhead = NewBulkhead(bhCfg)
 	}
+	var coalesceWait time.Duration
+	if coCfg != nil {
+		coalesceWait = coCfg.MaxWait
+	}
+	h.coalescer = NewCoalescer(coalesceWait)
+	h.summaries = newChainSummarizer(sw)
 	h.handlers = map[string]*handler{
 		"eth_blockNumber": {
 			before: h.hdlBlockNumberBefore,
@@ -63,6 +117,24 @@ func NewEthHandler(cacher cache.Cacher, auditor audit.Auditor, hWatcher *BlockHe
 			before: h.hdlGetBalanceBefore,
 			after: h.hdlGetBalanceAfter,
 		},
+		"eth_getBlockByHash": {
+			before: h.hdlGetBlockByHashBefore,
+		},
+		"eth_getTransactionByHash": {
+			before: h.hdlGetTransactionByHashBefore,
+		},
+		"trace_transaction": {
+			before: h.hdlTraceTransactionBefore,
+			after:  h.hdlTraceTransactionAfter,
+		},
+		"ots_getBlockDetails": {
+			before: h.hdlOtsGetBlockDetailsBefore,
+			after:  h.hdlOtsGetBlockDetailsAfter,
+		},
+		"ots_getBlockDetailsByHash": {
+			before: h.hdlOtsGetBlockDetailsBefore,
+			after:  h.hdlOtsGetBlockDetailsAfter,
+		},
 	}
 	return h
 }
@@ -80,8 +152,7 @@ func (h *EthHandler) Handle(res http.ResponseWriter, req *http.Request, backend
 	// check if this is a batch request
 	if firstChar == "[" {
 		h.logger.Debug("got batch request", log.WithRequestID(ctx)...)
-		var rpcReqs []jsonrpc.Request
-		err = json.Unmarshal(body, &rpcReqs)
+		rpcReqs, err := jsonrpc.ParseBatch(body)
 		if err != nil {
 			h.logger.Warn("received mal-formed batch request", log.WithRequestID(ctx, "err", err)...)
 			res.WriteHeader(http.StatusBadRequest)
@@ -89,67 +160,272 @@ func (h *EthHandler) Handle(res http.ResponseWriter, req *http.Request, backend
 		}
 
 		batch := pkg.NewBatchResponse(res)
+		var notifications int
 		for _, rpcReq := range rpcReqs {
-			h.hdlRPCRequest(batch.ResponseWriter(), req, backend, &rpcReq)
+			// notifications are forwarded, but get no entry in the batch
+			// response
+			w := batch.ResponseWriter
+			if rpcReq.IsNotification() {
+				notifications++
+				w = discardWriter
+			}
+			if ctx.Err() == context.DeadlineExceeded {
+				failTimedOut(w(), rpcReq.Id)
+				continue
+			}
+			if ctx.Err() != nil {
+				h.logger.Debug("client went away, abandoning remainder of batch", log.WithRequestID(ctx, "err", ctx.Err())...)
+				return
+			}
+			h.hdlRPCRequest(w(), req, backend, &rpcReq)
 		}
-		if err := batch.Flush(); err != nil {
-			h.logger.Error("failed to flush batch", log.WithRequestID(ctx, "err", err)...)
+		if len(rpcReqs) > 0 && notifications == len(rpcReqs) {
+			res.WriteHeader(http.StatusNoContent)
+		} else {
+			// like single requests, batches that ran out of time are
+			// answered with a 504, along with the responses served in time
+			if ctx.Err() == context.DeadlineExceeded {
+				res.WriteHeader(http.StatusGatewayTimeout)
+			}
+			if err := batch.Flush(); err != nil {
+				h.logger.Error("failed to flush batch", log.WithRequestID(ctx, "err", err)...)
+			}
 		}
 
 		h.logger.Debug("processed batch request", log.WithRequestID(ctx, "count", len(rpcReqs))...)
 	} else {
 		h.logger.Debug("got single request", log.WithRequestID(ctx, "err", err)...)
-		var rpcReq jsonrpc.Request
-		err = json.Unmarshal(body, &rpcReq)
+		rpcReq, err := jsonrpc.ParseRequest(body)
 		if err != nil {
 			h.logger.Warn("received mal-formed request", log.WithRequestID(ctx, "err", err)...)
 			res.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		if rpcReq.IsNotification() {
+			h.hdlRPCRequest(discardWriter(), req, backend, &rpcReq)
+			res.WriteHeader(http.StatusNoContent)
+			return
+		}
 		h.hdlRPCRequest(res, req, backend, &rpcReq)
 	}
 }
 
+// discardWriter returns a writer for the responses to notifications, which
+// are not sent to the client.
+func discardWriter() http.ResponseWriter {
+	return pkg.NewInterceptor()
+}
+
 func (h *EthHandler) hdlRPCRequest(res http.ResponseWriter, req *http.Request, backend *config.Backend, rpcReq *jsonrpc.Request) {
 	ctx := req.Context()
+	start := time.Now()
+	// failure is the kind of error the request failed with, if any
+	var failure string
+	var usedBackend string
+	defer func() {
+		tag, _ := ctx.Value(log.TagKey).(string)
+		client, _ := ctx.Value(log.ClientKey).(string)
+		h.stats.Record(&stats.Event{
+			Tag:     tag,
+			Client:  client,
+			Method:  rpcReq.Method,
+			Backend: usedBackend,
+			Elapsed: time.Since(start),
+			Failed:  failure != "",
+			Error:   failure,
+		})
+	}()
+
 	body, err := json.Marshal(rpcReq)
 	if err != nil {
 		h.logger.Error("failed to unmarshal request body", log.WithRequestID(ctx, "err", err)...)
 		return
 	}
 
+	// responses are captured after any transformation, i.e. as the client
+	// receives them
+	if h.bodies != nil && h.bodies.Sample(rpcReq.Method) {
+		w := &bodyLogWriter{ResponseWriter: res}
+		defer h.logBodies(ctx, rpcReq, body, w)
+		res = w
+	}
+
+	if req.Header.Get(pkg.DecodeHeader) == "true" || req.Header.Get(pkg.FieldsHeader) != "" {
+		interceptor := pkg.NewInterceptor()
+		defer h.writeTransformed(res, req, interceptor, rpcReq.Method)
+		res = interceptor
+	}
+
 	err = h.auditor.RecordRequest(req, body, pkg.EthBackend)
 	if err != nil {
 		h.logger.Error("failed to record audit log for request", log.WithRequestID(ctx, "err", err)...)
 	}
 
+	if rpcReq.Method == ChainSummaryMethod {
+		h.hdlChainSummary(res, req, rpcReq)
+		return
+	}
+	// subscriptions are held by the WebSocket connection the request arrived
+	// on; over HTTP they are forwarded, and fail as usual
+	if call := wsproxy.CallFrom(ctx); call != nil && wsproxy.IsSubscriptionMethod(rpcReq.Method) {
+		h.hdlSubscription(res, req, rpcReq, call)
+		return
+	}
+
+	// caches are keyed on the normalized request, so that requests that only
+	// differ in e.g. address casing share entries; the client's body is still
+	// forwarded as is
+	keyReq := rpcReq.Normalized()
 	hdlr := h.handlers[rpcReq.Method]
+	// notifications must reach the backend, so they are neither served from
+	// the cache nor post-processed
+	if rpcReq.IsNotification() {
+		hdlr = nil
+	}
 	handledInBefore := false
-	if hdlr != nil && hdlr.before != nil {
-		handledInBefore = hdlr.before(res, req, rpcReq)
+	bypassCache, _ := ctx.Value(cacheBypassKey{}).(bool)
+	if hdlr != nil && hdlr.before != nil && !bypassCache {
+		handledInBefore = hdlr.before(res, req, keyReq)
 	}
 	if handledInBefore {
+		traceFrom(ctx).cache(true)
 		h.logger.Debug("request handled in before filter", log.WithRequestID(ctx)...)
 		return
 	}
 
-	proxyRes, err := h.client.Post(backend.URL, "application/json", bytes.NewReader(body))
-	if err != nil || proxyRes.StatusCode != 200 {
-		failRequest(res, rpcReq.Id, -32602, "bad request")
-		return
+	clientKey, _ := ctx.Value(log.ClientKey).(string)
+	if h.pins != nil && isPinnedMethod(rpcReq.Method) {
+		if pinned := h.pins.Get(clientKey); pinned != nil {
+			h.logger.Debug("using pinned backend", log.WithRequestID(ctx, "backend", pinned.Name)...)
+			backend = pinned
+		}
 	}
-	defer proxyRes.Body.Close()
 
-	resBody, err := ioutil.ReadAll(proxyRes.Body)
+	// mempool views differ across nodes, so mempool queries stick to the
+	// designated mempool node
+	if h.mempool != nil && isMempoolQuery(keyReq) {
+		if mempool := h.mempoolBackend(); mempool != nil {
+			backend = mempool
+		} else {
+			h.logger.Warn("no mempool backend is healthy", log.WithRequestID(ctx)...)
+		}
+	}
+
+	// filters only exist on the node that created them, wherever their
+	// creation was routed
+	if id, ok := filterID(rpcReq); ok {
+		if owner := h.filters.Get(id); owner != nil {
+			h.logger.Debug("routing filter request to its backend", log.WithRequestID(ctx, "filter", id, "backend", owner.Name)...)
+			backend = owner
+			h.filters.Pin(id, owner)
+		}
+	}
+
+	if ns := methodNamespace(rpcReq.Method); ns != "" {
+		capable := h.capableBackend(backend, ns)
+		if capable == nil {
+			h.logger.Info("rejected request, no backend serves its namespace", log.WithRequestID(ctx, "namespace", ns)...)
+			failure = stats.ErrorRejected
+			failRequest(res, rpcReq.Id, chainderrors.BackendUnavailable, fmt.Sprintf("the %s namespace is not served by any available backend", ns))
+			return
+		}
+		backend = capable
+	}
+
+	if h.bulkhead != nil {
+		release, ok := h.bulkhead.Acquire(ctx, rpcReq.Method)
+		if !ok && ctx.Err() == context.DeadlineExceeded {
+			failure = stats.ErrorTimeout
+			failTimedOut(res, rpcReq.Id)
+			return
+		}
+		if !ok {
+			class := MethodClass(rpcReq.Method)
+			h.logger.Info("rejected request, method class is busy", log.WithRequestID(ctx, "class", class)...)
+			failure = stats.ErrorRejected
+			failBulkheadFull(res, rpcReq.Id, class)
+			return
+		}
+		defer release()
+	}
+
+	usedBackend = backend.Name
+	traceFrom(ctx).servedBy(backend.Name)
+	fetch := func() ([]byte, error) {
+		if rpcReq.IsNotification() {
+			return h.forward(ctx, backend, body)
+		} else if rpcReq.Method == "eth_estimateGas" && h.gasCfg != nil {
+			return h.estimateGas(ctx, backend, body)
+		} else if hdlr != nil && hdlr.after != nil && !bypassCache {
+			return h.forwardCoalesced(ctx, backend, keyReq, body)
+		}
+		return h.forward(ctx, backend, body)
+	}
+	var resBody []byte
+	if h.retrier != nil {
+		resBody, err = h.retrier.Do(ctx, rpcReq.Method, fetch)
+	} else {
+		resBody, err = fetch()
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		h.logger.Info("request timed out", log.WithRequestID(ctx, "backend", backend.Name)...)
+		failure = stats.ErrorTimeout
+		failTimedOut(res, rpcReq.Id)
+		return
+	}
+	if err != nil && ctx.Err() != nil {
+		h.logger.Debug("client went away, cancelled upstream request", log.WithRequestID(ctx, "err", ctx.Err())...)
+		return
+	}
+	if err == errUpstreamUnreachable {
+		failure = stats.ErrorUnreachable
+		failRequest(res, rpcReq.Id, chainderrors.BackendUnavailable, "backend is unreachable")
+		return
+	}
+	if err == errBadUpstreamResponse {
+		failure = stats.ErrorBadResponse
+		failRequest(res, rpcReq.Id, chainderrors.BadResponse, "backend returned an invalid response")
+		return
+	}
 	if err != nil {
+		failure = stats.ErrorInternal
+		h.logger.Error("failed to read body", log.WithRequestID(ctx, "err", err)...)
 		failWithInternalError(res, rpcReq.Id, err)
-		h.logger.Error("failed to read body", log.WithRequestID(ctx, "err", err))
+		return
+	}
+	if rpcReq.IsNotification() {
+		h.logger.Debug("forwarded notification", log.WithRequestID(ctx, "backend", backend.Name)...)
+		return
+	}
+	if len(resBody) == 0 {
+		failure = stats.ErrorBadResponse
+		h.logger.Debug("upstream returned no response to a request", log.WithRequestID(ctx, "backend", backend.Name)...)
+		failRequest(res, rpcReq.Id, chainderrors.BadResponse, "backend returned an empty response")
+		return
+	}
+
+	mismatch := false
+	if h.headers != nil {
+		switch h.verify(rpcReq.Method, resBody) {
+		case headerchain.Match:
+			res.Header().Set(pkg.VerifiedHeader, pkg.VerifiedMatch)
+		case headerchain.Mismatch:
+			h.logger.Warn("response doesn't match the verified header chain", log.WithRequestID(ctx, "backend", backend.Name, "method", rpcReq.Method)...)
+			if h.rejectMismatches {
+				failure = stats.ErrorMismatch
+				failRequest(res, rpcReq.Id, chainderrors.BadResponse, "response doesn't match the canonical chain")
+				return
+			}
+			mismatch = true
+			res.Header().Set(pkg.VerifiedHeader, pkg.VerifiedMismatch)
+		}
 	}
 
+	traceFrom(ctx).cache(false)
+	res.Header().Set(pkg.CacheStatusHeader, pkg.CacheMiss)
 	res.Write(resBody)
-	if err != nil {
-		h.logger.Error("failed to flush proxied request", log.WithRequestID(ctx, "err", err)...)
-		failWithInternalError(res, rpcReq.Id, err)
+	if mismatch {
+		h.logger.Debug("skipping post-processors for unverified response", log.WithRequestID(ctx)...)
 		return
 	}
 
@@ -159,9 +435,32 @@ func (h *EthHandler) hdlRPCRequest(res http.ResponseWriter, req *http.Request, b
 		h.logger.Debug("skipping post-processors for error response", log.WithRequestID(ctx)...)
 		return
 	}
+	// error responses have no result for the post-processors to parse
+	if rpcRes.Error != nil {
+		h.logger.Debug("skipping post-processors for JSON-RPC error", log.WithRequestID(ctx, "code", rpcRes.Error.Code)...)
+		return
+	}
+
+	if h.pins != nil && rpcReq.Method == "eth_sendRawTransaction" && clientKey != "" {
+		h.logger.Debug("pinning client to backend", log.WithRequestID(ctx, "backend", backend.Name)...)
+		h.pins.Pin(clientKey, backend)
+	}
+	if isFilterCreation(rpcReq.Method) {
+		var id string
+		if err := json.Unmarshal(rpcRes.Result, &id); err == nil && id != "" {
+			h.filters.Pin(strings.ToLower(id), backend)
+		}
+	}
+	if h.txTracker != nil && rpcReq.Method == "eth_sendRawTransaction" {
+		var hash string
+		if err := json.Unmarshal(rpcRes.Result, &hash); err == nil && hash != "" {
+			h.logger.Debug("tracking transaction", log.WithRequestID(ctx, "hash", hash)...)
+			h.txTracker.Track(hash, clientKey)
+		}
+	}
 
 	if hdlr != nil && hdlr.after != nil {
-		if err := hdlr.after(&rpcRes, rpcReq, req); err != nil {
+		if err := hdlr.after(&rpcRes, keyReq, req); err != nil {
 			h.logger.Error("request post-processing failed", log.WithRequestID(ctx, "err", err)...)
 		}
 	} else {
@@ -170,6 +469,247 @@ func (h *EthHandler) hdlRPCRequest(res http.ResponseWriter, req *http.Request, b
 
 }
 
+// writeTransformed writes the response captured by the interceptor to res,
+// pruned to the requested fields and augmented with decoded hex quantities.
+func (h *EthHandler) writeTransformed(res http.ResponseWriter, req *http.Request, interceptor *pkg.Interceptor, method string) {
+	for k, v := range interceptor.Header() {
+		res.Header()[k] = v
+	}
+	if interceptor.StatusCode() != 0 {
+		res.WriteHeader(interceptor.StatusCode())
+	}
+
+	body := interceptor.Body()
+	if len(body) == 0 {
+		return
+	}
+	if fields := jsonrpc.ParseFields(req.Header.Get(pkg.FieldsHeader)); len(fields) > 0 {
+		filtered, err := jsonrpc.FilterResultFields(body, fields)
+		if err != nil {
+			h.logger.Debug("failed to filter response fields, sending as is", log.WithRequestID(req.Context(), "err", err)...)
+		} else {
+			body = filtered
+		}
+	}
+	if req.Header.Get(pkg.DecodeHeader) == "true" {
+		decoded, err := jsonrpc.AddDecodedQuantities(method, body)
+		if err != nil {
+			h.logger.Debug("failed to decode response, sending as is", log.WithRequestID(req.Context(), "err", err)...)
+		} else {
+			body = decoded
+		}
+	}
+	res.Write(body)
+}
+
+// forward sends body to the backend and returns the raw response body.
+func (h *EthHandler) forward(ctx context.Context, backend *config.Backend, body []byte) ([]byte, error) {
+	h.inFlight.Inc(backend.Name)
+	defer h.inFlight.Dec(backend.Name)
+	start := time.Now()
+	defer func() {
+		traceFrom(ctx).upstreamRequest(time.Since(start))
+	}()
+
+	if h.faults != nil {
+		if delay := h.faults.Latency(backend.Name); delay > 0 {
+			h.logger.Debug("delaying upstream request, injected fault", log.WithRequestID(ctx, "backend", backend.Name, "delay", delay)...)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+
+	body, err := translateRequest(backend, body)
+	if err != nil {
+		h.logger.Error("failed to translate request", log.WithRequestID(ctx, "backend", backend.Name, "err", err)...)
+		return nil, err
+	}
+	// tie the upstream request to the client's context so that a disconnect
+	// cancels it instead of leaving e.g. a heavy eth_getLogs running upstream
+	proxyReq, err := newUpstreamRequest(ctx, backend, body)
+	if err != nil {
+		return nil, err
+	}
+	client, err := backendClient(backend, h.client)
+	if err != nil {
+		h.logger.Error("failed to configure backend client", log.WithRequestID(ctx, "backend", backend.Name, "err", err)...)
+		return nil, err
+	}
+	proxyRes, err := client.Do(proxyReq)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		h.logger.Debug("upstream request failed", log.WithRequestID(ctx, "backend", backend.Name, "err", err)...)
+		if isDialError(err) {
+			return nil, errUpstreamUnreachable
+		}
+		return nil, errBadUpstreamResponse
+	}
+	defer proxyRes.Body.Close()
+	// backends may answer notifications with no content
+	if proxyRes.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	if proxyRes.StatusCode != 200 {
+		h.logger.Debug("upstream returned non-200 response", log.WithRequestID(ctx, "backend", backend.Name, "status", proxyRes.StatusCode)...)
+		return nil, errBadUpstreamResponse
+	}
+
+	resBody, err := ioutil.ReadAll(proxyRes.Body)
+	if err == nil && h.faults != nil && h.faults.Drop(backend.Name) {
+		h.logger.Debug("dropping upstream response, injected fault", log.WithRequestID(ctx, "backend", backend.Name)...)
+		return nil, errBadUpstreamResponse
+	}
+	return resBody, err
+}
+
+// verify checks the block hash in a block, transaction or receipt response
+// against the verified header chain.
+func (h *EthHandler) verify(method string, resBody []byte) headerchain.Result {
+	numberField, hashField := "number", "hash"
+	switch method {
+	case "eth_getBlockByNumber", "eth_getBlockByHash":
+	case "eth_getTransactionByHash", "eth_getTransactionReceipt":
+		numberField, hashField = "blockNumber", "blockHash"
+	default:
+		return headerchain.Unknown
+	}
+
+	var rpcRes jsonrpc.Response
+	if err := json.Unmarshal(resBody, &rpcRes); err != nil || rpcRes.Error != nil {
+		return headerchain.Unknown
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(rpcRes.Result, &fields); err != nil || fields == nil {
+		return headerchain.Unknown
+	}
+	hexNum, _ := fields[numberField].(string)
+	hash, _ := fields[hashField].(string)
+	if hexNum == "" || hash == "" {
+		return headerchain.Unknown
+	}
+	number, err := jsonrpc.Hex2Uint64(hexNum)
+	if err != nil {
+		return headerchain.Unknown
+	}
+	return h.headers.Verify(number, hash)
+}
+
+// forwardCoalesced forwards a cacheable request, sharing the upstream fetch
+// with concurrent identical requests to the same backend.
+func (h *EthHandler) forwardCoalesced(ctx context.Context, backend *config.Backend, rpcReq *jsonrpc.Request, body []byte) ([]byte, error) {
+	key := backend.Name + ":" + rpcReq.Method + ":" + string(rpcReq.Params)
+	resBody, shared, err := h.coalescer.Do(ctx, key, func() ([]byte, error) {
+		resBody, err := h.forward(ctx, backend, body)
+		if err != nil && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return resBody, err
+	})
+	if err != nil || !shared {
+		return resBody, err
+	}
+
+	h.logger.Debug("sharing coalesced upstream response", log.WithRequestID(ctx, "method", rpcReq.Method)...)
+	// the shared response carries the id of the request that fetched it
+	var rpcRes jsonrpc.Response
+	if err := json.Unmarshal(resBody, &rpcRes); err != nil {
+		return resBody, nil
+	}
+	rpcRes.Id = rpcReq.Id
+	return json.Marshal(rpcRes)
+}
+
+// estimateGas forwards an eth_estimateGas request, optionally falling back to
+// the other healthy backends when the active one fails, and scales the
+// estimate by the configured multiplier. Reverted executions fail the same
+// way on every backend, so they aren't retried.
+func (h *EthHandler) estimateGas(ctx context.Context, backend *config.Backend, body []byte) ([]byte, error) {
+	candidates := []config.Backend{*backend}
+	if h.gasCfg.Fallback {
+		healthy := h.healthyBackends()
+		for _, b := range h.sw.Backends(pkg.EthBackend) {
+			if b.Name != backend.Name && healthy[b.Name] {
+				candidates = append(candidates, b)
+			}
+		}
+	}
+
+	var lastBody []byte
+	var lastErr error
+	for i := range candidates {
+		candidate := &candidates[i]
+		resBody, err := h.forward(ctx, candidate, body)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			lastErr = err
+			h.logger.Warn("eth_estimateGas failed, trying next backend", log.WithRequestID(ctx, "backend", candidate.Name, "err", err)...)
+			continue
+		}
+
+		var rpcRes jsonrpc.Response
+		if err := json.Unmarshal(resBody, &rpcRes); err != nil {
+			lastErr = errBadUpstreamResponse
+			h.logger.Warn("eth_estimateGas returned invalid JSON, trying next backend", log.WithRequestID(ctx, "backend", candidate.Name)...)
+			continue
+		}
+		if rpcRes.Error != nil && isRevert(rpcRes.Error) {
+			h.logger.Debug("eth_estimateGas execution reverted, not falling back", log.WithRequestID(ctx, "backend", candidate.Name)...)
+			return resBody, nil
+		}
+		if rpcRes.Error != nil {
+			lastBody = resBody
+			h.logger.Warn("eth_estimateGas returned an error, trying next backend", log.WithRequestID(ctx, "backend", candidate.Name, "code", rpcRes.Error.Code)...)
+			continue
+		}
+
+		return h.applyGasMultiplier(ctx, &rpcRes, resBody), nil
+	}
+
+	if lastBody != nil {
+		return lastBody, nil
+	}
+	return nil, lastErr
+}
+
+// isRevert returns whether an error reports a reverted execution. Geth and
+// its forks use code 3, other nodes only say so in the message.
+func isRevert(err *jsonrpc.ErrorData) bool {
+	return err.Code == 3 || strings.Contains(strings.ToLower(err.Message), "revert")
+}
+
+func (h *EthHandler) applyGasMultiplier(ctx context.Context, rpcRes *jsonrpc.Response, resBody []byte) []byte {
+	if h.gasCfg.Multiplier <= 1 {
+		return resBody
+	}
+
+	var hexGas string
+	if err := json.Unmarshal(rpcRes.Result, &hexGas); err != nil {
+		h.logger.Warn("eth_estimateGas returned a non-string result, not applying multiplier", log.WithRequestID(ctx)...)
+		return resBody
+	}
+	gas, err := jsonrpc.Hex2Uint64(hexGas)
+	if err != nil {
+		h.logger.Warn("eth_estimateGas returned an invalid result, not applying multiplier", log.WithRequestID(ctx, "result", hexGas)...)
+		return resBody
+	}
+
+	scaled := uint64(math.Ceil(float64(gas) * h.gasCfg.Multiplier))
+	rpcRes.Result = []byte("\"" + jsonrpc.Uint642Hex(scaled) + "\"")
+	out, err := json.Marshal(rpcRes)
+	if err != nil {
+		return resBody
+	}
+	h.logger.Debug("applied eth_estimateGas multiplier", log.WithRequestID(ctx, "estimate", gas, "scaled", scaled)...)
+	return out
+}
+
 func (h *EthHandler) hdlBlockNumberBefore(res http.ResponseWriter, req *http.Request, rpcReq *jsonrpc.Request) bool {
 	ctx := req.Context()
 	h.logger.Debug("pre-processing eth_blockNumber", log.WithRequestID(ctx)...)
@@ -216,7 +756,7 @@ func (h *EthHandler) hdlGetBlockByNumberBefore(res http.ResponseWriter, req *htt
 
 	cacheKey := blockNumCacheKey(blockNum, includeBodies)
 	h.logger.Debug("checking block number cache", log.WithRequestID(ctx, "cache_key", cacheKey)...)
-	cached, err := h.cacher.Get(cacheKey)
+	cached, err := h.cacherFor(req).Get(cacheKey)
 	if err == nil && cached != nil {
 		err = writeResponse(res, rpcReq.Id, cached)
 		if err != nil {
@@ -231,6 +771,11 @@ func (h *EthHandler) hdlGetBlockByNumberBefore(res http.ResponseWriter, req *htt
 		h.logger.Error("failed to get block from cache", log.WithRequestID(ctx, "err", err)...)
 	}
 
+	if h.writeArchived(res, req, rpcReq, cacheKey) {
+		h.logger.Debug("found archived block by number response, sending", log.WithRequestID(ctx)...)
+		return true
+	}
+
 	h.logger.Debug("found no blocks in block number cache", log.WithRequestID(ctx)...)
 	return false
 }
@@ -268,7 +813,8 @@ func (h *EthHandler) hdlGetBlockByNumberAfter(rpcRes *jsonrpc.Response, rpcReq *
 	}
 
 	cacheKey := blockNumCacheKey(blockNum, includeBodies)
-	err = h.cacher.SetEx(cacheKey, rpcRes.Result, expiry)
+	h.archiveResult(req, cacheKey, rpcRes.Result)
+	err = h.cacherFor(req).SetEx(cacheKey, rpcRes.Result, expiry)
 	if err != nil {
 		h.logger.Debug("post-processing failed while writing to cache", log.WithRequestID(ctx, "err", err)...)
 		return err
@@ -298,7 +844,7 @@ func (h *EthHandler) hdlGetTransactionReceiptBefore(res http.ResponseWriter, req
 
 	cacheKey := txReceiptCacheKey(hash)
 	h.logger.Debug("checking transaction receipt cache", log.WithRequestID(ctx, "cache_key", cacheKey)...)
-	cached, err := h.cacher.Get(cacheKey)
+	cached, err := h.cacherFor(req).Get(cacheKey)
 	if err == nil && cached != nil {
 		err = writeResponse(res, rpcReq.Id, cached)
 		if err != nil {
@@ -313,6 +859,11 @@ func (h *EthHandler) hdlGetTransactionReceiptBefore(res http.ResponseWriter, req
 		h.logger.Error("failed to get tx receipt from cache", log.WithRequestID(ctx, "err", err)...)
 	}
 
+	if h.writeArchived(res, req, rpcReq, cacheKey) {
+		h.logger.Debug("found archived tx receipt response, sending", log.WithRequestID(ctx)...)
+		return true
+	}
+
 	h.logger.Debug("found no tx receipts in tx receipt cache", log.WithRequestID(ctx)...)
 	return false
 }
@@ -353,7 +904,8 @@ func (h *EthHandler) hdlGetTransactionReceiptAfter(rpcRes *jsonrpc.Response, rpc
 	}
 
 	cacheKey := txReceiptCacheKey(txHash)
-	err = h.cacher.SetEx(cacheKey, rpcRes.Result, expiry)
+	h.archiveResult(req, cacheKey, rpcRes.Result)
+	err = h.cacherFor(req).SetEx(cacheKey, rpcRes.Result, expiry)
 	if err != nil {
 		h.logger.Debug("post-processing failed while writing to cache", log.WithRequestID(ctx, "err", err)...)
 		return err
@@ -377,12 +929,12 @@ func (h *EthHandler) hdlGetBalanceBefore(res http.ResponseWriter, req *http.Requ
 		return false
 	}
 
-	if reqBlockNum != "latest" {
+	if !h.isLatest(reqBlockNum) {
 		return false
 	}
 
 	ck := balanceCacheKey(addr)
-	cachedHeightBytes, err := h.cacher.MapGet(ck, "blockNumber")
+	cachedHeightBytes, err := h.cacherFor(req).MapGet(ck, "blockNumber")
 	if err != nil {
 		h.logger.Error("encountered error fetching blockNum from balance cache", log.WithRequestID(ctx, "err", err)...)
 		return false
@@ -397,7 +949,7 @@ func (h *EthHandler) hdlGetBalanceBefore(res http.ResponseWriter, req *http.Requ
 		return false
 	}
 
-	cached, err := h.cacher.MapGet(ck, "balance")
+	cached, err := h.cacherFor(req).MapGet(ck, "balance")
 	if err != nil {
 		h.logger.Error("encountered error fetching balance from balance cache", log.WithRequestID(ctx, "err", err)...)
 		return false
@@ -430,7 +982,7 @@ func (h *EthHandler) hdlGetBalanceAfter(rpcRes *jsonrpc.Response, rpcReq *jsonrp
 		h.logger.Debug("skipping mal-formed request height", log.WithRequestID(ctx, "err", err)...)
 		return err
 	}
-	if reqHeight != "latest" {
+	if !h.isLatest(reqHeight) {
 		h.logger.Debug("skipping non-latest block height balance", log.WithRequestID(ctx, "addr", addr, "req_height", reqHeight)...)
 		return nil
 	}
@@ -445,7 +997,228 @@ func (h *EthHandler) hdlGetBalanceAfter(rpcRes *jsonrpc.Response, rpcReq *jsonrp
 	}
 	cacheKey := balanceCacheKey(addr)
 	h.logger.Debug("stored request in balance cache", log.WithRequestID(ctx, "cache_key", cacheKey, "size", len(rpcRes.Result))...)
-	return h.cacher.MapSetEx(cacheKey, toCache, time.Minute)
+	return h.cacherFor(req).MapSetEx(cacheKey, toCache, time.Minute)
+}
+
+// hdlGetBlockByHashBefore answers lookups of recent blocks from the block
+// index. Blocks missing from the index are looked up upstream, since they
+// may just be older than the index.
+func (h *EthHandler) hdlGetBlockByHashBefore(res http.ResponseWriter, req *http.Request, rpcReq *jsonrpc.Request) bool {
+	if h.blocks == nil {
+		return false
+	}
+
+	ctx := req.Context()
+	params := rpcReq.ParamsPather()
+	hash, err := params.GetString("0")
+	if err != nil {
+		return false
+	}
+	full, err := params.GetBool("1")
+	if err != nil {
+		return false
+	}
+	block := h.blocks.Block(hash, full)
+	if block == nil {
+		return false
+	}
+
+	if err := writeResponse(res, rpcReq.Id, block); err != nil {
+		h.logger.Error("failed to write indexed response", log.WithRequestID(ctx, "err", err)...)
+		return false
+	}
+	h.logger.Debug("found indexed block by hash, sending", log.WithRequestID(ctx)...)
+	return true
+}
+
+// hdlGetTransactionByHashBefore answers lookups of transactions in recent
+// blocks from the block index.
+func (h *EthHandler) hdlGetTransactionByHashBefore(res http.ResponseWriter, req *http.Request, rpcReq *jsonrpc.Request) bool {
+	if h.blocks == nil {
+		return false
+	}
+
+	ctx := req.Context()
+	hash, err := rpcReq.ParamsPather().GetString("0")
+	if err != nil {
+		return false
+	}
+	tx := h.blocks.Transaction(hash)
+	if tx == nil {
+		return false
+	}
+
+	if err := writeResponse(res, rpcReq.Id, tx); err != nil {
+		h.logger.Error("failed to write indexed response", log.WithRequestID(ctx, "err", err)...)
+		return false
+	}
+	h.logger.Debug("found indexed transaction, sending", log.WithRequestID(ctx)...)
+	return true
+}
+
+// cacherFor returns the cacher of the tenant the request's client belongs
+// to, or the shared cacher.
+func (h *EthHandler) cacherFor(req *http.Request) cache.Cacher {
+	if h.tenants == nil {
+		return h.cacher
+	}
+	key, _ := req.Context().Value(log.ClientKey).(string)
+	if tenant := h.tenants.For(key); tenant != nil {
+		return tenant
+	}
+	return h.cacher
+}
+
+// isLatest returns whether a block parameter is the "latest" tag. Numbers
+// don't count even when they equal the current height, since the head may
+// advance before the response is cached as the latest state.
+func (h *EthHandler) isLatest(blockNum string) bool {
+	return blockNum == "latest"
+}
+
+func (h *EthHandler) hdlTraceTransactionBefore(res http.ResponseWriter, req *http.Request, rpcReq *jsonrpc.Request) bool {
+	ctx := req.Context()
+	h.logger.Debug("pre-processing trace_transaction", log.WithRequestID(ctx)...)
+	hash, err := rpcReq.ParamsPather().GetString("0")
+	if err != nil {
+		h.logger.Debug("encountered invalid tx hash param, bailing", log.WithRequestID(ctx, "err", err)...)
+		return false
+	}
+
+	return h.writeArchived(res, req, rpcReq, traceCacheKey(hash))
+}
+
+func (h *EthHandler) hdlTraceTransactionAfter(rpcRes *jsonrpc.Response, rpcReq *jsonrpc.Request, req *http.Request) error {
+	ctx := req.Context()
+	h.logger.Debug("post-processing trace_transaction", log.WithRequestID(ctx)...)
+	if h.archive == nil {
+		return nil
+	}
+
+	// unknown transactions have a null trace, which has no pather
+	result := rpcRes.ResultPather()
+	if result == nil {
+		h.logger.Debug("skipping post-processing for null trace", log.WithRequestID(ctx)...)
+		return nil
+	}
+	traceCount, err := result.GetLen("")
+	if err != nil || traceCount == 0 {
+		h.logger.Debug("skipping post-processing for empty trace", log.WithRequestID(ctx)...)
+		return nil
+	}
+
+	hash, err := rpcReq.ParamsPather().GetString("0")
+	if err != nil {
+		return err
+	}
+	blockNum, err := result.GetInt("0.blockNumber")
+	if err != nil {
+		return errors.New("failed to parse block number from trace results")
+	}
+	if !h.hWatcher.IsFinalized(uint64(blockNum)) {
+		h.logger.Debug("not archiving un-finalized trace")
+		return nil
+	}
+
+	h.archiveResult(req, traceCacheKey(hash), rpcRes.Result)
+	return nil
+}
+
+// hdlOtsGetBlockDetailsBefore serves ots_getBlockDetails and
+// ots_getBlockDetailsByHash from the cache. Both are keyed on their only
+// param, a block number or a block hash.
+func (h *EthHandler) hdlOtsGetBlockDetailsBefore(res http.ResponseWriter, req *http.Request, rpcReq *jsonrpc.Request) bool {
+	ctx := req.Context()
+	h.logger.Debug("pre-processing "+rpcReq.Method, log.WithRequestID(ctx)...)
+	cacheKey, ok := otsBlockDetailsCacheKey(rpcReq)
+	if !ok {
+		h.logger.Debug("encountered invalid block param, bailing", log.WithRequestID(ctx)...)
+		return false
+	}
+
+	cached, err := h.cacherFor(req).Get(cacheKey)
+	if err != nil {
+		h.logger.Error("failed to get block details from cache", log.WithRequestID(ctx, "err", err)...)
+		return false
+	}
+	if cached == nil {
+		return false
+	}
+	if err := writeResponse(res, rpcReq.Id, cached); err != nil {
+		h.logger.Error("failed to write cached response", log.WithRequestID(ctx, "err", err)...)
+		return false
+	}
+	h.logger.Debug("found cached block details response, sending", log.WithRequestID(ctx)...)
+	return true
+}
+
+func (h *EthHandler) hdlOtsGetBlockDetailsAfter(rpcRes *jsonrpc.Response, rpcReq *jsonrpc.Request, req *http.Request) error {
+	ctx := req.Context()
+	h.logger.Debug("post-processing "+rpcReq.Method, log.WithRequestID(ctx)...)
+	result := rpcRes.ResultPather()
+	if result == nil {
+		h.logger.Debug("skipping post-processing for null block details", log.WithRequestID(ctx)...)
+		return nil
+	}
+	isNil, err := result.IsNil("block")
+	if err != nil || isNil {
+		h.logger.Debug("skipping post-processing for null block")
+		return nil
+	}
+
+	blockNum, err := result.GetHexUint("block.number")
+	if err != nil {
+		return errors.New("failed to parse block number from RPC results")
+	}
+	if !h.hWatcher.IsFinalized(blockNum) {
+		h.logger.Debug("not caching un-finalized block details")
+		return nil
+	}
+
+	cacheKey, ok := otsBlockDetailsCacheKey(rpcReq)
+	if !ok {
+		return nil
+	}
+	if err := h.cacherFor(req).SetEx(cacheKey, rpcRes.Result, time.Hour); err != nil {
+		h.logger.Debug("post-processing failed while writing to cache", log.WithRequestID(ctx, "err", err)...)
+		return err
+	}
+	h.logger.Debug("stored block details in cache", log.WithRequestID(ctx, "cache_key", cacheKey)...)
+	return nil
+}
+
+func (h *EthHandler) writeArchived(res http.ResponseWriter, req *http.Request, rpcReq *jsonrpc.Request, key string) bool {
+	if h.archive == nil {
+		return false
+	}
+
+	ctx := req.Context()
+	archived, err := h.archive.Get(key)
+	if err != nil {
+		h.logger.Error("failed to read from archive", log.WithRequestID(ctx, "key", key, "err", err)...)
+		return false
+	}
+	if archived == nil {
+		return false
+	}
+
+	if err := writeResponse(res, rpcReq.Id, archived); err != nil {
+		h.logger.Error("failed to write archived response", log.WithRequestID(ctx, "err", err)...)
+		return false
+	}
+	return true
+}
+
+func (h *EthHandler) archiveResult(req *http.Request, key string, data []byte) {
+	if h.archive == nil {
+		return
+	}
+
+	if err := h.archive.Put(key, data); err != nil {
+		h.logger.Error("failed to write to archive", log.WithRequestID(req.Context(), "key", key, "err", err)...)
+		return
+	}
+	h.logger.Debug("stored result in archive", log.WithRequestID(req.Context(), "key", key, "size", len(data))...)
 }
 
 func writeResponse(res http.ResponseWriter, id interface{}, data []byte) error {
@@ -459,6 +1232,7 @@ func writeResponse(res http.ResponseWriter, id interface{}, data []byte) error {
 	if err != nil {
 		return err
 	}
+	res.Header().Set(pkg.CacheStatusHeader, pkg.CacheHit)
 	res.Write(out)
 	return nil
 }
@@ -467,21 +1241,38 @@ func failWithInternalError(res http.ResponseWriter, id interface{}, err error) {
 	failRequest(res, id, -32600, err.Error())
 }
 
+// failTimedOut fails a request that exceeded the request timeout with a 504.
+func failTimedOut(res http.ResponseWriter, id interface{}) {
+	res.WriteHeader(http.StatusGatewayTimeout)
+	writeError(res, id, chainderrors.New(chainderrors.Timeout, "request timed out", nil))
+}
+
 func failRequest(res http.ResponseWriter, id interface{}, code int, msg string) {
+	res.WriteHeader(http.StatusOK)
+	writeError(res, id, chainderrors.New(code, msg, nil))
+}
+
+// failBulkheadFull fails a call whose method class is at its bulkhead limit,
+// naming the class in the error's data.
+func failBulkheadFull(res http.ResponseWriter, id interface{}, class string) {
+	res.WriteHeader(http.StatusOK)
+	writeError(res, id, chainderrors.New(chainderrors.Busy, fmt.Sprintf("%s capacity exhausted, try again later", class), map[string]interface{}{
+		"class": class,
+	}))
+}
+
+// writeError writes the body of a JSON-RPC error, leaving the status to the
+// caller.
+func writeError(res http.ResponseWriter, id interface{}, errData *jsonrpc.ErrorData) {
 	outJson := &jsonrpc.ErrorResponse{
 		Jsonrpc: jsonrpc.Version,
 		Id:      id,
-		Error: &jsonrpc.ErrorData{
-			Code:    code,
-			Message: msg,
-		},
+		Error:   errData,
 	}
 	out, err := json.Marshal(outJson)
 	if err != nil {
 		out = []byte(jsonrpc.InternalError)
 	}
-
-	res.WriteHeader(http.StatusOK)
 	res.Write(out)
 }
 
@@ -490,7 +1281,34 @@ func blockNumCacheKey(blockNum uint64, includeBodies bool) string {
 }
 
 func txReceiptCacheKey(hash string) string {
-	return fmt.Sprintf("txreceipt:%s", hash)
+	return fmt.Sprintf("txreceipt:%s", strings.ToLower(hash))
+}
+
+func traceCacheKey(hash string) string {
+	return fmt.Sprintf("trace:%s", strings.ToLower(hash))
+}
+
+// otsBlockDetailsCacheKey returns the cache key of an ots_getBlockDetails
+// or ots_getBlockDetailsByHash request. Otterscan sends block numbers as
+// plain JSON numbers, but hex quantities are accepted too.
+func otsBlockDetailsCacheKey(rpcReq *jsonrpc.Request) (string, bool) {
+	params := rpcReq.ParamsPather()
+	if rpcReq.Method == "ots_getBlockDetailsByHash" {
+		hash, err := params.GetString("0")
+		if err != nil {
+			return "", false
+		}
+		return fmt.Sprintf("otsblock:%s", strings.ToLower(hash)), true
+	}
+
+	if num, err := params.GetInt("0"); err == nil && num >= 0 {
+		return fmt.Sprintf("otsblock:%d", num), true
+	}
+	num, err := params.GetHexUint("0")
+	if err != nil {
+		return "", false
+	}
+	return fmt.Sprintf("otsblock:%d", num), true
 }
 
 func balanceCacheKey(addr string) string {
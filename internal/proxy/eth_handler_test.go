@@ -0,0 +1,630 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/internal/bodylog"
+	"github.com/kyokan/chaind/internal/cache"
+	"github.com/kyokan/chaind/internal/stats"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/config"
+	chainderrors "github.com/kyokan/chaind/pkg/errors"
+	"github.com/kyokan/chaind/pkg/jsonrpc"
+	"github.com/kyokan/chaind/pkg/log"
+	"github.com/stretchr/testify/require"
+)
+
+type nopAuditor struct{}
+
+func (n *nopAuditor) RecordRequest(req *http.Request, body []byte, reqType pkg.BackendType) error {
+	return nil
+}
+
+type staticSwitch struct {
+	backends  []config.Backend
+	unhealthy map[string]bool
+	manual    bool
+}
+
+func (s *staticSwitch) Start() error {
+	return nil
+}
+
+func (s *staticSwitch) Stop() error {
+	return nil
+}
+
+func (s *staticSwitch) BackendFor(t pkg.BackendType) (*config.Backend, error) {
+	return &s.backends[0], nil
+}
+
+func (s *staticSwitch) Backends(t pkg.BackendType) []config.Backend {
+	return s.backends
+}
+
+func (s *staticSwitch) SwitchTo(t pkg.BackendType, name string) error {
+	return nil
+}
+
+func (s *staticSwitch) UpdateBackends(t pkg.BackendType, backends []config.Backend) {
+	s.backends = backends
+}
+
+func (s *staticSwitch) Manual(t pkg.BackendType) bool {
+	return s.manual
+}
+
+func (s *staticSwitch) RestoreHealth(t pkg.BackendType, health []BackendHealth) int {
+	return 0
+}
+
+func (s *staticSwitch) UseClient(client *http.Client) {
+}
+
+func (s *staticSwitch) UseCheck(check func(backend *config.Backend) error) {
+}
+
+func (s *staticSwitch) UseWarmer(warm func(backend *config.Backend)) {
+}
+
+func (s *staticSwitch) HealthcheckStats() HealthcheckStats {
+	return HealthcheckStats{}
+}
+
+func (s *staticSwitch) Health(t pkg.BackendType) []BackendHealth {
+	var out []BackendHealth
+	for _, backend := range s.backends {
+		state := HealthHealthy
+		if s.unhealthy[backend.Name] {
+			state = HealthUnhealthy
+		}
+		out = append(out, BackendHealth{Name: backend.Name, Tier: backend.Tier, State: state})
+	}
+	return out
+}
+
+func TestEthHandlerCancelsUpstreamOnDisconnect(t *testing.T) {
+	upstreamDone := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		select {
+		case <-r.Context().Done():
+			upstreamDone <- r.Context().Err()
+		case <-time.After(5 * time.Second):
+			upstreamDone <- nil
+		}
+	}))
+	defer srv.Close()
+
+	h := NewEthHandler(nil, nil, nil, &nopAuditor{}, nil, stats.NewStore(), nil, nil, nil, nil)
+	h.client.Timeout = 10 * time.Second
+	ctx, cancel := context.WithCancel(context.Background())
+	body := []byte("{\"jsonrpc\":\"2.0\",\"method\":\"eth_getLogs\",\"params\":[],\"id\":1}")
+	req := httptest.NewRequest(http.MethodPost, "/eth", bytes.NewReader(body)).WithContext(ctx)
+	res := httptest.NewRecorder()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	h.Handle(res, req, &config.Backend{
+		Name: "test",
+		URL:  srv.URL,
+		Type: pkg.EthBackend,
+	})
+	require.True(t, time.Since(start) < time.Second)
+
+	select {
+	case err := <-upstreamDone:
+		require.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("upstream request was not cancelled")
+	}
+	require.Equal(t, 0, res.Body.Len())
+}
+
+func TestEthHandlerEstimateGasFallback(t *testing.T) {
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer flaky.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{\"jsonrpc\":\"2.0\",\"result\":\"0x5208\",\"id\":1}"))
+	}))
+	defer healthy.Close()
+
+	sw := &staticSwitch{
+		backends: []config.Backend{
+			{Name: "flaky", URL: flaky.URL, Type: pkg.EthBackend},
+			{Name: "healthy", URL: healthy.URL, Type: pkg.EthBackend},
+		},
+	}
+	h := NewEthHandler(sw, nil, nil, &nopAuditor{}, nil, stats.NewStore(), &config.EstimateGasConfig{
+		Fallback:   true,
+		Multiplier: 1.5,
+	}, nil, nil, nil)
+	body := []byte("{\"jsonrpc\":\"2.0\",\"method\":\"eth_estimateGas\",\"params\":[{}],\"id\":1}")
+	req := httptest.NewRequest(http.MethodPost, "/eth", bytes.NewReader(body))
+	res := httptest.NewRecorder()
+	h.Handle(res, req, &sw.backends[0])
+
+	var rpcRes jsonrpc.Response
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &rpcRes))
+	require.Nil(t, rpcRes.Error)
+	// 21000 * 1.5 = 31500
+	require.Equal(t, "\"0x7b0c\"", string(rpcRes.Result))
+}
+
+func TestEthHandlerEstimateGasFallbackSkipsRevertsAndUnhealthyBackends(t *testing.T) {
+	var hits []string
+	newBackend := func(name string, resBody string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits = append(hits, name)
+			w.Write([]byte(resBody))
+		}))
+	}
+	reverting := newBackend("reverting", "{\"jsonrpc\":\"2.0\",\"error\":{\"code\":3,\"message\":\"execution reverted\"},\"id\":1}")
+	defer reverting.Close()
+	failing := newBackend("failing", "{\"jsonrpc\":\"2.0\",\"error\":{\"code\":-32000,\"message\":\"header not found\"},\"id\":1}")
+	defer failing.Close()
+	down := newBackend("down", "{\"jsonrpc\":\"2.0\",\"result\":\"0x5208\",\"id\":1}")
+	defer down.Close()
+	healthy := newBackend("healthy", "{\"jsonrpc\":\"2.0\",\"result\":\"0x5208\",\"id\":1}")
+	defer healthy.Close()
+
+	sw := &staticSwitch{
+		backends: []config.Backend{
+			{Name: "failing", URL: failing.URL, Type: pkg.EthBackend},
+			{Name: "down", URL: down.URL, Type: pkg.EthBackend},
+			{Name: "healthy", URL: healthy.URL, Type: pkg.EthBackend},
+			{Name: "reverting", URL: reverting.URL, Type: pkg.EthBackend},
+		},
+		unhealthy: map[string]bool{"down": true},
+	}
+	h := NewEthHandler(sw, nil, nil, &nopAuditor{}, nil, stats.NewStore(), &config.EstimateGasConfig{Fallback: true}, nil, nil, nil)
+	estimate := func(backend *config.Backend) *jsonrpc.Response {
+		body := []byte("{\"jsonrpc\":\"2.0\",\"method\":\"eth_estimateGas\",\"params\":[{}],\"id\":1}")
+		res := httptest.NewRecorder()
+		h.Handle(res, httptest.NewRequest(http.MethodPost, "/eth", bytes.NewReader(body)), backend)
+		var rpcRes jsonrpc.Response
+		require.NoError(t, json.Unmarshal(res.Body.Bytes(), &rpcRes))
+		return &rpcRes
+	}
+
+	rpcRes := estimate(&sw.backends[3])
+	require.NotNil(t, rpcRes.Error)
+	require.Equal(t, 3, rpcRes.Error.Code)
+	require.Equal(t, []string{"reverting"}, hits)
+
+	hits = nil
+	rpcRes = estimate(&sw.backends[0])
+	require.Nil(t, rpcRes.Error)
+	require.Equal(t, []string{"failing", "healthy"}, hits)
+}
+
+func TestEthHandlerEstimateGasWithoutFallback(t *testing.T) {
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer flaky.Close()
+
+	sw := &staticSwitch{
+		backends: []config.Backend{
+			{Name: "flaky", URL: flaky.URL, Type: pkg.EthBackend},
+		},
+	}
+	h := NewEthHandler(sw, nil, nil, &nopAuditor{}, nil, stats.NewStore(), &config.EstimateGasConfig{}, nil, nil, nil)
+	body := []byte("{\"jsonrpc\":\"2.0\",\"method\":\"eth_estimateGas\",\"params\":[{}],\"id\":1}")
+	req := httptest.NewRequest(http.MethodPost, "/eth", bytes.NewReader(body))
+	res := httptest.NewRecorder()
+	h.Handle(res, req, &sw.backends[0])
+
+	var rpcRes jsonrpc.Response
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &rpcRes))
+	require.NotNil(t, rpcRes.Error)
+	require.Equal(t, chainderrors.BadResponse, rpcRes.Error.Code)
+}
+
+func TestEthHandlerEmptyResponse(t *testing.T) {
+	empty := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	}))
+	defer empty.Close()
+
+	sw := &staticSwitch{
+		backends: []config.Backend{
+			{Name: "empty", URL: empty.URL, Type: pkg.EthBackend},
+		},
+	}
+	h := NewEthHandler(sw, nil, nil, &nopAuditor{}, nil, stats.NewStore(), nil, nil, nil, nil)
+	body := []byte("{\"jsonrpc\":\"2.0\",\"method\":\"eth_chainId\",\"params\":[],\"id\":1}")
+	res := httptest.NewRecorder()
+	h.Handle(res, httptest.NewRequest(http.MethodPost, "/eth", bytes.NewReader(body)), &sw.backends[0])
+
+	var rpcRes jsonrpc.Response
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &rpcRes))
+	require.NotNil(t, rpcRes.Error)
+	require.Equal(t, chainderrors.BadResponse, rpcRes.Error.Code)
+	require.Equal(t, "backend returned an empty response", rpcRes.Error.Message)
+}
+
+func TestEthHandlerPinsTransactionLookups(t *testing.T) {
+	var hits []string
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits = append(hits, name)
+			w.Write([]byte("{\"jsonrpc\":\"2.0\",\"result\":\"0xabc\",\"id\":1}"))
+		}))
+	}
+	accepting := newBackend("accepting")
+	defer accepting.Close()
+	lagging := newBackend("lagging")
+	defer lagging.Close()
+
+	backends := []config.Backend{
+		{Name: "accepting", URL: accepting.URL, Type: pkg.EthBackend},
+		{Name: "lagging", URL: lagging.URL, Type: pkg.EthBackend},
+	}
+	h := NewEthHandler(&staticSwitch{backends: backends}, nil, nil, &nopAuditor{}, nil, stats.NewStore(), nil, &config.ReadAfterWriteConfig{}, nil, nil)
+	do := func(client string, method string, backend *config.Backend) {
+		body := []byte("{\"jsonrpc\":\"2.0\",\"method\":\"" + method + "\",\"params\":[\"0xabc\"],\"id\":1}")
+		ctx := context.WithValue(context.Background(), log.ClientKey, client)
+		req := httptest.NewRequest(http.MethodPost, "/eth", bytes.NewReader(body)).WithContext(ctx)
+		h.Handle(httptest.NewRecorder(), req, backend)
+	}
+
+	do("sender", "eth_sendRawTransaction", &backends[0])
+	do("sender", "eth_getTransactionByHash", &backends[1])
+	do("other", "eth_getTransactionByHash", &backends[1])
+	do("sender", "eth_call", &backends[1])
+	require.Equal(t, []string{"accepting", "accepting", "lagging", "lagging"}, hits)
+}
+
+func TestEthHandlerDecodesQuantities(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{\"jsonrpc\":\"2.0\",\"result\":\"0x5208\",\"id\":1}"))
+	}))
+	defer srv.Close()
+
+	h := NewEthHandler(nil, nil, nil, &nopAuditor{}, nil, stats.NewStore(), nil, nil, nil, nil)
+	body := []byte("[{\"jsonrpc\":\"2.0\",\"method\":\"eth_gasPrice\",\"params\":[],\"id\":1}]")
+	req := httptest.NewRequest(http.MethodPost, "/eth", bytes.NewReader(body))
+	req.Header.Set(pkg.DecodeHeader, "true")
+	res := httptest.NewRecorder()
+	h.Handle(res, req, &config.Backend{Name: "test", URL: srv.URL, Type: pkg.EthBackend})
+
+	var out []map[string]interface{}
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &out))
+	require.Len(t, out, 1)
+	require.Equal(t, "0x5208", out[0]["result"])
+	require.Equal(t, "21000", out[0][jsonrpc.DecodedKey])
+}
+
+func TestEthHandlerLogsSampledBodies(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{\"jsonrpc\":\"2.0\",\"result\":\"0x5208\",\"id\":1}"))
+	}))
+	defer srv.Close()
+
+	h := NewEthHandler(nil, nil, nil, &nopAuditor{}, nil, stats.NewStore(), nil, nil, nil, nil)
+	var logged bytes.Buffer
+	h.logger = log15.New()
+	h.logger.SetHandler(log15.StreamHandler(&logged, log15.LogfmtFormat()))
+	h.bodies = bodylog.NewSampler()
+	_, err := h.bodies.Enable("eth_gasPrice", 1, time.Minute)
+	require.NoError(t, err)
+
+	for _, method := range []string{"eth_gasPrice", "eth_chainId"} {
+		body := []byte("{\"jsonrpc\":\"2.0\",\"method\":\"" + method + "\",\"params\":[],\"id\":1}")
+		req := httptest.NewRequest(http.MethodPost, "/eth", bytes.NewReader(body))
+		h.Handle(httptest.NewRecorder(), req, &config.Backend{Name: "test", URL: srv.URL, Type: pkg.EthBackend})
+	}
+	require.Equal(t, 1, strings.Count(logged.String(), "sampled request bodies"))
+	require.Contains(t, logged.String(), "eth_gasPrice")
+	require.Contains(t, logged.String(), "0x5208")
+	require.NotContains(t, logged.String(), "eth_chainId")
+}
+
+func TestEthHandlerBypassesCache(t *testing.T) {
+	var upstreamCalls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		w.Write([]byte("{\"jsonrpc\":\"2.0\",\"result\":{\"number\":\"0x1\"},\"id\":1}"))
+	}))
+	defer srv.Close()
+
+	cacher := cache.NewNopCacher()
+	h := NewEthHandler(nil, cacher, nil, &nopAuditor{}, nil, stats.NewStore(), nil, nil, nil, nil)
+	var beforeCalls int
+	h.handlers["eth_getBlockByNumber"] = &handler{
+		before: func(res http.ResponseWriter, req *http.Request, rpcReq *jsonrpc.Request) bool {
+			beforeCalls++
+			writeResponse(res, rpcReq.Id, []byte("{\"number\":\"0x1\"}"))
+			return true
+		},
+	}
+	do := func(ctx context.Context) *httptest.ResponseRecorder {
+		body := []byte("{\"jsonrpc\":\"2.0\",\"method\":\"eth_getBlockByNumber\",\"params\":[\"0x1\",false],\"id\":1}")
+		req := httptest.NewRequest(http.MethodPost, "/eth", bytes.NewReader(body)).WithContext(ctx)
+		res := httptest.NewRecorder()
+		h.Handle(res, req, &config.Backend{Name: "test", URL: srv.URL, Type: pkg.EthBackend})
+		return res
+	}
+
+	res := do(context.Background())
+	require.Equal(t, pkg.CacheHit, res.Header().Get(pkg.CacheStatusHeader))
+	res = do(context.WithValue(context.Background(), cacheBypassKey{}, true))
+	require.Equal(t, pkg.CacheMiss, res.Header().Get(pkg.CacheStatusHeader))
+	require.Equal(t, 1, beforeCalls)
+	require.Equal(t, 1, upstreamCalls)
+}
+
+func TestEthHandlerForwardsNotifications(t *testing.T) {
+	var forwarded []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		forwarded = append(forwarded, string(body))
+		var req jsonrpc.Request
+		require.NoError(t, json.Unmarshal(body, &req))
+		if req.IsNotification() {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		id, _ := json.Marshal(req.Id)
+		w.Write([]byte(fmt.Sprintf("{\"jsonrpc\":\"2.0\",\"result\":\"0x1\",\"id\":%s}", id)))
+	}))
+	defer srv.Close()
+
+	h := NewEthHandler(nil, nil, nil, &nopAuditor{}, nil, stats.NewStore(), nil, nil, nil, nil)
+	h.handlers["eth_getBlockByNumber"] = &handler{
+		before: func(res http.ResponseWriter, req *http.Request, rpcReq *jsonrpc.Request) bool {
+			writeResponse(res, rpcReq.Id, []byte("{\"number\":\"0x1\"}"))
+			return true
+		},
+	}
+	do := func(body string) *httptest.ResponseRecorder {
+		forwarded = nil
+		req := httptest.NewRequest(http.MethodPost, "/eth", bytes.NewReader([]byte(body)))
+		res := httptest.NewRecorder()
+		h.Handle(res, req, &config.Backend{Name: "test", URL: srv.URL, Type: pkg.EthBackend})
+		return res
+	}
+
+	// notifications skip the cache, and get no response
+	res := do("{\"jsonrpc\":\"2.0\",\"method\":\"eth_getBlockByNumber\",\"params\":[\"0x1\",false]}")
+	require.Equal(t, http.StatusNoContent, res.Code)
+	require.Empty(t, res.Body.String())
+	require.Equal(t, []string{"{\"jsonrpc\":\"2.0\",\"method\":\"eth_getBlockByNumber\",\"params\":[\"0x1\",false]}"}, forwarded)
+
+	// batches only hold the responses to the calls among them
+	res = do("[{\"jsonrpc\":\"2.0\",\"method\":\"eth_chainId\",\"params\":[]},{\"jsonrpc\":\"2.0\",\"method\":\"eth_chainId\",\"params\":[],\"id\":2},{\"jsonrpc\":\"2.0\",\"method\":\"eth_chainId\",\"params\":[],\"id\":null}]")
+	require.Equal(t, http.StatusOK, res.Code)
+	var batch []jsonrpc.Response
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &batch))
+	require.Len(t, batch, 2)
+	require.Equal(t, float64(2), batch[0].Id)
+	require.Nil(t, batch[1].Id)
+	require.Len(t, forwarded, 3)
+
+	res = do("[{\"jsonrpc\":\"2.0\",\"method\":\"eth_chainId\",\"params\":[]},{\"jsonrpc\":\"2.0\",\"method\":\"eth_chainId\",\"params\":[]}]")
+	require.Equal(t, http.StatusNoContent, res.Code)
+	require.Empty(t, res.Body.String())
+	require.Len(t, forwarded, 2)
+}
+
+func TestEthHandlerTimesOut(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("{\"jsonrpc\":\"2.0\",\"result\":\"0x1\",\"id\":1}"))
+	}))
+	defer srv.Close()
+
+	h := NewEthHandler(nil, nil, nil, &nopAuditor{}, nil, stats.NewStore(), nil, nil, nil, nil)
+	h.client = &http.Client{}
+	do := func(body string) *headerCounter {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		req := httptest.NewRequest(http.MethodPost, "/eth", bytes.NewReader([]byte(body))).WithContext(ctx)
+		res := &headerCounter{ResponseRecorder: httptest.NewRecorder()}
+		h.Handle(res, req, &config.Backend{Name: "test", URL: srv.URL, Type: pkg.EthBackend})
+		return res
+	}
+
+	res := do("{\"jsonrpc\":\"2.0\",\"method\":\"eth_chainId\",\"params\":[],\"id\":7}")
+	require.Equal(t, http.StatusGatewayTimeout, res.Code)
+	require.Equal(t, 1, res.headers)
+	var errRes jsonrpc.ErrorResponse
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &errRes))
+	require.Equal(t, chainderrors.Timeout, errRes.Error.Code)
+	require.Equal(t, float64(7), errRes.Id)
+
+	// the remainder of a batch fails once the budget is spent
+	res = do("[{\"jsonrpc\":\"2.0\",\"method\":\"eth_chainId\",\"params\":[],\"id\":1},{\"jsonrpc\":\"2.0\",\"method\":\"eth_chainId\",\"params\":[],\"id\":2}]")
+	require.Equal(t, http.StatusGatewayTimeout, res.Code)
+	require.Equal(t, 1, res.headers)
+	var batch []jsonrpc.ErrorResponse
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &batch))
+	require.Len(t, batch, 2)
+	for _, entry := range batch {
+		require.Equal(t, chainderrors.Timeout, entry.Error.Code)
+	}
+}
+
+// headerCounter counts the calls to WriteHeader, which the HTTP server
+// only honors once.
+type headerCounter struct {
+	*httptest.ResponseRecorder
+	headers int
+}
+
+func (w *headerCounter) WriteHeader(code int) {
+	w.headers++
+	w.ResponseRecorder.WriteHeader(code)
+}
+
+func TestEthHandlerRoutesOptionalNamespaces(t *testing.T) {
+	served := make(chan string, 1)
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			served <- name
+			w.Write([]byte("{\"jsonrpc\":\"2.0\",\"result\":\"0xAB\",\"id\":1}"))
+		}))
+	}
+	geth, erigon, otterscan := backend("geth"), backend("erigon"), backend("otterscan")
+	defer geth.Close()
+	defer erigon.Close()
+	defer otterscan.Close()
+
+	sw := &staticSwitch{
+		backends: []config.Backend{
+			{Name: "geth", URL: geth.URL, Type: pkg.EthBackend},
+			{Name: "erigon", URL: erigon.URL, Type: pkg.EthBackend, Tier: 1, Namespaces: []string{"ots", "erigon"}},
+			{Name: "otterscan", URL: otterscan.URL, Type: pkg.EthBackend, Tier: 2, Namespaces: []string{"ots"}},
+		},
+		unhealthy: make(map[string]bool),
+	}
+	h := NewEthHandler(sw, nil, nil, &nopAuditor{}, nil, stats.NewStore(), nil, nil, nil, nil)
+	send := func(method string) *httptest.ResponseRecorder {
+		body := []byte("{\"jsonrpc\":\"2.0\",\"method\":\"" + method + "\",\"params\":[],\"id\":1}")
+		res := httptest.NewRecorder()
+		h.Handle(res, httptest.NewRequest(http.MethodPost, "/eth", bytes.NewReader(body)), &sw.backends[0])
+		return res
+	}
+
+	send("eth_chainId")
+	require.Equal(t, "geth", <-served)
+	send("ots_searchTransactionsBefore")
+	require.Equal(t, "erigon", <-served)
+	send("erigon_getHeaderByNumber")
+	require.Equal(t, "erigon", <-served)
+
+	sw.unhealthy["erigon"] = true
+	send("ots_searchTransactionsBefore")
+	require.Equal(t, "otterscan", <-served)
+
+	res := send("erigon_getHeaderByNumber")
+	var rpcRes jsonrpc.Response
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &rpcRes))
+	require.NotNil(t, rpcRes.Error)
+	require.Equal(t, chainderrors.BackendUnavailable, rpcRes.Error.Code)
+	require.Len(t, served, 0)
+}
+
+func TestEthHandlerRoutesMempoolQueries(t *testing.T) {
+	served := make(chan string, 1)
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			served <- name
+			w.Write([]byte("{\"jsonrpc\":\"2.0\",\"result\":\"0xAB\",\"id\":1}"))
+		}))
+	}
+	geth, primary, secondary := backend("geth"), backend("primary"), backend("secondary")
+	defer geth.Close()
+	defer primary.Close()
+	defer secondary.Close()
+
+	sw := &staticSwitch{
+		backends: []config.Backend{
+			{Name: "geth", URL: geth.URL, Type: pkg.EthBackend},
+			{Name: "primary", URL: primary.URL, Type: pkg.EthBackend},
+			{Name: "secondary", URL: secondary.URL, Type: pkg.EthBackend},
+		},
+		unhealthy: make(map[string]bool),
+	}
+	h := NewEthHandler(sw, nil, nil, &nopAuditor{}, nil, stats.NewStore(), nil, nil, nil, nil)
+	h.mempool = &config.MempoolConfig{Primary: "primary", Secondary: "secondary"}
+	send := func(method string, params string) {
+		body := []byte("{\"jsonrpc\":\"2.0\",\"method\":\"" + method + "\",\"params\":" + params + ",\"id\":1}")
+		h.Handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/eth", bytes.NewReader(body)), &sw.backends[0])
+	}
+
+	send("eth_getTransactionCount", "[\"0x407d73d8a49eeb85d32cf465507dd71d507100c1\",\"latest\"]")
+	require.Equal(t, "geth", <-served)
+	send("eth_getTransactionCount", "[\"0x407d73d8a49eeb85d32cf465507dd71d507100c1\",\"pending\"]")
+	require.Equal(t, "primary", <-served)
+	send("txpool_content", "[]")
+	require.Equal(t, "primary", <-served)
+	send("eth_getLogs", "[{\"fromBlock\":\"latest\",\"toBlock\":\"pending\"}]")
+	require.Equal(t, "primary", <-served)
+
+	// filters are polled on the node that created them
+	send("eth_newPendingTransactionFilter", "[]")
+	require.Equal(t, "primary", <-served)
+	send("eth_getFilterChanges", "[\"0xab\"]")
+	require.Equal(t, "primary", <-served)
+	send("eth_uninstallFilter", "[\"0xAB\"]")
+	require.Equal(t, "primary", <-served)
+
+	sw.unhealthy["primary"] = true
+	send("txpool_status", "[]")
+	require.Equal(t, "secondary", <-served)
+
+	// without a healthy mempool node, requests are routed as usual
+	sw.unhealthy["secondary"] = true
+	send("txpool_status", "[]")
+	require.Equal(t, "geth", <-served)
+}
+
+type memArchive struct {
+	data map[string][]byte
+}
+
+func (m *memArchive) Start() error {
+	return nil
+}
+
+func (m *memArchive) Stop() error {
+	return nil
+}
+
+func (m *memArchive) Get(key string) ([]byte, error) {
+	return m.data[key], nil
+}
+
+func (m *memArchive) Put(key string, data []byte) error {
+	m.data[key] = data
+	return nil
+}
+
+func (m *memArchive) Has(key string) (bool, error) {
+	_, ok := m.data[key]
+	return ok, nil
+}
+
+func TestEthHandlerSkipsPostProcessingWithoutResult(t *testing.T) {
+	for _, resBody := range []string{
+		"{\"jsonrpc\":\"2.0\",\"result\":null,\"id\":1}",
+		"{\"jsonrpc\":\"2.0\",\"error\":{\"code\":-32000,\"message\":\"unknown transaction\"},\"id\":1}",
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(resBody))
+		}))
+
+		backend := config.Backend{Name: "test", URL: srv.URL, Type: pkg.EthBackend, Namespaces: []string{"ots"}}
+		sw := &staticSwitch{backends: []config.Backend{backend}}
+		arch := &memArchive{data: make(map[string][]byte)}
+		h := NewEthHandler(sw, cache.NewNopCacher(), arch, &nopAuditor{}, nil, stats.NewStore(), nil, nil, nil, nil)
+		for _, body := range []string{
+			"{\"jsonrpc\":\"2.0\",\"method\":\"trace_transaction\",\"params\":[\"0xabc\"],\"id\":1}",
+			"{\"jsonrpc\":\"2.0\",\"method\":\"ots_getBlockDetails\",\"params\":[\"0x10\"],\"id\":1}",
+		} {
+			res := httptest.NewRecorder()
+			h.Handle(res, httptest.NewRequest(http.MethodPost, "/eth", bytes.NewReader([]byte(body))), &backend)
+			require.Equal(t, resBody, res.Body.String())
+		}
+		srv.Close()
+
+		require.Len(t, arch.data, 0)
+	}
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/jsonrpc"
+)
+
+// isMempoolQuery returns whether a request reads the mempool: txpool_*
+// methods, pending transaction filters, and queries tagged "pending".
+func isMempoolQuery(rpcReq *jsonrpc.Request) bool {
+	if strings.HasPrefix(rpcReq.Method, "txpool_") || rpcReq.Method == "eth_newPendingTransactionFilter" {
+		return true
+	}
+
+	var params []interface{}
+	if err := json.Unmarshal(rpcReq.Params, &params); err != nil {
+		return false
+	}
+	for _, param := range params {
+		switch p := param.(type) {
+		case string:
+			if p == "pending" {
+				return true
+			}
+		case map[string]interface{}:
+			if p["fromBlock"] == "pending" || p["toBlock"] == "pending" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mempoolBackend returns the backend that should serve mempool queries:
+// the primary mempool node if it is healthy, or else the secondary. It
+// returns nil if neither is healthy, in which case mempool queries are
+// routed like any other request.
+func (h *EthHandler) mempoolBackend() *config.Backend {
+	healthy := h.healthyBackends()
+	backends := h.sw.Backends(pkg.EthBackend)
+	for _, name := range []string{h.mempool.Primary, h.mempool.Secondary} {
+		if name == "" || !healthy[name] {
+			continue
+		}
+		for i := range backends {
+			if backends[i].Name == name {
+				return &backends[i]
+			}
+		}
+	}
+	return nil
+}
+
+// filterWindow is how long a filter is remembered after it was last polled.
+// Nodes uninstall filters that aren't polled for 5 minutes.
+const filterWindow = 5 * time.Minute
+
+// isFilterCreation returns whether the method installs a filter, whose ID
+// is only known to the node that created it.
+func isFilterCreation(method string) bool {
+	return method == "eth_newFilter" || method == "eth_newBlockFilter" || method == "eth_newPendingTransactionFilter"
+}
+
+// filterID returns the ID of the filter a request polls or uninstalls.
+func filterID(rpcReq *jsonrpc.Request) (string, bool) {
+	switch rpcReq.Method {
+	case "eth_getFilterChanges", "eth_getFilterLogs", "eth_uninstallFilter":
+	default:
+		return "", false
+	}
+
+	var params []string
+	if err := json.Unmarshal(rpcReq.Params, &params); err != nil || len(params) == 0 {
+		return "", false
+	}
+	return strings.ToLower(params[0]), true
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/config"
+)
+
+// methodNamespace returns the optional namespace of a method, e.g. ots for
+// ots_getBlockDetails, or an empty string if every backend serves it.
+func methodNamespace(method string) string {
+	i := strings.IndexByte(method, '_')
+	if i == -1 {
+		return ""
+	}
+	ns := method[:i]
+	for _, optional := range config.OptionalNamespaces {
+		if ns == optional {
+			return ns
+		}
+	}
+	return ""
+}
+
+func servesNamespace(backend *config.Backend, ns string) bool {
+	for _, served := range backend.Namespaces {
+		if served == ns {
+			return true
+		}
+	}
+	return false
+}
+
+// capableBackend returns the backend that should serve a method of an
+// optional namespace: the given backend if it serves the namespace, or else
+// the cheapest healthy backend that does. It returns nil if no healthy
+// backend serves it.
+func (h *EthHandler) capableBackend(backend *config.Backend, ns string) *config.Backend {
+	if servesNamespace(backend, ns) {
+		return backend
+	}
+
+	healthy := h.healthyBackends()
+	var best *config.Backend
+	for _, candidate := range h.sw.Backends(pkg.EthBackend) {
+		if !healthy[candidate.Name] || !servesNamespace(&candidate, ns) {
+			continue
+		}
+		if best == nil || candidate.Tier < best.Tier {
+			c := candidate
+			best = &c
+		}
+	}
+	return best
+}
+
+// healthyBackends returns the names of the backends that are healthy, or
+// haven't been checked yet.
+func (h *EthHandler) healthyBackends() map[string]bool {
+	healthy := make(map[string]bool)
+	for _, entry := range h.sw.Health(pkg.EthBackend) {
+		healthy[entry.Name] = entry.State == HealthHealthy || entry.State == HealthUnknown
+	}
+	return healthy
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kyokan/chaind/pkg/config"
+)
+
+const DefaultPinWindow = 30 * time.Second
+
+// maxPins bounds the pin store; expired pins are pruned once it is reached.
+const maxPins = 10000
+
+type pin struct {
+	backend config.Backend
+	expires time.Time
+}
+
+// PinStore remembers which backend accepted a client's most recent
+// transaction, so that the client's follow-up lookups for it can be routed
+// to the same backend while the transaction propagates to the others.
+type PinStore struct {
+	window time.Duration
+	pins   map[string]*pin
+	mtx    sync.Mutex
+	now    func() time.Time
+}
+
+func NewPinStore(window time.Duration) *PinStore {
+	if window == 0 {
+		window = DefaultPinWindow
+	}
+
+	return &PinStore{
+		window: window,
+		pins:   make(map[string]*pin),
+		now:    time.Now,
+	}
+}
+
+func (p *PinStore) Pin(key string, backend *config.Backend) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	now := p.now()
+	if len(p.pins) >= maxPins {
+		p.prune(now)
+	}
+	p.pins[key] = &pin{
+		backend: *backend,
+		expires: now.Add(p.window),
+	}
+}
+
+// Get returns the backend the key is pinned to, or nil if the key isn't
+// pinned or its pin has expired.
+func (p *PinStore) Get(key string) *config.Backend {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	pn, ok := p.pins[key]
+	if !ok {
+		return nil
+	}
+	if !p.now().Before(pn.expires) {
+		delete(p.pins, key)
+		return nil
+	}
+
+	backend := pn.backend
+	return &backend
+}
+
+func (p *PinStore) prune(now time.Time) {
+	for key, pn := range p.pins {
+		if !now.Before(pn.expires) {
+			delete(p.pins, key)
+		}
+	}
+}
+
+func isPinnedMethod(method string) bool {
+	return method == "eth_getTransactionByHash" || method == "eth_getTransactionReceipt"
+}
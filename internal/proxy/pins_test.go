@@ -0,0 +1,24 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPinStoreExpiry(t *testing.T) {
+	now := time.Unix(1000, 0)
+	p := NewPinStore(10 * time.Second)
+	p.now = func() time.Time {
+		return now
+	}
+
+	p.Pin("sender", &config.Backend{Name: "infura"})
+	require.Equal(t, "infura", p.Get("sender").Name)
+	require.Nil(t, p.Get("other"))
+
+	now = now.Add(10 * time.Second)
+	require.Nil(t, p.Get("sender"))
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kyokan/chaind/pkg/config"
+)
+
+const (
+	DefaultPrewarmConnections = 8
+	DefaultPrewarmTimeout     = time.Second
+)
+
+var prewarmBody = []byte("{\"jsonrpc\":\"2.0\",\"method\":\"web3_clientVersion\",\"params\":[],\"id\":1}")
+
+// prewarmTransport returns the transport of upstream requests when
+// connections are prewarmed. Its idle pool holds every prewarmed connection,
+// which the default transport would close down to two per backend.
+func prewarmTransport(connections int) *http.Transport {
+	return &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: connections,
+	}
+}
+
+// prewarm opens connections to a backend before traffic fails over to it,
+// so that the first wave of requests doesn't pay for TCP and TLS setup. The
+// connections are opened by concurrent cheap requests, and are left idle in
+// the upstream client's pool. It gives up after the prewarm timeout.
+func (h *EthHandler) prewarm(backend *config.Backend) {
+	client, err := backendClient(backend, h.client)
+	if err != nil {
+		h.logger.Error("failed to configure backend client", "backend", backend.Name, "err", err)
+		return
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), h.prewarmCfg.Timeout)
+	defer cancel()
+	var warmed int32
+	var wg sync.WaitGroup
+	for i := 0; i < h.prewarmCfg.Connections; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := newUpstreamRequest(ctx, backend, prewarmBody)
+			if err != nil {
+				return
+			}
+			res, err := client.Do(req)
+			if err != nil {
+				return
+			}
+			// the body must be drained for the connection to be reused
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+			atomic.AddInt32(&warmed, 1)
+		}()
+	}
+	wg.Wait()
+	h.logger.Info("prewarmed backend connections", "backend", backend.Name, "connections", warmed, "elapsed", time.Since(start))
+}
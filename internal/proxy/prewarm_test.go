@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/internal/stats"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEthHandlerPrewarm(t *testing.T) {
+	var conns int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// slow enough that concurrent requests can't share a connection
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("{\"jsonrpc\":\"2.0\",\"result\":\"0x1\",\"id\":1}"))
+	}))
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	sw := &staticSwitch{
+		backends: []config.Backend{
+			{Name: "test-1", URL: srv.URL, Type: pkg.EthBackend},
+		},
+	}
+	h := NewEthHandler(sw, nil, nil, &nopAuditor{}, nil, stats.NewStore(), nil, nil, nil, nil)
+	h.prewarmCfg = &config.PrewarmConfig{Connections: 4, Timeout: time.Second}
+	h.client.Transport = prewarmTransport(4)
+
+	h.prewarm(&sw.backends[0])
+	require.Equal(t, int32(4), atomic.LoadInt32(&conns))
+
+	// requests after the failover reuse the warm connections
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		go func() {
+			body := []byte("{\"jsonrpc\":\"2.0\",\"method\":\"eth_chainId\",\"params\":[],\"id\":1}")
+			h.Handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/eth", bytes.NewReader(body)), &sw.backends[0])
+			done <- true
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+	require.Equal(t, int32(4), atomic.LoadInt32(&conns))
+}
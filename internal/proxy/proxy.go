@@ -11,26 +11,100 @@ import (
 	"github.com/kyokan/chaind/internal/audit"
 	"github.com/satori/go.uuid"
 	"github.com/kyokan/chaind/internal/cache"
+	"github.com/kyokan/chaind/internal/archive"
+	"github.com/kyokan/chaind/internal/ratelimit"
+	"net"
+	"os"
+	"strings"
+	"github.com/kyokan/chaind/internal/acl"
+	"github.com/kyokan/chaind/internal/stats"
+	"encoding/json"
+	"github.com/kyokan/chaind/pkg/jsonrpc"
+	"math"
+	"strconv"
+	"github.com/kyokan/chaind/internal/tlsutil"
+	"github.com/kyokan/chaind/internal/chaos"
+	"github.com/kyokan/chaind/internal/bodylog"
+	"github.com/kyokan/chaind/internal/txtrack"
+	"github.com/kyokan/chaind/internal/headerchain"
+	"github.com/kyokan/chaind/internal/jwtauth"
+	"io/ioutil"
+	"bytes"
+	"sync/atomic"
+	"github.com/kyokan/chaind/internal/egress"
+	"github.com/kyokan/chaind/internal/blockindex"
+	"github.com/kyokan/chaind/internal/extauthz"
+	"github.com/kyokan/chaind/internal/wsconn"
+	"github.com/kyokan/chaind/internal/wsproxy"
+	chainderrors "github.com/kyokan/chaind/pkg/errors"
+	"github.com/kyokan/chaind/pkg/version"
 )
 
+// VersionPath serves the build info of the running chaind.
+const VersionPath = "/version"
+
 var logger = log.NewLog("proxy")
 
+// cacheBypassKey marks request contexts whose responses must not be served
+// from the cache.
+type cacheBypassKey struct{}
+
 type Proxy struct {
 	sw         BackendSwitch
 	config     *config.Config
 	ethHandler *EthHandler
+	limiter    *ratelimit.Limiter
+	jwt        *jwtauth.Verifier
+	egress     *egress.Meter
+	concurrency *ConcurrencyLimiter
+	authorizer *extauthz.Authorizer
+	weights    *WeightTuner
+	websockets *wsproxy.Hub
 	quitChan   chan bool
 	errChan    chan error
+	failures   chan error
+	// trustedProxies may set the client address with X-Real-IP
+	trustedProxies []*net.IPNet
+	// debugKeys may request debug traces, which name the backends
+	debugKeys map[string]bool
+	// listenerFile is a socket inherited from e.g. systemd socket activation
+	listenerFile *os.File
+	// handler is the RPC listener's handler, set by Start
+	handler atomic.Value
 }
 
-func NewProxy(sw BackendSwitch, auditor audit.Auditor, cacher cache.Cacher, fHelper *BlockHeightWatcher, config *config.Config) *Proxy {
-	return &Proxy{
+func NewProxy(sw BackendSwitch, auditor audit.Auditor, cacher cache.Cacher, arch archive.Archive, limiter *ratelimit.Limiter, fHelper *BlockHeightWatcher, statsStore *stats.Store, config *config.Config) *Proxy {
+	ethHandler := NewEthHandler(sw, cacher, arch, auditor, fHelper, statsStore, config.EstimateGas, config.ReadAfterWrite, config.BulkheadConfig, config.CoalesceConfig)
+	if config.RequestTimeout > 0 {
+		// upstream requests are bounded by the request's remaining budget
+		// instead of a fixed timeout per attempt
+		ethHandler.client = &http.Client{}
+	}
+	if len(config.RetryConfig) > 0 {
+		ethHandler.retrier = NewRetrier(config.RetryConfig)
+	}
+	ethHandler.mempool = config.MempoolConfig
+	// healthchecks share the upstream client, so that they can't pass while
+	// proxied requests fail
+	sw.UseClient(ethHandler.client)
+
+	p := &Proxy{
 		sw:         sw,
 		config:     config,
-		ethHandler: NewEthHandler(cacher, auditor, fHelper),
+		ethHandler: ethHandler,
+		limiter:    limiter,
 		quitChan:   make(chan bool),
 		errChan:    make(chan error),
+		failures:   make(chan error, 1),
+		debugKeys:  make(map[string]bool),
+	}
+	for _, key := range config.DebugKeys {
+		p.debugKeys[key] = true
 	}
+	if config.Concurrency != nil {
+		p.concurrency = NewConcurrencyLimiter(config.Concurrency)
+	}
+	return p
 }
 
 func (p *Proxy) Start() error {
@@ -38,21 +112,71 @@ func (p *Proxy) Start() error {
 		panic("TLS not implemented yet")
 	}
 
+	trustedProxies, err := acl.ParseCIDRs(p.config.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	p.trustedProxies = trustedProxies
+
 	mux := http.NewServeMux()
 	mux.HandleFunc(fmt.Sprintf("/%s", p.config.ETHUrl), p.handleETHRequest)
+	mux.HandleFunc("/health", p.handleHealth)
+	mux.HandleFunc(ChainSummaryPath, p.handleSummary)
+	mux.HandleFunc(VersionPath, p.handleVersion)
+	var rules *config.ACLRules
+	if p.config.ACLConfig != nil {
+		rules = p.config.ACLConfig.RPC
+	}
+	handler, err := acl.Wrap(rules, withCORS(p.config.CORSConfig, mux))
+	if err != nil {
+		return err
+	}
+	p.handler.Store(handler)
 	s := new(http.Server)
 	s.Addr = fmt.Sprintf(":%d", p.config.RPCPort)
-	s.Handler = mux
+	s.Handler = handler
+
+	serve := s.ListenAndServe
+	if p.config.TLSConfig != nil {
+		tlsCfg, err := tlsutil.ServerConfig(p.config.TLSConfig)
+		if err != nil {
+			return err
+		}
+		s.TLSConfig = tlsCfg
+		serve = func() error {
+			return s.ListenAndServeTLS("", "")
+		}
+	}
+	if p.listenerFile != nil {
+		// the inherited socket is duplicated so that it survives the
+		// listener being closed on shutdown, and the proxy can be restarted
+		l, err := net.FileListener(p.listenerFile)
+		if err != nil {
+			return err
+		}
+		serve = func() error {
+			if s.TLSConfig != nil {
+				return s.ServeTLS(l, "", "")
+			}
+			return s.Serve(l)
+		}
+		logger.Info("using inherited listener", "addr", l.Addr())
+	}
 
 	go func() {
-		if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := serve(); err != nil && err != http.ErrServerClosed {
 			logger.Error("proxy server error", "port", p.config.RPCPort, "err", err)
+			select {
+			case p.failures <- err:
+			default:
+			}
 		}
 	}()
 
 	go func() {
 		<-p.quitChan
-		ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
 		if err := s.Shutdown(ctx); err != nil {
 			p.errChan <- err
 		}
@@ -63,13 +187,180 @@ func (p *Proxy) Start() error {
 	return nil
 }
 
+// ServeHTTP serves a request like the RPC listener, e.g. for requests the
+// admin UI hands over in-process. Requests are rejected until Start.
+func (p *Proxy) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	handler, ok := p.handler.Load().(http.Handler)
+	if !ok {
+		res.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	handler.ServeHTTP(res, req)
+}
+
 func (p *Proxy) Stop() error {
 	p.quitChan <- true
 	return <-p.errChan
 }
 
+// UseListenerFile makes the proxy serve on an already open socket rather
+// than binding the RPC port itself.
+func (p *Proxy) UseListenerFile(f *os.File) {
+	p.listenerFile = f
+}
+
+// UseFaultInjector injects faults into requests to backends. It must be
+// called before Start.
+func (p *Proxy) UseFaultInjector(faults *chaos.Injector) {
+	p.ethHandler.faults = faults
+}
+
+// UseTxTracker tracks the transactions submitted through the proxy. It must
+// be called before Start.
+func (p *Proxy) UseTxTracker(tracker *txtrack.Tracker) {
+	p.ethHandler.txTracker = tracker
+}
+
+// UseHeaderChain checks the block hashes returned by backends against the
+// verified header chain. With reject set, mismatching responses are failed
+// rather than flagged. It must be called before Start.
+func (p *Proxy) UseHeaderChain(chain *headerchain.Chain, reject bool) {
+	p.ethHandler.headers = chain
+	p.ethHandler.rejectMismatches = reject
+}
+
+// UseJWTVerifier authenticates clients with bearer JWTs. Verified client
+// certificates still take precedence. It must be called before Start.
+func (p *Proxy) UseJWTVerifier(v *jwtauth.Verifier) {
+	p.jwt = v
+}
+
+// UseExternalAuthorizer asks an external policy service whether to serve
+// each request, and which rate limit tier to apply to it.
+func (p *Proxy) UseExternalAuthorizer(a *extauthz.Authorizer) {
+	p.authorizer = a
+}
+
+// UseWeightTuner spreads requests over the backends of the current tier by
+// their adaptive weights.
+func (p *Proxy) UseWeightTuner(w *WeightTuner) {
+	p.weights = w
+}
+
+// UseWebsockets accepts WebSocket connections on the RPC endpoint, whose
+// subscriptions are held by hub. It must be called before Start.
+func (p *Proxy) UseWebsockets(hub *wsproxy.Hub) {
+	p.websockets = hub
+}
+
+// UseTenants namespaces the cache entries of each tenant's clients, and
+// keeps them within the tenant's cache quota.
+func (p *Proxy) UseTenants(tenants *cache.Tenants) {
+	p.ethHandler.tenants = tenants
+}
+
+// UseEgressMeter enforces daily limits on the response bytes served to each
+// client. It must be called before Start.
+func (p *Proxy) UseEgressMeter(m *egress.Meter) {
+	p.egress = m
+}
+
+// UseBodySampler logs the bodies of the requests sampled by s. It must be
+// called before Start.
+func (p *Proxy) UseBodySampler(s *bodylog.Sampler) {
+	p.ethHandler.bodies = s
+}
+
+// UseBlockIndex answers lookups of recent blocks and transactions from the
+// block index. It must be called before Start.
+func (p *Proxy) UseBlockIndex(idx *blockindex.Index) {
+	p.ethHandler.blocks = idx
+}
+
+// UsePrewarming opens connections to backends before traffic fails over to
+// them. It must be called before Start.
+func (p *Proxy) UsePrewarming(cfg *config.PrewarmConfig) {
+	prewarmCfg := *cfg
+	if prewarmCfg.Connections == 0 {
+		prewarmCfg.Connections = DefaultPrewarmConnections
+	}
+	if prewarmCfg.Timeout == 0 {
+		prewarmCfg.Timeout = DefaultPrewarmTimeout
+	}
+	p.ethHandler.prewarmCfg = &prewarmCfg
+	p.ethHandler.client.Transport = prewarmTransport(prewarmCfg.Connections)
+	p.sw.UseWarmer(p.ethHandler.prewarm)
+}
+
+// InFlight tracks the requests currently being proxied to each backend.
+func (p *Proxy) InFlight() *InFlight {
+	return p.ethHandler.inFlight
+}
+
+func (p *Proxy) Failures() <-chan error {
+	return p.failures
+}
+
 func (p *Proxy) handleETHRequest(res http.ResponseWriter, req *http.Request) {
-	ctx := context.WithValue(req.Context(), log.RequestIDKey, uuid.NewV4().String())
+	requestID := req.Header.Get(pkg.RequestIDHeader)
+	if requestID == "" {
+		requestID = uuid.NewV4().String()
+	}
+	res.Header().Set(pkg.RequestIDHeader, requestID)
+	ctx := context.WithValue(req.Context(), log.RequestIDKey, requestID)
+	ctx = context.WithValue(ctx, log.TagKey, stats.SanitizeTag(req.Header.Get(pkg.TagHeader)))
+	// verified client certificates take precedence over bearer tokens, and
+	// both over API keys
+	key := tlsutil.Identity(p.config.TLSConfig, req)
+	var identity *jwtauth.Identity
+	if key == "" && p.jwt != nil {
+		var err error
+		identity, err = p.jwt.Authenticate(req)
+		if err != nil {
+			logger.Info("rejected request with invalid bearer token", "request_id", requestID, "err", err)
+			failUnauthorized(res, err.Error())
+			return
+		}
+		if identity == nil && p.config.JWTConfig.Required {
+			failUnauthorized(res, "bearer token required")
+			return
+		}
+		if identity != nil {
+			key = identity.Key
+		} else {
+			identity = p.jwt.Anonymous()
+		}
+	}
+	if key == "" {
+		key = clientKey(req, p.trustedProxies)
+	}
+	ctx = context.WithValue(ctx, log.ClientKey, key)
+	// WebSocket connections hold no concurrency slot; each of their
+	// messages is capped and limited like a request
+	if p.websockets != nil && wsconn.IsUpgrade(req) {
+		p.serveWebsocket(res, req.WithContext(ctx), key)
+		return
+	}
+	// the cap is taken before the body is read, so that rejected requests
+	// cost next to nothing
+	if p.concurrency != nil {
+		release, ok := p.concurrency.Acquire(key)
+		if !ok {
+			logger.Info("rejected request over concurrency limit", log.WithRequestID(ctx, "client", key)...)
+			failBusy(res)
+			return
+		}
+		defer release()
+	}
+	if p.config.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.config.RequestTimeout)
+		defer cancel()
+	}
+	if p.bypassesCache(req, key) {
+		logger.Debug("bypassing cache", log.WithRequestID(ctx)...)
+		ctx = context.WithValue(ctx, cacheBypassKey{}, true)
+	}
 	req = req.WithContext(ctx)
 	if req.Method != "POST" {
 		logger.Info("rejected non-POST request to eth endpoint", log.WithRequestID(ctx)...)
@@ -77,12 +368,344 @@ func (p *Proxy) handleETHRequest(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.Info("failed to read request body", log.WithRequestID(ctx, "err", err)...)
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	methods := requestMethods(body)
+	if identity != nil {
+		for _, method := range methods {
+			if !identity.Allows(method) {
+				logger.Info("rejected request for forbidden method", log.WithRequestID(ctx, "client", key, "method", method)...)
+				failForbidden(res, method)
+				return
+			}
+		}
+	}
+	var rateTier string
+	if p.authorizer != nil {
+		calls, err := p.authorizer.Calls(body)
+		if err != nil {
+			// unparseable requests are still checked, by key alone
+			logger.Debug("failed to parse request for authorization", log.WithRequestID(ctx, "err", err)...)
+		}
+		tag, _ := ctx.Value(log.TagKey).(string)
+		decision := p.authorizer.Check(ctx, &extauthz.CheckRequest{
+			Key:        key,
+			RemoteAddr: req.RemoteAddr,
+			Tag:        tag,
+			Calls:      calls,
+		})
+		if !decision.Allow {
+			logger.Info("rejected request denied by policy service", log.WithRequestID(ctx, "client", key, "reason", decision.Reason)...)
+			failDenied(res, decision.Reason)
+			return
+		}
+		rateTier = decision.RateTier
+	}
+	if len(methods) == 1 && methods[0] == EstimateCostMethod {
+		p.handleEstimateCost(res, body, key)
+		return
+	}
+
+	if p.limiter != nil {
+		bucket, policy := p.rateLimitKeys(key)
+		// the policy service's tier takes precedence over the token's
+		if identity != nil && identity.Tier != "" {
+			policy = identity.Tier
+		}
+		if rateTier != "" {
+			policy = rateTier
+		}
+		dec := p.limiter.TakeNAs(bucket, policy, p.limiter.Cost(methods))
+		writeRateLimitHeaders(res, dec)
+		if !dec.Allowed {
+			logger.Info("rate limited request", log.WithRequestID(ctx, "client", key)...)
+			failRateLimited(res, dec)
+			return
+		}
+		if dec.Delay > 0 {
+			logger.Debug("delaying request over soft rate limit", log.WithRequestID(ctx, "client", key, "delay", dec.Delay)...)
+			select {
+			case <-time.After(dec.Delay):
+			case <-ctx.Done():
+				if ctx.Err() == context.DeadlineExceeded {
+					failTimedOut(res, nil)
+				}
+				return
+			}
+		}
+	}
+
+	if p.egress != nil {
+		usage := p.egress.Check(key)
+		writeEgressHeaders(res, usage)
+		if usage.Exceeded {
+			logger.Info("rejected request over daily egress limit", log.WithRequestID(ctx, "client", key)...)
+			failEgressExceeded(res, p.egress.ResetIn())
+			return
+		}
+	}
 	start := time.Now()
 	backend, err := p.sw.BackendFor(pkg.EthBackend)
 	if err != nil {
+		logger.Warn("rejected request, no backend is available", log.WithRequestID(ctx, "err", err)...)
+		failUnavailable(res)
+		return
+	}
+	if p.weights != nil {
+		backend = p.weights.Pick(backend)
+	}
+	var w http.ResponseWriter = res
+	if req.Header.Get(pkg.DebugHeader) == "true" && p.debugKeys[key] {
+		var trace *debugTrace
+		ctx, trace = withDebugTrace(ctx)
+		req = req.WithContext(ctx)
+		w = &debugWriter{ResponseWriter: res, trace: trace}
+	}
+	rec := &statusWriter{ResponseWriter: w}
+	p.ethHandler.Handle(rec, req, backend)
+	if p.egress != nil {
+		p.egress.Record(key, rec.Written())
+	}
+	logger.Info("finished handling Ethereum JSON-RPC request", log.WithRequestID(ctx, "path", req.URL.Path, "status", rec.Status(), "elapsed", time.Since(start))...)
+}
+
+// handleHealth reports whether requests can currently be proxied, e.g. for
+// load balancer or Consul health checks.
+func (p *Proxy) handleHealth(res http.ResponseWriter, req *http.Request) {
+	if _, err := p.sw.BackendFor(pkg.EthBackend); err != nil {
 		res.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
-	p.ethHandler.Handle(res, req, backend)
-	logger.Info("finished handling Ethereum JSON-RPC request", log.WithRequestID(ctx, "elapsed", time.Since(start))...)
+
+	res.WriteHeader(http.StatusOK)
+}
+
+// handleVersion reports the build chaind was built from and the features it
+// runs with, so replicas of a fleet can be told apart.
+func (p *Proxy) handleVersion(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(version.Get(p.config.Features.Enabled()))
+}
+
+// failUnauthorized rejects a request whose bearer token is missing or
+// invalid, as described by RFC 6750.
+func failUnauthorized(res http.ResponseWriter, reason string) {
+	res.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer error=\"invalid_token\", error_description=%q", reason))
+	res.WriteHeader(http.StatusUnauthorized)
+}
+
+// failForbidden rejects a request calling a method the client isn't allowed
+// to call. Like failRateLimited, the error has a null ID.
+func failForbidden(res http.ResponseWriter, method string) {
+	failDenied(res, fmt.Sprintf("method %s is not allowed", method))
+}
+
+// failDenied rejects a request the client isn't allowed to make, e.g. as
+// decided by an external policy service.
+func failDenied(res http.ResponseWriter, reason string) {
+	if reason == "" {
+		reason = "request is not allowed"
+	}
+	out, err := json.Marshal(&jsonrpc.ErrorResponse{
+		Jsonrpc: jsonrpc.Version,
+		Error:   chainderrors.New(chainderrors.MethodBlocked, reason, nil),
+	})
+	if err != nil {
+		out = []byte(jsonrpc.InternalError)
+	}
+	res.Header().Set("content-type", "application/json")
+	res.WriteHeader(http.StatusForbidden)
+	res.Write(out)
+}
+
+// failUnavailable rejects a request when no backend is healthy. Like
+// failRateLimited, the error has a null ID.
+func failUnavailable(res http.ResponseWriter) {
+	out, err := json.Marshal(&jsonrpc.ErrorResponse{
+		Jsonrpc: jsonrpc.Version,
+		Error:   chainderrors.New(chainderrors.BackendUnavailable, "no backend is available", nil),
+	})
+	if err != nil {
+		out = []byte(jsonrpc.InternalError)
+	}
+	res.Header().Set("content-type", "application/json")
+	res.WriteHeader(http.StatusServiceUnavailable)
+	res.Write(out)
+}
+
+// failBusy rejects a request while the listener or the client is at its
+// concurrency cap. Like failRateLimited, the error has a null ID.
+func failBusy(res http.ResponseWriter) {
+	out, err := json.Marshal(&jsonrpc.ErrorResponse{
+		Jsonrpc: jsonrpc.Version,
+		Error:   chainderrors.New(chainderrors.Busy, "too many concurrent requests", nil),
+	})
+	if err != nil {
+		out = []byte(jsonrpc.InternalError)
+	}
+	res.Header().Set(pkg.RetryAfterHeader, "1")
+	res.Header().Set("content-type", "application/json")
+	res.WriteHeader(http.StatusServiceUnavailable)
+	res.Write(out)
+}
+
+func writeRateLimitHeaders(res http.ResponseWriter, dec ratelimit.Decision) {
+	res.Header().Set(pkg.RateLimitLimitHeader, strconv.Itoa(dec.Limit))
+	res.Header().Set(pkg.RateLimitRemainingHeader, strconv.Itoa(dec.Remaining))
+	res.Header().Set(pkg.RateLimitResetHeader, strconv.Itoa(ceilSeconds(dec.Reset)))
+}
+
+// failRateLimited rejects a request with a JSON-RPC error, since the request
+// ID isn't known yet the error has a null ID.
+func failRateLimited(res http.ResponseWriter, dec ratelimit.Decision) {
+	retryAfter := ceilSeconds(dec.RetryAfter)
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	out, err := json.Marshal(&jsonrpc.ErrorResponse{
+		Jsonrpc: jsonrpc.Version,
+		Error: chainderrors.New(chainderrors.RateLimited, "rate limit exceeded", map[string]interface{}{
+			"retry_after": retryAfter,
+		}),
+	})
+	if err != nil {
+		out = []byte(jsonrpc.InternalError)
+	}
+
+	res.Header().Set(pkg.RetryAfterHeader, strconv.Itoa(retryAfter))
+	res.Header().Set("content-type", "application/json")
+	res.WriteHeader(http.StatusTooManyRequests)
+	res.Write(out)
+}
+
+func writeEgressHeaders(res http.ResponseWriter, usage egress.Usage) {
+	if usage.Limit == 0 {
+		return
+	}
+	res.Header().Set(pkg.EgressLimitHeader, strconv.FormatInt(usage.Limit, 10))
+	res.Header().Set(pkg.EgressUsedHeader, strconv.FormatInt(usage.Bytes, 10))
+	if usage.Warned {
+		res.Header().Set(pkg.EgressWarningHeader, "true")
+	}
+}
+
+// failEgressExceeded rejects a request from a client over its daily egress
+// limit until the limit resets. Like failRateLimited, the error has a null
+// ID.
+func failEgressExceeded(res http.ResponseWriter, resetIn time.Duration) {
+	retryAfter := ceilSeconds(resetIn)
+	out, err := json.Marshal(&jsonrpc.ErrorResponse{
+		Jsonrpc: jsonrpc.Version,
+		Error: chainderrors.New(chainderrors.RateLimited, "daily egress limit exceeded", map[string]interface{}{
+			"retry_after": retryAfter,
+		}),
+	})
+	if err != nil {
+		out = []byte(jsonrpc.InternalError)
+	}
+
+	res.Header().Set(pkg.RetryAfterHeader, strconv.Itoa(retryAfter))
+	res.Header().Set("content-type", "application/json")
+	res.WriteHeader(http.StatusTooManyRequests)
+	res.Write(out)
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+func (p *Proxy) bypassesCache(req *http.Request, key string) bool {
+	if p.config.CacheControl == nil || !strings.Contains(req.Header.Get("Cache-Control"), "no-cache") {
+		return false
+	}
+
+	for _, privileged := range p.config.CacheControl.PrivilegedKeys {
+		if privileged == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rateLimitKeys returns the key of the client's rate limit bucket, and the
+// rate limit key whose policy applies to it. Tenants' clients get buckets of
+// their own, under the policy of their client key.
+func (p *Proxy) rateLimitKeys(key string) (string, string) {
+	if p.ethHandler == nil || p.ethHandler.tenants == nil {
+		return key, ""
+	}
+	return p.ethHandler.tenants.Namespaced(key), key
+}
+
+// clientKey identifies a client by its API key, or else by its address. The
+// X-Real-IP header is only honored on connections from trusted proxies, since
+// any other client could rotate it to evade per-IP limits.
+func clientKey(req *http.Request, trustedProxies []*net.IPNet) string {
+	if key := req.Header.Get(pkg.APIKeyHeader); key != "" {
+		return key
+	}
+
+	addr, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		addr = req.RemoteAddr
+	}
+	if realIP := req.Header.Get("x-real-ip"); realIP != "" && isTrustedProxy(trustedProxies, addr) {
+		addr = realIP
+	}
+	return "ip:" + addr
+}
+
+func isTrustedProxy(trustedProxies []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// statusWriter records the status code written to the response for request
+// logging.
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (s *statusWriter) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusWriter) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.written += int64(n)
+	return n, err
+}
+
+// Written returns the number of body bytes written.
+func (s *statusWriter) Written() int64 {
+	return s.written
+}
+
+func (s *statusWriter) Status() int {
+	if s.status == 0 {
+		return http.StatusOK
+	}
+	return s.status
 }
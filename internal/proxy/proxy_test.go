@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/internal/acl"
+	"github.com/kyokan/chaind/internal/egress"
+	"github.com/kyokan/chaind/internal/cache"
+	"github.com/kyokan/chaind/internal/ratelimit"
+	"github.com/kyokan/chaind/pkg/config"
+	chainderrors "github.com/kyokan/chaind/pkg/errors"
+	"github.com/kyokan/chaind/pkg/jsonrpc"
+	"github.com/kyokan/chaind/pkg/version"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailRateLimited(t *testing.T) {
+	dec := ratelimit.Decision{
+		Limit:      10,
+		Reset:      4500 * time.Millisecond,
+		RetryAfter: 400 * time.Millisecond,
+	}
+	res := httptest.NewRecorder()
+	writeRateLimitHeaders(res, dec)
+	failRateLimited(res, dec)
+
+	require.Equal(t, http.StatusTooManyRequests, res.Code)
+	require.Equal(t, "10", res.Header().Get("X-RateLimit-Limit"))
+	require.Equal(t, "0", res.Header().Get("X-RateLimit-Remaining"))
+	require.Equal(t, "5", res.Header().Get("X-RateLimit-Reset"))
+	require.Equal(t, "1", res.Header().Get("Retry-After"))
+
+	var rpcRes jsonrpc.ErrorResponse
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &rpcRes))
+	require.Equal(t, chainderrors.RateLimited, rpcRes.Error.Code)
+	require.Equal(t, map[string]interface{}{"chaind_error": "rate_limited", "retry_after": float64(1)}, rpcRes.Error.Data)
+}
+
+func TestEstimateCost(t *testing.T) {
+	limiter := ratelimit.NewLimiter(&config.RateLimitConfig{
+		RateLimitPolicy: config.RateLimitPolicy{
+			Rate:  1,
+			Burst: 100,
+		},
+		MethodCosts: map[string]int{
+			"eth_getLogs": 10,
+		},
+	})
+	p := &Proxy{limiter: limiter}
+	limiter.TakeN("key", 30)
+
+	res := httptest.NewRecorder()
+	p.handleEstimateCost(res, []byte(`{"jsonrpc":"2.0","id":1,"method":"chaind_estimateCost","params":[[{"method":"eth_getLogs"},{"method":"eth_call"}]]}`), "key")
+	var rpcRes jsonrpc.Response
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &rpcRes))
+	var estimate CostEstimate
+	require.NoError(t, json.Unmarshal(rpcRes.Result, &estimate))
+	require.Equal(t, 11, estimate.Cost)
+	require.Equal(t, 100, estimate.Quota.Limit)
+	require.Equal(t, 70, estimate.Quota.Remaining)
+
+	res = httptest.NewRecorder()
+	p.handleEstimateCost(res, []byte(`{"jsonrpc":"2.0","id":1,"method":"chaind_estimateCost","params":[]}`), "key")
+	var errRes jsonrpc.ErrorResponse
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &errRes))
+	require.Equal(t, -32602, errRes.Error.Code)
+}
+
+func TestFailUnauthorizedAndForbidden(t *testing.T) {
+	res := httptest.NewRecorder()
+	failUnauthorized(res, "token is expired")
+	require.Equal(t, http.StatusUnauthorized, res.Code)
+	require.Equal(t, `Bearer error="invalid_token", error_description="token is expired"`, res.Header().Get("WWW-Authenticate"))
+
+	res = httptest.NewRecorder()
+	failForbidden(res, "eth_sendRawTransaction")
+	require.Equal(t, http.StatusForbidden, res.Code)
+	var rpcRes jsonrpc.ErrorResponse
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &rpcRes))
+	require.Equal(t, chainderrors.MethodBlocked, rpcRes.Error.Code)
+	require.Equal(t, "method eth_sendRawTransaction is not allowed", rpcRes.Error.Message)
+}
+
+func TestFailUnavailable(t *testing.T) {
+	res := httptest.NewRecorder()
+	failUnavailable(res)
+	require.Equal(t, http.StatusServiceUnavailable, res.Code)
+	var rpcRes jsonrpc.ErrorResponse
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &rpcRes))
+	require.Equal(t, chainderrors.BackendUnavailable, rpcRes.Error.Code)
+	require.Equal(t, map[string]interface{}{"chaind_error": "backend_unavailable"}, rpcRes.Error.Data)
+}
+
+func TestFailBusy(t *testing.T) {
+	res := httptest.NewRecorder()
+	failBusy(res)
+	require.Equal(t, http.StatusServiceUnavailable, res.Code)
+	require.Equal(t, "1", res.Header().Get("Retry-After"))
+	var rpcRes jsonrpc.ErrorResponse
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &rpcRes))
+	require.Equal(t, chainderrors.Busy, rpcRes.Error.Code)
+	require.Equal(t, map[string]interface{}{"chaind_error": "busy"}, rpcRes.Error.Data)
+}
+
+func TestFailEgressExceeded(t *testing.T) {
+	res := httptest.NewRecorder()
+	writeEgressHeaders(res, egress.Usage{Bytes: 900, Limit: 1000, Warned: true})
+	require.Equal(t, "1000", res.Header().Get("X-Chaind-Egress-Limit"))
+	require.Equal(t, "900", res.Header().Get("X-Chaind-Egress-Used"))
+	require.Equal(t, "true", res.Header().Get("X-Chaind-Egress-Warning"))
+
+	failEgressExceeded(res, 90*time.Minute)
+	require.Equal(t, http.StatusTooManyRequests, res.Code)
+	require.Equal(t, "5400", res.Header().Get("Retry-After"))
+	var rpcRes jsonrpc.ErrorResponse
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &rpcRes))
+	require.Equal(t, chainderrors.RateLimited, rpcRes.Error.Code)
+	require.Equal(t, "daily egress limit exceeded", rpcRes.Error.Message)
+}
+
+func TestHandleVersion(t *testing.T) {
+	p := &Proxy{config: &config.Config{Features: config.FeaturesConfig{Cache: true, Metrics: true}}}
+	res := httptest.NewRecorder()
+	p.handleVersion(res, httptest.NewRequest(http.MethodGet, VersionPath, nil))
+	require.Equal(t, http.StatusOK, res.Code)
+	var info version.Info
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &info))
+	require.Equal(t, version.Version, info.Version)
+	require.Equal(t, version.Commit, info.Commit)
+	require.Equal(t, []string{"cache", "metrics"}, info.Features)
+}
+
+func TestClientKey(t *testing.T) {
+	trusted, err := acl.ParseCIDRs([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/eth", nil)
+	req.RemoteAddr = "203.0.113.7:4321"
+	req.Header.Set("X-Real-IP", "198.51.100.1")
+	require.Equal(t, "ip:203.0.113.7", clientKey(req, trusted))
+
+	req.RemoteAddr = "10.1.2.3:4321"
+	require.Equal(t, "ip:198.51.100.1", clientKey(req, trusted))
+
+	req.Header.Set("X-Api-Key", "key")
+	require.Equal(t, "key", clientKey(req, trusted))
+}
+
+func TestRateLimitKeysOfTenants(t *testing.T) {
+	p := &Proxy{ethHandler: &EthHandler{}}
+	bucket, policy := p.rateLimitKeys("acme-1")
+	require.Equal(t, "acme-1", bucket)
+	require.Equal(t, "", policy)
+
+	p.UseTenants(cache.NewTenants(cache.NewNopCacher(), []config.TenantConfig{
+		{Name: "acme", Keys: []string{"acme-1"}},
+	}))
+	bucket, policy = p.rateLimitKeys("acme-1")
+	require.Equal(t, "tenant:acme:acme-1", bucket)
+	require.Equal(t, "acme-1", policy)
+	bucket, _ = p.rateLimitKeys("other")
+	require.Equal(t, "other", bucket)
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/jsonrpc"
+)
+
+const (
+	DefaultInitialBackoff = 100 * time.Millisecond
+	DefaultMaxBackoff     = 2 * time.Second
+)
+
+// errUpstreamUnreachable is returned when the backend couldn't be connected
+// to, so the request certainly wasn't processed.
+var errUpstreamUnreachable = errors.New("upstream unreachable")
+
+type retryPolicy struct {
+	maxAttempts int
+	backoff     string
+	initial     time.Duration
+	max         time.Duration
+	codes       map[int]bool
+	idempotent  bool
+}
+
+// Retrier retries failed upstream requests according to the policy of their
+// method class. Classes without a policy are not retried.
+type Retrier struct {
+	policies map[string]*retryPolicy
+}
+
+func NewRetrier(cfg map[string]config.RetryPolicy) *Retrier {
+	r := &Retrier{
+		policies: make(map[string]*retryPolicy),
+	}
+	for class, p := range cfg {
+		policy := &retryPolicy{
+			maxAttempts: p.MaxAttempts,
+			backoff:     p.Backoff,
+			initial:     p.InitialBackoff,
+			max:         p.MaxBackoff,
+			codes:       make(map[int]bool),
+			// sends aren't idempotent unless configured otherwise, since
+			// resubmitting e.g. a transaction that timed out may fail or
+			// race with the original submission
+			idempotent: class != ClassSends,
+		}
+		if p.Idempotent != nil {
+			policy.idempotent = *p.Idempotent
+		}
+		if policy.backoff == "" {
+			policy.backoff = config.BackoffExponential
+		}
+		if policy.initial == 0 {
+			policy.initial = DefaultInitialBackoff
+		}
+		if policy.max == 0 {
+			policy.max = DefaultMaxBackoff
+		}
+		for _, code := range p.RetryCodes {
+			policy.codes[code] = true
+		}
+		r.policies[class] = policy
+	}
+
+	return r
+}
+
+// Do calls fetch until it succeeds, the method's attempts are exhausted, or
+// ctx is done, and returns the result of the last attempt.
+func (r *Retrier) Do(ctx context.Context, method string, fetch func() ([]byte, error)) ([]byte, error) {
+	policy, ok := r.policies[MethodClass(method)]
+	if !ok {
+		return fetch()
+	}
+
+	var body []byte
+	var err error
+	for attempt := 1; ; attempt++ {
+		body, err = fetch()
+		if attempt >= policy.maxAttempts || !policy.retryable(body, err) || ctx.Err() != nil {
+			return body, err
+		}
+
+		traceFrom(ctx).retry()
+		select {
+		case <-time.After(policy.delay(attempt)):
+		case <-ctx.Done():
+			return body, err
+		}
+	}
+}
+
+func (p *retryPolicy) retryable(body []byte, err error) bool {
+	if err == errUpstreamUnreachable {
+		return true
+	}
+	if err != nil {
+		return p.idempotent && err == errBadUpstreamResponse
+	}
+
+	var rpcRes jsonrpc.Response
+	if json.Unmarshal(body, &rpcRes) != nil || rpcRes.Error == nil {
+		return false
+	}
+	return p.codes[rpcRes.Error.Code]
+}
+
+// delay returns the backoff before the attempt following the given one.
+func (p *retryPolicy) delay(attempt int) time.Duration {
+	if p.backoff == config.BackoffConstant {
+		return p.initial
+	}
+	d := p.initial
+	for i := 1; i < attempt && d < p.max; i++ {
+		d *= 2
+	}
+	if d > p.max {
+		d = p.max
+	}
+	return d
+}
+
+func isDialError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetrier(t *testing.T) {
+	notIdempotent := false
+	r := NewRetrier(map[string]config.RetryPolicy{
+		ClassReads: {
+			MaxAttempts:    3,
+			Backoff:        config.BackoffConstant,
+			InitialBackoff: time.Millisecond,
+			RetryCodes:     []int{-32000},
+		},
+		ClassSends: {
+			MaxAttempts:    3,
+			InitialBackoff: time.Millisecond,
+			Idempotent:     &notIdempotent,
+		},
+	})
+	ctx := context.Background()
+
+	var calls int
+	failing := func(err error) func() ([]byte, error) {
+		return func() ([]byte, error) {
+			calls++
+			return nil, err
+		}
+	}
+
+	_, err := r.Do(ctx, "eth_call", failing(errBadUpstreamResponse))
+	require.Equal(t, errBadUpstreamResponse, err)
+	require.Equal(t, 3, calls)
+
+	calls = 0
+	body, err := r.Do(ctx, "eth_call", func() ([]byte, error) {
+		calls++
+		if calls == 1 {
+			return []byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"header not found"}}`), nil
+		}
+		return []byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`), nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, `{"jsonrpc":"2.0","id":1,"result":"0x1"}`, string(body))
+	require.Equal(t, 2, calls)
+
+	// sends may have reached the backend, so they're only retried if it
+	// was unreachable
+	calls = 0
+	_, err = r.Do(ctx, "eth_sendRawTransaction", failing(errBadUpstreamResponse))
+	require.Equal(t, errBadUpstreamResponse, err)
+	require.Equal(t, 1, calls)
+	calls = 0
+	_, err = r.Do(ctx, "eth_sendRawTransaction", failing(errUpstreamUnreachable))
+	require.Equal(t, errUpstreamUnreachable, err)
+	require.Equal(t, 3, calls)
+
+	// classes without a policy aren't retried
+	calls = 0
+	_, err = r.Do(ctx, "eth_getLogs", failing(errBadUpstreamResponse))
+	require.Equal(t, errBadUpstreamResponse, err)
+	require.Equal(t, 1, calls)
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := &retryPolicy{
+		backoff: config.BackoffExponential,
+		initial: 100 * time.Millisecond,
+		max:     time.Second,
+	}
+	require.Equal(t, 100*time.Millisecond, p.delay(1))
+	require.Equal(t, 200*time.Millisecond, p.delay(2))
+	require.Equal(t, 800*time.Millisecond, p.delay(4))
+	require.Equal(t, time.Second, p.delay(10))
+}
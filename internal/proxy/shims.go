@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/kyokan/chaind/pkg/config"
+)
+
+var jsonNull = []byte("null")
+
+// shimFor returns the backend's shim for the method, if any. Shims for a
+// method take precedence over the shim for all methods.
+func shimFor(backend *config.Backend, method string) *config.Shim {
+	var all *config.Shim
+	for i := range backend.Shims {
+		shim := &backend.Shims[i]
+		if shim.Method == method {
+			return shim
+		} else if shim.Method == config.ShimAllMethods {
+			all = shim
+		}
+	}
+	return all
+}
+
+// translateRequest applies the backend's shims to a single request body, so
+// that backends running different node implementations can serve the same
+// client-facing API. Bodies without a matching shim are returned as is.
+func translateRequest(backend *config.Backend, body []byte) ([]byte, error) {
+	if len(backend.Shims) == 0 {
+		return body, nil
+	}
+
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+	var method string
+	if err := json.Unmarshal(req["method"], &method); err != nil {
+		return nil, err
+	}
+	shim := shimFor(backend, method)
+	if shim == nil {
+		return body, nil
+	}
+
+	var params []json.RawMessage
+	if raw := req["params"]; len(raw) > 0 && !bytes.Equal(raw, jsonNull) {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, err
+		}
+	}
+	if shim.TrimNulls {
+		for len(params) > 0 && bytes.Equal(params[len(params)-1], jsonNull) {
+			params = params[:len(params)-1]
+		}
+	}
+	for _, param := range shim.AppendParams {
+		params = append(params, json.RawMessage(param))
+	}
+	if params == nil {
+		params = []json.RawMessage{}
+	}
+	rawParams, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	req["params"] = rawParams
+	if shim.Rename != "" {
+		renamed, err := json.Marshal(shim.Rename)
+		if err != nil {
+			return nil, err
+		}
+		req["method"] = renamed
+	}
+	return json.Marshal(req)
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTranslateRequest(t *testing.T) {
+	backend := &config.Backend{
+		Name: "geth",
+		Shims: []config.Shim{
+			{Method: "trace_transaction", Rename: "debug_traceTransaction", AppendParams: []string{`{"tracer":"callTracer"}`}},
+			{Method: config.ShimAllMethods, TrimNulls: true},
+		},
+	}
+
+	translate := func(body string) string {
+		out, err := translateRequest(backend, []byte(body))
+		require.NoError(t, err)
+		return string(out)
+	}
+	require.Equal(t,
+		`{"id":1,"jsonrpc":"2.0","method":"debug_traceTransaction","params":["0xabc",{"tracer":"callTracer"}]}`,
+		translate(`{"jsonrpc":"2.0","id":1,"method":"trace_transaction","params":["0xabc"]}`),
+	)
+	require.Equal(t,
+		`{"id":1,"jsonrpc":"2.0","method":"eth_getLogs","params":[{"fromBlock":"0x1"}]}`,
+		translate(`{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"fromBlock":"0x1"},null]}`),
+	)
+	require.Equal(t,
+		`{"id":1,"jsonrpc":"2.0","method":"eth_blockNumber","params":[]}`,
+		translate(`{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":null}`),
+	)
+
+	// backends without shims get the client's body as is
+	body := `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":null}`
+	out, err := translateRequest(&config.Backend{Name: "infura"}, []byte(body))
+	require.NoError(t, err)
+	require.Equal(t, body, string(out))
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"errors"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/log"
+)
+
+// StartupGate applies the configured startup policy when no backend is
+// healthy. Services that must not start before a backend is available
+// should depend on it.
+type StartupGate struct {
+	sw           BackendSwitch
+	policy       string
+	pollInterval time.Duration
+	logger       log15.Logger
+}
+
+func NewStartupGate(sw BackendSwitch, policy string) *StartupGate {
+	if policy == "" {
+		policy = config.StartupPolicyDegrade
+	}
+
+	return &StartupGate{
+		sw:           sw,
+		policy:       policy,
+		pollInterval: time.Second,
+		logger:       log.NewLog("proxy/startup_gate"),
+	}
+}
+
+func (g *StartupGate) Start() error {
+	if g.healthy() {
+		return nil
+	}
+
+	switch g.policy {
+	case config.StartupPolicyFailFast:
+		return errors.New("no healthy backends available")
+	case config.StartupPolicyWait:
+		g.logger.Warn("no healthy backends available, waiting for one to recover")
+		start := time.Now()
+		for !g.healthy() {
+			time.Sleep(g.pollInterval)
+		}
+		g.logger.Info("backend recovered, continuing startup", "waited", time.Since(start))
+		return nil
+	default:
+		g.logger.Warn("no healthy backends available, starting anyway")
+		return nil
+	}
+}
+
+func (g *StartupGate) Stop() error {
+	return nil
+}
+
+func (g *StartupGate) healthy() bool {
+	_, err := g.sw.BackendFor(pkg.EthBackend)
+	return err == nil
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+type flakySwitch struct {
+	staticSwitch
+	healthyAfter int32
+	calls        int32
+}
+
+func (f *flakySwitch) BackendFor(t pkg.BackendType) (*config.Backend, error) {
+	if atomic.AddInt32(&f.calls, 1) <= f.healthyAfter {
+		return nil, errors.New("no backends available")
+	}
+
+	return &config.Backend{Name: "test"}, nil
+}
+
+func TestStartupGate(t *testing.T) {
+	require.Error(t, NewStartupGate(&flakySwitch{healthyAfter: 1}, config.StartupPolicyFailFast).Start())
+	require.NoError(t, NewStartupGate(&flakySwitch{healthyAfter: 1}, config.StartupPolicyDegrade).Start())
+	require.NoError(t, NewStartupGate(&flakySwitch{healthyAfter: 0}, config.StartupPolicyFailFast).Start())
+
+	sw := &flakySwitch{healthyAfter: 3}
+	gate := NewStartupGate(sw, config.StartupPolicyWait)
+	gate.pollInterval = time.Millisecond
+	require.NoError(t, gate.Start())
+	require.Equal(t, int32(4), atomic.LoadInt32(&sw.calls))
+}
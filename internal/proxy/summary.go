@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kyokan/chaind/pkg"
+	chainderrors "github.com/kyokan/chaind/pkg/errors"
+	"github.com/kyokan/chaind/pkg/jsonrpc"
+	"github.com/kyokan/chaind/pkg/log"
+)
+
+// ChainSummaryMethod is the extension method that returns a ChainSummary,
+// which dashboards would otherwise assemble from several calls.
+const ChainSummaryMethod = "chaind_chainSummary"
+
+// ChainSummaryPath serves the same summary over plain HTTP GET.
+const ChainSummaryPath = "/summary"
+
+// ChainSummaryTTL is how long a summary is served before it is rebuilt, so
+// that dashboards polling it don't multiply backend load.
+const ChainSummaryTTL = 2 * time.Second
+
+// ChainSummary is the result of chaind_chainSummary. Quantities are hex
+// encoded, as in JSON-RPC results.
+type ChainSummary struct {
+	ChainID         string `json:"chain_id"`
+	HeadNumber      string `json:"head_number"`
+	HeadHash        string `json:"head_hash"`
+	FinalizedNumber string `json:"finalized_number"`
+	// GasPrice is omitted when the head block has no transactions.
+	GasPrice  *GasPricePercentiles `json:"gas_price,omitempty"`
+	Backends  []SummaryBackend     `json:"backends"`
+	UpdatedAt time.Time            `json:"updated_at"`
+}
+
+// SummaryBackend is the public part of a backend's health; errors are left
+// out, since they may contain backend URLs and credentials.
+type SummaryBackend struct {
+	Name    string `json:"name"`
+	State   string `json:"state"`
+	Current bool   `json:"current"`
+}
+
+// GasPricePercentiles are percentiles of the gas prices paid in the head
+// block.
+type GasPricePercentiles struct {
+	P10 string `json:"p10"`
+	P50 string `json:"p50"`
+	P90 string `json:"p90"`
+}
+
+type summaryBlock struct {
+	Number       string `json:"number"`
+	Hash         string `json:"hash"`
+	Transactions []struct {
+		GasPrice string `json:"gasPrice"`
+	} `json:"transactions"`
+}
+
+// chainSummarizer builds chain summaries, and caches them for
+// ChainSummaryTTL. Concurrent callers wait for a single rebuild.
+type chainSummarizer struct {
+	sw      BackendSwitch
+	client  *SwitchClient
+	summary *ChainSummary
+	mtx     sync.Mutex
+	now     func() time.Time
+}
+
+func newChainSummarizer(sw BackendSwitch) *chainSummarizer {
+	return &chainSummarizer{
+		sw:     sw,
+		client: NewSwitchClient(sw),
+		now:    time.Now,
+	}
+}
+
+func (s *chainSummarizer) Summary() (*ChainSummary, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	now := s.now()
+	if s.summary != nil && now.Sub(s.summary.UpdatedAt) < ChainSummaryTTL {
+		return s.summary, nil
+	}
+	summary, err := s.build()
+	if err != nil {
+		return nil, err
+	}
+	summary.UpdatedAt = now
+	s.summary = summary
+	return summary, nil
+}
+
+func (s *chainSummarizer) build() (*ChainSummary, error) {
+	var chainID string
+	if err := s.execute("eth_chainId", nil, &chainID); err != nil {
+		return nil, err
+	}
+	var head summaryBlock
+	if err := s.execute("eth_getBlockByNumber", []interface{}{"latest", true}, &head); err != nil {
+		return nil, err
+	}
+	headNumber, err := jsonrpc.Hex2Uint64(head.Number)
+	if err != nil {
+		return nil, err
+	}
+
+	// backends without the finalized tag, e.g. before the merge, fall back
+	// to chaind's own notion of finality
+	var finalized summaryBlock
+	if err := s.execute("eth_getBlockByNumber", []interface{}{"finalized", false}, &finalized); err != nil || finalized.Number == "" {
+		var number uint64
+		if headNumber > FinalityDepth {
+			number = headNumber - FinalityDepth
+		}
+		finalized.Number = jsonrpc.Uint642Hex(number)
+	}
+
+	health := s.sw.Health(pkg.EthBackend)
+	backends := make([]SummaryBackend, 0, len(health))
+	for _, b := range health {
+		backends = append(backends, SummaryBackend{
+			Name:    b.Name,
+			State:   b.State,
+			Current: b.Current,
+		})
+	}
+	return &ChainSummary{
+		ChainID:         chainID,
+		HeadNumber:      head.Number,
+		HeadHash:        head.Hash,
+		FinalizedNumber: finalized.Number,
+		GasPrice:        gasPricePercentiles(head),
+		Backends:        backends,
+	}, nil
+}
+
+func (s *chainSummarizer) execute(method string, params interface{}, out interface{}) error {
+	res, err := s.client.Execute(method, params)
+	if err != nil {
+		return err
+	}
+	if res.Error != nil {
+		return errors.New(res.Error.Message)
+	}
+	return json.Unmarshal(res.Result, out)
+}
+
+// gasPricePercentiles returns the nearest-rank percentiles of the gas prices
+// paid in the block, or nil if it has no transactions.
+func gasPricePercentiles(block summaryBlock) *GasPricePercentiles {
+	var prices []*big.Int
+	for _, tx := range block.Transactions {
+		if price, err := jsonrpc.Hex2Big(tx.GasPrice); err == nil {
+			prices = append(prices, price)
+		}
+	}
+	if len(prices) == 0 {
+		return nil
+	}
+	sort.Slice(prices, func(i, j int) bool {
+		return prices[i].Cmp(prices[j]) < 0
+	})
+
+	percentile := func(p int) string {
+		i := (len(prices)*p+99)/100 - 1
+		if i < 0 {
+			i = 0
+		}
+		return "0x" + prices[i].Text(16)
+	}
+	return &GasPricePercentiles{
+		P10: percentile(10),
+		P50: percentile(50),
+		P90: percentile(90),
+	}
+}
+
+// hdlChainSummary answers chaind_chainSummary, alone or within a batch.
+func (h *EthHandler) hdlChainSummary(res http.ResponseWriter, req *http.Request, rpcReq *jsonrpc.Request) {
+	summary, err := h.summaries.Summary()
+	if err != nil {
+		h.logger.Warn("failed to build chain summary", log.WithRequestID(req.Context(), "err", err)...)
+		failRequest(res, rpcReq.Id, chainderrors.BackendUnavailable, "failed to build chain summary")
+		return
+	}
+
+	out, err := json.Marshal(summary)
+	if err != nil {
+		failWithInternalError(res, rpcReq.Id, err)
+		return
+	}
+	if err := writeResponse(res, rpcReq.Id, out); err != nil {
+		h.logger.Error("failed to write chain summary", log.WithRequestID(req.Context(), "err", err)...)
+	}
+}
+
+// chainSummaryRequest is the request /summary is answered with.
+var chainSummaryRequest = []byte(`{"jsonrpc":"2.0","id":1,"method":"` + ChainSummaryMethod + `","params":[]}`)
+
+// handleSummary serves the chain summary at ChainSummaryPath. It is
+// requested through the JSON-RPC endpoint, so that it is subject to the same
+// authentication and rate limits.
+func (p *Proxy) handleSummary(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	rpcReq := req.WithContext(req.Context())
+	rpcReq.Method = http.MethodPost
+	rpcReq.Body = ioutil.NopCloser(bytes.NewReader(chainSummaryRequest))
+	rpcReq.ContentLength = int64(len(chainSummaryRequest))
+	interceptor := pkg.NewInterceptor()
+	p.handleETHRequest(interceptor, rpcReq)
+
+	for k, v := range interceptor.Header() {
+		res.Header()[k] = v
+	}
+	var rpcRes jsonrpc.Response
+	if interceptor.IsOK() && json.Unmarshal(interceptor.Body(), &rpcRes) == nil && rpcRes.Error == nil && len(rpcRes.Result) > 0 {
+		res.Header().Set("content-type", "application/json")
+		res.Write(rpcRes.Result)
+		return
+	}
+	status := interceptor.StatusCode()
+	if status == 0 || status == http.StatusOK {
+		status = http.StatusServiceUnavailable
+	}
+	res.WriteHeader(status)
+	res.Write(interceptor.Body())
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/internal/ratelimit"
+	"github.com/kyokan/chaind/internal/stats"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/jsonrpc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChainSummary(t *testing.T) {
+	var calls int
+	finalized := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		var req jsonrpc.Request
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		var result string
+		switch {
+		case req.Method == "eth_chainId":
+			result = `"0x1"`
+		case string(req.Params) == `["latest",true]`:
+			result = `{"number":"0x64","hash":"0xabc","transactions":[{"gasPrice":"0x5"},{"gasPrice":"0x1"},{"gasPrice":"0x3"},{"gasPrice":"0x2"},{"gasPrice":"0x4"}]}`
+		case finalized:
+			result = `{"number":"0x40","hash":"0xdef","transactions":[]}`
+		default:
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32602,"message":"invalid block tag"}}`))
+			return
+		}
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":` + result + `}`))
+	}))
+	defer srv.Close()
+
+	now := time.Now()
+	s := newChainSummarizer(&staticSwitch{backends: []config.Backend{{Name: "local", URL: srv.URL}}})
+	s.now = func() time.Time {
+		return now
+	}
+	summary, err := s.Summary()
+	require.NoError(t, err)
+	require.Equal(t, "0x1", summary.ChainID)
+	require.Equal(t, "0x64", summary.HeadNumber)
+	require.Equal(t, "0xabc", summary.HeadHash)
+	require.Equal(t, "0x40", summary.FinalizedNumber)
+	require.Equal(t, &GasPricePercentiles{P10: "0x1", P50: "0x3", P90: "0x5"}, summary.GasPrice)
+	require.Len(t, summary.Backends, 1)
+	require.Equal(t, 3, calls)
+
+	// summaries are cached
+	_, err = s.Summary()
+	require.NoError(t, err)
+	require.Equal(t, 3, calls)
+
+	// backends without the finalized tag fall back to chaind's finality
+	finalized = false
+	now = now.Add(ChainSummaryTTL)
+	summary, err = s.Summary()
+	require.NoError(t, err)
+	require.Equal(t, 6, calls)
+	require.Equal(t, "0x5d", summary.FinalizedNumber)
+
+	// the summary is answered within batches, alone or not
+	sw := &staticSwitch{backends: []config.Backend{{Name: "local", URL: srv.URL}}}
+	h := NewEthHandler(sw, nil, nil, &nopAuditor{}, nil, stats.NewStore(), nil, nil, nil, nil)
+	h.summaries = s
+	res := httptest.NewRecorder()
+	h.Handle(res, httptest.NewRequest(http.MethodPost, "/eth", strings.NewReader(`[{"jsonrpc":"2.0","id":7,"method":"chaind_chainSummary","params":[]}]`)), &sw.backends[0])
+	var rpcRes []jsonrpc.Response
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &rpcRes))
+	require.Len(t, rpcRes, 1)
+	require.EqualValues(t, 7, rpcRes[0].Id)
+	var got ChainSummary
+	require.NoError(t, json.Unmarshal(rpcRes[0].Result, &got))
+	require.Equal(t, "0x5d", got.FinalizedNumber)
+	require.Equal(t, []SummaryBackend{{Name: "local", State: HealthHealthy}}, got.Backends)
+
+	limiter := ratelimit.NewLimiter(&config.RateLimitConfig{
+		RateLimitPolicy: config.RateLimitPolicy{
+			Rate:  1,
+			Burst: 1,
+		},
+	})
+	p := &Proxy{sw: sw, ethHandler: h, limiter: limiter, config: &config.Config{}}
+	res = httptest.NewRecorder()
+	p.handleSummary(res, httptest.NewRequest(http.MethodGet, ChainSummaryPath, nil))
+	require.Equal(t, http.StatusOK, res.Code)
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &got))
+	require.Equal(t, "0x64", got.HeadNumber)
+
+	// /summary is rate limited like any other request
+	res = httptest.NewRecorder()
+	p.handleSummary(res, httptest.NewRequest(http.MethodGet, ChainSummaryPath, nil))
+	require.Equal(t, http.StatusTooManyRequests, res.Code)
+}
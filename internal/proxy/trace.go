@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kyokan/chaind/pkg"
+)
+
+type debugTraceKey struct{}
+
+// debugTrace records how a request was served, so that it can be reported
+// to clients that send X-Chaind-Debug. Batch requests aggregate the traces
+// of their requests.
+type debugTrace struct {
+	backends    []string
+	cacheHits   int
+	cacheMisses int
+	upstream    int
+	retries     int
+	latency     time.Duration
+	mtx         sync.Mutex
+}
+
+func withDebugTrace(ctx context.Context) (context.Context, *debugTrace) {
+	trace := &debugTrace{}
+	return context.WithValue(ctx, debugTraceKey{}, trace), trace
+}
+
+// traceFrom returns the request's trace, or nil if the client didn't ask
+// for one. All methods are no-ops on a nil trace.
+func traceFrom(ctx context.Context) *debugTrace {
+	trace, _ := ctx.Value(debugTraceKey{}).(*debugTrace)
+	return trace
+}
+
+func (t *debugTrace) servedBy(backend string) {
+	if t == nil {
+		return
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	for _, b := range t.backends {
+		if b == backend {
+			return
+		}
+	}
+	t.backends = append(t.backends, backend)
+}
+
+func (t *debugTrace) cache(hit bool) {
+	if t == nil {
+		return
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if hit {
+		t.cacheHits++
+	} else {
+		t.cacheMisses++
+	}
+}
+
+func (t *debugTrace) upstreamRequest(elapsed time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.upstream++
+	t.latency += elapsed
+}
+
+func (t *debugTrace) retry() {
+	if t == nil {
+		return
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.retries++
+}
+
+func (t *debugTrace) String() string {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return fmt.Sprintf(
+		"backends=%s; cache_hits=%d; cache_misses=%d; upstream_requests=%d; retries=%d; upstream_ms=%d",
+		strings.Join(t.backends, ","),
+		t.cacheHits,
+		t.cacheMisses,
+		t.upstream,
+		t.retries,
+		t.latency/time.Millisecond,
+	)
+}
+
+// debugWriter adds the trace to the response headers before the response
+// is written.
+type debugWriter struct {
+	http.ResponseWriter
+	trace   *debugTrace
+	flushed bool
+}
+
+func (w *debugWriter) WriteHeader(code int) {
+	w.writeTrace()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *debugWriter) Write(b []byte) (int, error) {
+	w.writeTrace()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *debugWriter) writeTrace() {
+	if w.flushed {
+		return
+	}
+	w.flushed = true
+	w.Header().Set(pkg.DebugInfoHeader, w.trace.String())
+}
@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/pkg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugTrace(t *testing.T) {
+	// untraced requests don't record anything
+	traceFrom(context.Background()).cache(true)
+
+	ctx, trace := withDebugTrace(context.Background())
+	traceFrom(ctx).cache(true)
+	traceFrom(ctx).servedBy("infura")
+	traceFrom(ctx).servedBy("infura")
+	traceFrom(ctx).cache(false)
+	traceFrom(ctx).upstreamRequest(120 * time.Millisecond)
+	traceFrom(ctx).retry()
+	traceFrom(ctx).upstreamRequest(30 * time.Millisecond)
+
+	res := httptest.NewRecorder()
+	w := &debugWriter{ResponseWriter: res, trace: trace}
+	w.Write([]byte("{}"))
+	// the trace is only reported once, before the body
+	traceFrom(ctx).servedBy("alchemy")
+	w.Write([]byte("{}"))
+	require.Equal(t, "backends=infura; cache_hits=1; cache_misses=1; upstream_requests=2; retries=1; upstream_ms=150", res.Header().Get(pkg.DebugInfoHeader))
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/kyokan/chaind/internal/wsconn"
+	"github.com/kyokan/chaind/internal/wslimit"
+	"github.com/kyokan/chaind/internal/wsproxy"
+	"github.com/kyokan/chaind/pkg"
+	chainderrors "github.com/kyokan/chaind/pkg/errors"
+	"github.com/kyokan/chaind/pkg/jsonrpc"
+	"github.com/kyokan/chaind/pkg/log"
+)
+
+// handshakeHeaders are the headers of a WebSocket handshake that don't
+// carry over to the requests of its messages.
+var handshakeHeaders = []string{
+	"Connection",
+	"Upgrade",
+	"Sec-Websocket-Key",
+	"Sec-Websocket-Version",
+	"Sec-Websocket-Extensions",
+	"Sec-Websocket-Protocol",
+	pkg.RequestIDHeader,
+}
+
+// serveWebsocket upgrades a request to the RPC endpoint to a WebSocket
+// connection for the client with the given key. Each message is served like
+// a POST to the endpoint with the headers of the handshake, so that it is
+// authenticated, authorized, rate limited and cached like one; subscriptions
+// are held by the hub. Clients over the connection limits are rejected
+// before the handshake.
+func (p *Proxy) serveWebsocket(res http.ResponseWriter, req *http.Request, key string) {
+	session, err := p.websockets.Admit(key)
+	if err != nil {
+		logger.Info("rejected websocket connection over limit", log.WithRequestID(req.Context(), "client", key, "err", err)...)
+		failWebsocketLimit(res, err)
+		return
+	}
+	conn, err := wsconn.Upgrade(res, req)
+	if err != nil {
+		session.Close()
+		logger.Info("rejected websocket handshake", log.WithRequestID(req.Context(), "err", err)...)
+		return
+	}
+	logger.Info("accepted websocket connection", log.WithRequestID(req.Context(), "remote", req.RemoteAddr)...)
+
+	header := make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		header[k] = v
+	}
+	for _, k := range handshakeHeaders {
+		header.Del(k)
+	}
+	header.Set("Content-Type", "application/json")
+
+	session.Serve(req.Context(), conn, func(ctx context.Context, msg []byte) []byte {
+		if len(bytes.TrimSpace(msg)) == 0 {
+			return websocketReply(http.StatusBadRequest, nil)
+		}
+		msgReq := req.WithContext(ctx)
+		msgReq.Method = http.MethodPost
+		msgReq.Header = header.Clone()
+		msgReq.Body = ioutil.NopCloser(bytes.NewReader(msg))
+		msgReq.ContentLength = int64(len(msg))
+		interceptor := pkg.NewInterceptor()
+		p.handleETHRequest(interceptor, msgReq)
+		return websocketReply(interceptor.StatusCode(), interceptor.Body())
+	})
+}
+
+// websocketReply returns the message to answer a WebSocket message with,
+// given the status and body of the response to its request. Failures
+// without a JSON-RPC body, such as malformed requests, are answered with an
+// error.
+func websocketReply(status int, body []byte) []byte {
+	if len(body) > 0 || status == http.StatusNoContent {
+		return body
+	}
+	if status == 0 || status == http.StatusOK {
+		return nil
+	}
+
+	errData := &jsonrpc.ErrorData{
+		Code:    -32603,
+		Message: fmt.Sprintf("request failed with status %d", status),
+	}
+	if status == http.StatusBadRequest {
+		errData = &jsonrpc.ErrorData{
+			Code:    -32700,
+			Message: "parse error",
+		}
+	}
+	out, err := json.Marshal(&jsonrpc.ErrorResponse{
+		Jsonrpc: jsonrpc.Version,
+		Error:   errData,
+	})
+	if err != nil {
+		return []byte(jsonrpc.InternalError)
+	}
+	return out
+}
+
+// failWebsocketLimit rejects a WebSocket handshake over a connection limit:
+// the listener's is answered like a saturated concurrency cap, a client
+// key's like a rate limit. Like failRateLimited, the error has a null ID.
+func failWebsocketLimit(res http.ResponseWriter, limitErr error) {
+	code, status := chainderrors.RateLimited, http.StatusTooManyRequests
+	if limitErr == wslimit.ErrListenerFull {
+		code, status = chainderrors.Busy, http.StatusServiceUnavailable
+		res.Header().Set(pkg.RetryAfterHeader, "1")
+	}
+	out, err := json.Marshal(&jsonrpc.ErrorResponse{
+		Jsonrpc: jsonrpc.Version,
+		Error:   chainderrors.New(code, limitErr.Error(), nil),
+	})
+	if err != nil {
+		out = []byte(jsonrpc.InternalError)
+	}
+	res.Header().Set("content-type", "application/json")
+	res.WriteHeader(status)
+	res.Write(out)
+}
+
+// hdlSubscription answers eth_subscribe and eth_unsubscribe calls made over
+// a WebSocket connection.
+func (h *EthHandler) hdlSubscription(res http.ResponseWriter, req *http.Request, rpcReq *jsonrpc.Request, call *wsproxy.Call) {
+	result, errData := call.Handle(rpcReq.Method, rpcReq.Params)
+	if errData != nil {
+		out, err := json.Marshal(&jsonrpc.ErrorResponse{
+			Jsonrpc: jsonrpc.Version,
+			Id:      rpcReq.Id,
+			Error:   errData,
+		})
+		if err != nil {
+			out = []byte(jsonrpc.InternalError)
+		}
+		res.Write(out)
+		return
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		failWithInternalError(res, rpcReq.Id, err)
+		return
+	}
+	out, err := json.Marshal(&jsonrpc.Response{
+		Jsonrpc: jsonrpc.Version,
+		Id:      rpcReq.Id,
+		Result:  data,
+	})
+	if err != nil {
+		failWithInternalError(res, rpcReq.Id, err)
+		return
+	}
+	res.Write(out)
+	h.logger.Debug("answered subscription call", log.WithRequestID(req.Context(), "method", rpcReq.Method)...)
+}
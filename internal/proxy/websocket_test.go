@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/internal/ratelimit"
+	"github.com/kyokan/chaind/internal/stats"
+	"github.com/kyokan/chaind/internal/wsconn"
+	"github.com/kyokan/chaind/internal/wsproxy"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/jsonrpc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebsocketMessagesAreServedLikeRequests(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	defer backend.Close()
+
+	sw := &staticSwitch{backends: []config.Backend{{Name: "http", URL: backend.URL}}}
+	hub := wsproxy.NewHub(&config.WebsocketConfig{MaxConnectionsPerKey: 1}, func() (*config.Backend, error) {
+		return sw.BackendFor("")
+	})
+	require.NoError(t, hub.Start())
+	defer hub.Stop()
+	p := &Proxy{
+		sw:         sw,
+		ethHandler: NewEthHandler(sw, nil, nil, &nopAuditor{}, nil, stats.NewStore(), nil, nil, nil, nil),
+		limiter: ratelimit.NewLimiter(&config.RateLimitConfig{
+			RateLimitPolicy: config.RateLimitPolicy{
+				Rate:  1,
+				Burst: 3,
+			},
+		}),
+		config:     &config.Config{},
+		websockets: hub,
+	}
+	// the handshake's headers, such as the API key, apply to its messages
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("X-Api-Key", "key")
+		p.handleETHRequest(w, r)
+	}))
+	defer srv.Close()
+	c, err := wsconn.Dial(context.Background(), &config.Backend{WSURL: strings.Replace(srv.URL, "http://", "ws://", 1)})
+	require.NoError(t, err)
+	defer c.Close()
+
+	call := func(msg string) *jsonrpc.ErrorResponse {
+		require.NoError(t, c.WriteText([]byte(msg)))
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		res, err := c.ReadMessage()
+		require.NoError(t, err)
+		var out jsonrpc.ErrorResponse
+		require.NoError(t, json.Unmarshal(res, &out), string(res))
+		return &out
+	}
+
+	require.Nil(t, call(`{"jsonrpc":"2.0","id":1,"method":"eth_chainId","params":[]}`).Error)
+	// subscriptions are held by the hub rather than forwarded
+	res := call(`{"jsonrpc":"2.0","id":2,"method":"eth_subscribe","params":["newHeads"]}`)
+	require.EqualValues(t, 2, res.Id)
+	require.Equal(t, "the backend doesn't support subscriptions", res.Error.Message)
+	require.Equal(t, -32700, call(`{"jsonrpc"`).Error.Code)
+	// and each message is rate limited
+	require.Equal(t, -32005, call(`{"jsonrpc":"2.0","id":3,"method":"eth_chainId","params":[]}`).Error.Code)
+	require.False(t, p.limiter.Peek("key").Allowed)
+
+	// the key holds as many connections as it may
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	httpRes, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer httpRes.Body.Close()
+	require.Equal(t, http.StatusTooManyRequests, httpRes.StatusCode)
+	var out jsonrpc.ErrorResponse
+	require.NoError(t, json.NewDecoder(httpRes.Body).Decode(&out))
+	require.Equal(t, -32005, out.Error.Code)
+}
@@ -0,0 +1,289 @@
+package proxy
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/internal/quarantine"
+	"github.com/kyokan/chaind/internal/stats"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/log"
+)
+
+const (
+	DefaultWeightInterval      = 10 * time.Second
+	DefaultWeightFloor         = 1
+	DefaultWeightCeiling       = 100
+	DefaultWeightIncrease      = 10
+	DefaultWeightDecrease      = 0.5
+	DefaultWeightLatencyTarget = time.Second
+	DefaultWeightMaxErrorRate  = 0.05
+)
+
+// BackendWeight is a backend's adaptive weight, along with what was observed
+// of it in the last interval.
+type BackendWeight struct {
+	Name         string  `json:"name"`
+	Weight       float64 `json:"weight"`
+	Requests     uint64  `json:"requests"`
+	ErrorRate    float64 `json:"error_rate"`
+	AvgLatencyMS float64 `json:"avg_latency_ms"`
+}
+
+// WeightTuner spreads requests over the healthy backends in the current
+// backend's tier in proportion to their weights, and tunes the weights from
+// the latency and error rate each backend showed in the stats store: weights
+// of backends that are struggling are cut multiplicatively, and the others
+// recover additively, so that routing follows the capacity nodes actually
+// have rather than weights set by hand.
+type WeightTuner struct {
+	cfg        config.AdaptiveWeightsConfig
+	sw         BackendSwitch
+	quarantine *quarantine.List
+	stats      *stats.Store
+	weights    map[string]*BackendWeight
+	last       map[string]stats.MethodStats
+	// candidates are the backends that were available when the weights
+	// were last tuned
+	candidates []config.Backend
+	mtx        sync.RWMutex
+	quitChan   chan bool
+	logger     log15.Logger
+	rand       func() float64
+}
+
+// NewWeightTuner creates a WeightTuner. Backends on the quarantine list, which
+// may be nil, are never picked.
+func NewWeightTuner(cfg *config.AdaptiveWeightsConfig, sw BackendSwitch, q *quarantine.List, statsStore *stats.Store) *WeightTuner {
+	tuned := *cfg
+	if tuned.Interval == 0 {
+		tuned.Interval = DefaultWeightInterval
+	}
+	if tuned.Floor == 0 {
+		tuned.Floor = DefaultWeightFloor
+	}
+	if tuned.Ceiling == 0 {
+		tuned.Ceiling = math.Max(DefaultWeightCeiling, tuned.Floor)
+	}
+	if tuned.Increase == 0 {
+		tuned.Increase = DefaultWeightIncrease
+	}
+	if tuned.Decrease == 0 {
+		tuned.Decrease = DefaultWeightDecrease
+	}
+	if tuned.LatencyTarget == 0 {
+		tuned.LatencyTarget = DefaultWeightLatencyTarget
+	}
+	if tuned.MaxErrorRate == 0 {
+		tuned.MaxErrorRate = DefaultWeightMaxErrorRate
+	}
+
+	return &WeightTuner{
+		cfg:        tuned,
+		sw:         sw,
+		quarantine: q,
+		stats:      statsStore,
+		weights:    make(map[string]*BackendWeight),
+		last:       make(map[string]stats.MethodStats),
+		quitChan:   make(chan bool),
+		logger:     log.NewLog("proxy/weight_tuner"),
+		rand:       rand.Float64,
+	}
+}
+
+func (w *WeightTuner) Start() error {
+	w.last = w.stats.Backends()
+	candidates := w.availableBackends()
+	w.mtx.Lock()
+	w.candidates = candidates
+	w.mtx.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(w.cfg.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				w.tune()
+			case <-w.quitChan:
+				return
+			}
+		}
+	}()
+
+	w.logger.Info("started", "interval", w.cfg.Interval, "floor", w.cfg.Floor, "ceiling", w.cfg.Ceiling)
+	return nil
+}
+
+func (w *WeightTuner) Stop() error {
+	w.quitChan <- true
+	return nil
+}
+
+// Weights returns the weight of each backend. Backends start at the
+// ceiling.
+func (w *WeightTuner) Weights() []BackendWeight {
+	w.mtx.RLock()
+	defer w.mtx.RUnlock()
+
+	var out []BackendWeight
+	for _, backend := range w.sw.Backends(pkg.EthBackend) {
+		weight := BackendWeight{
+			Name:   backend.Name,
+			Weight: w.cfg.Ceiling,
+		}
+		if tuned, ok := w.weights[backend.Name]; ok {
+			weight = *tuned
+		}
+		out = append(out, weight)
+	}
+	return out
+}
+
+// Pick returns the backend to send a request to, given the switch's current
+// backend: one of the available backends in its tier, chosen at random in
+// proportion to their weights. The current backend is returned as is while
+// it was selected by an operator, e.g. to drain another backend.
+func (w *WeightTuner) Pick(current *config.Backend) *config.Backend {
+	if w.sw.Manual(pkg.EthBackend) {
+		return current
+	}
+	// candidates are rechecked against the live health table, since they
+	// may have failed a healthcheck since the weights were last tuned
+	available := w.availableNames()
+
+	w.mtx.RLock()
+	defer w.mtx.RUnlock()
+
+	// the current backend is a candidate even if it wasn't available at the
+	// last tuning
+	total := w.weightOf(current.Name)
+	count := 1
+	for i := range w.candidates {
+		if w.pickable(&w.candidates[i], current, available) {
+			total += w.weightOf(w.candidates[i].Name)
+			count++
+		}
+	}
+	if count < 2 || total <= 0 {
+		return current
+	}
+
+	target := w.rand()*total - w.weightOf(current.Name)
+	if target < 0 {
+		return current
+	}
+	for i := range w.candidates {
+		if !w.pickable(&w.candidates[i], current, available) {
+			continue
+		}
+		target -= w.weightOf(w.candidates[i].Name)
+		if target < 0 {
+			return &w.candidates[i]
+		}
+	}
+	return current
+}
+
+// pickable reports whether requests for the current backend may be sent to
+// the candidate instead, given the names of the available backends. It must
+// be called with mtx held.
+func (w *WeightTuner) pickable(candidate *config.Backend, current *config.Backend, available map[string]bool) bool {
+	if candidate.Tier != current.Tier || candidate.Name == current.Name || !available[candidate.Name] {
+		return false
+	}
+	return w.quarantine == nil || !w.quarantine.IsQuarantined(candidate.Name)
+}
+
+// weightOf returns a backend's weight. It must be called with mtx held.
+func (w *WeightTuner) weightOf(name string) float64 {
+	if tuned, ok := w.weights[name]; ok {
+		return tuned.Weight
+	}
+	return w.cfg.Ceiling
+}
+
+// availableNames returns the names of the backends that are healthy, or
+// haven't been checked yet.
+func (w *WeightTuner) availableNames() map[string]bool {
+	available := make(map[string]bool)
+	for _, entry := range w.sw.Health(pkg.EthBackend) {
+		if entry.State == HealthHealthy || entry.State == HealthUnknown {
+			available[entry.Name] = true
+		}
+	}
+	return available
+}
+
+// availableBackends returns the backends that are healthy, or haven't been
+// checked yet, in config order.
+func (w *WeightTuner) availableBackends() []config.Backend {
+	available := w.availableNames()
+	var out []config.Backend
+	for _, backend := range w.sw.Backends(pkg.EthBackend) {
+		if available[backend.Name] {
+			out = append(out, backend)
+		}
+	}
+	return out
+}
+
+// tune adjusts each backend's weight from the requests it served since the
+// last call, and refreshes the candidates of Pick. Backends that served no
+// requests keep their weight.
+func (w *WeightTuner) tune() {
+	curr := w.stats.Backends()
+	backends := w.sw.Backends(pkg.EthBackend)
+	candidates := w.availableBackends()
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	w.candidates = candidates
+
+	for _, backend := range backends {
+		weight, ok := w.weights[backend.Name]
+		if !ok {
+			weight = &BackendWeight{
+				Name:   backend.Name,
+				Weight: w.cfg.Ceiling,
+			}
+			w.weights[backend.Name] = weight
+		}
+
+		now := curr[backend.Name]
+		prev := w.last[backend.Name]
+		weight.Requests = now.Requests - prev.Requests
+		if weight.Requests == 0 {
+			weight.ErrorRate = 0
+			weight.AvgLatencyMS = 0
+			continue
+		}
+		weight.ErrorRate = float64(now.Errors-prev.Errors) / float64(weight.Requests)
+		avgLatency := (now.TotalLatency - prev.TotalLatency) / time.Duration(weight.Requests)
+		weight.AvgLatencyMS = float64(avgLatency) / float64(time.Millisecond)
+
+		prevWeight := weight.Weight
+		if weight.ErrorRate > w.cfg.MaxErrorRate || avgLatency > w.cfg.LatencyTarget {
+			weight.Weight = math.Max(w.cfg.Floor, weight.Weight*w.cfg.Decrease)
+		} else {
+			weight.Weight = math.Min(w.cfg.Ceiling, weight.Weight+w.cfg.Increase)
+		}
+		if weight.Weight < prevWeight {
+			w.logger.Info("decreased backend weight", "name", backend.Name, "weight", weight.Weight, "error_rate", weight.ErrorRate, "avg_latency", avgLatency)
+		}
+	}
+
+	// backends removed e.g. by service discovery are forgotten
+	for name := range w.weights {
+		if !hasBackendNamed(backends, name) {
+			delete(w.weights, name)
+		}
+	}
+	w.last = curr
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/internal/quarantine"
+	"github.com/kyokan/chaind/internal/stats"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWeightTunerAIMD(t *testing.T) {
+	store := stats.NewStore()
+	sw := &staticSwitch{backends: []config.Backend{{Name: "a"}, {Name: "b"}}}
+	tuner := NewWeightTuner(&config.AdaptiveWeightsConfig{
+		Floor:         10,
+		Ceiling:       100,
+		Increase:      20,
+		LatencyTarget: 100 * time.Millisecond,
+	}, sw, nil, store)
+
+	record := func(backend string, n int, elapsed time.Duration, failed bool) {
+		for i := 0; i < n; i++ {
+			store.Record(&stats.Event{Method: "eth_call", Backend: backend, Elapsed: elapsed, Failed: failed})
+		}
+	}
+	weightOf := func(name string) BackendWeight {
+		for _, w := range tuner.Weights() {
+			if w.Name == name {
+				return w
+			}
+		}
+		t.Fatalf("no weight for %s", name)
+		return BackendWeight{}
+	}
+
+	// a is too slow and b fails too often, so both are cut in half
+	record("a", 10, 200*time.Millisecond, false)
+	record("b", 9, 10*time.Millisecond, false)
+	record("b", 1, 10*time.Millisecond, true)
+	tuner.tune()
+	require.Equal(t, 50.0, weightOf("a").Weight)
+	require.Equal(t, 200.0, weightOf("a").AvgLatencyMS)
+	require.Equal(t, 50.0, weightOf("b").Weight)
+	require.Equal(t, 0.1, weightOf("b").ErrorRate)
+
+	// but never below the floor
+	for i := 0; i < 3; i++ {
+		record("a", 10, 200*time.Millisecond, false)
+		tuner.tune()
+	}
+	require.Equal(t, 10.0, weightOf("a").Weight)
+
+	// healthy backends recover additively, up to the ceiling, and idle ones
+	// keep their weight
+	record("a", 10, 10*time.Millisecond, false)
+	tuner.tune()
+	require.Equal(t, 30.0, weightOf("a").Weight)
+	require.Equal(t, 50.0, weightOf("b").Weight)
+	for i := 0; i < 5; i++ {
+		record("b", 10, 10*time.Millisecond, false)
+		tuner.tune()
+	}
+	require.Equal(t, 100.0, weightOf("b").Weight)
+}
+
+func TestWeightTunerPick(t *testing.T) {
+	sw := &staticSwitch{
+		backends: []config.Backend{
+			{Name: "a"},
+			{Name: "b"},
+			{Name: "c"},
+			{Name: "cheap", Tier: 1},
+		},
+		unhealthy: map[string]bool{"c": true},
+	}
+	q, err := quarantine.NewList(&config.QuarantineConfig{})
+	require.NoError(t, err)
+	tuner := NewWeightTuner(&config.AdaptiveWeightsConfig{}, sw, q, stats.NewStore())
+	tuner.tune()
+	tuner.weights["a"] = &BackendWeight{Name: "a", Weight: 25}
+	tuner.weights["b"] = &BackendWeight{Name: "b", Weight: 75}
+
+	// only available backends in the current backend's tier are picked, in
+	// proportion to their weights
+	picks := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		r := float64(i) / 100
+		tuner.rand = func() float64 {
+			return r
+		}
+		picks[tuner.Pick(&sw.backends[0]).Name]++
+	}
+	require.Equal(t, map[string]int{"a": 25, "b": 75}, picks)
+
+	require.Equal(t, "cheap", tuner.Pick(&sw.backends[3]).Name)
+
+	// quarantined backends are skipped right away
+	q.Drain("b")
+	tuner.rand = func() float64 {
+		return 0.99
+	}
+	require.Equal(t, "a", tuner.Pick(&sw.backends[0]).Name)
+	q.Release("b")
+	require.Equal(t, "b", tuner.Pick(&sw.backends[0]).Name)
+
+	// as are backends that failed a healthcheck since the last tuning
+	sw.unhealthy["b"] = true
+	require.Equal(t, "a", tuner.Pick(&sw.backends[0]).Name)
+	delete(sw.unhealthy, "b")
+
+	// and requests stick to backends selected by an operator
+	sw.manual = true
+	require.Equal(t, "a", tuner.Pick(&sw.backends[0]).Name)
+}
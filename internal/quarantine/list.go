@@ -0,0 +1,224 @@
+package quarantine
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/log"
+)
+
+const DefaultDuration = 5 * time.Minute
+
+// DefaultFailures is the number of consecutive failed healthchecks after
+// which a backend is ejected.
+const DefaultFailures = 3
+
+const (
+	ReasonHealthcheck = "failed healthcheck"
+	ReasonDrained     = "drained"
+)
+
+type Entry struct {
+	Backend string `json:"backend"`
+	Reason  string `json:"reason"`
+	// Until is zero for entries that last until they are released.
+	Until time.Time `json:"until,omitempty"`
+}
+
+// List tracks quarantined backends and persists them to a file, so that a
+// restart doesn't route traffic back to a known-bad backend.
+type List struct {
+	file     string
+	duration time.Duration
+	failures int
+	entries  map[string]*Entry
+	mtx      sync.Mutex
+	logger   log15.Logger
+	now      func() time.Time
+}
+
+func NewList(cfg *config.QuarantineConfig) (*List, error) {
+	duration := cfg.Duration
+	if duration == 0 {
+		duration = DefaultDuration
+	}
+	failures := cfg.Failures
+	if failures == 0 {
+		failures = DefaultFailures
+	}
+
+	l := &List{
+		file:     cfg.File,
+		duration: duration,
+		failures: failures,
+		entries:  make(map[string]*Entry),
+		logger:   log.NewLog("quarantine"),
+		now:      time.Now,
+	}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Failures returns the number of consecutive failed healthchecks after which
+// a backend should be ejected.
+func (l *List) Failures() int {
+	return l.failures
+}
+
+// Eject quarantines a backend for the configured duration.
+func (l *List) Eject(backend string, reason string) {
+	l.add(&Entry{
+		Backend: backend,
+		Reason:  reason,
+		Until:   l.now().Add(l.duration),
+	})
+}
+
+// Drain quarantines a backend until it is released.
+func (l *List) Drain(backend string) {
+	l.add(&Entry{
+		Backend: backend,
+		Reason:  ReasonDrained,
+	})
+}
+
+// Release removes a backend from quarantine. It returns false if the backend
+// wasn't quarantined.
+func (l *List) Release(backend string) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if _, ok := l.entries[backend]; !ok {
+		return false
+	}
+	delete(l.entries, backend)
+	l.save()
+	return true
+}
+
+func (l *List) IsQuarantined(backend string) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	entry, ok := l.entries[backend]
+	if !ok {
+		return false
+	}
+	if l.expired(entry) {
+		delete(l.entries, backend)
+		l.save()
+		return false
+	}
+
+	return true
+}
+
+// Entries returns the active quarantine entries.
+func (l *List) Entries() []Entry {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	out := make([]Entry, 0, len(l.entries))
+	for _, entry := range l.entries {
+		if !l.expired(entry) {
+			out = append(out, *entry)
+		}
+	}
+
+	return out
+}
+
+// Restore adds the active entries exported by another instance, e.g. during
+// a blue/green cutover. It returns the number of entries restored.
+func (l *List) Restore(entries []Entry) int {
+	var restored int
+	for i := range entries {
+		entry := entries[i]
+		if entry.Backend == "" || l.expired(&entry) {
+			continue
+		}
+		l.add(&entry)
+		restored++
+	}
+
+	return restored
+}
+
+func (l *List) add(entry *Entry) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	// don't let a failed healthcheck shorten a manual drain
+	if existing, ok := l.entries[entry.Backend]; ok && existing.Until.IsZero() && !entry.Until.IsZero() {
+		return
+	}
+	l.entries[entry.Backend] = entry
+	l.logger.Warn("quarantined backend", "backend", entry.Backend, "reason", entry.Reason, "until", entry.Until)
+	l.save()
+}
+
+func (l *List) expired(entry *Entry) bool {
+	return !entry.Until.IsZero() && !l.now().Before(entry.Until)
+}
+
+func (l *List) load() error {
+	data, err := ioutil.ReadFile(l.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var entries []*Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !l.expired(entry) {
+			l.entries[entry.Backend] = entry
+		}
+	}
+
+	return nil
+}
+
+// save must be called with the lock held. Failures are logged rather than
+// returned, since the in-memory list is still authoritative.
+func (l *List) save() {
+	entries := make([]*Entry, 0, len(l.entries))
+	for _, entry := range l.entries {
+		entries = append(entries, entry)
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		l.logger.Error("failed to marshal quarantine list", "err", err)
+		return
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(l.file), ".tmp-")
+	if err == nil {
+		_, err = tmp.Write(data)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), l.file)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		l.logger.Error("failed to persist quarantine list", "file", l.file, "err", err)
+	}
+}
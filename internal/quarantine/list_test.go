@@ -0,0 +1,62 @@
+package quarantine
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListPersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chaind-quarantine")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := &config.QuarantineConfig{
+		File:     path.Join(dir, "quarantine.json"),
+		Duration: time.Minute,
+	}
+	l, err := NewList(cfg)
+	require.NoError(t, err)
+	l.Eject("flaky", ReasonHealthcheck)
+	l.Drain("maintenance")
+	require.True(t, l.IsQuarantined("flaky"))
+	require.False(t, l.IsQuarantined("healthy"))
+
+	reloaded, err := NewList(cfg)
+	require.NoError(t, err)
+	require.True(t, reloaded.IsQuarantined("flaky"))
+	require.True(t, reloaded.IsQuarantined("maintenance"))
+	require.Len(t, reloaded.Entries(), 2)
+
+	now := time.Now().Add(time.Minute)
+	reloaded.now = func() time.Time {
+		return now
+	}
+	require.False(t, reloaded.IsQuarantined("flaky"))
+	require.True(t, reloaded.IsQuarantined("maintenance"))
+
+	require.True(t, reloaded.Release("maintenance"))
+	require.False(t, reloaded.Release("maintenance"))
+	reloaded, err = NewList(cfg)
+	require.NoError(t, err)
+	require.Empty(t, reloaded.Entries())
+}
+
+func TestEjectDoesNotShortenDrain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chaind-quarantine")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	l, err := NewList(&config.QuarantineConfig{
+		File: path.Join(dir, "quarantine.json"),
+	})
+	require.NoError(t, err)
+	l.Drain("maintenance")
+	l.Eject("maintenance", ReasonHealthcheck)
+	require.Equal(t, ReasonDrained, l.Entries()[0].Reason)
+}
@@ -0,0 +1,369 @@
+package ratelimit
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/events"
+	"github.com/kyokan/chaind/pkg/log"
+)
+
+const idleBucketTTL = 10 * time.Minute
+
+// Decision is the outcome of taking a token. Limit, Remaining and Reset
+// describe the bucket after the take, for reporting to clients.
+type Decision struct {
+	Allowed bool
+	Delay   time.Duration
+	// Limit is the bucket size
+	Limit int
+	// Remaining is the number of whole tokens left
+	Remaining int
+	// Reset is the time until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is the time until a token is available when the request
+	// was not allowed
+	RetryAfter time.Duration
+}
+
+type bucket struct {
+	tokens   float64
+	last     time.Time
+	policy   *config.RateLimitPolicy
+	lastUsed time.Time
+}
+
+// Limiter is a token bucket rate limiter keyed by API key. Each key refills
+// at its policy's sustained rate up to its burst size. Keys in soft limit
+// mode are delayed rather than rejected, as long as the delay fits within
+// the policy's max delay.
+type Limiter struct {
+	defaultPolicy *config.RateLimitPolicy
+	policies      map[string]*config.RateLimitPolicy
+	costs         map[string]int
+	buckets       map[string]*bucket
+	mtx           sync.Mutex
+	bus           *events.Bus
+	quitChan      chan bool
+	logger        log15.Logger
+	now           func() time.Time
+}
+
+func NewLimiter(cfg *config.RateLimitConfig) *Limiter {
+	return &Limiter{
+		defaultPolicy: &cfg.RateLimitPolicy,
+		policies:      policyMap(cfg),
+		costs:         cfg.MethodCosts,
+		buckets:       make(map[string]*bucket),
+		quitChan:      make(chan bool),
+		logger:        log.NewLog("ratelimit"),
+		now:           time.Now,
+	}
+}
+
+// WatchConfig makes the limiter apply the rate limit policies of configs
+// reloaded on the bus. It must be called before Start.
+func (l *Limiter) WatchConfig(bus *events.Bus) {
+	l.bus = bus
+}
+
+func (l *Limiter) Start() error {
+	// a nil channel never receives, so without a bus only the ticker fires
+	var reloads <-chan events.Event
+	var sub *events.Subscription
+	if l.bus != nil {
+		sub = l.bus.Subscribe(events.ConfigReload)
+		reloads = sub.Events()
+	}
+
+	go func() {
+		tick := time.NewTicker(time.Minute)
+
+		for {
+			select {
+			case <-tick.C:
+				l.sweep()
+			case ev := <-reloads:
+				data, ok := ev.Data.(events.ConfigReloadData)
+				if ok && data.Config != nil && data.Config.RateLimitConfig != nil {
+					l.Update(data.Config.RateLimitConfig)
+				}
+			case <-l.quitChan:
+				tick.Stop()
+				if sub != nil {
+					sub.Close()
+				}
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (l *Limiter) Stop() error {
+	l.quitChan <- true
+	return nil
+}
+
+// Take consumes a token for the given key. If the key is in soft limit mode
+// and the bucket is empty, the returned decision carries the delay the caller
+// must wait before proceeding.
+func (l *Limiter) Take(key string) Decision {
+	return l.TakeN(key, 1)
+}
+
+// TakeN consumes n tokens for the given key, like Take. Costs above the
+// bucket size are charged as a full bucket, so that they can still be served.
+func (l *Limiter) TakeN(key string, n int) Decision {
+	return l.TakeNAs(key, "", n)
+}
+
+// TakeNAs consumes n tokens for the given key, like TakeN, under the policy
+// of the rate limit key named tier, e.g. as assigned by an external
+// authorizer. Unknown or empty tiers use the key's own policy.
+func (l *Limiter) TakeNAs(key string, tier string, n int) Decision {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := l.now()
+	policy := l.PolicyFor(key)
+	if tierPolicy, ok := l.policies[tier]; ok {
+		policy = tierPolicy
+	}
+	b := l.bucketWith(key, policy, now)
+	if b.policy != policy {
+		b.refill(now)
+		b.policy = policy
+		b.tokens = math.Min(b.tokens, burstSize(policy))
+	}
+	b.lastUsed = now
+	b.refill(now)
+	cost := math.Min(float64(n), burstSize(b.policy))
+
+	if b.tokens >= cost {
+		b.tokens -= cost
+		return b.decision(true, 0)
+	}
+
+	delay := b.timeUntil(cost)
+	if !b.policy.SoftLimit || delay > b.policy.MaxDelay {
+		dec := b.decision(false, 0)
+		dec.RetryAfter = delay
+		return dec
+	}
+
+	// reserve the tokens now so concurrent callers queue up behind this one
+	b.tokens -= cost
+	return b.decision(true, delay)
+}
+
+// Peek reports the key's quota without consuming any tokens.
+func (l *Limiter) Peek(key string) Decision {
+	return l.PeekAs(key, "")
+}
+
+// PeekAs reports the key's quota like Peek, for a key rate limited under the
+// policy of the rate limit key named tier, as with TakeNAs.
+func (l *Limiter) PeekAs(key string, tier string) Decision {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := l.now()
+	policy := l.PolicyFor(key)
+	if tierPolicy, ok := l.policies[tier]; ok {
+		policy = tierPolicy
+	}
+	b := l.bucketWith(key, policy, now)
+	b.refill(now)
+	return b.decision(b.tokens >= 1, 0)
+}
+
+// Cost returns the number of tokens charged for an HTTP request making the
+// given calls. Without method costs, every HTTP request costs one token.
+func (l *Limiter) Cost(methods []string) int {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if len(l.costs) == 0 {
+		return 1
+	}
+	var cost int
+	for _, method := range methods {
+		if c, ok := l.costs[method]; ok {
+			cost += c
+		} else if c, ok := l.costs[namespaceWildcard(method)]; ok {
+			cost += c
+		} else {
+			cost++
+		}
+	}
+	return cost
+}
+
+// namespaceWildcard returns the method_costs key that matches every method
+// of the method's namespace, e.g. ots_* for ots_getBlockDetails.
+func namespaceWildcard(method string) string {
+	i := strings.IndexByte(method, '_')
+	if i == -1 {
+		return ""
+	}
+	return method[:i+1] + "*"
+}
+
+// BucketState is the state of a key's bucket, as exported for handing quotas
+// over to another instance.
+type BucketState struct {
+	Key    string    `json:"key"`
+	Tokens float64   `json:"tokens"`
+	At     time.Time `json:"at"`
+}
+
+// Buckets returns the state of the buckets of the keys seen recently.
+func (l *Limiter) Buckets() []BucketState {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	out := make([]BucketState, 0, len(l.buckets))
+	for key, b := range l.buckets {
+		out = append(out, BucketState{
+			Key:    key,
+			Tokens: b.tokens,
+			At:     b.last,
+		})
+	}
+	return out
+}
+
+// Restore applies buckets exported by another instance. Buckets refill for
+// the time since they were exported, and keys that already spent more of
+// their quota here keep their current bucket, so that a cutover never hands
+// out a fresh burst allowance. It returns the number of buckets restored.
+func (l *Limiter) Restore(states []BucketState) int {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := l.now()
+	for _, state := range states {
+		b := l.bucketFor(state.Key, now)
+		b.refill(now)
+		b.lastUsed = now
+		last := state.At
+		if last.After(now) {
+			last = now
+		}
+		imported := &bucket{
+			tokens: state.Tokens,
+			last:   last,
+			policy: b.policy,
+		}
+		imported.refill(now)
+		b.tokens = math.Min(b.tokens, imported.tokens)
+	}
+	l.logger.Info("restored rate limit buckets", "keys", len(states))
+	return len(states)
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(burstSize(b.policy), b.tokens+now.Sub(b.last).Seconds()*b.policy.Rate)
+	b.last = now
+}
+
+func (b *bucket) decision(allowed bool, delay time.Duration) Decision {
+	burst := burstSize(b.policy)
+	return Decision{
+		Allowed:   allowed,
+		Delay:     delay,
+		Limit:     int(burst),
+		Remaining: int(math.Max(0, math.Floor(b.tokens))),
+		Reset:     b.timeUntil(burst),
+	}
+}
+
+// timeUntil returns how long the bucket takes to refill to the given number
+// of tokens.
+func (b *bucket) timeUntil(tokens float64) time.Duration {
+	if b.tokens >= tokens {
+		return 0
+	}
+
+	return time.Duration((tokens - b.tokens) / b.policy.Rate * float64(time.Second))
+}
+
+// Update swaps in new policies without resetting the state of existing
+// buckets, so clients don't get a fresh burst allowance on every reload.
+func (l *Limiter) Update(cfg *config.RateLimitConfig) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.defaultPolicy = &cfg.RateLimitPolicy
+	l.policies = policyMap(cfg)
+	l.costs = cfg.MethodCosts
+	for key, b := range l.buckets {
+		b.policy = l.PolicyFor(key)
+		b.tokens = math.Min(b.tokens, burstSize(b.policy))
+	}
+	l.logger.Info("updated rate limit policies", "keys", len(l.policies))
+}
+
+func (l *Limiter) PolicyFor(key string) *config.RateLimitPolicy {
+	if policy, ok := l.policies[key]; ok {
+		return policy
+	}
+
+	return l.defaultPolicy
+}
+
+func (l *Limiter) bucketFor(key string, now time.Time) *bucket {
+	return l.bucketWith(key, l.PolicyFor(key), now)
+}
+
+// bucketWith returns the bucket of key, creating it under policy if it
+// doesn't exist yet.
+func (l *Limiter) bucketWith(key string, policy *config.RateLimitPolicy, now time.Time) *bucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{
+			tokens: burstSize(policy),
+			last:   now,
+			policy: policy,
+		}
+		l.buckets[key] = b
+	}
+
+	return b
+}
+
+func (l *Limiter) sweep() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := l.now()
+	for key, b := range l.buckets {
+		if now.Sub(b.lastUsed) > idleBucketTTL {
+			delete(l.buckets, key)
+		}
+	}
+	l.logger.Debug("swept idle rate limit buckets", "remaining", len(l.buckets))
+}
+
+func burstSize(policy *config.RateLimitPolicy) float64 {
+	if policy.Burst < 1 {
+		return 1
+	}
+
+	return float64(policy.Burst)
+}
+
+func policyMap(cfg *config.RateLimitConfig) map[string]*config.RateLimitPolicy {
+	policies := make(map[string]*config.RateLimitPolicy)
+	for i := range cfg.Keys {
+		policies[cfg.Keys[i].Key] = &cfg.Keys[i].RateLimitPolicy
+	}
+
+	return policies
+}
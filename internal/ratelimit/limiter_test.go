@@ -0,0 +1,222 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/events"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	return f.now
+}
+
+func newTestLimiter(clock *fakeClock) *Limiter {
+	l := NewLimiter(&config.RateLimitConfig{
+		RateLimitPolicy: config.RateLimitPolicy{
+			Rate:  1,
+			Burst: 2,
+		},
+		Keys: []config.RateLimitKey{
+			{
+				Key: "soft",
+				RateLimitPolicy: config.RateLimitPolicy{
+					Rate:      10,
+					Burst:     1,
+					SoftLimit: true,
+					MaxDelay:  150 * time.Millisecond,
+				},
+			},
+		},
+	})
+	l.now = clock.Now
+	return l
+}
+
+func TestLimiterBurstThenSustained(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	l := newTestLimiter(clock)
+
+	require.True(t, l.Take("a").Allowed)
+	require.True(t, l.Take("a").Allowed)
+	require.False(t, l.Take("a").Allowed)
+	require.True(t, l.Take("b").Allowed)
+
+	clock.now = clock.now.Add(time.Second)
+	require.True(t, l.Take("a").Allowed)
+	require.False(t, l.Take("a").Allowed)
+
+	clock.now = clock.now.Add(time.Hour)
+	require.True(t, l.Take("a").Allowed)
+	require.True(t, l.Take("a").Allowed)
+	require.False(t, l.Take("a").Allowed)
+}
+
+func TestLimiterSoftLimit(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	l := newTestLimiter(clock)
+
+	dec := l.Take("soft")
+	require.True(t, dec.Allowed)
+	require.Equal(t, time.Duration(0), dec.Delay)
+
+	dec = l.Take("soft")
+	require.True(t, dec.Allowed)
+	require.Equal(t, 100*time.Millisecond, dec.Delay)
+
+	dec = l.Take("soft")
+	require.False(t, dec.Allowed)
+
+	clock.now = clock.now.Add(200 * time.Millisecond)
+	dec = l.Take("soft")
+	require.True(t, dec.Allowed)
+	require.Equal(t, time.Duration(0), dec.Delay)
+}
+
+func TestLimiterSweep(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	l := newTestLimiter(clock)
+	l.Take("a")
+	clock.now = clock.now.Add(idleBucketTTL + time.Second)
+	l.sweep()
+	require.Len(t, l.buckets, 0)
+}
+
+func TestLimiterDecisionReportsQuota(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	l := newTestLimiter(clock)
+
+	dec := l.Take("a")
+	require.Equal(t, 2, dec.Limit)
+	require.Equal(t, 1, dec.Remaining)
+	require.Equal(t, time.Second, dec.Reset)
+
+	l.Take("a")
+	dec = l.Take("a")
+	require.False(t, dec.Allowed)
+	require.Equal(t, 0, dec.Remaining)
+	require.Equal(t, 2*time.Second, dec.Reset)
+	require.Equal(t, time.Second, dec.RetryAfter)
+}
+
+func TestLimiterWatchConfig(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	l := newTestLimiter(clock)
+	bus := events.NewBus()
+	l.WatchConfig(bus)
+	require.NoError(t, l.Start())
+	defer l.Stop()
+
+	bus.Publish(events.ConfigReload, events.ConfigReloadData{
+		Config: &config.Config{
+			RateLimitConfig: &config.RateLimitConfig{
+				RateLimitPolicy: config.RateLimitPolicy{Rate: 5, Burst: 10},
+			},
+		},
+	})
+	burst := func() int {
+		l.mtx.Lock()
+		defer l.mtx.Unlock()
+		return l.defaultPolicy.Burst
+	}
+	for i := 0; i < 100 && burst() != 10; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, 10, burst())
+}
+
+func TestLimiterMethodCosts(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	l := newTestLimiter(clock)
+	require.Equal(t, 1, l.Cost([]string{"eth_getLogs", "eth_call"}))
+
+	l.Update(&config.RateLimitConfig{
+		RateLimitPolicy: config.RateLimitPolicy{
+			Rate:  1,
+			Burst: 10,
+		},
+		MethodCosts: map[string]int{
+			"eth_getLogs":         5,
+			"eth_blockNumber":     0,
+			"ots_*":               3,
+			"ots_getBlockDetails": 2,
+		},
+	})
+	require.Equal(t, 6, l.Cost([]string{"eth_getLogs", "eth_call", "eth_blockNumber"}))
+	require.Equal(t, 5, l.Cost([]string{"ots_searchTransactionsBefore", "ots_getBlockDetails"}))
+
+	require.True(t, l.TakeN("a", 6).Allowed)
+	require.Equal(t, 4, l.Peek("a").Remaining)
+	require.Equal(t, 4, l.Peek("a").Remaining)
+	dec := l.TakeN("a", 5)
+	require.False(t, dec.Allowed)
+	require.Equal(t, time.Second, dec.RetryAfter)
+
+	// costs above the burst size are charged as a full bucket
+	clock.now = clock.now.Add(time.Hour)
+	require.True(t, l.TakeN("a", 50).Allowed)
+	require.Equal(t, 0, l.Peek("a").Remaining)
+}
+
+func TestLimiterRestore(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	blue := newTestLimiter(clock)
+	blue.TakeN("a", 2)
+	blue.TakeN("b", 1)
+	states := blue.Buckets()
+	require.Len(t, states, 2)
+
+	// the cutover takes a second, during which a's bucket refills a token,
+	// while b already spent its tokens on the new instance
+	clock.now = clock.now.Add(time.Second)
+	green := newTestLimiter(clock)
+	green.TakeN("b", 2)
+	require.Equal(t, 2, green.Restore(states))
+	require.Equal(t, 1, green.Peek("a").Remaining)
+	require.Equal(t, 0, green.Peek("b").Remaining)
+	require.Equal(t, 2, green.Peek("c").Remaining)
+}
+
+func TestLimiterTakeNAsTier(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	l := newTestLimiter(clock)
+	l.Update(&config.RateLimitConfig{
+		RateLimitPolicy: config.RateLimitPolicy{
+			Rate:  1,
+			Burst: 2,
+		},
+		Keys: []config.RateLimitKey{
+			{
+				Key: "gold",
+				RateLimitPolicy: config.RateLimitPolicy{
+					Rate:  1,
+					Burst: 5,
+				},
+			},
+		},
+	})
+
+	require.True(t, l.TakeNAs("a", "gold", 4).Allowed)
+	dec := l.TakeNAs("a", "gold", 1)
+	require.True(t, dec.Allowed)
+	require.Equal(t, 5, dec.Limit)
+	require.False(t, l.TakeNAs("a", "gold", 1).Allowed)
+
+	// unknown tiers fall back to the key's own policy
+	require.True(t, l.TakeNAs("b", "platinum", 2).Allowed)
+	dec = l.TakeNAs("b", "platinum", 1)
+	require.False(t, dec.Allowed)
+	require.Equal(t, 2, dec.Limit)
+
+	// quotas are peeked under the same policy
+	dec = l.PeekAs("c", "gold")
+	require.True(t, dec.Allowed)
+	require.Equal(t, 5, dec.Limit)
+	require.Equal(t, 5, dec.Remaining)
+}
@@ -0,0 +1,299 @@
+package scorecard
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/internal/proxy"
+	"github.com/kyokan/chaind/internal/stats"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/log"
+)
+
+const DefaultInterval = 24 * time.Hour
+
+// sampleInterval is how often the health table is sampled for availability.
+const sampleInterval = 10 * time.Second
+
+// reportBuffer bounds the reports waiting to be written; further reports are
+// dropped rather than holding up sampling.
+const reportBuffer = 4
+
+// Report is the scorecard of every backend over one reporting period.
+type Report struct {
+	Start    time.Time       `json:"start"`
+	End      time.Time       `json:"end"`
+	Backends []*BackendScore `json:"backends"`
+	// TierSeconds is the time traffic was routed to each backend cost tier.
+	TierSeconds map[string]float64 `json:"tier_seconds"`
+}
+
+type BackendScore struct {
+	Name string `json:"name"`
+	Tier int    `json:"tier"`
+	// Availability is the fraction of the period's health samples in which
+	// the backend was healthy.
+	Availability float64 `json:"availability"`
+	Requests     uint64  `json:"requests"`
+	Errors       uint64  `json:"errors"`
+	P95MS        float64 `json:"p95_ms"`
+	// ErrorKinds breaks down Errors by kind, e.g. timeout.
+	ErrorKinds map[string]uint64 `json:"error_kinds"`
+	// BehindIncidents is the number of times the backend failed its
+	// healthchecks because it was syncing or had fallen behind.
+	BehindIncidents int `json:"behind_incidents"`
+}
+
+type totals struct {
+	backends  map[string]stats.MethodStats
+	errors    map[string]map[string]uint64
+	tierTimes map[int]time.Duration
+}
+
+// Reporter compiles a scorecard of every backend once per interval, and
+// appends it as a JSON line to a file and/or POSTs it to a webhook. Reports
+// are aligned to multiples of the interval in UTC, so daily reports cover
+// whole days.
+type Reporter struct {
+	cfg      *config.ScorecardConfig
+	sw       proxy.BackendSwitch
+	store    *stats.Store
+	interval time.Duration
+	client   *http.Client
+	start    time.Time
+	prev     *totals
+	samples  map[string]int
+	healthy  map[string]int
+	down     map[string]bool
+	behind   map[string]int
+	reports  chan []byte
+	quitChan chan bool
+	logger   log15.Logger
+	now      func() time.Time
+}
+
+func NewReporter(cfg *config.ScorecardConfig, sw proxy.BackendSwitch, store *stats.Store) *Reporter {
+	interval := cfg.Interval
+	if interval == 0 {
+		interval = DefaultInterval
+	}
+
+	return &Reporter{
+		cfg:      cfg,
+		sw:       sw,
+		store:    store,
+		interval: interval,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		samples:  make(map[string]int),
+		healthy:  make(map[string]int),
+		down:     make(map[string]bool),
+		behind:   make(map[string]int),
+		reports:  make(chan []byte, reportBuffer),
+		quitChan: make(chan bool),
+		logger:   log.NewLog("scorecard"),
+		now:      time.Now,
+	}
+}
+
+func (r *Reporter) Start() error {
+	r.start = r.now()
+	r.prev = r.totals()
+	r.sample()
+
+	go func() {
+		tick := time.NewTicker(sampleInterval)
+		timer := time.NewTimer(r.untilNextReport())
+
+		for {
+			select {
+			case <-tick.C:
+				r.sample()
+			case <-timer.C:
+				r.report()
+				timer.Reset(r.untilNextReport())
+			case <-r.quitChan:
+				tick.Stop()
+				timer.Stop()
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case data := <-r.reports:
+				r.write(data)
+			case <-r.quitChan:
+				return
+			}
+		}
+	}()
+
+	r.logger.Info("started", "interval", r.interval, "file", r.cfg.File, "webhook_url", r.cfg.WebhookURL)
+	return nil
+}
+
+func (r *Reporter) Stop() error {
+	close(r.quitChan)
+	return nil
+}
+
+// untilNextReport returns the time until the next multiple of the interval,
+// e.g. the next midnight UTC for daily reports.
+func (r *Reporter) untilNextReport() time.Duration {
+	now := r.now()
+	return now.Truncate(r.interval).Add(r.interval).Sub(now)
+}
+
+// sample records the current health of every backend. Backends that haven't
+// been checked yet aren't counted.
+func (r *Reporter) sample() {
+	for _, health := range r.sw.Health(pkg.EthBackend) {
+		if health.State == proxy.HealthUnknown {
+			continue
+		}
+
+		name := health.Name
+		r.samples[name]++
+		if health.State == proxy.HealthHealthy {
+			r.healthy[name]++
+			r.down[name] = false
+			continue
+		}
+		if !r.down[name] && health.LastError == proxy.ErrBackendSyncing.Error() {
+			r.behind[name]++
+		}
+		r.down[name] = true
+	}
+}
+
+// report compiles the scorecard, and hands it to the writer goroutine so
+// that a slow webhook doesn't delay sampling.
+func (r *Reporter) report() {
+	rep := r.compile()
+	data, err := json.Marshal(rep)
+	if err != nil {
+		r.logger.Error("failed to marshal scorecard", "err", err)
+		return
+	}
+
+	select {
+	case r.reports <- data:
+	default:
+		r.logger.Error("dropped scorecard, writer is backed up", "start", rep.Start, "end", rep.End)
+	}
+	r.logger.Info("compiled scorecard", "backends", len(rep.Backends))
+}
+
+func (r *Reporter) write(data []byte) {
+	if r.cfg.File != "" {
+		if err := appendLine(r.cfg.File, data); err != nil {
+			r.logger.Error("failed to write scorecard", "file", r.cfg.File, "err", err)
+		}
+	}
+	if r.cfg.WebhookURL != "" {
+		if err := r.push(data); err != nil {
+			r.logger.Error("failed to push scorecard", "webhook_url", r.cfg.WebhookURL, "err", err)
+		}
+	}
+}
+
+// compile builds the report for the period since the previous one, and
+// starts the next period.
+func (r *Reporter) compile() *Report {
+	now := r.now()
+	curr := r.totals()
+	rep := &Report{
+		Start:       r.start,
+		End:         now,
+		TierSeconds: make(map[string]float64),
+	}
+	for tier, d := range curr.tierTimes {
+		if delta := d - r.prev.tierTimes[tier]; delta > 0 {
+			rep.TierSeconds[strconv.Itoa(tier)] = delta.Seconds()
+		}
+	}
+
+	p95s := make(map[string]float64)
+	rows := r.store.Query(&stats.Query{
+		From:    r.start,
+		GroupBy: []string{stats.GroupBackend},
+	})
+	for _, row := range rows {
+		p95s[row.Backend] = row.P95MS
+	}
+
+	for _, health := range r.sw.Health(pkg.EthBackend) {
+		name := health.Name
+		score := &BackendScore{
+			Name:            name,
+			Tier:            health.Tier,
+			Availability:    1,
+			Requests:        curr.backends[name].Requests - r.prev.backends[name].Requests,
+			Errors:          curr.backends[name].Errors - r.prev.backends[name].Errors,
+			P95MS:           p95s[name],
+			ErrorKinds:      make(map[string]uint64),
+			BehindIncidents: r.behind[name],
+		}
+		if r.samples[name] > 0 {
+			score.Availability = float64(r.healthy[name]) / float64(r.samples[name])
+		}
+		for kind, count := range curr.errors[name] {
+			if d := count - r.prev.errors[name][kind]; d > 0 {
+				score.ErrorKinds[kind] = d
+			}
+		}
+		rep.Backends = append(rep.Backends, score)
+	}
+	sort.Slice(rep.Backends, func(i, j int) bool {
+		return rep.Backends[i].Name < rep.Backends[j].Name
+	})
+
+	r.start = now
+	r.prev = curr
+	r.samples = make(map[string]int)
+	r.healthy = make(map[string]int)
+	r.behind = make(map[string]int)
+	return rep
+}
+
+func (r *Reporter) totals() *totals {
+	return &totals{
+		backends:  r.store.Backends(),
+		errors:    r.store.BackendErrors(),
+		tierTimes: r.store.TierTimes(),
+	}
+}
+
+func (r *Reporter) push(data []byte) error {
+	res, err := r.client.Post(r.cfg.WebhookURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+func appendLine(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
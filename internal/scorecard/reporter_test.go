@@ -0,0 +1,123 @@
+package scorecard
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/internal/proxy"
+	"github.com/kyokan/chaind/internal/stats"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+type healthSwitch struct {
+	proxy.BackendSwitch
+	health []proxy.BackendHealth
+}
+
+func (h *healthSwitch) Health(t pkg.BackendType) []proxy.BackendHealth {
+	return h.health
+}
+
+func TestReporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chaind-scorecard")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	pushed := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		pushed <- body
+	}))
+	defer srv.Close()
+
+	store := stats.NewStore()
+	store.Record(&stats.Event{Method: "eth_call", Backend: "infura", Failed: true, Error: stats.ErrorTimeout})
+	sw := &healthSwitch{
+		health: []proxy.BackendHealth{
+			{Name: "infura", Tier: 1},
+			{Name: "alchemy", Tier: 0},
+		},
+	}
+
+	file := path.Join(dir, "scorecard.jsonl")
+	r := NewReporter(&config.ScorecardConfig{
+		File:       file,
+		WebhookURL: srv.URL,
+	}, sw, store)
+	now := time.Unix(1000, 0)
+	r.now = func() time.Time {
+		return now
+	}
+	r.start = now
+	r.prev = r.totals()
+
+	store.Record(&stats.Event{Method: "eth_call", Backend: "alchemy", Elapsed: 10 * time.Millisecond})
+	store.Record(&stats.Event{Method: "eth_call", Backend: "infura", Failed: true, Error: stats.ErrorTimeout})
+	store.Record(&stats.Event{Method: "eth_call", Backend: "infura", Failed: true, Error: stats.ErrorRejected})
+	store.Record(&stats.Event{Method: "eth_call", Backend: "infura"})
+	store.AddTierTime(0, 30*time.Second)
+	// infura falls behind for one of ten samples, and alchemy goes down for
+	// the last one
+	sample := func(infura string, infuraErr string, alchemy string) {
+		sw.health[0].State = infura
+		sw.health[0].LastError = infuraErr
+		sw.health[1].State = alchemy
+		r.sample()
+	}
+	sample(proxy.HealthHealthy, "", proxy.HealthHealthy)
+	sample(proxy.HealthUnhealthy, proxy.ErrBackendSyncing.Error(), proxy.HealthHealthy)
+	for i := 0; i < 7; i++ {
+		sample(proxy.HealthHealthy, "", proxy.HealthHealthy)
+	}
+	sample(proxy.HealthHealthy, "", proxy.HealthUnhealthy)
+	now = now.Add(100 * time.Second)
+	r.report()
+	r.write(<-r.reports)
+
+	data, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, string(data), string(<-pushed)+"\n")
+
+	var rep Report
+	require.NoError(t, json.Unmarshal(data, &rep))
+	require.Len(t, rep.Backends, 2)
+	alchemy, infura := rep.Backends[0], rep.Backends[1]
+	require.Equal(t, "alchemy", alchemy.Name)
+	require.Equal(t, uint64(1), alchemy.Requests)
+	require.Equal(t, 0.9, alchemy.Availability)
+	require.Equal(t, 0, alchemy.BehindIncidents)
+	require.Equal(t, "infura", infura.Name)
+	require.Equal(t, 1, infura.Tier)
+	require.Equal(t, uint64(3), infura.Requests)
+	require.Equal(t, uint64(2), infura.Errors)
+	require.Equal(t, map[string]uint64{stats.ErrorTimeout: 1, stats.ErrorRejected: 1}, infura.ErrorKinds)
+	require.Equal(t, 0.9, infura.Availability)
+	require.Equal(t, 1, infura.BehindIncidents)
+	require.Equal(t, map[string]float64{"0": 30}, rep.TierSeconds)
+
+	// samples start over in the next period
+	sample(proxy.HealthHealthy, "", proxy.HealthUnhealthy)
+	now = now.Add(100 * time.Second)
+	rep2 := r.compile()
+	require.Equal(t, 0.0, rep2.Backends[0].Availability)
+	require.Equal(t, 1.0, rep2.Backends[1].Availability)
+	require.Equal(t, 0, rep2.Backends[1].BehindIncidents)
+	require.Equal(t, uint64(0), rep2.Backends[1].Requests)
+	require.Empty(t, rep2.Backends[1].ErrorKinds)
+}
+
+func TestReporterAlignsToInterval(t *testing.T) {
+	r := NewReporter(&config.ScorecardConfig{File: "unused"}, &healthSwitch{}, stats.NewStore())
+	r.now = func() time.Time {
+		return time.Date(2020, 1, 1, 18, 30, 0, 0, time.UTC)
+	}
+	require.Equal(t, 5*time.Hour+30*time.Minute, r.untilNextReport())
+}
@@ -0,0 +1,214 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/log"
+)
+
+const initialBackoff = time.Second
+const maxBackoff = time.Minute
+
+// failures further apart than this don't count towards backoff
+const backoffResetAfter = 5 * time.Minute
+
+type entry struct {
+	name string
+	svc  pkg.Service
+	deps []string
+}
+
+// Manager starts services in dependency order, stops them in reverse order
+// and restarts services that report failures with exponential backoff.
+type Manager struct {
+	entries  map[string]*entry
+	names    []string
+	started  []*entry
+	quitChan chan bool
+	quitOnce sync.Once
+	wg       sync.WaitGroup
+	mtx      sync.Mutex
+	logger   log15.Logger
+	sleep    func(d time.Duration, quit <-chan bool) bool
+}
+
+func NewManager() *Manager {
+	return &Manager{
+		entries:  make(map[string]*entry),
+		quitChan: make(chan bool),
+		logger:   log.NewLog("service_manager"),
+		sleep:    sleep,
+	}
+}
+
+// Register adds a service that will be started after all of the named
+// dependencies have started.
+func (m *Manager) Register(name string, svc pkg.Service, deps ...string) {
+	if _, ok := m.entries[name]; ok {
+		panic(fmt.Sprintf("service %s registered twice", name))
+	}
+
+	m.entries[name] = &entry{
+		name: name,
+		svc:  svc,
+		deps: deps,
+	}
+	m.names = append(m.names, name)
+}
+
+func (m *Manager) Start() error {
+	order, err := m.startOrder()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range order {
+		m.logger.Info("starting service", "name", e.name)
+		if err := e.svc.Start(); err != nil {
+			m.logger.Error("failed to start service, stopping started services", "name", e.name, "err", err)
+			m.Stop()
+			return fmt.Errorf("failed to start %s: %s", e.name, err)
+		}
+
+		m.mtx.Lock()
+		m.started = append(m.started, e)
+		m.mtx.Unlock()
+		if fs, ok := e.svc.(pkg.FailingService); ok {
+			m.wg.Add(1)
+			go m.supervise(e, fs)
+		}
+	}
+
+	return nil
+}
+
+func (m *Manager) Stop() error {
+	m.quitOnce.Do(func() {
+		close(m.quitChan)
+	})
+	m.wg.Wait()
+	return m.stopStarted()
+}
+
+func (m *Manager) stopStarted() error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	var lastErr error
+	for i := len(m.started) - 1; i >= 0; i-- {
+		e := m.started[i]
+		m.logger.Info("stopping service", "name", e.name)
+		if err := e.svc.Stop(); err != nil {
+			m.logger.Error("failed to stop service", "name", e.name, "err", err)
+			lastErr = err
+		}
+	}
+	m.started = nil
+
+	return lastErr
+}
+
+func (m *Manager) supervise(e *entry, fs pkg.FailingService) {
+	defer m.wg.Done()
+
+	backoff := initialBackoff
+	var lastFailure time.Time
+	for {
+		var failure error
+		select {
+		case failure = <-fs.Failures():
+		case <-m.quitChan:
+			return
+		}
+
+		if time.Since(lastFailure) > backoffResetAfter {
+			backoff = initialBackoff
+		}
+		lastFailure = time.Now()
+
+		for {
+			m.logger.Error("service failed, restarting", "name", e.name, "err", failure, "backoff", backoff)
+			if !m.sleep(backoff, m.quitChan) {
+				return
+			}
+			backoff = nextBackoff(backoff)
+
+			m.mtx.Lock()
+			if err := e.svc.Stop(); err != nil {
+				m.logger.Warn("failed to stop failed service", "name", e.name, "err", err)
+			}
+			failure = e.svc.Start()
+			m.mtx.Unlock()
+			if failure == nil {
+				m.logger.Info("restarted service", "name", e.name)
+				break
+			}
+		}
+	}
+}
+
+// startOrder sorts the registered services topologically, preserving
+// registration order between services that don't depend on each other.
+func (m *Manager) startOrder() ([]*entry, error) {
+	var order []*entry
+	visited := make(map[string]bool)
+	visiting := make(map[string]bool)
+
+	var visit func(name string, from string) error
+	visit = func(name string, from string) error {
+		e, ok := m.entries[name]
+		if !ok {
+			return fmt.Errorf("service %s depends on unknown service %s", from, name)
+		}
+		if visited[name] {
+			return nil
+		}
+		if visiting[name] {
+			return fmt.Errorf("dependency cycle detected at service %s", name)
+		}
+
+		visiting[name] = true
+		for _, dep := range e.deps {
+			if err := visit(dep, name); err != nil {
+				return err
+			}
+		}
+		visiting[name] = false
+		visited[name] = true
+		order = append(order, e)
+		return nil
+	}
+
+	for _, name := range m.names {
+		if err := visit(name, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	return order, nil
+}
+
+func nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > maxBackoff {
+		return maxBackoff
+	}
+
+	return backoff
+}
+
+func sleep(d time.Duration, quit <-chan bool) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-quit:
+		return false
+	}
+}
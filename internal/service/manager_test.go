@@ -0,0 +1,133 @@
+package service
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type recorder struct {
+	events []string
+	mtx    sync.Mutex
+}
+
+func (r *recorder) record(ev string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.events = append(r.events, ev)
+}
+
+func (r *recorder) Events() []string {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return append([]string{}, r.events...)
+}
+
+type fakeService struct {
+	name     string
+	rec      *recorder
+	startErr error
+	failures chan error
+}
+
+func (f *fakeService) Start() error {
+	f.rec.record("start " + f.name)
+	return f.startErr
+}
+
+func (f *fakeService) Stop() error {
+	f.rec.record("stop " + f.name)
+	return nil
+}
+
+type failingService struct {
+	fakeService
+}
+
+func (f *failingService) Failures() <-chan error {
+	return f.failures
+}
+
+func TestManagerOrdering(t *testing.T) {
+	rec := new(recorder)
+	m := NewManager()
+	m.Register("proxy", &fakeService{name: "proxy", rec: rec}, "cache", "watcher")
+	m.Register("watcher", &fakeService{name: "watcher", rec: rec}, "switch")
+	m.Register("cache", &fakeService{name: "cache", rec: rec})
+	m.Register("switch", &fakeService{name: "switch", rec: rec})
+
+	require.NoError(t, m.Start())
+	require.NoError(t, m.Stop())
+	require.Equal(t, []string{
+		"start cache",
+		"start switch",
+		"start watcher",
+		"start proxy",
+		"stop proxy",
+		"stop watcher",
+		"stop switch",
+		"stop cache",
+	}, rec.Events())
+}
+
+func TestManagerStartFailure(t *testing.T) {
+	rec := new(recorder)
+	m := NewManager()
+	m.Register("cache", &fakeService{name: "cache", rec: rec})
+	m.Register("proxy", &fakeService{name: "proxy", rec: rec, startErr: errors.New("no port")}, "cache")
+
+	require.Error(t, m.Start())
+	require.Equal(t, []string{
+		"start cache",
+		"start proxy",
+		"stop cache",
+	}, rec.Events())
+}
+
+func TestManagerInvalidDependencies(t *testing.T) {
+	m := NewManager()
+	m.Register("a", &fakeService{rec: new(recorder)}, "b")
+	m.Register("b", &fakeService{rec: new(recorder)}, "a")
+	require.Error(t, m.Start())
+
+	m = NewManager()
+	m.Register("a", &fakeService{rec: new(recorder)}, "missing")
+	require.Error(t, m.Start())
+}
+
+func TestManagerRestartsFailedService(t *testing.T) {
+	rec := new(recorder)
+	svc := &failingService{
+		fakeService: fakeService{
+			name:     "proxy",
+			rec:      rec,
+			failures: make(chan error),
+		},
+	}
+	m := NewManager()
+	var sleeps []time.Duration
+	m.sleep = func(d time.Duration, quit <-chan bool) bool {
+		sleeps = append(sleeps, d)
+		return true
+	}
+	m.Register("proxy", svc)
+
+	require.NoError(t, m.Start())
+	svc.failures <- errors.New("listener died")
+	require.NoError(t, m.Stop())
+	require.Equal(t, []string{
+		"start proxy",
+		"stop proxy",
+		"start proxy",
+		"stop proxy",
+	}, rec.Events())
+	require.Equal(t, []time.Duration{initialBackoff}, sleeps)
+}
+
+func TestNextBackoff(t *testing.T) {
+	require.Equal(t, 2*time.Second, nextBackoff(time.Second))
+	require.Equal(t, maxBackoff, nextBackoff(maxBackoff))
+}
@@ -10,10 +10,35 @@ import (
 	"github.com/kyokan/chaind/internal/audit"
 	"github.com/kyokan/chaind/internal/cache"
 	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/internal/archive"
+	"github.com/kyokan/chaind/internal/ratelimit"
+	"github.com/kyokan/chaind/internal/admin"
+	"github.com/kyokan/chaind/internal/stats"
+	"github.com/kyokan/chaind/internal/service"
+	"github.com/kyokan/chaind/internal/metrics"
+	"github.com/kyokan/chaind/internal/systemd"
+	"github.com/kyokan/chaind/internal/quarantine"
+	"github.com/kyokan/chaind/internal/consul"
+	"github.com/kyokan/chaind/internal/chaos"
+	"github.com/kyokan/chaind/internal/bodylog"
+	"github.com/kyokan/chaind/internal/txtrack"
+	"github.com/kyokan/chaind/internal/headerchain"
+	"github.com/kyokan/chaind/internal/scorecard"
+	"github.com/kyokan/chaind/internal/jwtauth"
+	"github.com/kyokan/chaind/internal/egress"
+	"github.com/kyokan/chaind/internal/blockindex"
+	"github.com/kyokan/chaind/internal/extauthz"
+	"github.com/kyokan/chaind/internal/wshealth"
+	"github.com/kyokan/chaind/internal/wsproxy"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/events"
+	"github.com/kyokan/chaind/pkg/version"
+	"strings"
 	)
 
 func Start(cfg *config.Config) error {
-	if err := config.ValidateConfig(cfg); err != nil {
+	validation := config.Validate(cfg)
+	if err := validation.Err(); err != nil {
 	    return err
 	}
 
@@ -24,30 +49,254 @@ func Start(cfg *config.Config) error {
 		lvl = log15.LvlInfo
 	}
 	log.SetLevel(lvl)
+	log.SetFormat(cfg.LogFormat)
+	build := version.Get(cfg.Features.Enabled())
+	logger.Info("starting chaind", "version", build.Version, "commit", build.Commit, "build_date", build.BuildDate, "features", strings.Join(build.Features, ","))
+	for _, warning := range validation.Warnings {
+		logger.Warn("config warning", "warning", warning)
+	}
 
-	sw := proxy.NewBackendSwitch(cfg.Backends)
-	if err := sw.Start(); err != nil {
-		return err
+	var quarantineList *quarantine.List
+	if cfg.QuarantineConfig != nil {
+		quarantineList, err = quarantine.NewList(cfg.QuarantineConfig)
+		if err != nil {
+			return err
+		}
 	}
 
-	cacher := cache.NewRedisCacher(cfg.RedisConfig)
-	if err := cacher.Start(); err != nil {
-		return err
+	statsStore := stats.NewStore()
+	bus := events.NewBus()
+	mgr := service.NewManager()
+	var faults *chaos.Injector
+	if cfg.ChaosConfig != nil {
+		logger.Warn("fault injection is enabled, do not use in production")
+		faults = chaos.NewInjector(cfg.ChaosConfig)
+	}
+	sw := proxy.NewBackendSwitch(cfg.Backends, quarantineList, statsStore, faults, bus)
+	var swDeps []string
+	if wsMonitor := wshealth.NewMonitor(cfg.Backends); len(wsMonitor.Status()) > 0 {
+		mgr.Register("ws_health", wsMonitor)
+		sw.UseCheck(wsMonitor.Check)
+		swDeps = append(swDeps, "ws_health")
+	}
+	mgr.Register("backend_switch", sw, swDeps...)
+
+	var cacher cache.Cacher
+	var memCache *cache.MemoryCacher
+	if cfg.Features.Cache {
+		cacher = cache.NewRedisCacher(cfg.RedisConfig)
+		if prefix := config.CacheKeyPrefix(cfg.Backends); prefix != "" {
+			cacher = cache.NewPrefixedCacher(cacher, prefix)
+		}
+		if cfg.MemoryCache != nil {
+			memCache = cache.NewMemoryCacher(cacher, cfg.MemoryCache)
+			cacher = memCache
+		}
+	} else {
+		logger.Info("cache disabled")
+		cacher = cache.NewNopCacher()
+	}
+	mgr.Register("cacher", cacher)
+	gateDeps := []string{"backend_switch"}
+	if cfg.ConsulConfig != nil && cfg.ConsulConfig.Service != "" {
+		mgr.Register("consul_discovery", consul.NewDiscovery(cfg.ConsulConfig, cfg.Backends, sw), "backend_switch")
+		gateDeps = append(gateDeps, "consul_discovery")
+	}
+	mgr.Register("startup_gate", proxy.NewStartupGate(sw, cfg.StartupPolicy), gateDeps...)
+	proxyDeps := []string{"startup_gate", "cacher", "block_height_watcher"}
+
+	var arch archive.Archive
+	if cfg.ArchiveConfig != nil {
+		fsArchive, err := archive.NewFSArchive(cfg.ArchiveConfig)
+		if err != nil {
+			return err
+		}
+		arch = fsArchive
+		mgr.Register("archive", arch)
+		proxyDeps = append(proxyDeps, "archive")
+	}
+
+	var limiter *ratelimit.Limiter
+	if cfg.RateLimitConfig != nil {
+		limiter = ratelimit.NewLimiter(cfg.RateLimitConfig)
+		limiter.WatchConfig(bus)
+		mgr.Register("rate_limiter", limiter)
+		proxyDeps = append(proxyDeps, "rate_limiter")
+	}
+
+	var auditor audit.Auditor
+	if cfg.Features.Auditor {
+		auditor, err = audit.NewLogAuditor(cfg.LogAuditorConfig)
+		if err != nil {
+			return err
+		}
+		if days := cfg.LogAuditorConfig.RetentionDays; days > 0 {
+			mgr.Register("audit_pruner", audit.NewPruner(auditor.(*audit.LogAuditor), days))
+		}
+	} else {
+		logger.Info("auditor disabled")
+		auditor = audit.NewNopAuditor()
+	}
+
+	fHelper := proxy.NewBlockHeightWatcher(sw, bus)
+	mgr.Register("block_height_watcher", fHelper, "backend_switch")
+
+	prox := proxy.NewProxy(sw, auditor, cacher, arch, limiter, fHelper, statsStore, cfg)
+	var tenants *cache.Tenants
+	if len(cfg.Tenants) > 0 {
+		tenants = cache.NewTenants(cacher, cfg.Tenants)
+		prox.UseTenants(tenants)
+	}
+	if files := systemd.ListenerFiles(); len(files) > 0 {
+		if len(files) > 1 {
+			logger.Warn("received multiple sockets, only using the first", "count", len(files))
+		}
+		prox.UseListenerFile(files[0])
+	}
+	if faults != nil {
+		prox.UseFaultInjector(faults)
+	}
+	if cfg.HeaderVerification != nil {
+		chain := headerchain.NewChain(cfg.HeaderVerification, proxy.NewSwitchClientFor(sw, cfg.HeaderVerification.Source))
+		mgr.Register("header_chain", chain, "backend_switch")
+		prox.UseHeaderChain(chain, cfg.HeaderVerification.Reject)
+	}
+	var tracker *txtrack.Tracker
+	if cfg.TxTrackerConfig != nil {
+		tracker = txtrack.NewTracker(cfg.TxTrackerConfig, proxy.NewSwitchClient(sw))
+		mgr.Register("tx_tracker", tracker, "backend_switch")
+		prox.UseTxTracker(tracker)
 	}
+	if cfg.BlockIndex != nil {
+		idx := blockindex.NewIndex(cfg.BlockIndex, proxy.NewSwitchClient(sw), bus)
+		mgr.Register("block_index", idx, "backend_switch")
+		prox.UseBlockIndex(idx)
+	}
+	var meter *egress.Meter
+	if cfg.EgressConfig != nil {
+		meter = egress.NewMeter(cfg.EgressConfig)
+		mgr.Register("egress_meter", meter)
+		prox.UseEgressMeter(meter)
+		proxyDeps = append(proxyDeps, "egress_meter")
+	}
+	if cfg.PrewarmConfig != nil {
+		prox.UsePrewarming(cfg.PrewarmConfig)
+	}
+	if cfg.JWTConfig != nil {
+		verifier := jwtauth.NewVerifier(cfg.JWTConfig)
+		mgr.Register("jwt_verifier", verifier)
+		prox.UseJWTVerifier(verifier)
+		proxyDeps = append(proxyDeps, "jwt_verifier")
+	}
+	var tuner *proxy.WeightTuner
+	if cfg.AdaptiveWeights != nil {
+		tuner = proxy.NewWeightTuner(cfg.AdaptiveWeights, sw, quarantineList, statsStore)
+		mgr.Register("weight_tuner", tuner, "backend_switch")
+		prox.UseWeightTuner(tuner)
+		proxyDeps = append(proxyDeps, "weight_tuner")
+	}
+	if cfg.ExtAuthz != nil {
+		prox.UseExternalAuthorizer(extauthz.NewAuthorizer(cfg.ExtAuthz))
+	}
+	if cfg.WebsocketConfig != nil {
+		hub := wsproxy.NewHub(cfg.WebsocketConfig, func() (*config.Backend, error) {
+			return sw.BackendFor(pkg.EthBackend)
+		})
+		mgr.Register("websockets", hub, "backend_switch")
+		prox.UseWebsockets(hub)
+		proxyDeps = append(proxyDeps, "websockets")
+	}
+	mgr.Register("proxy", prox, proxyDeps...)
 
-	auditor, err := audit.NewLogAuditor(cfg.LogAuditorConfig)
+	if cfg.ConsulConfig != nil && cfg.ConsulConfig.RegisterName != "" {
+		mgr.Register("consul_registration", consul.NewSelfRegistration(cfg.ConsulConfig, cfg.RPCPort, cfg.TLSConfig), "proxy")
+	}
+
+	if cfg.Features.Metrics && cfg.MetricsConfig != nil {
+		snapshotter := metrics.NewSnapshotter(cfg.MetricsConfig, statsStore)
+		snapshotter.UseBuildInfo(build)
+		if memCache != nil {
+			snapshotter.UseMemoryCache(memCache.Stats)
+		}
+		mgr.Register("metrics_snapshotter", snapshotter)
+	}
+	if cfg.ScorecardConfig != nil {
+		mgr.Register("scorecard", scorecard.NewReporter(cfg.ScorecardConfig, sw, statsStore), "backend_switch")
+	}
+
+	if cfg.Features.Admin && cfg.AdminConfig != nil {
+		adminSrv := admin.NewServer(cfg, statsStore, bus, func(next *config.Config) error {
+			lvl := log15.LvlInfo
+			if next.LogLevel != "" {
+				parsed, err := log15.LvlFromString(next.LogLevel)
+				if err != nil {
+					return err
+				}
+				lvl = parsed
+			}
+			log.SetLevel(lvl)
+			log.SetFormat(next.LogFormat)
+			return nil
+		})
+		if quarantineList != nil {
+			adminSrv.RegisterQuarantine(quarantineList)
+		}
+		adminSrv.RegisterFailover(proxy.NewDrainer(sw, prox.InFlight()))
+		adminSrv.RegisterHealth(sw)
+		if tuner != nil {
+			adminSrv.RegisterWeights(tuner)
+		}
+		adminSrv.RegisterCache(cacher)
+		if tenants != nil {
+			adminSrv.RegisterTenants(tenants)
+		}
+		if memCache != nil {
+			adminSrv.RegisterMemoryCache(memCache)
+		}
+		adminSrv.RegisterUI(prox)
+		bodies := bodylog.NewSampler()
+		prox.UseBodySampler(bodies)
+		adminSrv.RegisterBodyLogging(bodies)
+		if tracker != nil {
+			adminSrv.RegisterTransactions(tracker)
+		}
+		if meter != nil {
+			adminSrv.RegisterEgress(meter)
+		}
+		if faults != nil {
+			adminSrv.RegisterChaos(faults)
+		}
+		adminSrv.RegisterState(sw, quarantineList, limiter, meter)
+		mgr.Register("admin", adminSrv, "proxy")
+	}
+
+	watchdogInterval, err := systemd.WatchdogInterval()
 	if err != nil {
-		return err
+		logger.Warn("invalid watchdog config, not pinging watchdog", "err", err)
+	} else if watchdogInterval > 0 {
+		mgr.Register("watchdog", systemd.NewWatchdogPinger(watchdogInterval), "proxy")
 	}
 
-	fHelper := proxy.NewBlockHeightWatcher(sw)
-	if err := fHelper.Start(); err != nil {
+	if err := mgr.Start(); err != nil {
 		return err
 	}
+	if err := systemd.Notify(systemd.Ready); err != nil {
+		logger.Warn("failed to notify systemd of readiness", "err", err)
+	}
 
-	prox := proxy.NewProxy(sw, auditor, cacher, fHelper, cfg)
-	if err := prox.Start(); err != nil {
-		return err
+	if logAuditor, ok := auditor.(*audit.LogAuditor); ok {
+		// logrotate sends SIGUSR1 once it moved the audit log away
+		reopen := make(chan os.Signal, 1)
+		signal.Notify(reopen, syscall.SIGUSR1)
+		go func() {
+			for range reopen {
+				if err := logAuditor.Reopen(); err != nil {
+					logger.Error("failed to reopen audit log", "err", err)
+					continue
+				}
+				logger.Info("reopened audit log")
+			}
+		}()
 	}
 
 	sigs := make(chan os.Signal, 1)
@@ -57,17 +306,11 @@ func Start(cfg *config.Config) error {
 	go func() {
 		<-sigs
 		logger.Info("interrupted, shutting down")
-		if err := sw.Stop(); err != nil {
-			logger.Error("failed to stop backend switch", "err", err)
-		}
-		if err := cacher.Stop(); err != nil {
-			logger.Error("failed to stop cacher", "err", err)
-		}
-		if err := fHelper.Stop(); err != nil {
-			logger.Error("failed to stop finalization helper", "err", err)
+		if err := systemd.Notify(systemd.Stopping); err != nil {
+			logger.Warn("failed to notify systemd of shutdown", "err", err)
 		}
-		if err := prox.Stop(); err != nil {
-			logger.Error("failed to stop proxy", "err", err)
+		if err := mgr.Stop(); err != nil {
+			logger.Error("failed to stop services", "err", err)
 		}
 		done <- true
 	}()
@@ -0,0 +1,363 @@
+package stats
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// HistoryRetention is how long hourly request history is kept for queries.
+const HistoryRetention = 7 * 24 * time.Hour
+
+// maxSeriesPerHour caps the distinct client/method/backend combinations
+// tracked per hour, since client keys are supplied by clients. Combinations
+// beyond the cap are counted under OtherTag.
+const maxSeriesPerHour = 10000
+
+const (
+	GroupHour    = "hour"
+	GroupClient  = "client"
+	GroupMethod  = "method"
+	GroupBackend = "backend"
+)
+
+const (
+	SortRequests = "requests"
+	SortErrors   = "errors"
+	SortLatency  = "avg_latency"
+	SortP95      = "p95"
+)
+
+// latencyBounds are the upper bounds of the latency histogram buckets.
+// Percentiles are reported as the bound of the bucket they fall in.
+var latencyBounds = []time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2 * time.Second,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+}
+
+type seriesKey struct {
+	client  string
+	method  string
+	backend string
+}
+
+type series struct {
+	requests     uint64
+	errors       uint64
+	totalLatency time.Duration
+	// latencies has an extra bucket for latencies above the last bound
+	latencies []uint64
+}
+
+type hourBucket struct {
+	start  time.Time
+	series map[seriesKey]*series
+}
+
+// Query selects and aggregates request history. Zero-valued filters match
+// everything.
+type Query struct {
+	From    time.Time
+	To      time.Time
+	Client  string
+	Method  string
+	Backend string
+	GroupBy []string
+	SortBy  string
+	Limit   int
+}
+
+type QueryRow struct {
+	Hour         *time.Time `json:"hour,omitempty"`
+	Client       string     `json:"client,omitempty"`
+	Method       string     `json:"method,omitempty"`
+	Backend      string     `json:"backend,omitempty"`
+	Requests     uint64     `json:"requests"`
+	Errors       uint64     `json:"errors"`
+	AvgLatencyMS float64    `json:"avg_latency_ms"`
+	P50MS        float64    `json:"p50_ms"`
+	P95MS        float64    `json:"p95_ms"`
+	P99MS        float64    `json:"p99_ms"`
+
+	latencies []uint64
+	latency   time.Duration
+}
+
+func (q *Query) Validate() error {
+	for _, group := range q.GroupBy {
+		switch group {
+		case GroupHour, GroupClient, GroupMethod, GroupBackend:
+		default:
+			return fmt.Errorf("invalid group: %s", group)
+		}
+	}
+
+	switch q.SortBy {
+	case "", SortRequests, SortErrors, SortLatency, SortP95:
+	default:
+		return fmt.Errorf("invalid sort: %s", q.SortBy)
+	}
+
+	if q.Limit < 0 {
+		return errors.New("limit cannot be negative")
+	}
+	if !q.To.IsZero() && q.To.Before(q.From) {
+		return errors.New("query must end after it starts")
+	}
+
+	return nil
+}
+
+// recordHistory must be called with the store's mutex held.
+func (s *Store) recordHistory(ev *Event) {
+	now := s.now()
+	start := now.Truncate(time.Hour)
+
+	var bucket *hourBucket
+	if n := len(s.history); n > 0 && s.history[n-1].start.Equal(start) {
+		bucket = s.history[n-1]
+	} else {
+		bucket = &hourBucket{
+			start:  start,
+			series: make(map[seriesKey]*series),
+		}
+		s.history = append(s.history, bucket)
+		s.pruneHistory(now)
+	}
+
+	key := seriesKey{
+		client:  ev.Client,
+		method:  ev.Method,
+		backend: ev.Backend,
+	}
+	sr, ok := bucket.series[key]
+	if !ok {
+		if len(bucket.series) >= maxSeriesPerHour {
+			key = seriesKey{client: OtherTag, method: OtherTag, backend: OtherTag}
+			sr = bucket.series[key]
+		}
+		if sr == nil {
+			sr = &series{
+				latencies: make([]uint64, len(latencyBounds)+1),
+			}
+			bucket.series[key] = sr
+		}
+	}
+
+	sr.requests++
+	if ev.Failed {
+		sr.errors++
+	}
+	sr.totalLatency += ev.Elapsed
+	sr.latencies[latencyBucket(ev.Elapsed)]++
+}
+
+func (s *Store) pruneHistory(now time.Time) {
+	cutoff := now.Add(-HistoryRetention)
+	i := 0
+	for i < len(s.history) && s.history[i].start.Before(cutoff) {
+		i++
+	}
+	s.history = s.history[i:]
+}
+
+// Query aggregates the hourly request history. Since history is kept per
+// hour, From and To are rounded to whole hours.
+func (s *Store) Query(q *Query) []*QueryRow {
+	groups := make(map[groupKey]*QueryRow)
+	var rows []*QueryRow
+	for _, bucket := range s.historySnapshot(q) {
+		for key, sr := range bucket.series {
+			if (q.Client != "" && key.client != q.Client) ||
+				(q.Method != "" && key.method != q.Method) ||
+				(q.Backend != "" && key.backend != q.Backend) {
+				continue
+			}
+
+			gk := groupKeyFor(q.GroupBy, bucket.start, key)
+			row, ok := groups[gk]
+			if !ok {
+				row = gk.row()
+				groups[gk] = row
+				rows = append(rows, row)
+			}
+			row.Requests += sr.requests
+			row.Errors += sr.errors
+			row.latency += sr.totalLatency
+			for i, count := range sr.latencies {
+				row.latencies[i] += count
+			}
+		}
+	}
+
+	for _, row := range rows {
+		if row.Requests > 0 {
+			row.AvgLatencyMS = toMS(row.latency) / float64(row.Requests)
+		}
+		row.P50MS = percentile(row.latencies, 0.5)
+		row.P95MS = percentile(row.latencies, 0.95)
+		row.P99MS = percentile(row.latencies, 0.99)
+	}
+
+	sortRows(rows, q.SortBy)
+	if q.Limit > 0 && len(rows) > q.Limit {
+		rows = rows[:q.Limit]
+	}
+
+	return rows
+}
+
+// historySnapshot returns the hourly buckets in the query's range, so that
+// they can be aggregated without holding the store's mutex. Only the bucket
+// of the current hour is still written to, so it is copied.
+func (s *Store) historySnapshot(q *Query) []*hourBucket {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	from := q.From.Truncate(time.Hour)
+	var buckets []*hourBucket
+	for i, bucket := range s.history {
+		if bucket.start.Before(from) || (!q.To.IsZero() && !bucket.start.Before(q.To)) {
+			continue
+		}
+		if i == len(s.history)-1 {
+			bucket = bucket.copy()
+		}
+		buckets = append(buckets, bucket)
+	}
+
+	return buckets
+}
+
+func (b *hourBucket) copy() *hourBucket {
+	out := &hourBucket{
+		start:  b.start,
+		series: make(map[seriesKey]*series, len(b.series)),
+	}
+	for key, sr := range b.series {
+		copied := *sr
+		copied.latencies = append([]uint64(nil), sr.latencies...)
+		out.series[key] = &copied
+	}
+
+	return out
+}
+
+type groupKey struct {
+	seriesKey
+	hour time.Time
+}
+
+func groupKeyFor(groupBy []string, hour time.Time, key seriesKey) groupKey {
+	var gk groupKey
+	for _, group := range groupBy {
+		switch group {
+		case GroupHour:
+			gk.hour = hour
+		case GroupClient:
+			gk.client = key.client
+		case GroupMethod:
+			gk.method = key.method
+		case GroupBackend:
+			gk.backend = key.backend
+		}
+	}
+
+	return gk
+}
+
+func (g groupKey) row() *QueryRow {
+	row := &QueryRow{
+		Client:    g.client,
+		Method:    g.method,
+		Backend:   g.backend,
+		latencies: make([]uint64, len(latencyBounds)+1),
+	}
+	if !g.hour.IsZero() {
+		hour := g.hour
+		row.Hour = &hour
+	}
+
+	return row
+}
+
+func sortRows(rows []*QueryRow, sortBy string) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		switch sortBy {
+		case SortRequests:
+			return a.Requests > b.Requests
+		case SortErrors:
+			return a.Errors > b.Errors
+		case SortLatency:
+			return a.AvgLatencyMS > b.AvgLatencyMS
+		case SortP95:
+			return a.P95MS > b.P95MS
+		}
+
+		// unsorted queries are ordered chronologically, then by name
+		if a.Hour != nil && !a.Hour.Equal(*b.Hour) {
+			return a.Hour.Before(*b.Hour)
+		}
+		if a.Client != b.Client {
+			return a.Client < b.Client
+		}
+		if a.Method != b.Method {
+			return a.Method < b.Method
+		}
+		return a.Backend < b.Backend
+	})
+}
+
+func latencyBucket(d time.Duration) int {
+	for i, bound := range latencyBounds {
+		if d <= bound {
+			return i
+		}
+	}
+
+	return len(latencyBounds)
+}
+
+func percentile(latencies []uint64, p float64) float64 {
+	var total uint64
+	for _, count := range latencies {
+		total += count
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := uint64(math.Ceil(p * float64(total)))
+	var seen uint64
+	for i, count := range latencies {
+		seen += count
+		if seen >= rank {
+			if i == len(latencyBounds) {
+				// above the last bound, so the bound is the best estimate
+				i--
+			}
+			return toMS(latencyBounds[i])
+		}
+	}
+
+	return 0
+}
+
+func toMS(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,68 @@
+package stats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreQuery(t *testing.T) {
+	s := NewStore()
+	now := time.Date(2018, 6, 1, 12, 30, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		s.Record(&Event{Client: "alice", Method: "eth_call", Backend: "infura", Elapsed: 40 * time.Millisecond})
+	}
+	s.Record(&Event{Client: "alice", Method: "eth_getLogs", Backend: "local", Elapsed: 400 * time.Millisecond, Failed: true})
+	s.Record(&Event{Client: "bob", Method: "eth_blockNumber", Backend: "local", Elapsed: time.Millisecond})
+	now = now.Add(time.Hour)
+	s.Record(&Event{Client: "alice", Method: "eth_getLogs", Backend: "local", Elapsed: 3 * time.Second})
+
+	rows := s.Query(&Query{
+		Client:  "alice",
+		GroupBy: []string{GroupMethod},
+		SortBy:  SortRequests,
+		Limit:   1,
+	})
+	require.Len(t, rows, 1)
+	require.Equal(t, "eth_call", rows[0].Method)
+	require.Equal(t, uint64(3), rows[0].Requests)
+	require.Equal(t, float64(40), rows[0].AvgLatencyMS)
+	require.Equal(t, float64(50), rows[0].P95MS)
+
+	rows = s.Query(&Query{
+		Backend: "local",
+		GroupBy: []string{GroupBackend, GroupHour},
+	})
+	require.Len(t, rows, 2)
+	require.Equal(t, time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC), *rows[0].Hour)
+	require.Equal(t, uint64(2), rows[0].Requests)
+	require.Equal(t, uint64(1), rows[0].Errors)
+	require.Equal(t, float64(500), rows[0].P95MS)
+	require.Equal(t, float64(5000), rows[1].P95MS)
+
+	rows = s.Query(&Query{From: now})
+	require.Len(t, rows, 1)
+	require.Equal(t, uint64(1), rows[0].Requests)
+}
+
+func TestStorePrunesHistory(t *testing.T) {
+	s := NewStore()
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	s.Record(&Event{Method: "eth_call"})
+	now = now.Add(HistoryRetention + time.Hour)
+	s.Record(&Event{Method: "eth_call"})
+
+	require.Len(t, s.history, 1)
+	require.Len(t, s.Query(&Query{}), 1)
+}
+
+func TestQueryValidate(t *testing.T) {
+	require.NoError(t, (&Query{GroupBy: []string{GroupMethod, GroupHour}, SortBy: SortP95}).Validate())
+	require.Error(t, (&Query{GroupBy: []string{"tag"}}).Validate())
+	require.Error(t, (&Query{SortBy: "name"}).Validate())
+	require.Error(t, (&Query{Limit: -1}).Validate())
+}
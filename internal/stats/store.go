@@ -0,0 +1,220 @@
+package stats
+
+import (
+	"sync"
+	"time"
+)
+
+const Untagged = "untagged"
+const OtherTag = "other"
+
+// MaxTags caps the number of distinct tags tracked, since tags are supplied
+// by clients. Requests with tags beyond the cap are counted under OtherTag.
+const MaxTags = 128
+
+const maxTagLength = 64
+
+// Error kinds of failed requests.
+const (
+	ErrorTimeout     = "timeout"
+	ErrorRejected    = "rejected"
+	ErrorUnreachable = "unreachable"
+	ErrorBadResponse = "bad_response"
+	ErrorMismatch    = "chain_mismatch"
+	ErrorInternal    = "internal"
+)
+
+type Event struct {
+	Tag string
+	// Client identifies the client, as for rate limiting.
+	Client string
+	Method string
+	// Backend is empty when the request was answered without contacting a
+	// backend, e.g. from the cache.
+	Backend string
+	Elapsed time.Duration
+	Failed  bool
+	// Error is the kind of error a failed request failed with.
+	Error string
+}
+
+type MethodStats struct {
+	Requests     uint64        `json:"requests"`
+	Errors       uint64        `json:"errors"`
+	TotalLatency time.Duration `json:"total_latency_ns"`
+}
+
+type TagStats struct {
+	MethodStats
+	Methods map[string]*MethodStats `json:"methods"`
+}
+
+type Store struct {
+	tags      map[string]*TagStats
+	backends  map[string]*MethodStats
+	tierTimes map[int]time.Duration
+	// backendErrors counts failed requests per backend and error kind
+	backendErrors map[string]map[string]uint64
+	// history holds hourly buckets in chronological order
+	history []*hourBucket
+	now     func() time.Time
+	mtx     sync.Mutex
+}
+
+func NewStore() *Store {
+	return &Store{
+		tags:          make(map[string]*TagStats),
+		backends:      make(map[string]*MethodStats),
+		tierTimes:     make(map[int]time.Duration),
+		backendErrors: make(map[string]map[string]uint64),
+		now:           time.Now,
+	}
+}
+
+func (s *Store) Record(ev *Event) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	tag := ev.Tag
+	if tag == "" {
+		tag = Untagged
+	}
+	ts, ok := s.tags[tag]
+	if !ok {
+		if len(s.tags) >= MaxTags {
+			tag = OtherTag
+			ts = s.tags[tag]
+		}
+		if ts == nil {
+			ts = &TagStats{
+				Methods: make(map[string]*MethodStats),
+			}
+			s.tags[tag] = ts
+		}
+	}
+
+	ms, ok := ts.Methods[ev.Method]
+	if !ok {
+		ms = new(MethodStats)
+		ts.Methods[ev.Method] = ms
+	}
+	ts.MethodStats.add(ev)
+	ms.add(ev)
+
+	if ev.Backend != "" {
+		bs, ok := s.backends[ev.Backend]
+		if !ok {
+			bs = new(MethodStats)
+			s.backends[ev.Backend] = bs
+		}
+		bs.add(ev)
+		if ev.Failed && ev.Error != "" {
+			errs, ok := s.backendErrors[ev.Backend]
+			if !ok {
+				errs = make(map[string]uint64)
+				s.backendErrors[ev.Backend] = errs
+			}
+			errs[ev.Error]++
+		}
+	}
+
+	s.recordHistory(ev)
+}
+
+// Tags returns a copy of the per-tag stats.
+func (s *Store) Tags() map[string]*TagStats {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	out := make(map[string]*TagStats)
+	for tag, ts := range s.tags {
+		cp := &TagStats{
+			MethodStats: ts.MethodStats,
+			Methods:     make(map[string]*MethodStats),
+		}
+		for method, ms := range ts.Methods {
+			msCp := *ms
+			cp.Methods[method] = &msCp
+		}
+		out[tag] = cp
+	}
+
+	return out
+}
+
+// Backends returns a copy of the per-backend stats of forwarded requests.
+func (s *Store) Backends() map[string]MethodStats {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	out := make(map[string]MethodStats)
+	for name, bs := range s.backends {
+		out[name] = *bs
+	}
+
+	return out
+}
+
+// BackendErrors returns the number of failed requests per backend and error
+// kind.
+func (s *Store) BackendErrors() map[string]map[string]uint64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	out := make(map[string]map[string]uint64)
+	for name, errs := range s.backendErrors {
+		cp := make(map[string]uint64)
+		for kind, count := range errs {
+			cp[kind] = count
+		}
+		out[name] = cp
+	}
+
+	return out
+}
+
+// AddTierTime records time during which traffic was routed to a backend in
+// the given cost tier.
+func (s *Store) AddTierTime(tier int, d time.Duration) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.tierTimes[tier] += d
+}
+
+// TierTimes returns the total time spent on each cost tier.
+func (s *Store) TierTimes() map[int]time.Duration {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	out := make(map[int]time.Duration)
+	for tier, d := range s.tierTimes {
+		out[tier] = d
+	}
+
+	return out
+}
+
+func (m *MethodStats) add(ev *Event) {
+	m.Requests++
+	if ev.Failed {
+		m.Errors++
+	}
+	m.TotalLatency += ev.Elapsed
+}
+
+// SanitizeTag normalizes a client-supplied tag. Tags containing anything
+// other than letters, digits, '-', '_' and '.' are rejected.
+func SanitizeTag(tag string) string {
+	if tag == "" || len(tag) > maxTagLength {
+		return ""
+	}
+
+	for _, c := range tag {
+		isAlnum := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+		if !isAlnum && c != '-' && c != '_' && c != '.' {
+			return ""
+		}
+	}
+
+	return tag
+}
@@ -0,0 +1,73 @@
+package stats
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreRecord(t *testing.T) {
+	s := NewStore()
+	s.Record(&Event{Tag: "indexer", Method: "eth_getLogs", Elapsed: time.Second})
+	s.Record(&Event{Tag: "indexer", Method: "eth_getLogs", Elapsed: time.Second, Failed: true})
+	s.Record(&Event{Tag: "indexer", Method: "eth_call", Elapsed: time.Millisecond})
+	s.Record(&Event{Method: "eth_call", Elapsed: time.Millisecond})
+
+	tags := s.Tags()
+	require.Len(t, tags, 2)
+	require.Equal(t, uint64(3), tags["indexer"].Requests)
+	require.Equal(t, uint64(1), tags["indexer"].Errors)
+	require.Equal(t, 2*time.Second+time.Millisecond, tags["indexer"].TotalLatency)
+	require.Equal(t, uint64(2), tags["indexer"].Methods["eth_getLogs"].Requests)
+	require.Equal(t, uint64(1), tags[Untagged].Methods["eth_call"].Requests)
+
+	// snapshots must not alias the live stats
+	tags["indexer"].Methods["eth_call"].Requests = 100
+	require.Equal(t, uint64(1), s.Tags()["indexer"].Methods["eth_call"].Requests)
+}
+
+func TestStoreBackends(t *testing.T) {
+	s := NewStore()
+	s.Record(&Event{Method: "eth_call", Backend: "infura"})
+	s.Record(&Event{Method: "eth_call", Backend: "infura", Failed: true})
+	s.Record(&Event{Method: "eth_blockNumber"})
+
+	backends := s.Backends()
+	require.Len(t, backends, 1)
+	require.Equal(t, uint64(2), backends["infura"].Requests)
+	require.Equal(t, uint64(1), backends["infura"].Errors)
+}
+
+func TestStoreBackendErrors(t *testing.T) {
+	s := NewStore()
+	s.Record(&Event{Method: "eth_call", Backend: "infura", Failed: true, Error: ErrorTimeout})
+	s.Record(&Event{Method: "eth_call", Backend: "infura", Failed: true, Error: ErrorTimeout})
+	s.Record(&Event{Method: "eth_call", Backend: "alchemy", Failed: true, Error: ErrorUnreachable})
+	s.Record(&Event{Method: "eth_call", Backend: "alchemy"})
+
+	require.Equal(t, map[string]map[string]uint64{
+		"infura":  {ErrorTimeout: 2},
+		"alchemy": {ErrorUnreachable: 1},
+	}, s.BackendErrors())
+}
+
+func TestStoreCapsTags(t *testing.T) {
+	s := NewStore()
+	for i := 0; i < MaxTags+10; i++ {
+		s.Record(&Event{Tag: fmt.Sprintf("tag-%d", i), Method: "eth_call"})
+	}
+
+	tags := s.Tags()
+	require.Len(t, tags, MaxTags+1)
+	require.Equal(t, uint64(10), tags[OtherTag].Requests)
+}
+
+func TestSanitizeTag(t *testing.T) {
+	require.Equal(t, "indexer", SanitizeTag("indexer"))
+	require.Equal(t, "cron.daily-1_a", SanitizeTag("cron.daily-1_a"))
+	require.Equal(t, "", SanitizeTag("bad tag"))
+	require.Equal(t, "", SanitizeTag("bad\"tag"))
+	require.Equal(t, "", SanitizeTag(string(make([]byte, 65))))
+}
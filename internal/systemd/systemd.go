@@ -0,0 +1,100 @@
+package systemd
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+const (
+	Ready    = "READY=1"
+	Stopping = "STOPPING=1"
+	Watchdog = "WATCHDOG=1"
+)
+
+// ListenerFiles returns the sockets passed to this process by systemd socket
+// activation, or nil if the process wasn't socket activated. The environment
+// variables are unset so that child processes don't inherit them.
+func ListenerFiles() []*os.File {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count == 0 {
+		return nil
+	}
+
+	files := make([]*os.File, count)
+	for i := 0; i < count; i++ {
+		fd := listenFDsStart + i
+		syscall.CloseOnExec(fd)
+		files[i] = os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+	}
+
+	return files
+}
+
+// Notify sends a state update to systemd. It's a no-op when chaind isn't
+// running under a systemd unit with Type=notify.
+func Notify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	addr := &net.UnixAddr{
+		Name: socket,
+		Net:  "unixgram",
+	}
+	// abstract namespace sockets are passed with a leading @
+	if socket[0] == '@' {
+		addr.Name = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix(addr.Net, nil, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// WatchdogInterval returns the watchdog timeout configured for this process,
+// or zero if the watchdog is disabled.
+func WatchdogInterval() (time.Duration, error) {
+	usecStr := os.Getenv("WATCHDOG_USEC")
+	if usecStr == "" {
+		return 0, nil
+	}
+	if pidStr := os.Getenv("WATCHDOG_PID"); pidStr != "" {
+		pid, err := strconv.Atoi(pidStr)
+		if err != nil {
+			return 0, err
+		}
+		if pid != os.Getpid() {
+			return 0, nil
+		}
+	}
+
+	usec, err := strconv.Atoi(usecStr)
+	if err != nil {
+		return 0, err
+	}
+	if usec <= 0 {
+		return 0, errors.New("WATCHDOG_USEC must be positive")
+	}
+
+	return time.Duration(usec) * time.Microsecond, nil
+}
@@ -0,0 +1,60 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chaind-systemd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	socket := path.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", socket)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	require.NoError(t, Notify(Ready))
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, Ready, string(buf[:n]))
+}
+
+func TestNotifyWithoutSocket(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	require.NoError(t, Notify(Ready))
+}
+
+func TestListenerFilesIgnoresOtherProcesses(t *testing.T) {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	require.Nil(t, ListenerFiles())
+	require.Empty(t, os.Getenv("LISTEN_FDS"))
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+	interval, err := WatchdogInterval()
+	require.NoError(t, err)
+	require.Equal(t, 30*time.Second, interval)
+
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	defer os.Unsetenv("WATCHDOG_PID")
+	interval, err = WatchdogInterval()
+	require.NoError(t, err)
+	require.Equal(t, time.Duration(0), interval)
+}
@@ -0,0 +1,50 @@
+package systemd
+
+import (
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/pkg/log"
+)
+
+// WatchdogPinger keeps systemd's watchdog from firing by pinging it at half
+// the watchdog interval.
+type WatchdogPinger struct {
+	interval time.Duration
+	quitChan chan bool
+	logger   log15.Logger
+}
+
+func NewWatchdogPinger(interval time.Duration) *WatchdogPinger {
+	return &WatchdogPinger{
+		interval: interval,
+		quitChan: make(chan bool),
+		logger:   log.NewLog("systemd"),
+	}
+}
+
+func (w *WatchdogPinger) Start() error {
+	go func() {
+		tick := time.NewTicker(w.interval / 2)
+
+		for {
+			select {
+			case <-tick.C:
+				if err := Notify(Watchdog); err != nil {
+					w.logger.Error("failed to ping watchdog", "err", err)
+				}
+			case <-w.quitChan:
+				tick.Stop()
+				return
+			}
+		}
+	}()
+
+	w.logger.Info("started watchdog pinger", "interval", w.interval)
+	return nil
+}
+
+func (w *WatchdogPinger) Stop() error {
+	w.quitChan <- true
+	return nil
+}
@@ -0,0 +1,99 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/kyokan/chaind/pkg/config"
+)
+
+// IdentityPrefix prefixes the identities of clients whose certificate
+// subject isn't mapped to a key.
+const IdentityPrefix = "cert:"
+
+// ClientConfig returns the TLS config for connections to a backend, or nil
+// if the backend doesn't configure TLS.
+func ClientConfig(backend *config.Backend) (*tls.Config, error) {
+	if backend.CAFile == "" && backend.CertFile == "" {
+		return nil, nil
+	}
+
+	tlsCfg := new(tls.Config)
+	if backend.CAFile != "" {
+		pool, err := loadCertPool(backend.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if backend.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(backend.CertFile, backend.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsCfg, nil
+}
+
+// ServerConfig returns the TLS config for a listener.
+func ServerConfig(cfg *config.TLSConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	if cfg.ClientCAFile != "" {
+		pool, err := loadCertPool(cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if cfg.RequireClientCert {
+			tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return tlsCfg, nil
+}
+
+// Identity returns the client key of a request's verified client
+// certificate, or an empty string if there is none. Subjects without a
+// mapping are identified by their common name.
+func Identity(cfg *config.TLSConfig, req *http.Request) string {
+	if cfg == nil || req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+
+	cert := req.TLS.VerifiedChains[0][0]
+	subject := cert.Subject.String()
+	for _, identity := range cfg.Identities {
+		if identity.Subject == subject {
+			return identity.Key
+		}
+	}
+
+	return IdentityPrefix + cert.Subject.CommonName
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,136 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newTestCA(t *testing.T, dir string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	ca := &testCA{cert: cert, key: key, dir: dir}
+	writePEM(t, path.Join(dir, "ca.pem"), "CERTIFICATE", der)
+	return ca
+}
+
+// issue writes a certificate and key signed by the CA, and returns their
+// paths.
+func (c *testCA) issue(t *testing.T, name string, subject pkix.Name, usage x509.ExtKeyUsage) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, c.cert, &key.PublicKey, c.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := path.Join(c.dir, name+".pem")
+	keyFile := path.Join(c.dir, name+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, file string, typ string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	require.NoError(t, ioutil.WriteFile(file, data, 0600))
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chaind-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, dir)
+	serverCert, serverKey := ca.issue(t, "server", pkix.Name{CommonName: "chaind"}, x509.ExtKeyUsageServerAuth)
+	indexerCert, indexerKey := ca.issue(t, "indexer", pkix.Name{CommonName: "indexer", Organization: []string{"Acme"}}, x509.ExtKeyUsageClientAuth)
+	otherCert, otherKey := ca.issue(t, "other", pkix.Name{CommonName: "other"}, x509.ExtKeyUsageClientAuth)
+
+	serverCfg := &config.TLSConfig{
+		CertFile:          serverCert,
+		KeyFile:           serverKey,
+		ClientCAFile:      path.Join(dir, "ca.pem"),
+		RequireClientCert: true,
+		Identities: []config.TLSIdentity{
+			{Subject: "CN=indexer,O=Acme", Key: "indexer-key"},
+		},
+	}
+	tlsCfg, err := ServerConfig(serverCfg)
+	require.NoError(t, err)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(Identity(serverCfg, r)))
+	}))
+	srv.TLS = tlsCfg
+	srv.StartTLS()
+	defer srv.Close()
+
+	get := func(backend *config.Backend) (string, error) {
+		clientCfg, err := ClientConfig(backend)
+		require.NoError(t, err)
+		client := &http.Client{
+			Transport: &http.Transport{TLSClientConfig: clientCfg},
+		}
+		res, err := client.Get(srv.URL)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		return string(body), err
+	}
+
+	identity, err := get(&config.Backend{CAFile: path.Join(dir, "ca.pem"), CertFile: indexerCert, KeyFile: indexerKey})
+	require.NoError(t, err)
+	require.Equal(t, "indexer-key", identity)
+
+	identity, err = get(&config.Backend{CAFile: path.Join(dir, "ca.pem"), CertFile: otherCert, KeyFile: otherKey})
+	require.NoError(t, err)
+	require.Equal(t, IdentityPrefix+"other", identity)
+
+	_, err = get(&config.Backend{CAFile: path.Join(dir, "ca.pem")})
+	require.Error(t, err)
+}
@@ -0,0 +1,381 @@
+package txtrack
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/jsonrpc"
+	"github.com/kyokan/chaind/pkg/log"
+)
+
+const (
+	DefaultPollInterval = 5 * time.Second
+	DefaultDropAfter    = 10 * time.Minute
+	DefaultRetention    = time.Hour
+)
+
+// maxTracked bounds the tracker; the oldest transactions are forgotten
+// once it is reached.
+const maxTracked = 10000
+
+// pollConcurrency bounds the pending transactions checked at once.
+const pollConcurrency = 8
+
+// webhookBuffer bounds the status changes waiting for the webhook; further
+// changes are dropped rather than holding up polling.
+const webhookBuffer = 256
+
+type Status string
+
+const (
+	StatusPending  Status = "pending"
+	StatusMined    Status = "mined"
+	StatusDropped  Status = "dropped"
+	StatusReplaced Status = "replaced"
+)
+
+// Tx is the tracked state of a submitted transaction.
+type Tx struct {
+	Hash        string    `json:"hash"`
+	Client      string    `json:"client,omitempty"`
+	Submitted   time.Time `json:"submitted"`
+	Updated     time.Time `json:"updated"`
+	Status      Status    `json:"status"`
+	From        string    `json:"from,omitempty"`
+	Nonce       string    `json:"nonce,omitempty"`
+	BlockNumber string    `json:"block_number,omitempty"`
+	// Succeeded is the receipt status of mined transactions.
+	Succeeded *bool `json:"succeeded,omitempty"`
+}
+
+// Tracker watches the transactions submitted through chaind until they are
+// mined, dropped or replaced, and POSTs every status change to a webhook.
+type Tracker struct {
+	cfg          *config.TxTrackerConfig
+	rpc          jsonrpc.Executor
+	pollInterval time.Duration
+	dropAfter    time.Duration
+	retention    time.Duration
+	txs          map[string]*Tx
+	mtx          sync.Mutex
+	client       *http.Client
+	webhooks     chan Tx
+	quitChan     chan bool
+	logger       log15.Logger
+	now          func() time.Time
+}
+
+func NewTracker(cfg *config.TxTrackerConfig, rpc jsonrpc.Executor) *Tracker {
+	t := &Tracker{
+		cfg:          cfg,
+		rpc:          rpc,
+		pollInterval: cfg.PollInterval,
+		dropAfter:    cfg.DropAfter,
+		retention:    cfg.Retention,
+		txs:          make(map[string]*Tx),
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		webhooks: make(chan Tx, webhookBuffer),
+		quitChan: make(chan bool),
+		logger:   log.NewLog("txtrack"),
+		now:      time.Now,
+	}
+	if t.pollInterval == 0 {
+		t.pollInterval = DefaultPollInterval
+	}
+	if t.dropAfter == 0 {
+		t.dropAfter = DefaultDropAfter
+	}
+	if t.retention == 0 {
+		t.retention = DefaultRetention
+	}
+	return t
+}
+
+func (t *Tracker) Start() error {
+	go func() {
+		tick := time.NewTicker(t.pollInterval)
+
+		for {
+			select {
+			case <-tick.C:
+				t.poll()
+			case <-t.quitChan:
+				tick.Stop()
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case tx := <-t.webhooks:
+				t.notify(&tx)
+			case <-t.quitChan:
+				return
+			}
+		}
+	}()
+
+	t.logger.Info("started", "poll_interval", t.pollInterval, "webhook_url", t.cfg.WebhookURL)
+	return nil
+}
+
+func (t *Tracker) Stop() error {
+	close(t.quitChan)
+	return nil
+}
+
+// Track starts watching the transaction with the given hash, submitted by
+// the given client.
+func (t *Tracker) Track(hash string, client string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	hash = strings.ToLower(hash)
+	if _, ok := t.txs[hash]; ok {
+		return
+	}
+	if len(t.txs) >= maxTracked {
+		t.evictOldest()
+	}
+	now := t.now()
+	t.txs[hash] = &Tx{
+		Hash:      hash,
+		Client:    client,
+		Submitted: now,
+		Updated:   now,
+		Status:    StatusPending,
+	}
+}
+
+// Get returns the tracked transaction with the given hash, or nil.
+func (t *Tracker) Get(hash string) *Tx {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	tx, ok := t.txs[strings.ToLower(hash)]
+	if !ok {
+		return nil
+	}
+	out := *tx
+	return &out
+}
+
+// List returns the tracked transactions, most recently submitted first,
+// optionally restricted to a client and a status.
+func (t *Tracker) List(client string, status Status) []Tx {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	out := []Tx{}
+	for _, tx := range t.txs {
+		if client != "" && tx.Client != client {
+			continue
+		}
+		if status != "" && tx.Status != status {
+			continue
+		}
+		out = append(out, *tx)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Submitted.After(out[j].Submitted)
+	})
+	return out
+}
+
+func (t *Tracker) poll() {
+	t.mtx.Lock()
+	now := t.now()
+	var pending []Tx
+	for hash, tx := range t.txs {
+		if tx.Status != StatusPending {
+			if now.Sub(tx.Updated) > t.retention {
+				delete(t.txs, hash)
+			}
+			continue
+		}
+		pending = append(pending, *tx)
+	}
+	t.mtx.Unlock()
+
+	// backend calls are made without holding the lock, so that Track isn't
+	// blocked by a slow backend
+	sem := make(chan struct{}, pollConcurrency)
+	var wg sync.WaitGroup
+	for i := range pending {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(tx *Tx) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			t.refresh(tx, now)
+		}(&pending[i])
+	}
+	wg.Wait()
+}
+
+func (t *Tracker) refresh(tx *Tx, now time.Time) {
+	prev := tx.Status
+	if err := t.check(tx, now); err != nil {
+		t.logger.Debug("failed to check transaction", "hash", tx.Hash, "err", err)
+		return
+	}
+	t.update(tx)
+	if tx.Status != prev {
+		t.logger.Info("transaction status changed", "hash", tx.Hash, "status", tx.Status)
+		t.enqueue(tx)
+	}
+}
+
+// check refreshes the status of a pending transaction.
+func (t *Tracker) check(tx *Tx, now time.Time) error {
+	receipt, err := t.call("eth_getTransactionReceipt", tx.Hash)
+	if err != nil {
+		return err
+	}
+	if receipt != nil {
+		var fields struct {
+			BlockNumber string `json:"blockNumber"`
+			Status      string `json:"status"`
+		}
+		if err := json.Unmarshal(receipt, &fields); err != nil {
+			return err
+		}
+		if fields.BlockNumber != "" {
+			tx.Status = StatusMined
+			tx.BlockNumber = fields.BlockNumber
+			if fields.Status != "" {
+				succeeded := fields.Status == "0x1"
+				tx.Succeeded = &succeeded
+			}
+			tx.Updated = now
+			return nil
+		}
+	}
+
+	found, err := t.call("eth_getTransactionByHash", tx.Hash)
+	if err != nil {
+		return err
+	}
+	if found != nil {
+		var fields struct {
+			From  string `json:"from"`
+			Nonce string `json:"nonce"`
+		}
+		if err := json.Unmarshal(found, &fields); err != nil {
+			return err
+		}
+		tx.From = strings.ToLower(fields.From)
+		tx.Nonce = fields.Nonce
+		return nil
+	}
+
+	// the backend no longer knows the transaction; if another transaction
+	// from the same sender used its nonce, it was replaced
+	if tx.From != "" && tx.Nonce != "" {
+		count, err := t.call("eth_getTransactionCount", tx.From, "latest")
+		if err != nil {
+			return err
+		}
+		var hexCount string
+		if err := json.Unmarshal(count, &hexCount); err != nil {
+			return err
+		}
+		mined, err := jsonrpc.Hex2Uint64(hexCount)
+		if err != nil {
+			return err
+		}
+		nonce, err := jsonrpc.Hex2Uint64(tx.Nonce)
+		if err != nil {
+			return err
+		}
+		if mined > nonce {
+			tx.Status = StatusReplaced
+			tx.Updated = now
+			return nil
+		}
+	}
+
+	if now.Sub(tx.Submitted) > t.dropAfter {
+		tx.Status = StatusDropped
+		tx.Updated = now
+	}
+	return nil
+}
+
+// call executes a JSON-RPC call and returns its result, or nil if the
+// result is null.
+func (t *Tracker) call(method string, params ...interface{}) (json.RawMessage, error) {
+	res, err := t.rpc.Execute(method, params)
+	if err != nil {
+		return nil, err
+	}
+	if res.Error != nil {
+		return nil, fmt.Errorf("%s returned error %d: %s", method, res.Error.Code, res.Error.Message)
+	}
+	if len(res.Result) == 0 || string(res.Result) == "null" {
+		return nil, nil
+	}
+	return res.Result, nil
+}
+
+func (t *Tracker) update(tx *Tx) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if _, ok := t.txs[tx.Hash]; ok {
+		updated := *tx
+		t.txs[tx.Hash] = &updated
+	}
+}
+
+// enqueue hands a status change to the webhook goroutine.
+func (t *Tracker) enqueue(tx *Tx) {
+	if t.cfg.WebhookURL == "" {
+		return
+	}
+
+	select {
+	case t.webhooks <- *tx:
+	default:
+		t.logger.Error("dropped transaction status change, webhook is backed up", "hash", tx.Hash, "status", tx.Status)
+	}
+}
+
+func (t *Tracker) notify(tx *Tx) {
+	data, err := json.Marshal(tx)
+	if err != nil {
+		t.logger.Error("failed to marshal transaction", "err", err)
+		return
+	}
+	res, err := t.client.Post(t.cfg.WebhookURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.logger.Error("failed to call webhook", "webhook_url", t.cfg.WebhookURL, "err", err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		t.logger.Error("webhook returned an error", "webhook_url", t.cfg.WebhookURL, "status", res.StatusCode)
+	}
+}
+
+func (t *Tracker) evictOldest() {
+	var oldest *Tx
+	for _, tx := range t.txs {
+		if oldest == nil || tx.Submitted.Before(oldest.Submitted) {
+			oldest = tx
+		}
+	}
+	if oldest != nil {
+		delete(t.txs, oldest.Hash)
+	}
+}
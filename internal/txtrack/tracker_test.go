@@ -0,0 +1,90 @@
+package txtrack
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/jsonrpc"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeRPC struct {
+	results map[string]string
+}
+
+func (f *fakeRPC) Execute(method string, params interface{}) (*jsonrpc.Response, error) {
+	key := method
+	for _, p := range params.([]interface{}) {
+		key += ":" + p.(string)
+	}
+	result, ok := f.results[key]
+	if !ok {
+		result = "null"
+	}
+	return &jsonrpc.Response{Result: json.RawMessage(result)}, nil
+}
+
+func TestTrackerStatuses(t *testing.T) {
+	var mtx sync.Mutex
+	var notified []Tx
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var tx Tx
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&tx))
+		mtx.Lock()
+		notified = append(notified, tx)
+		mtx.Unlock()
+	}))
+	defer webhook.Close()
+
+	rpc := &fakeRPC{results: map[string]string{
+		"eth_getTransactionByHash:0xaa": `{"from":"0x01","nonce":"0x5"}`,
+		"eth_getTransactionByHash:0xbb": `{"from":"0x02","nonce":"0x7"}`,
+	}}
+	tracker := NewTracker(&config.TxTrackerConfig{WebhookURL: webhook.URL}, rpc)
+	now := time.Unix(1000, 0)
+	tracker.now = func() time.Time { return now }
+	require.NoError(t, tracker.Start())
+	defer tracker.Stop()
+	tracker.Track("0xAA", "indexer")
+	tracker.Track("0xbb", "indexer")
+	tracker.Track("0xcc", "cron")
+
+	tracker.poll()
+	require.Equal(t, StatusPending, tracker.Get("0xaa").Status)
+	require.Equal(t, "0x01", tracker.Get("0xaa").From)
+	require.Empty(t, notified)
+
+	// 0xaa is mined, 0xbb's nonce was used by another transaction, and 0xcc
+	// was never seen by the backend
+	rpc.results["eth_getTransactionReceipt:0xaa"] = `{"blockNumber":"0x10","status":"0x1"}`
+	delete(rpc.results, "eth_getTransactionByHash:0xbb")
+	rpc.results["eth_getTransactionCount:0x02:latest"] = `"0x8"`
+	now = now.Add(DefaultDropAfter + time.Second)
+	tracker.poll()
+
+	mined := tracker.Get("0xaa")
+	require.Equal(t, StatusMined, mined.Status)
+	require.Equal(t, "0x10", mined.BlockNumber)
+	require.True(t, *mined.Succeeded)
+	require.Equal(t, StatusReplaced, tracker.Get("0xbb").Status)
+	require.Equal(t, StatusDropped, tracker.Get("0xcc").Status)
+	require.Eventually(t, func() bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return len(notified) == 3
+	}, time.Second, 10*time.Millisecond)
+
+	require.Len(t, tracker.List("indexer", ""), 2)
+	require.Len(t, tracker.List("", StatusDropped), 1)
+
+	// settled transactions are forgotten after the retention period
+	now = now.Add(DefaultRetention + time.Second)
+	tracker.poll()
+	require.Nil(t, tracker.Get("0xaa"))
+	require.Empty(t, tracker.List("", ""))
+}
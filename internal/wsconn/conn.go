@@ -0,0 +1,376 @@
+// Package wsconn implements the parts of RFC 6455 chaind needs: dialing
+// backends' WebSocket endpoints, accepting clients' connections, and
+// exchanging text messages over them.
+package wsconn
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kyokan/chaind/internal/tlsutil"
+	"github.com/kyokan/chaind/pkg/config"
+)
+
+// acceptGUID is appended to the handshake key to compute the accept header,
+// as described by RFC 6455.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// MaxMessageSize bounds the messages read from a connection. Heads, logs and
+// subscription requests are a few kilobytes.
+const MaxMessageSize = 1 << 20
+
+// closeTimeout bounds writing the close frame to a peer that stopped
+// reading.
+const closeTimeout = time.Second
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// ErrClosed is returned by ReadMessage when the peer closes the connection.
+var ErrClosed = errors.New("connection closed by peer")
+
+// Conn is a minimal WebSocket connection, enough to proxy JSON-RPC and hold
+// subscriptions: it writes text frames, reads unfragmented or fragmented
+// messages and answers pings. Writes may be made concurrently with reads
+// and with each other.
+type Conn struct {
+	nc net.Conn
+	br *bufio.Reader
+	// client connections mask the frames they write, and servers require
+	// the frames they read to be masked
+	client bool
+	wmtx   sync.Mutex
+	onPong func()
+}
+
+// Dial opens a WebSocket connection to the backend's ws_url, using the
+// backend's TLS config for wss URLs.
+func Dial(ctx context.Context, backend *config.Backend) (*Conn, error) {
+	u, err := url.Parse(backend.WSURL)
+	if err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "wss" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(deadline)
+	}
+	if u.Scheme == "wss" {
+		tlsCfg, err := tlsutil.ClientConfig(backend)
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+		if tlsCfg == nil {
+			tlsCfg = new(tls.Config)
+		}
+		tlsCfg.ServerName = u.Hostname()
+		tc := tls.Client(nc, tlsCfg)
+		if err := tc.Handshake(); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		nc = tc
+	}
+
+	c := &Conn{
+		nc:     nc,
+		br:     bufio.NewReader(nc),
+		client: true,
+	}
+	if err := c.handshake(u); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	nc.SetDeadline(time.Time{})
+	return c, nil
+}
+
+func (c *Conn) handshake(u *url.URL) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Host:       u.Host,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Upgrade":               {"websocket"},
+			"Connection":            {"Upgrade"},
+			"Sec-WebSocket-Key":     {key},
+			"Sec-WebSocket-Version": {"13"},
+		},
+	}
+	if err := req.Write(c.nc); err != nil {
+		return err
+	}
+	res, err := http.ReadResponse(c.br, req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("websocket handshake failed with status %d", res.StatusCode)
+	}
+	if res.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return errors.New("websocket handshake returned an invalid accept key")
+	}
+	return nil
+}
+
+// IsUpgrade returns whether the request asks to upgrade to a WebSocket
+// connection.
+func IsUpgrade(req *http.Request) bool {
+	return hasToken(req.Header, "Connection", "upgrade") && hasToken(req.Header, "Upgrade", "websocket")
+}
+
+// Upgrade completes a client's WebSocket handshake and takes over its
+// connection. Invalid handshakes are answered with 400 Bad Request.
+func Upgrade(res http.ResponseWriter, req *http.Request) (*Conn, error) {
+	key := req.Header.Get("Sec-WebSocket-Key")
+	var err error
+	switch {
+	case req.Method != http.MethodGet:
+		err = errors.New("websocket handshake must use GET")
+	case !IsUpgrade(req):
+		err = errors.New("missing websocket upgrade headers")
+	case req.Header.Get("Sec-WebSocket-Version") != "13":
+		err = errors.New("unsupported websocket version")
+	case key == "":
+		err = errors.New("missing websocket key")
+	}
+	if err != nil {
+		res.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return nil, err
+	}
+	hijacker, ok := res.(http.Hijacker)
+	if !ok {
+		err := errors.New("connection can't be upgraded")
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return nil, err
+	}
+
+	nc, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// deadlines set by the server's timeouts don't apply to the upgraded
+	// connection
+	nc.SetDeadline(time.Time{})
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return &Conn{
+		nc: nc,
+		br: rw.Reader,
+	}, nil
+}
+
+func hasToken(h http.Header, name string, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// RemoteAddr returns the address of the peer.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.nc.RemoteAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.nc.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.nc.SetReadDeadline(t)
+}
+
+// OnPong calls f for each pong read, e.g. to track the liveness of the
+// peer. It must be called before reading.
+func (c *Conn) OnPong(f func()) {
+	c.onPong = f
+}
+
+// WriteText writes a text message.
+func (c *Conn) WriteText(data []byte) error {
+	return c.writeFrame(opText, data)
+}
+
+// Ping sends a ping frame. Peers answer with a pong, which is reported to
+// the OnPong callback.
+func (c *Conn) Ping() error {
+	return c.writeFrame(opPing, nil)
+}
+
+// writeFrame writes a single frame. Client frames are masked, as required
+// by RFC 6455.
+func (c *Conn) writeFrame(op byte, data []byte) error {
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	frame := []byte{0x80 | op}
+	switch n := len(data); {
+	case n < 126:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, maskBit|126, byte(n>>8), byte(n))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(n))
+		frame = append(frame, maskBit|127)
+		frame = append(frame, ext[:]...)
+	}
+
+	if c.client {
+		mask := make([]byte, 4)
+		if _, err := rand.Read(mask); err != nil {
+			return err
+		}
+		frame = append(frame, mask...)
+		for i, b := range data {
+			frame = append(frame, b^mask[i%4])
+		}
+	} else {
+		frame = append(frame, data...)
+	}
+
+	c.wmtx.Lock()
+	defer c.wmtx.Unlock()
+	_, err := c.nc.Write(frame)
+	return err
+}
+
+// ReadMessage returns the next text or binary message, answering the pings
+// that arrive before it. It must not be called concurrently.
+func (c *Conn) ReadMessage() ([]byte, error) {
+	var msg []byte
+	for {
+		var hdr [2]byte
+		if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+			return nil, err
+		}
+		fin := hdr[0]&0x80 != 0
+		op := hdr[0] & 0x0f
+		masked := hdr[1]&0x80 != 0
+		if !c.client && !masked {
+			return nil, errors.New("unmasked websocket frame from client")
+		}
+		n := uint64(hdr[1] & 0x7f)
+		switch n {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+				return nil, err
+			}
+			n = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+				return nil, err
+			}
+			n = binary.BigEndian.Uint64(ext[:])
+		}
+		if n+uint64(len(msg)) > MaxMessageSize {
+			return nil, errors.New("websocket message too large")
+		}
+		var mask [4]byte
+		if masked {
+			if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+				return nil, err
+			}
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return nil, err
+		}
+		if masked {
+			for i := range payload {
+				payload[i] ^= mask[i%4]
+			}
+		}
+
+		switch op {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			if c.onPong != nil {
+				c.onPong()
+			}
+			continue
+		case opClose:
+			return nil, ErrClosed
+		case opText, opBinary, opContinuation:
+			msg = append(msg, payload...)
+		default:
+			return nil, fmt.Errorf("unknown websocket opcode %d", op)
+		}
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+// Close sends a close frame and closes the connection. Peers that stopped
+// reading get closeTimeout to take the close frame.
+func (c *Conn) Close() error {
+	// the deadline also unblocks writes stuck on such a peer
+	c.nc.SetWriteDeadline(time.Now().Add(closeTimeout))
+	c.writeFrame(opClose, nil)
+	return c.nc.Close()
+}
@@ -0,0 +1,87 @@
+package wsconn
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialAndUpgrade(t *testing.T) {
+	pongs := make(chan bool, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.True(t, IsUpgrade(r))
+		c, err := Upgrade(w, r)
+		require.NoError(t, err)
+		defer c.Close()
+		c.OnPong(func() {
+			pongs <- true
+		})
+
+		require.NoError(t, c.Ping())
+		for {
+			msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := c.WriteText(append([]byte("echo "), msg...)); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	c, err := Dial(ctx, &config.Backend{WSURL: strings.Replace(srv.URL, "http://", "ws://", 1)})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// long messages use extended lengths, and the ping is answered while
+	// reading
+	long := strings.Repeat("x", 70000)
+	for _, msg := range []string{"hello", strings.Repeat("x", 300), long} {
+		require.NoError(t, c.WriteText([]byte(msg)))
+		res, err := c.ReadMessage()
+		require.NoError(t, err)
+		require.Equal(t, "echo "+msg, string(res))
+	}
+	select {
+	case <-pongs:
+	case <-time.After(time.Second):
+		t.Fatal("no pong")
+	}
+}
+
+func TestUpgradeRejectsInvalidHandshakes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := Upgrade(w, r)
+		require.Error(t, err)
+	}))
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "8")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	require.Equal(t, "13", res.Header.Get("Sec-WebSocket-Version"))
+
+	req.Header.Del("Upgrade")
+	require.False(t, IsUpgrade(req))
+}
+
+func TestAcceptKey(t *testing.T) {
+	// the example of RFC 6455
+	require.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", acceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
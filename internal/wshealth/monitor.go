@@ -0,0 +1,287 @@
+package wshealth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/internal/wsconn"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/log"
+)
+
+const (
+	// DefaultHeadTimeout is the time a backend's newHeads subscription may
+	// go without a head, unless the backend sets ws_head_timeout.
+	DefaultHeadTimeout = 30 * time.Second
+	// DialTimeout bounds connecting and subscribing to a backend.
+	DialTimeout = 5 * time.Second
+	// retryDelay is the time between attempts to reconnect to a backend
+	// whose connection failed. Stalled subscriptions are resubscribed right
+	// away.
+	retryDelay = time.Second
+)
+
+const subscribeBody = `{"jsonrpc":"2.0","id":1,"method":"eth_subscribe","params":["newHeads"]}`
+
+// ErrStalled fails the healthchecks of backends whose newHeads subscription
+// went quiet, until a head arrives again.
+var ErrStalled = errors.New("websocket subscription stalled")
+
+// Status is the state of a backend's subscription.
+type Status struct {
+	Connected    bool      `json:"connected"`
+	Stalled      bool      `json:"stalled"`
+	LastHead     time.Time `json:"last_head,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+	Resubscribes uint64    `json:"resubscribes"`
+}
+
+type backendState struct {
+	Status
+	err  error
+	conn *wsconn.Conn
+}
+
+// Monitor holds a newHeads subscription on each backend with a ws_url.
+// WebSocket endpoints fail in ways HTTP healthchecks don't notice, such as
+// half-open connections and subscriptions that silently stop delivering
+// events: when no head arrives within the backend's head timeout, the
+// subscription is considered stalled and resubscribed, and the backend fails
+// its healthchecks until heads arrive again.
+type Monitor struct {
+	backends []config.Backend
+	states   map[string]*backendState
+	mtx      sync.Mutex
+	quitChan chan bool
+	wg       sync.WaitGroup
+	logger   log15.Logger
+}
+
+func NewMonitor(backends []config.Backend) *Monitor {
+	m := &Monitor{
+		states:   make(map[string]*backendState),
+		quitChan: make(chan bool),
+		logger:   log.NewLog("wshealth"),
+	}
+	for _, backend := range backends {
+		if backend.WSURL == "" {
+			continue
+		}
+		m.backends = append(m.backends, backend)
+		m.states[backend.Name] = new(backendState)
+	}
+	return m
+}
+
+func (m *Monitor) Start() error {
+	for i := range m.backends {
+		backend := &m.backends[i]
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			m.watch(backend)
+		}()
+	}
+
+	m.logger.Info("started", "backends", len(m.backends))
+	return nil
+}
+
+func (m *Monitor) Stop() error {
+	close(m.quitChan)
+	m.mtx.Lock()
+	for _, state := range m.states {
+		if state.conn != nil {
+			state.conn.Close()
+		}
+	}
+	m.mtx.Unlock()
+	m.wg.Wait()
+	return nil
+}
+
+// Check returns why the backend's WebSocket endpoint is unhealthy, if it
+// is. Backends without a ws_url always pass.
+func (m *Monitor) Check(backend *config.Backend) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	state, ok := m.states[backend.Name]
+	if !ok {
+		return nil
+	}
+	if state.err != nil {
+		return state.err
+	}
+	if state.Stalled {
+		return ErrStalled
+	}
+	return nil
+}
+
+// Status returns the state of each monitored backend's subscription, keyed
+// by backend name.
+func (m *Monitor) Status() map[string]Status {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	out := make(map[string]Status, len(m.states))
+	for name, state := range m.states {
+		out[name] = state.Status
+	}
+	return out
+}
+
+func (m *Monitor) watch(backend *config.Backend) {
+	timeout := backend.WSHeadTimeout
+	if timeout == 0 {
+		timeout = DefaultHeadTimeout
+	}
+
+	for {
+		err := m.subscribe(backend, timeout)
+		select {
+		case <-m.quitChan:
+			return
+		default:
+		}
+
+		if err == ErrStalled {
+			m.logger.Warn("no head within timeout, resubscribing", "name", backend.Name, "timeout", timeout)
+			continue
+		}
+		m.logger.Warn("websocket connection failed", "name", backend.Name, "url", backend.WSURL, "err", err)
+		select {
+		case <-time.After(retryDelay):
+		case <-m.quitChan:
+			return
+		}
+	}
+}
+
+// subscribe connects to the backend and reads its heads until the
+// connection fails, or no head arrives within timeout.
+func (m *Monitor) subscribe(backend *config.Backend, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DialTimeout)
+	c, err := wsconn.Dial(ctx, backend)
+	cancel()
+	if err != nil {
+		m.failed(backend.Name, err)
+		return err
+	}
+	if !m.connected(backend.Name, c) {
+		c.Close()
+		return nil
+	}
+	defer m.disconnected(backend.Name)
+
+	c.SetDeadline(time.Now().Add(DialTimeout))
+	if err := c.WriteText([]byte(subscribeBody)); err != nil {
+		m.failed(backend.Name, err)
+		return err
+	}
+	msg, err := c.ReadMessage()
+	if err != nil {
+		m.failed(backend.Name, err)
+		return err
+	}
+	var res struct {
+		Result string `json:"result"`
+		Error  *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(msg, &res); err != nil || res.Result == "" {
+		err = errors.New("invalid eth_subscribe response")
+		if res.Error != nil {
+			err = errors.New(res.Error.Message)
+		}
+		m.failed(backend.Name, err)
+		return err
+	}
+	m.subscribed(backend.Name)
+
+	for {
+		c.SetDeadline(time.Now().Add(timeout))
+		msg, err := c.ReadMessage()
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			m.stalled(backend.Name)
+			return ErrStalled
+		}
+		if err != nil {
+			m.failed(backend.Name, err)
+			return err
+		}
+
+		var notification struct {
+			Method string `json:"method"`
+		}
+		if json.Unmarshal(msg, &notification) == nil && notification.Method == "eth_subscription" {
+			m.head(backend.Name)
+		}
+	}
+}
+
+// connected registers the connection, so that Stop can close it. It
+// returns false if the monitor is stopping.
+func (m *Monitor) connected(name string, c *wsconn.Conn) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	select {
+	case <-m.quitChan:
+		return false
+	default:
+	}
+	m.states[name].conn = c
+	return true
+}
+
+func (m *Monitor) disconnected(name string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	state := m.states[name]
+	state.conn.Close()
+	state.conn = nil
+	state.Connected = false
+}
+
+func (m *Monitor) subscribed(name string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	state := m.states[name]
+	state.err = nil
+	state.LastError = ""
+	state.Connected = true
+}
+
+func (m *Monitor) head(name string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	state := m.states[name]
+	if state.Stalled {
+		m.logger.Info("subscription recovered", "name", name)
+	}
+	state.Stalled = false
+	state.LastHead = time.Now()
+}
+
+func (m *Monitor) stalled(name string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	state := m.states[name]
+	state.Stalled = true
+	state.Resubscribes++
+}
+
+func (m *Monitor) failed(name string, err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	state := m.states[name]
+	state.err = err
+	state.LastError = err.Error()
+}
@@ -0,0 +1,131 @@
+package wshealth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/internal/wsconn"
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+const headNotification = `{"jsonrpc":"2.0","method":"eth_subscription","params":{"subscription":"0x1","result":{"number":"0x1"}}}`
+
+// wsBackend is a node that answers eth_subscribe and sends a head for each
+// value sent on heads.
+type wsBackend struct {
+	*httptest.Server
+	heads         chan bool
+	subscriptions int32
+}
+
+func newWSBackend(t *testing.T) *wsBackend {
+	b := &wsBackend{heads: make(chan bool)}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := wsconn.Upgrade(w, r)
+		require.NoError(t, err)
+		defer c.Close()
+
+		msg, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+		require.Contains(t, string(msg), "newHeads")
+		atomic.AddInt32(&b.subscriptions, 1)
+		if c.WriteText([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`)) != nil {
+			return
+		}
+		for range b.heads {
+			if c.WriteText([]byte(headNotification)) != nil {
+				return
+			}
+		}
+	}))
+	return b
+}
+
+func (b *wsBackend) Close() {
+	close(b.heads)
+	b.Server.Close()
+}
+
+func (b *wsBackend) config(timeout time.Duration) config.Backend {
+	return config.Backend{
+		Type:          pkg.EthBackend,
+		Name:          "ws",
+		URL:           b.URL,
+		WSURL:         strings.Replace(b.URL, "http://", "ws://", 1),
+		WSHeadTimeout: timeout,
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMonitorDetectsStalls(t *testing.T) {
+	backend := newWSBackend(t)
+	defer backend.Close()
+	cfg := backend.config(100 * time.Millisecond)
+	m := NewMonitor([]config.Backend{cfg, {Name: "http"}})
+	require.Len(t, m.Status(), 1)
+	require.NoError(t, m.Start())
+
+	sendHead := func() bool {
+		select {
+		case backend.heads <- true:
+		case <-time.After(10 * time.Millisecond):
+		}
+		return !m.Status()["ws"].LastHead.IsZero()
+	}
+	waitFor(t, sendHead)
+	require.NoError(t, m.Check(&cfg))
+	require.True(t, m.Status()["ws"].Connected)
+
+	// the subscription goes quiet, so it is resubscribed and fails checks
+	waitFor(t, func() bool {
+		return m.Check(&cfg) == ErrStalled
+	})
+	waitFor(t, func() bool {
+		return atomic.LoadInt32(&backend.subscriptions) > 1
+	})
+	require.NoError(t, m.Check(&config.Backend{Name: "http"}))
+
+	// and recovers with the next head
+	waitFor(t, func() bool {
+		sendHead()
+		return m.Check(&cfg) == nil
+	})
+	require.NoError(t, m.Stop())
+}
+
+func TestMonitorReportsConnectionFailures(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	cfg := config.Backend{
+		Name:  "ws",
+		WSURL: strings.Replace(srv.URL, "http://", "ws://", 1),
+	}
+	m := NewMonitor([]config.Backend{cfg})
+	require.NoError(t, m.Start())
+	waitFor(t, func() bool {
+		return m.Check(&cfg) != nil
+	})
+	require.Contains(t, m.Check(&cfg).Error(), "status 404")
+	require.False(t, m.Status()["ws"].Connected)
+	require.NoError(t, m.Stop())
+}
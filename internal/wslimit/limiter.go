@@ -0,0 +1,248 @@
+// Package wslimit bounds the WebSocket connections and subscriptions of
+// clients, and closes connections that go idle.
+package wslimit
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/log"
+)
+
+const (
+	DefaultIdleTimeout  = 5 * time.Minute
+	DefaultPingInterval = 30 * time.Second
+)
+
+var (
+	ErrListenerFull         = errors.New("too many websocket connections")
+	ErrTooManyConnections   = errors.New("too many connections for this client")
+	ErrTooManySubscriptions = errors.New("too many subscriptions")
+	ErrClosed               = errors.New("connection closed")
+)
+
+// Conn is a client WebSocket connection.
+type Conn interface {
+	// Ping sends a ping frame. Clients answer with a pong, which the
+	// connection reports via Session.Touch.
+	Ping() error
+	Close() error
+}
+
+// Limiter bounds the WebSocket connections of a listener, and the
+// connections and subscriptions of each client key, and closes connections
+// that stop answering pings, e.g. because they were leaked by a dapp tab.
+// Limits that are zero are unrestricted.
+type Limiter struct {
+	cfg          *config.WebsocketConfig
+	idleTimeout  time.Duration
+	pingInterval time.Duration
+	sessions     map[*Session]bool
+	perKey       map[string]int
+	subsPerKey   map[string]int
+	mtx          sync.Mutex
+	quitChan     chan bool
+	logger       log15.Logger
+	now          func() time.Time
+}
+
+// Session is a connection admitted by the limiter.
+type Session struct {
+	key          string
+	conn         Conn
+	limiter      *Limiter
+	subs         int
+	lastActivity time.Time
+	lastPing     time.Time
+	closed       bool
+}
+
+func NewLimiter(cfg *config.WebsocketConfig) *Limiter {
+	l := &Limiter{
+		cfg:          cfg,
+		idleTimeout:  cfg.IdleTimeout,
+		pingInterval: cfg.PingInterval,
+		sessions:     make(map[*Session]bool),
+		perKey:       make(map[string]int),
+		subsPerKey:   make(map[string]int),
+		quitChan:     make(chan bool),
+		logger:       log.NewLog("wslimit"),
+		now:          time.Now,
+	}
+	if l.idleTimeout == 0 {
+		l.idleTimeout = DefaultIdleTimeout
+	}
+	if l.pingInterval == 0 {
+		l.pingInterval = DefaultPingInterval
+	}
+	return l
+}
+
+func (l *Limiter) Start() error {
+	go func() {
+		tick := time.NewTicker(l.pingInterval / 2)
+
+		for {
+			select {
+			case <-tick.C:
+				l.sweep()
+			case <-l.quitChan:
+				tick.Stop()
+				return
+			}
+		}
+	}()
+
+	l.logger.Info("started", "idle_timeout", l.idleTimeout, "ping_interval", l.pingInterval)
+	return nil
+}
+
+func (l *Limiter) Stop() error {
+	l.quitChan <- true
+	return nil
+}
+
+// Admit registers a new connection from the client with the given key. It
+// returns ErrListenerFull if the listener is at capacity, and
+// ErrTooManyConnections if the key is.
+func (l *Limiter) Admit(key string, conn Conn) (*Session, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.cfg.MaxConnections > 0 && len(l.sessions) >= l.cfg.MaxConnections {
+		return nil, ErrListenerFull
+	}
+	if l.cfg.MaxConnectionsPerKey > 0 && l.perKey[key] >= l.cfg.MaxConnectionsPerKey {
+		return nil, ErrTooManyConnections
+	}
+
+	now := l.now()
+	s := &Session{
+		key:          key,
+		conn:         conn,
+		limiter:      l,
+		lastActivity: now,
+	}
+	l.sessions[s] = true
+	l.perKey[key]++
+	return s, nil
+}
+
+// Connections returns the number of open connections of the given key.
+func (l *Limiter) Connections(key string) int {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.perKey[key]
+}
+
+// Subscriptions returns the number of subscriptions of the given key.
+func (l *Limiter) Subscriptions(key string) int {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.subsPerKey[key]
+}
+
+// sweep pings connections that have been quiet for a ping interval, and
+// closes those that have been quiet for the idle timeout.
+func (l *Limiter) sweep() {
+	l.mtx.Lock()
+	now := l.now()
+	var idle, quiet []*Session
+	for s := range l.sessions {
+		switch {
+		case now.Sub(s.lastActivity) >= l.idleTimeout:
+			idle = append(idle, s)
+		case now.Sub(s.lastActivity) >= l.pingInterval && now.Sub(s.lastPing) >= l.pingInterval:
+			s.lastPing = now
+			quiet = append(quiet, s)
+		}
+	}
+	l.mtx.Unlock()
+
+	// connections are written to without holding the lock, so that a slow
+	// client can't block the others
+	for _, s := range quiet {
+		if err := s.conn.Ping(); err != nil {
+			l.logger.Debug("failed to ping connection, closing", "key", s.key, "err", err)
+			idle = append(idle, s)
+		}
+	}
+	for _, s := range idle {
+		l.logger.Info("closing idle connection", "key", s.key)
+		s.Close()
+	}
+}
+
+// Touch records activity on the connection, i.e. a message or a pong.
+func (s *Session) Touch() {
+	s.limiter.mtx.Lock()
+	defer s.limiter.mtx.Unlock()
+	s.lastActivity = s.limiter.now()
+}
+
+// Subscribe counts a new subscription on the connection, or returns
+// ErrTooManySubscriptions if the connection's key is at capacity.
+func (s *Session) Subscribe() error {
+	l := s.limiter
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if l.cfg.MaxSubscriptionsPerKey > 0 && l.subsPerKey[s.key] >= l.cfg.MaxSubscriptionsPerKey {
+		return ErrTooManySubscriptions
+	}
+	s.subs++
+	l.subsPerKey[s.key]++
+	return nil
+}
+
+// Unsubscribe releases a subscription counted by Subscribe.
+func (s *Session) Unsubscribe() {
+	l := s.limiter
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if s.closed || s.subs == 0 {
+		return
+	}
+	s.subs--
+	l.decSubs(s.key, 1)
+}
+
+// Close closes the connection and releases its connection and
+// subscriptions. It is safe to call more than once.
+func (s *Session) Close() error {
+	if !s.Release() {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// Release releases the connection and its subscriptions without closing
+// it, for connections that were closed otherwise. It returns whether they
+// were still held.
+func (s *Session) Release() bool {
+	l := s.limiter
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if s.closed {
+		return false
+	}
+	s.closed = true
+	delete(l.sessions, s)
+	if l.perKey[s.key]--; l.perKey[s.key] == 0 {
+		delete(l.perKey, s.key)
+	}
+	l.decSubs(s.key, s.subs)
+	s.subs = 0
+	return true
+}
+
+func (l *Limiter) decSubs(key string, n int) {
+	if l.subsPerKey[key] -= n; l.subsPerKey[key] <= 0 {
+		delete(l.subsPerKey, key)
+	}
+}
@@ -0,0 +1,106 @@
+package wslimit
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeConn struct {
+	pings   int
+	closed  bool
+	pingErr error
+}
+
+func (c *fakeConn) Ping() error {
+	c.pings++
+	return c.pingErr
+}
+
+func (c *fakeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestLimiterConnections(t *testing.T) {
+	l := NewLimiter(&config.WebsocketConfig{
+		MaxConnections:       3,
+		MaxConnectionsPerKey: 2,
+	})
+
+	a1, err := l.Admit("a", &fakeConn{})
+	require.NoError(t, err)
+	_, err = l.Admit("a", &fakeConn{})
+	require.NoError(t, err)
+	_, err = l.Admit("a", &fakeConn{})
+	require.Equal(t, ErrTooManyConnections, err)
+	_, err = l.Admit("b", &fakeConn{})
+	require.NoError(t, err)
+	_, err = l.Admit("c", &fakeConn{})
+	require.Equal(t, ErrListenerFull, err)
+
+	require.NoError(t, a1.Close())
+	require.NoError(t, a1.Close())
+	require.False(t, a1.Release())
+	require.Equal(t, 1, l.Connections("a"))
+	_, err = l.Admit("c", &fakeConn{})
+	require.NoError(t, err)
+}
+
+func TestLimiterSubscriptions(t *testing.T) {
+	l := NewLimiter(&config.WebsocketConfig{
+		MaxSubscriptionsPerKey: 2,
+	})
+	s1, err := l.Admit("a", &fakeConn{})
+	require.NoError(t, err)
+	s2, err := l.Admit("a", &fakeConn{})
+	require.NoError(t, err)
+
+	require.NoError(t, s1.Subscribe())
+	require.NoError(t, s2.Subscribe())
+	require.Equal(t, ErrTooManySubscriptions, s2.Subscribe())
+	s2.Unsubscribe()
+	require.NoError(t, s1.Subscribe())
+	require.Equal(t, 2, l.Subscriptions("a"))
+
+	// closing a connection releases its subscriptions
+	require.NoError(t, s1.Close())
+	require.Equal(t, 0, l.Subscriptions("a"))
+}
+
+func TestLimiterSweep(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewLimiter(&config.WebsocketConfig{
+		IdleTimeout:  time.Minute,
+		PingInterval: 10 * time.Second,
+	})
+	l.now = func() time.Time { return now }
+
+	active := &fakeConn{}
+	activeSess, err := l.Admit("a", active)
+	require.NoError(t, err)
+	leaked := &fakeConn{}
+	_, err = l.Admit("a", leaked)
+	require.NoError(t, err)
+	broken := &fakeConn{pingErr: errors.New("broken pipe")}
+	_, err = l.Admit("b", broken)
+	require.NoError(t, err)
+
+	now = now.Add(15 * time.Second)
+	l.sweep()
+	require.Equal(t, 1, active.pings)
+	require.Equal(t, 1, leaked.pings)
+	require.True(t, broken.closed)
+
+	// the active connection answers its pings, the leaked one doesn't
+	activeSess.Touch()
+	now = now.Add(50 * time.Second)
+	l.sweep()
+	require.False(t, active.closed)
+	require.True(t, leaked.closed)
+	require.Equal(t, 1, l.Connections("a"))
+	require.Equal(t, 0, l.Connections("b"))
+}
@@ -0,0 +1,540 @@
+// Package wsproxy serves JSON-RPC over clients' WebSocket connections, and
+// shares their eth_subscribe subscriptions over a single connection to the
+// current backend.
+package wsproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/kyokan/chaind/internal/logfilter"
+	"github.com/kyokan/chaind/internal/wslimit"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/log"
+)
+
+const (
+	// DefaultSendBuffer is the number of messages queued for a client,
+	// unless the config sets send_buffer.
+	DefaultSendBuffer = 256
+	// callTimeout bounds connecting to the backend and each eth_subscribe
+	// and eth_unsubscribe call to it.
+	callTimeout = 5 * time.Second
+	// checkInterval is how often the hub checks that its subscriptions are
+	// held on the current backend.
+	checkInterval = time.Second
+	// dedupWindow is the number of recent heads and logs remembered, to drop
+	// those delivered by more than one upstream subscription.
+	dedupWindow = 1024
+)
+
+const (
+	kindHeads = "newHeads"
+	kindLogs  = "logs"
+)
+
+var (
+	errNoWSURL = errors.New("backend has no ws_url")
+	errClosed  = errors.New("connection closed")
+)
+
+// BackendFunc returns the backend subscriptions are held on.
+type BackendFunc func() (*config.Backend, error)
+
+type subscription struct {
+	session *Session
+	kind    string
+	// active is set once the client received the subscription's ID, so
+	// that notifications can't overtake it
+	active bool
+}
+
+// Hub holds the subscriptions of all WebSocket clients on a single
+// connection to the current backend's ws_url. Clients subscribed to
+// newHeads share one upstream subscription, and clients' log filters are
+// fanned in to a covering set of upstream subscriptions, whose logs are
+// demultiplexed back to the clients whose own filters match them. This keeps
+// the upstream subscription count low on providers with strict limits.
+//
+// When the connection fails, or traffic switches to another backend, the
+// upstream subscriptions are opened again on the current backend; clients
+// keep their subscription IDs.
+type Hub struct {
+	backend    BackendFunc
+	sendBuffer int
+	logs       *logfilter.Mux
+	limits     *wslimit.Limiter
+
+	// subMtx serializes changes to the upstream subscriptions, which wait
+	// for the backend. It is taken before mtx.
+	subMtx   sync.Mutex
+	up       *upstream
+	headsSub string
+	// logSubs maps the keys of the upstream log filters to the IDs of
+	// their subscriptions
+	logSubs map[string]string
+
+	// mtx guards the state read to route notifications
+	mtx      sync.Mutex
+	subs     map[string]*subscription
+	heads    int
+	seen     *dedup
+	sessions map[*Session]bool
+	stopped  bool
+
+	wake     chan bool
+	quitChan chan bool
+	logger   log15.Logger
+}
+
+func NewHub(cfg *config.WebsocketConfig, backend BackendFunc) *Hub {
+	h := &Hub{
+		backend:    backend,
+		sendBuffer: cfg.SendBuffer,
+		logs:       logfilter.NewMux(),
+		limits:     wslimit.NewLimiter(cfg),
+		logSubs:    make(map[string]string),
+		subs:       make(map[string]*subscription),
+		seen:       newDedup(dedupWindow),
+		sessions:   make(map[*Session]bool),
+		wake:       make(chan bool, 1),
+		quitChan:   make(chan bool),
+		logger:     log.NewLog("wsproxy"),
+	}
+	if h.sendBuffer == 0 {
+		h.sendBuffer = DefaultSendBuffer
+	}
+	return h
+}
+
+func (h *Hub) Start() error {
+	if err := h.limits.Start(); err != nil {
+		return err
+	}
+	go func() {
+		tick := time.NewTicker(checkInterval)
+
+		for {
+			select {
+			case <-tick.C:
+				h.check()
+			case <-h.wake:
+				h.check()
+			case <-h.quitChan:
+				tick.Stop()
+				return
+			}
+		}
+	}()
+
+	h.logger.Info("started", "send_buffer", h.sendBuffer)
+	return nil
+}
+
+// Stop closes the client connections and the connection to the backend.
+func (h *Hub) Stop() error {
+	close(h.quitChan)
+	h.limits.Stop()
+	h.mtx.Lock()
+	h.stopped = true
+	var sessions []*Session
+	for s := range h.sessions {
+		sessions = append(sessions, s)
+	}
+	h.mtx.Unlock()
+
+	for _, s := range sessions {
+		s.Close()
+	}
+	h.subMtx.Lock()
+	if h.up != nil {
+		h.up.close()
+		h.up = nil
+	}
+	h.subMtx.Unlock()
+	return nil
+}
+
+// Subscriptions returns the number of client subscriptions and upstream
+// subscriptions.
+func (h *Hub) Subscriptions() (int, int) {
+	h.subMtx.Lock()
+	defer h.subMtx.Unlock()
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	upstream := len(h.logSubs)
+	if h.headsSub != "" {
+		upstream++
+	}
+	return len(h.subs), upstream
+}
+
+// subscribe opens a subscription for the session, and returns its ID. The
+// subscription receives notifications once activated.
+func (h *Hub) subscribe(s *Session, kind string, filter logfilter.Filter) (string, error) {
+	id, err := newID()
+	if err != nil {
+		return "", err
+	}
+
+	h.subMtx.Lock()
+	defer h.subMtx.Unlock()
+	up, err := h.connect()
+	if err != nil {
+		return "", err
+	}
+	switch kind {
+	case kindHeads:
+		if h.headsSub == "" {
+			sub, err := up.subscribe(kindHeads, kindHeads)
+			if err != nil {
+				return "", err
+			}
+			h.headsSub = sub
+		}
+	case kindLogs:
+		plan := h.logs.Subscribe(id, filter)
+		if err := h.apply(up, plan); err != nil {
+			// the covering set is restored along with the client set
+			h.logs.Unsubscribe(id)
+			return "", err
+		}
+	}
+
+	h.mtx.Lock()
+	if s.closed {
+		// the session went away while the backend was subscribing
+		h.mtx.Unlock()
+		h.release(id, kind)
+		return "", errClosed
+	}
+	h.subs[id] = &subscription{
+		session: s,
+		kind:    kind,
+	}
+	s.subs[id] = true
+	if kind == kindHeads {
+		h.heads++
+	}
+	h.mtx.Unlock()
+	return id, nil
+}
+
+// unsubscribe closes the session's subscription with the given ID, and
+// returns whether it existed.
+func (h *Hub) unsubscribe(s *Session, id string) bool {
+	h.subMtx.Lock()
+	defer h.subMtx.Unlock()
+
+	h.mtx.Lock()
+	sub := h.subs[id]
+	if sub == nil || sub.session != s {
+		h.mtx.Unlock()
+		return false
+	}
+	delete(h.subs, id)
+	delete(s.subs, id)
+	if sub.kind == kindHeads {
+		h.heads--
+	}
+	h.mtx.Unlock()
+
+	h.release(id, sub.kind)
+	return true
+}
+
+// drop closes the subscriptions of a closed session.
+func (h *Hub) drop(s *Session) {
+	h.subMtx.Lock()
+	defer h.subMtx.Unlock()
+
+	h.mtx.Lock()
+	delete(h.sessions, s)
+	var subs []*subscription
+	var ids []string
+	for id := range s.subs {
+		sub := h.subs[id]
+		delete(h.subs, id)
+		if sub.kind == kindHeads {
+			h.heads--
+		}
+		subs = append(subs, sub)
+		ids = append(ids, id)
+	}
+	s.subs = make(map[string]bool)
+	stopped := h.stopped
+	h.mtx.Unlock()
+	if stopped {
+		// the connection to the backend is closed along with the hub
+		return
+	}
+
+	for i, sub := range subs {
+		h.release(ids[i], sub.kind)
+	}
+}
+
+// activate lets the subscriptions with the given IDs receive
+// notifications.
+func (h *Hub) activate(ids []string) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	for _, id := range ids {
+		if sub := h.subs[id]; sub != nil {
+			sub.active = true
+		}
+	}
+}
+
+// release closes the upstream subscriptions no longer needed once the
+// client subscription with the given ID is gone. subMtx must be held.
+func (h *Hub) release(id string, kind string) {
+	switch kind {
+	case kindHeads:
+		h.mtx.Lock()
+		remaining := h.heads
+		h.mtx.Unlock()
+		if remaining > 0 || h.headsSub == "" || h.up == nil {
+			return
+		}
+		sub := h.headsSub
+		h.headsSub = ""
+		if err := h.up.unsubscribe(sub); err != nil {
+			h.reset(err)
+		}
+	case kindLogs:
+		plan := h.logs.Unsubscribe(id)
+		if h.up == nil {
+			return
+		}
+		if err := h.apply(h.up, plan); err != nil {
+			h.reset(err)
+		}
+	}
+}
+
+// apply opens and closes the upstream log subscriptions of a plan. New
+// subscriptions are opened first, so that no logs are missed while the
+// covering set changes. If one can't be opened, those opened before it are
+// closed again. subMtx must be held.
+func (h *Hub) apply(up *upstream, plan logfilter.Plan) error {
+	var opened []string
+	for _, f := range plan.Subscribe {
+		sub, err := up.subscribe(kindLogs, kindLogs, f)
+		if err != nil {
+			for _, key := range opened {
+				up.unsubscribe(h.logSubs[key])
+				delete(h.logSubs, key)
+			}
+			return err
+		}
+		h.logSubs[f.Key()] = sub
+		opened = append(opened, f.Key())
+	}
+	for _, f := range plan.Unsubscribe {
+		sub, ok := h.logSubs[f.Key()]
+		if !ok {
+			continue
+		}
+		delete(h.logSubs, f.Key())
+		if err := up.unsubscribe(sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// connect returns the connection to the current backend, opening it and
+// moving the subscriptions to it if needed. subMtx must be held.
+func (h *Hub) connect() (*upstream, error) {
+	backend, err := h.backend()
+	if err != nil {
+		return nil, err
+	}
+	if h.up != nil && h.up.failure() == nil && h.up.name == backend.Name {
+		return h.up, nil
+	}
+	if err := h.resubscribe(backend); err != nil {
+		return nil, err
+	}
+	return h.up, nil
+}
+
+// resubscribe opens the upstream subscriptions on a new connection to the
+// backend, and replaces the current connection with it. Both connections
+// deliver notifications until the switch, and duplicates are dropped.
+// subMtx must be held.
+func (h *Hub) resubscribe(backend *config.Backend) error {
+	up, err := dialUpstream(backend)
+	if err != nil {
+		return err
+	}
+	go up.read(h)
+
+	h.mtx.Lock()
+	heads := h.heads
+	h.mtx.Unlock()
+	var headsSub string
+	if heads > 0 {
+		if headsSub, err = up.subscribe(kindHeads, kindHeads); err != nil {
+			up.close()
+			return err
+		}
+	}
+	logSubs := make(map[string]string)
+	for _, f := range h.logs.Upstream() {
+		sub, err := up.subscribe(kindLogs, kindLogs, f)
+		if err != nil {
+			up.close()
+			return err
+		}
+		logSubs[f.Key()] = sub
+	}
+
+	old := h.up
+	h.up, h.headsSub, h.logSubs = up, headsSub, logSubs
+	if old != nil {
+		old.close()
+	}
+	h.logger.Info("subscribed to backend", "backend", up.name, "logs", len(logSubs), "heads", headsSub != "")
+	return nil
+}
+
+// reset closes a connection whose subscriptions no longer match the
+// clients', so that they are opened again on a new one. subMtx must be
+// held.
+func (h *Hub) reset(err error) {
+	h.logger.Warn("failed to update subscriptions, reconnecting", "err", err)
+	if h.up != nil {
+		h.up.close()
+	}
+	h.up = nil
+	h.headsSub = ""
+	h.logSubs = make(map[string]string)
+	h.wakeUp()
+}
+
+// check moves the subscriptions to the current backend if the connection
+// failed or traffic switched to another backend.
+func (h *Hub) check() {
+	h.subMtx.Lock()
+	defer h.subMtx.Unlock()
+
+	h.mtx.Lock()
+	wanted := len(h.subs) > 0
+	h.mtx.Unlock()
+	if !wanted {
+		// idle connections are closed once they fail, and opened again
+		// by the next subscription
+		if h.up != nil && h.up.failure() != nil {
+			h.up = nil
+		}
+		return
+	}
+	backend, err := h.backend()
+	if err != nil {
+		// subscriptions stay where they are until a backend is available
+		return
+	}
+	if h.up != nil && h.up.failure() == nil && h.up.name == backend.Name {
+		return
+	}
+	if err := h.resubscribe(backend); err != nil {
+		h.logger.Warn("failed to resubscribe", "backend", backend.Name, "err", err)
+	}
+}
+
+// lost is called when an upstream connection fails.
+func (h *Hub) lost(up *upstream) {
+	if up.failure() != errClosed {
+		h.logger.Warn("lost connection to backend", "backend", up.name, "err", up.failure())
+	}
+	h.wakeUp()
+}
+
+func (h *Hub) wakeUp() {
+	select {
+	case h.wake <- true:
+	default:
+	}
+}
+
+// dispatch routes a notification of an upstream subscription to the client
+// subscriptions it matches.
+func (h *Hub) dispatch(up *upstream, upstreamID string, result json.RawMessage) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	switch up.kinds[upstreamID] {
+	case kindHeads:
+		var head struct {
+			Hash string `json:"hash"`
+		}
+		if err := json.Unmarshal(result, &head); err != nil {
+			h.logger.Debug("dropping malformed head", "backend", up.name, "err", err)
+			return
+		}
+		if head.Hash != "" && !h.seen.add("head:"+head.Hash) {
+			return
+		}
+		for id, sub := range h.subs {
+			if sub.kind == kindHeads && sub.active {
+				sub.session.notify(id, result)
+			}
+		}
+	case kindLogs:
+		var l struct {
+			logfilter.Log
+			BlockHash string `json:"blockHash"`
+			LogIndex  string `json:"logIndex"`
+			Removed   bool   `json:"removed"`
+		}
+		if err := json.Unmarshal(result, &l); err != nil {
+			h.logger.Debug("dropping malformed log", "backend", up.name, "err", err)
+			return
+		}
+		key := "log:" + l.BlockHash + ":" + l.LogIndex
+		if l.Removed {
+			key += ":removed"
+		}
+		if !h.seen.add(key) {
+			return
+		}
+		for _, id := range h.logs.Dispatch(&l.Log) {
+			if sub := h.subs[id]; sub != nil && sub.active {
+				sub.session.notify(id, result)
+			}
+		}
+	}
+}
+
+// dedup remembers the last keys added to it.
+type dedup struct {
+	keys []string
+	next int
+	seen map[string]bool
+}
+
+func newDedup(size int) *dedup {
+	return &dedup{
+		keys: make([]string, size),
+		seen: make(map[string]bool, size),
+	}
+}
+
+// add returns false if the key was already seen.
+func (d *dedup) add(key string) bool {
+	if d.seen[key] {
+		return false
+	}
+	if old := d.keys[d.next]; old != "" {
+		delete(d.seen, old)
+	}
+	d.keys[d.next] = key
+	d.next = (d.next + 1) % len(d.keys)
+	d.seen[key] = true
+	return true
+}
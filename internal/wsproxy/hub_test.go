@@ -0,0 +1,396 @@
+package wsproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/internal/wsconn"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/jsonrpc"
+	"github.com/stretchr/testify/require"
+)
+
+type backendSub struct {
+	conn   *wsconn.Conn
+	params []json.RawMessage
+}
+
+// wsBackend is a node that holds subscriptions and publishes notifications
+// to them.
+type wsBackend struct {
+	*httptest.Server
+	name string
+	mtx  sync.Mutex
+	subs map[string]*backendSub
+	next int
+}
+
+func newWSBackend(t *testing.T, name string) *wsBackend {
+	b := &wsBackend{
+		name: name,
+		subs: make(map[string]*backendSub),
+	}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := wsconn.Upgrade(w, r)
+		require.NoError(t, err)
+		defer b.drop(c)
+
+		for {
+			msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			var req struct {
+				ID     uint64            `json:"id"`
+				Method string            `json:"method"`
+				Params []json.RawMessage `json:"params"`
+			}
+			require.NoError(t, json.Unmarshal(msg, &req))
+			var result interface{}
+			b.mtx.Lock()
+			switch req.Method {
+			case "eth_subscribe":
+				b.next++
+				id := fmt.Sprintf("0x%d", b.next)
+				b.subs[id] = &backendSub{conn: c, params: req.Params}
+				result = id
+			case "eth_unsubscribe":
+				var id string
+				json.Unmarshal(req.Params[0], &id)
+				_, result = b.subs[id]
+				delete(b.subs, id)
+			}
+			b.mtx.Unlock()
+			out, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": result})
+			c.WriteText(out)
+		}
+	}))
+	return b
+}
+
+func (b *wsBackend) drop(c *wsconn.Conn) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for id, sub := range b.subs {
+		if sub.conn == c {
+			delete(b.subs, id)
+		}
+	}
+	c.Close()
+}
+
+// disconnect closes the connections of all subscriptions.
+func (b *wsBackend) disconnect() {
+	b.mtx.Lock()
+	var conns []*wsconn.Conn
+	for _, sub := range b.subs {
+		conns = append(conns, sub.conn)
+	}
+	b.mtx.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+func (b *wsBackend) config() *config.Backend {
+	return &config.Backend{
+		Name:  b.name,
+		URL:   b.URL,
+		WSURL: strings.Replace(b.URL, "http://", "ws://", 1),
+	}
+}
+
+// subscriptions returns the params of the subscriptions of the given kind.
+func (b *wsBackend) subscriptions(kind string) []string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	var out []string
+	for _, sub := range b.subs {
+		if string(sub.params[0]) == `"`+kind+`"` {
+			var params []string
+			for _, p := range sub.params[1:] {
+				params = append(params, string(p))
+			}
+			out = append(out, strings.Join(params, ","))
+		}
+	}
+	return out
+}
+
+// publish sends the result to the subscriptions of the given kind.
+func (b *wsBackend) publish(kind string, result string) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for id, sub := range b.subs {
+		if string(sub.params[0]) == `"`+kind+`"` {
+			sub.conn.WriteText([]byte(`{"jsonrpc":"2.0","method":"eth_subscription","params":{"subscription":"` + id + `","result":` + result + `}}`))
+		}
+	}
+}
+
+// newTestHub serves the hub on a test server, answering subscription calls
+// and failing any other request. All clients share a key.
+func newTestHub(t *testing.T, cfg *config.WebsocketConfig, backend BackendFunc) (*Hub, *httptest.Server) {
+	hub := NewHub(cfg, backend)
+	require.NoError(t, hub.Start())
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, err := hub.Admit("key")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		c, err := wsconn.Upgrade(w, r)
+		require.NoError(t, err)
+		session.Serve(context.Background(), c, func(ctx context.Context, msg []byte) []byte {
+			var req jsonrpc.Request
+			require.NoError(t, json.Unmarshal(msg, &req))
+			if !IsSubscriptionMethod(req.Method) {
+				out, _ := json.Marshal(&jsonrpc.ErrorResponse{Jsonrpc: "2.0", Id: req.Id, Error: &jsonrpc.ErrorData{Code: -32601, Message: "not found"}})
+				return out
+			}
+			result, errData := CallFrom(ctx).Handle(req.Method, req.Params)
+			if errData != nil {
+				out, _ := json.Marshal(&jsonrpc.ErrorResponse{Jsonrpc: "2.0", Id: req.Id, Error: errData})
+				return out
+			}
+			data, _ := json.Marshal(result)
+			out, _ := json.Marshal(&jsonrpc.Response{Jsonrpc: "2.0", Id: req.Id, Result: data})
+			return out
+		})
+	}))
+	return hub, srv
+}
+
+type testClient struct {
+	t    *testing.T
+	conn *wsconn.Conn
+}
+
+func dialHub(t *testing.T, srv *httptest.Server) *testClient {
+	c, err := wsconn.Dial(context.Background(), &config.Backend{WSURL: strings.Replace(srv.URL, "http://", "ws://", 1)})
+	require.NoError(t, err)
+	return &testClient{t: t, conn: c}
+}
+
+func (c *testClient) read() map[string]json.RawMessage {
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	msg, err := c.conn.ReadMessage()
+	require.NoError(c.t, err)
+	var out map[string]json.RawMessage
+	require.NoError(c.t, json.Unmarshal(msg, &out))
+	return out
+}
+
+func (c *testClient) call(method string, params string) map[string]json.RawMessage {
+	require.NoError(c.t, c.conn.WriteText([]byte(`{"jsonrpc":"2.0","id":1,"method":"`+method+`","params":`+params+`}`)))
+	return c.read()
+}
+
+func (c *testClient) subscribe(params string) string {
+	res := c.call("eth_subscribe", params)
+	require.Nil(c.t, res["error"], string(res["error"]))
+	var id string
+	require.NoError(c.t, json.Unmarshal(res["result"], &id))
+	return id
+}
+
+// notification reads the next notification, and returns its subscription
+// and result.
+func (c *testClient) notification() (string, string) {
+	var params notificationParams
+	require.NoError(c.t, json.Unmarshal(c.read()["params"], &params))
+	return params.Subscription, string(params.Result)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHubSharesHeads(t *testing.T) {
+	backend := newWSBackend(t, "node")
+	defer backend.Close()
+	hub, srv := newTestHub(t, &config.WebsocketConfig{}, func() (*config.Backend, error) {
+		return backend.config(), nil
+	})
+	defer srv.Close()
+	defer hub.Stop()
+
+	c1 := dialHub(t, srv)
+	c2 := dialHub(t, srv)
+	id1 := c1.subscribe(`["newHeads"]`)
+	id2 := c2.subscribe(`["newHeads"]`)
+	require.NotEqual(t, id1, id2)
+	require.Len(t, backend.subscriptions("newHeads"), 1)
+
+	head := `{"hash":"0xa","number":"0x1"}`
+	backend.publish("newHeads", head)
+	for _, c := range []*testClient{c1, c2} {
+		sub, result := c.notification()
+		require.Contains(t, []string{id1, id2}, sub)
+		require.Equal(t, head, result)
+	}
+	clientSubs, upstreamSubs := hub.Subscriptions()
+	require.Equal(t, 2, clientSubs)
+	require.Equal(t, 1, upstreamSubs)
+
+	// the upstream subscription is closed along with the last client's
+	res := c1.call("eth_unsubscribe", `["`+id1+`"]`)
+	require.Equal(t, "true", string(res["result"]))
+	res = c1.call("eth_unsubscribe", `["`+id1+`"]`)
+	require.Equal(t, "false", string(res["result"]))
+	require.Len(t, backend.subscriptions("newHeads"), 1)
+	c2.conn.Close()
+	waitFor(t, func() bool {
+		return len(backend.subscriptions("newHeads")) == 0
+	})
+	c1.conn.Close()
+}
+
+func TestHubFansInLogs(t *testing.T) {
+	backend := newWSBackend(t, "node")
+	defer backend.Close()
+	hub, srv := newTestHub(t, &config.WebsocketConfig{}, func() (*config.Backend, error) {
+		return backend.config(), nil
+	})
+	defer srv.Close()
+	defer hub.Stop()
+
+	c1 := dialHub(t, srv)
+	defer c1.conn.Close()
+	c2 := dialHub(t, srv)
+	defer c2.conn.Close()
+	id1 := c1.subscribe(`["logs",{"address":"0xAA"}]`)
+	id2 := c2.subscribe(`["logs",{"address":"0xaa","topics":["0x01"]}]`)
+	require.Equal(t, []string{`{"address":["0xaa"]}`}, backend.subscriptions("logs"))
+
+	other := `{"address":"0xaa","topics":["0x02"],"blockHash":"0xb","logIndex":"0x0"}`
+	matching := `{"address":"0xaa","topics":["0x01"],"blockHash":"0xb","logIndex":"0x1"}`
+	backend.publish("logs", other)
+	backend.publish("logs", matching)
+	// duplicates, e.g. from overlapping upstream subscriptions, are dropped
+	backend.publish("logs", matching)
+	sub, result := c1.notification()
+	require.Equal(t, id1, sub)
+	require.Equal(t, other, result)
+	sub, result = c1.notification()
+	require.Equal(t, id1, sub)
+	require.Equal(t, matching, result)
+	sub, result = c2.notification()
+	require.Equal(t, id2, sub)
+	require.Equal(t, matching, result)
+
+	// the remaining filter gets a subscription of its own
+	c1.call("eth_unsubscribe", `["`+id1+`"]`)
+	require.Equal(t, []string{`{"address":["0xaa"],"topics":[["0x01"]]}`}, backend.subscriptions("logs"))
+
+	res := c2.call("eth_subscribe", `["syncing"]`)
+	require.Contains(t, string(res["error"]), "unsupported subscription type")
+	res = c2.call("eth_subscribe", `["logs",{"address":1}]`)
+	require.Contains(t, string(res["error"]), "invalid logs filter")
+}
+
+func TestHubFollowsBackendSwitches(t *testing.T) {
+	first := newWSBackend(t, "first")
+	defer first.Close()
+	second := newWSBackend(t, "second")
+	defer second.Close()
+	var mtx sync.Mutex
+	current := first
+	hub, srv := newTestHub(t, &config.WebsocketConfig{}, func() (*config.Backend, error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if current == nil {
+			return nil, errors.New("no backend is available")
+		}
+		return current.config(), nil
+	})
+	defer srv.Close()
+	defer hub.Stop()
+
+	c := dialHub(t, srv)
+	defer c.conn.Close()
+	id := c.subscribe(`["newHeads"]`)
+	require.Len(t, first.subscriptions("newHeads"), 1)
+
+	mtx.Lock()
+	current = second
+	mtx.Unlock()
+	waitFor(t, func() bool {
+		return len(second.subscriptions("newHeads")) == 1 && len(first.subscriptions("newHeads")) == 0
+	})
+	second.publish("newHeads", `{"hash":"0xc"}`)
+	sub, _ := c.notification()
+	require.Equal(t, id, sub)
+
+	// subscriptions are opened again when the connection fails
+	second.disconnect()
+	waitFor(t, func() bool {
+		return len(second.subscriptions("newHeads")) == 1
+	})
+	second.publish("newHeads", `{"hash":"0xd"}`)
+	sub, _ = c.notification()
+	require.Equal(t, id, sub)
+}
+
+func TestHubRequiresWSURL(t *testing.T) {
+	hub, srv := newTestHub(t, &config.WebsocketConfig{}, func() (*config.Backend, error) {
+		return &config.Backend{Name: "http"}, nil
+	})
+	defer srv.Close()
+	defer hub.Stop()
+
+	c := dialHub(t, srv)
+	defer c.conn.Close()
+	res := c.call("eth_subscribe", `["newHeads"]`)
+	require.Contains(t, string(res["error"]), "the backend doesn't support subscriptions")
+	require.Contains(t, string(c.call("eth_chainId", `[]`)["error"]), "not found")
+}
+
+func TestHubLimitsConnections(t *testing.T) {
+	backend := newWSBackend(t, "node")
+	defer backend.Close()
+	hub, srv := newTestHub(t, &config.WebsocketConfig{
+		MaxConnectionsPerKey:   1,
+		MaxSubscriptionsPerKey: 1,
+		IdleTimeout:            300 * time.Millisecond,
+		PingInterval:           100 * time.Millisecond,
+	}, func() (*config.Backend, error) {
+		return backend.config(), nil
+	})
+	defer srv.Close()
+	defer hub.Stop()
+
+	c := dialHub(t, srv)
+	_, err := wsconn.Dial(context.Background(), &config.Backend{WSURL: strings.Replace(srv.URL, "http://", "ws://", 1)})
+	require.Error(t, err)
+
+	id := c.subscribe(`["newHeads"]`)
+	res := c.call("eth_subscribe", `["logs",{}]`)
+	require.Contains(t, string(res["error"]), "too many subscriptions")
+	c.call("eth_unsubscribe", `["`+id+`"]`)
+	c.subscribe(`["logs",{}]`)
+	require.Equal(t, 1, hub.limits.Subscriptions("key"))
+
+	// the client stops reading, and so answering pings, and is closed
+	// along with its subscriptions
+	waitFor(t, func() bool {
+		return hub.limits.Connections("key") == 0 && len(backend.subscriptions("logs")) == 0
+	})
+	require.Equal(t, 0, hub.limits.Subscriptions("key"))
+	c = dialHub(t, srv)
+	c.conn.Close()
+}
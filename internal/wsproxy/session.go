@@ -0,0 +1,325 @@
+package wsproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"sync"
+
+	"github.com/kyokan/chaind/internal/logfilter"
+	"github.com/kyokan/chaind/internal/wsconn"
+	"github.com/kyokan/chaind/internal/wslimit"
+	chainderrors "github.com/kyokan/chaind/pkg/errors"
+	"github.com/kyokan/chaind/pkg/jsonrpc"
+)
+
+// maxInFlight bounds the messages of a connection that are served at once.
+// Further messages wait to be read.
+const maxInFlight = 16
+
+// invalidParams is the JSON-RPC error code of requests with invalid params.
+const invalidParams = -32602
+
+// Forwarder serves a JSON-RPC message received over a WebSocket connection,
+// and returns the response to send back, if any. Subscription calls in the
+// message are to be answered through the Call carried by ctx.
+type Forwarder func(ctx context.Context, msg []byte) []byte
+
+// Session is a client's WebSocket connection.
+type Session struct {
+	hub     *Hub
+	limits  *wslimit.Session
+	forward Forwarder
+	out     chan []byte
+	sem     chan bool
+	done    chan bool
+	once    sync.Once
+	// conn, ctx, cancel, subs and closed are guarded by the hub's mtx;
+	// conn, ctx and cancel are set once the session is served
+	conn   *wsconn.Conn
+	ctx    context.Context
+	cancel context.CancelFunc
+	subs   map[string]bool
+	closed bool
+}
+
+// Admit reserves a connection for the client with the given key ahead of
+// its handshake, so that clients over the connection limits can be turned
+// away with an HTTP error. It returns wslimit.ErrListenerFull or
+// wslimit.ErrTooManyConnections if they are. The session must be served or
+// closed.
+func (h *Hub) Admit(key string) (*Session, error) {
+	s := &Session{
+		hub:  h,
+		out:  make(chan []byte, h.sendBuffer),
+		sem:  make(chan bool, maxInFlight),
+		done: make(chan bool),
+		subs: make(map[string]bool),
+	}
+	limits, err := h.limits.Admit(key, s)
+	if err != nil {
+		return nil, err
+	}
+	s.limits = limits
+	return s, nil
+}
+
+// Serve serves the messages of the client's connection until it is closed.
+// Messages are served concurrently, and their responses sent in the order
+// they complete.
+func (s *Session) Serve(ctx context.Context, conn *wsconn.Conn, forward Forwarder) {
+	h := s.hub
+	ctx, cancel := context.WithCancel(ctx)
+	h.mtx.Lock()
+	if h.stopped || s.closed {
+		h.mtx.Unlock()
+		cancel()
+		conn.Close()
+		s.Close()
+		return
+	}
+	s.conn, s.ctx, s.cancel = conn, ctx, cancel
+	s.forward = forward
+	h.sessions[s] = true
+	h.mtx.Unlock()
+
+	conn.OnPong(s.limits.Touch)
+	go s.write()
+	s.read()
+}
+
+func (s *Session) read() {
+	defer s.Close()
+	for {
+		msg, err := s.conn.ReadMessage()
+		if err != nil {
+			select {
+			case <-s.done:
+			default:
+				if err != wsconn.ErrClosed {
+					s.hub.logger.Debug("websocket connection failed", "remote", s.conn.RemoteAddr(), "err", err)
+				}
+			}
+			return
+		}
+		s.limits.Touch()
+
+		select {
+		case s.sem <- true:
+		case <-s.done:
+			return
+		}
+		go func() {
+			defer func() {
+				<-s.sem
+			}()
+			s.serve(msg)
+		}()
+	}
+}
+
+func (s *Session) serve(msg []byte) {
+	// unlike the HTTP server, nothing else recovers panics of messages
+	defer func() {
+		if err := recover(); err != nil {
+			s.hub.logger.Error("panic serving websocket message", "remote", s.conn.RemoteAddr(), "err", err, "stack", string(debug.Stack()))
+			s.Close()
+		}
+	}()
+	call := &Call{session: s}
+	if res := s.forward(NewContext(s.ctx, call), msg); len(res) > 0 {
+		s.send(res)
+	}
+	// subscriptions are activated once the response with their ID is
+	// queued, so that their notifications can't overtake it
+	s.hub.activate(call.opened)
+}
+
+func (s *Session) write() {
+	for {
+		select {
+		case msg := <-s.out:
+			if err := s.conn.WriteText(msg); err != nil {
+				s.Close()
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// send queues a message for the client. Clients that fall a full send
+// buffer behind are disconnected, rather than holding up the others.
+func (s *Session) send(msg []byte) {
+	select {
+	case s.out <- msg:
+	case <-s.done:
+	default:
+		s.hub.logger.Info("closing websocket connection of slow client", "remote", s.conn.RemoteAddr())
+		go s.Close()
+	}
+}
+
+// notify sends a notification of the client subscription with the given
+// ID.
+func (s *Session) notify(id string, result json.RawMessage) {
+	out, err := json.Marshal(&notification{
+		Jsonrpc: jsonrpc.Version,
+		Method:  "eth_subscription",
+		Params: notificationParams{
+			Subscription: id,
+			Result:       result,
+		},
+	})
+	if err != nil {
+		return
+	}
+	s.send(out)
+}
+
+// Ping pings the client, once the session is served.
+func (s *Session) Ping() error {
+	s.hub.mtx.Lock()
+	conn := s.conn
+	s.hub.mtx.Unlock()
+	if conn == nil {
+		return nil
+	}
+	return conn.Ping()
+}
+
+// Close closes the connection and its subscriptions. It is safe to call
+// more than once.
+func (s *Session) Close() error {
+	s.once.Do(func() {
+		s.hub.mtx.Lock()
+		s.closed = true
+		conn, cancel := s.conn, s.cancel
+		s.hub.mtx.Unlock()
+		close(s.done)
+		s.limits.Release()
+		if conn != nil {
+			cancel()
+			conn.Close()
+		}
+		s.hub.drop(s)
+	})
+	return nil
+}
+
+type notification struct {
+	Jsonrpc string             `json:"jsonrpc"`
+	Method  string             `json:"method"`
+	Params  notificationParams `json:"params"`
+}
+
+type notificationParams struct {
+	Subscription string          `json:"subscription"`
+	Result       json.RawMessage `json:"result"`
+}
+
+type callKey struct{}
+
+// Call answers the subscription calls of a message received over a
+// WebSocket connection.
+type Call struct {
+	session *Session
+	opened  []string
+}
+
+// NewContext returns a context carrying the call.
+func NewContext(ctx context.Context, call *Call) context.Context {
+	return context.WithValue(ctx, callKey{}, call)
+}
+
+// CallFrom returns the call carried by ctx, or nil for requests that
+// didn't arrive over a WebSocket connection.
+func CallFrom(ctx context.Context) *Call {
+	call, _ := ctx.Value(callKey{}).(*Call)
+	return call
+}
+
+// IsSubscriptionMethod returns whether the method is answered by Call.Handle
+// on WebSocket connections.
+func IsSubscriptionMethod(method string) bool {
+	return method == "eth_subscribe" || method == "eth_unsubscribe"
+}
+
+// Handle answers an eth_subscribe or eth_unsubscribe call. Subscriptions to
+// newHeads and logs are supported.
+func (c *Call) Handle(method string, params json.RawMessage) (interface{}, *jsonrpc.ErrorData) {
+	var args []json.RawMessage
+	if err := json.Unmarshal(params, &args); err != nil || len(args) == 0 {
+		return nil, &jsonrpc.ErrorData{Code: invalidParams, Message: "missing params"}
+	}
+
+	if method == "eth_unsubscribe" {
+		var id string
+		if err := json.Unmarshal(args[0], &id); err != nil {
+			return nil, &jsonrpc.ErrorData{Code: invalidParams, Message: "invalid subscription id"}
+		}
+		ok := c.session.hub.unsubscribe(c.session, id)
+		if ok {
+			c.session.limits.Unsubscribe()
+		}
+		return ok, nil
+	}
+
+	var kind string
+	if err := json.Unmarshal(args[0], &kind); err != nil {
+		return nil, &jsonrpc.ErrorData{Code: invalidParams, Message: "invalid subscription type"}
+	}
+	var filter logfilter.Filter
+	switch kind {
+	case kindHeads:
+		if len(args) > 1 {
+			return nil, &jsonrpc.ErrorData{Code: invalidParams, Message: "newHeads takes no options"}
+		}
+	case kindLogs:
+		var raw []byte
+		if len(args) > 1 {
+			raw = args[1]
+		}
+		var err error
+		if filter, err = logfilter.ParseFilter(raw); err != nil {
+			return nil, &jsonrpc.ErrorData{Code: invalidParams, Message: "invalid logs filter: " + err.Error()}
+		}
+	default:
+		return nil, &jsonrpc.ErrorData{Code: invalidParams, Message: fmt.Sprintf("unsupported subscription type %q", kind)}
+	}
+
+	if err := c.session.limits.Subscribe(); err != nil {
+		if err == wslimit.ErrTooManySubscriptions {
+			return nil, chainderrors.New(chainderrors.RateLimited, "too many subscriptions", nil)
+		}
+		return nil, chainderrors.New(chainderrors.BackendUnavailable, "failed to subscribe", nil)
+	}
+	id, err := c.session.hub.subscribe(c.session, kind, filter)
+	if err != nil {
+		c.session.limits.Unsubscribe()
+		if rpcErr, ok := err.(*rpcError); ok {
+			return nil, rpcErr.data
+		}
+		// backend addresses and errors are only logged
+		c.session.hub.logger.Warn("failed to subscribe", "type", kind, "err", err)
+		msg := "failed to subscribe"
+		if err == errNoWSURL {
+			msg = "the backend doesn't support subscriptions"
+		}
+		return nil, chainderrors.New(chainderrors.BackendUnavailable, msg, nil)
+	}
+	c.opened = append(c.opened, id)
+	return id, nil
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "0x" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,206 @@
+package wsproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/kyokan/chaind/internal/wsconn"
+	"github.com/kyokan/chaind/pkg/config"
+	"github.com/kyokan/chaind/pkg/jsonrpc"
+)
+
+var errCallTimeout = errors.New("backend didn't answer in time")
+
+// rpcError is an error the backend answered a call with.
+type rpcError struct {
+	data *jsonrpc.ErrorData
+}
+
+func (e *rpcError) Error() string {
+	return e.data.Message
+}
+
+type pendingCall struct {
+	res chan *jsonrpc.Response
+	// kind is the kind of subscription an eth_subscribe call opens
+	kind string
+}
+
+// upstream is the hub's connection to a backend's ws_url, over which the
+// subscriptions of all clients are held.
+type upstream struct {
+	name    string
+	conn    *wsconn.Conn
+	mtx     sync.Mutex
+	nextID  uint64
+	pending map[uint64]*pendingCall
+	err     error
+	done    chan bool
+	// kinds maps the IDs of the upstream subscriptions to their kind. It is
+	// guarded by the hub's mtx, since notifications are routed with it.
+	kinds map[string]string
+}
+
+func dialUpstream(backend *config.Backend) (*upstream, error) {
+	if backend.WSURL == "" {
+		return nil, errNoWSURL
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+	conn, err := wsconn.Dial(ctx, backend)
+	if err != nil {
+		return nil, err
+	}
+	return &upstream{
+		name:    backend.Name,
+		conn:    conn,
+		pending: make(map[uint64]*pendingCall),
+		done:    make(chan bool),
+		kinds:   make(map[string]string),
+	}, nil
+}
+
+// read reads responses and notifications until the connection fails.
+// Notifications are passed to the hub.
+func (u *upstream) read(h *Hub) {
+	for {
+		msg, err := u.conn.ReadMessage()
+		if err != nil {
+			u.fail(err)
+			h.lost(u)
+			return
+		}
+
+		var in struct {
+			ID     *uint64            `json:"id"`
+			Method string             `json:"method"`
+			Result json.RawMessage    `json:"result"`
+			Error  *jsonrpc.ErrorData `json:"error"`
+			Params struct {
+				Subscription string          `json:"subscription"`
+				Result       json.RawMessage `json:"result"`
+			} `json:"params"`
+		}
+		if err := json.Unmarshal(msg, &in); err != nil {
+			h.logger.Debug("dropping malformed message from backend", "backend", u.name, "err", err)
+			continue
+		}
+		if in.Method == "eth_subscription" {
+			h.dispatch(u, in.Params.Subscription, in.Params.Result)
+			continue
+		}
+		if in.ID == nil {
+			continue
+		}
+
+		u.mtx.Lock()
+		call := u.pending[*in.ID]
+		delete(u.pending, *in.ID)
+		u.mtx.Unlock()
+		if call == nil {
+			continue
+		}
+		// the subscription is routed before the call returns, since its
+		// first notification may follow right after the response
+		var id string
+		if call.kind != "" && in.Error == nil && json.Unmarshal(in.Result, &id) == nil {
+			h.mtx.Lock()
+			u.kinds[id] = call.kind
+			h.mtx.Unlock()
+		}
+		call.res <- &jsonrpc.Response{
+			Result: in.Result,
+			Error:  in.Error,
+		}
+	}
+}
+
+// call sends a request to the backend and waits for its result.
+func (u *upstream) call(kind string, method string, params ...interface{}) (json.RawMessage, error) {
+	call := &pendingCall{
+		res:  make(chan *jsonrpc.Response, 1),
+		kind: kind,
+	}
+	u.mtx.Lock()
+	if u.err != nil {
+		err := u.err
+		u.mtx.Unlock()
+		return nil, err
+	}
+	u.nextID++
+	id := u.nextID
+	u.pending[id] = call
+	u.mtx.Unlock()
+	defer func() {
+		u.mtx.Lock()
+		delete(u.pending, id)
+		u.mtx.Unlock()
+	}()
+
+	body, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": jsonrpc.Version,
+		"id":      id,
+		"method":  method,
+		"params":  params,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := u.conn.WriteText(body); err != nil {
+		return nil, err
+	}
+
+	select {
+	case res := <-call.res:
+		if res.Error != nil {
+			return nil, &rpcError{data: res.Error}
+		}
+		return res.Result, nil
+	case <-u.done:
+		return nil, u.failure()
+	case <-time.After(callTimeout):
+		return nil, errCallTimeout
+	}
+}
+
+// subscribe opens an upstream subscription and returns its ID.
+func (u *upstream) subscribe(kind string, params ...interface{}) (string, error) {
+	result, err := u.call(kind, "eth_subscribe", params...)
+	if err != nil {
+		return "", err
+	}
+	var id string
+	if err := json.Unmarshal(result, &id); err != nil || id == "" {
+		return "", errors.New("invalid eth_subscribe response")
+	}
+	return id, nil
+}
+
+func (u *upstream) unsubscribe(id string) error {
+	_, err := u.call("", "eth_unsubscribe", id)
+	return err
+}
+
+func (u *upstream) fail(err error) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	if u.err != nil {
+		return
+	}
+	u.err = err
+	close(u.done)
+}
+
+func (u *upstream) failure() error {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	return u.err
+}
+
+func (u *upstream) close() {
+	u.fail(errClosed)
+	u.conn.Close()
+}
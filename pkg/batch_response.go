@@ -24,7 +24,8 @@ func (b *BatchResponse) ResponseWriter() http.ResponseWriter {
 
 func (b *BatchResponse) Flush() error {
 	b.res.Write([]byte("["))
-	for i, w := range b.writers {
+	var written int
+	for _, w := range b.writers {
 		var buf bytes.Buffer
 		n, err := w.buf.WriteTo(&buf)
 		if err != nil {
@@ -33,10 +34,11 @@ func (b *BatchResponse) Flush() error {
 		if n == 0 {
 			continue
 		}
-		if i != 0 {
+		if written != 0 {
 			b.res.Write([]byte(","))
 		}
 		buf.WriteTo(b.res)
+		written++
 
 	}
 	b.res.Write([]byte("]"))
@@ -73,6 +75,10 @@ func (w *Interceptor) Body() []byte {
 	return w.buf.Bytes()
 }
 
+func (w *Interceptor) StatusCode() int {
+	return w.statusCode
+}
+
 func (w *Interceptor) IsOK() bool {
 	return w.statusCode == 200 || (w.statusCode == 0 && w.buf.Len() > 0)
 }
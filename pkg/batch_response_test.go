@@ -24,6 +24,7 @@ func TestBatchResponse(t *testing.T) {
 	icept := NewInterceptor()
 	batch := NewBatchResponse(icept)
 	bodies := [][]byte{
+		{},
 		[]byte("[\"foo\"]"),
 		[]byte("[\"bar\"]"),
 		{},
@@ -0,0 +1,194 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/kyokan/chaind/pkg"
+	chainderrors "github.com/kyokan/chaind/pkg/errors"
+	"github.com/kyokan/chaind/pkg/jsonrpc"
+	"github.com/satori/go.uuid"
+)
+
+const DefaultTimeout = 10 * time.Second
+const DefaultMaxRetries = 3
+const DefaultRetryBackoff = 250 * time.Millisecond
+
+// Config configures a Client. URL should point at a chaind RPC path,
+// e.g. http://localhost:8080/eth.
+type Config struct {
+	URL          string
+	APIKey       string
+	Tag          string
+	Timeout      time.Duration
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+// Result wraps a JSON-RPC response together with the chaind-specific
+// metadata returned in the response headers.
+type Result struct {
+	*jsonrpc.Response
+	RequestID   string
+	CacheStatus string
+}
+
+func (r *Result) IsCacheHit() bool {
+	return r.CacheStatus == pkg.CacheHit
+}
+
+// RetryableError is returned once retries are exhausted, with the status of
+// the last response, or its JSON-RPC error if chaind answered with one that
+// pkg/errors deems retryable.
+type RetryableError struct {
+	StatusCode int
+	RPCError   *jsonrpc.ErrorData
+}
+
+func (e *RetryableError) Error() string {
+	if e.RPCError != nil {
+		return fmt.Sprintf("chaind returned retryable error %d: %s", e.RPCError.Code, e.RPCError.Message)
+	}
+	return fmt.Sprintf("chaind returned retryable status %d", e.StatusCode)
+}
+
+type Client struct {
+	cfg    Config
+	client *http.Client
+}
+
+func New(cfg Config) *Client {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = DefaultMaxRetries
+	}
+	if cfg.RetryBackoff == 0 {
+		cfg.RetryBackoff = DefaultRetryBackoff
+	}
+
+	return &Client{
+		cfg: cfg,
+		client: &http.Client{
+			Timeout: cfg.Timeout,
+		},
+	}
+}
+
+func (c *Client) Execute(method string, params interface{}) (*Result, error) {
+	if params == nil {
+		params = []interface{}{}
+	}
+
+	serParams, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(&jsonrpc.Request{
+		Jsonrpc: jsonrpc.Version,
+		Id:      time.Now().UnixNano(),
+		Method:  method,
+		Params:  serParams,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	requestID := uuid.NewV4().String()
+	var lastErr error
+	for attempt := 0; attempt <= c.cfg.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * c.cfg.RetryBackoff)
+		}
+
+		res, err := c.do(body, requestID)
+		if err == nil {
+			return res, nil
+		}
+		if _, ok := err.(*RetryableError); !ok && !isTransportError(err) {
+			return nil, err
+		}
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+func (c *Client) do(body []byte, requestID string) (*Result, error) {
+	req, err := http.NewRequest(http.MethodPost, c.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set(pkg.RequestIDHeader, requestID)
+	if c.cfg.APIKey != "" {
+		req.Header.Set(pkg.APIKeyHeader, c.cfg.APIKey)
+	}
+	if c.cfg.Tag != "" {
+		req.Header.Set(pkg.TagHeader, c.cfg.Tag)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, &transportError{err: err}
+	}
+	defer res.Body.Close()
+
+	if isRetryableStatus(res.StatusCode) {
+		return nil, &RetryableError{StatusCode: res.StatusCode}
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("chaind returned status %d", res.StatusCode)
+	}
+
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, &transportError{err: err}
+	}
+	var rpcRes jsonrpc.Response
+	if err := json.Unmarshal(resBody, &rpcRes); err != nil {
+		return nil, errors.New("chaind returned invalid JSON")
+	}
+	// e.g. a backend that went down or answered garbage, which another
+	// attempt may route around
+	if rpcRes.Error != nil && chainderrors.IsRetryable(rpcRes.Error.Code) {
+		return nil, &RetryableError{
+			StatusCode: res.StatusCode,
+			RPCError:   rpcRes.Error,
+		}
+	}
+
+	return &Result{
+		Response:    &rpcRes,
+		RequestID:   res.Header.Get(pkg.RequestIDHeader),
+		CacheStatus: res.Header.Get(pkg.CacheStatusHeader),
+	}, nil
+}
+
+type transportError struct {
+	err error
+}
+
+func (t *transportError) Error() string {
+	return t.err.Error()
+}
+
+func isTransportError(err error) bool {
+	_, ok := err.(*transportError)
+	return ok
+}
+
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/pkg"
+	"github.com/kyokan/chaind/pkg/jsonrpc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientExecute(t *testing.T) {
+	var calls int32
+	var apiKey, requestID string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		apiKey = r.Header.Get(pkg.APIKeyHeader)
+		requestID = r.Header.Get(pkg.RequestIDHeader)
+		w.Header().Set(pkg.RequestIDHeader, requestID)
+		w.Header().Set(pkg.CacheStatusHeader, pkg.CacheHit)
+		w.Write([]byte("{\"jsonrpc\":\"2.0\",\"result\":\"0x123\",\"id\":1}"))
+	}))
+	defer srv.Close()
+
+	c := New(Config{
+		URL:          srv.URL,
+		APIKey:       "test-key",
+		RetryBackoff: time.Millisecond,
+	})
+	res, err := c.Execute("eth_blockNumber", nil)
+	require.NoError(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	require.Equal(t, "test-key", apiKey)
+	require.NotEmpty(t, requestID)
+	require.Equal(t, requestID, res.RequestID)
+	require.True(t, res.IsCacheHit())
+	require.Equal(t, "\"0x123\"", string(res.Result))
+}
+
+func TestClientExecuteGivesUp(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	c := New(Config{
+		URL:          srv.URL,
+		MaxRetries:   2,
+		RetryBackoff: time.Millisecond,
+	})
+	_, err := c.Execute("eth_blockNumber", nil)
+	require.Error(t, err)
+	require.IsType(t, &RetryableError{}, err)
+	require.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestClientExecuteDoesNotRetryBadRequest(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	c := New(Config{
+		URL:          srv.URL,
+		RetryBackoff: time.Millisecond,
+	})
+	_, err := c.Execute("eth_blockNumber", nil)
+	require.Error(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestClientExecuteRetriesRetryableErrors(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32041,"message":"backend unavailable"}}`))
+		case 2:
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32044,"message":"bad response"}}`))
+		case 3:
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":3,"message":"execution reverted"}}`))
+		}
+	}))
+	defer srv.Close()
+
+	c := New(Config{
+		URL:          srv.URL,
+		RetryBackoff: time.Millisecond,
+	})
+	// errors of the call itself are returned as is
+	res, err := c.Execute("eth_call", nil)
+	require.NoError(t, err)
+	require.Equal(t, "execution reverted", res.Error.Message)
+	require.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	c.cfg.MaxRetries = 1
+	atomic.StoreInt32(&calls, 0)
+	_, err = c.Execute("eth_call", nil)
+	require.Equal(t, &RetryableError{
+		StatusCode: http.StatusOK,
+		RPCError:   &jsonrpc.ErrorData{Code: -32044, Message: "bad response"},
+	}, err)
+}
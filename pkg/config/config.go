@@ -8,12 +8,24 @@ import (
 	"github.com/mitchellh/go-homedir"
 	"errors"
 	"github.com/kyokan/chaind/pkg"
-	"net/url"
+	"time"
+	"io"
 )
 
 const DefaultHome = "~/.chaind"
 const DefaultConfigFile = "chaind.toml"
 
+const (
+	StartupPolicyDegrade  = "degrade"
+	StartupPolicyFailFast = "fail_fast"
+	StartupPolicyWait     = "wait"
+)
+
+const (
+	BackoffConstant    = "constant"
+	BackoffExponential = "exponential"
+)
+
 const (
 	FlagHome     = "home"
 	FlagCertPath = "cert_path"
@@ -29,19 +41,444 @@ type Config struct {
 	ETHUrl           string            `mapstructure:"eth_url"`
 	RPCPort          int               `mapstructure:"rpc_port"`
 	LogLevel         string            `mapstructure:"log_level"`
+	LogFormat        string            `mapstructure:"log_format"`
+	StartupPolicy    string            `mapstructure:"startup_policy"`
+	RequestTimeout   time.Duration     `mapstructure:"request_timeout"`
+	// TrustedProxies are the addresses of the reverse proxies whose
+	// X-Real-IP header identifies the client.
+	TrustedProxies   []string          `mapstructure:"trusted_proxies"`
+	// DebugKeys are the client keys allowed to request debug traces.
+	DebugKeys        []string          `mapstructure:"debug_keys"`
 	LogAuditorConfig *LogAuditorConfig `mapstructure:"log_auditor"`
 	RedisConfig      *RedisConfig      `mapstructure:"redis"`
+	ArchiveConfig    *ArchiveConfig    `mapstructure:"archive"`
+	RateLimitConfig  *RateLimitConfig  `mapstructure:"rate_limit"`
+	AdminConfig      *AdminConfig      `mapstructure:"admin"`
+	Features         FeaturesConfig    `mapstructure:"features"`
+	EstimateGas      *EstimateGasConfig `mapstructure:"estimate_gas"`
+	MetricsConfig    *MetricsConfig    `mapstructure:"metrics"`
+	ReadAfterWrite   *ReadAfterWriteConfig `mapstructure:"read_after_write"`
+	QuarantineConfig *QuarantineConfig `mapstructure:"quarantine"`
+	ACLConfig        *ACLConfig        `mapstructure:"acl"`
+	CacheControl     *CacheControlConfig `mapstructure:"cache_control"`
+	ConsulConfig     *ConsulConfig     `mapstructure:"consul"`
+	BulkheadConfig   *BulkheadConfig   `mapstructure:"bulkhead"`
+	TLSConfig        *TLSConfig        `mapstructure:"tls"`
+	ChaosConfig      *ChaosConfig      `mapstructure:"chaos"`
+	CoalesceConfig   *CoalesceConfig   `mapstructure:"coalesce"`
+	TxTrackerConfig  *TxTrackerConfig  `mapstructure:"tx_tracker"`
+	HeaderVerification *HeaderVerificationConfig `mapstructure:"header_verification"`
+	CORSConfig       *CORSConfig       `mapstructure:"cors"`
+	RetryConfig      map[string]RetryPolicy `mapstructure:"retry"`
+	ScorecardConfig  *ScorecardConfig  `mapstructure:"scorecard"`
+	JWTConfig        *JWTConfig        `mapstructure:"jwt"`
+	MempoolConfig    *MempoolConfig    `mapstructure:"mempool"`
+	PrewarmConfig    *PrewarmConfig    `mapstructure:"prewarm"`
+	EgressConfig     *EgressConfig     `mapstructure:"egress"`
+	BlockIndex       *BlockIndexConfig `mapstructure:"block_index"`
+	Concurrency      *ConcurrencyConfig `mapstructure:"concurrency"`
+	ExtAuthz         *ExtAuthzConfig   `mapstructure:"ext_authz"`
+	AdaptiveWeights  *AdaptiveWeightsConfig `mapstructure:"adaptive_weights"`
+	Tenants          []TenantConfig    `mapstructure:"tenant"`
+	MemoryCache      *MemoryCacheConfig `mapstructure:"memory_cache"`
+	WebsocketConfig  *WebsocketConfig  `mapstructure:"websocket"`
 	Backends         []Backend         `mapstructure:"backend"`
+
+	// templates holds the values of the keys whose placeholders were
+	// expanded, as written in the config file
+	templates map[string]string
 }
 
+// LogAuditorConfig configures the audit log. Records older than
+// RetentionDays are pruned, unless it is 0. SigningKeyFile is the PEM-encoded
+// ECDSA key compliance exports are signed with.
 type LogAuditorConfig struct {
-	LogFile string `mapstructure:"log_file"`
+	LogFile        string `mapstructure:"log_file"`
+	RetentionDays  int    `mapstructure:"retention_days"`
+	SigningKeyFile string `mapstructure:"signing_key_file"`
 }
 
+// RedisConfig configures the connection to a single Redis server at URL, to
+// the master named MasterName as reported by SentinelAddrs, or to the Redis
+// Cluster reachable at ClusterAddrs.
 type RedisConfig struct {
-	URL      string `mapstructure:"url"`
-	Password string `mapstructure:"password"`
-	DB       int    `mapstructure:"db"`
+	URL           string   `mapstructure:"url"`
+	Password      string   `mapstructure:"password"`
+	DB            int      `mapstructure:"db"`
+	MasterName    string   `mapstructure:"master_name"`
+	SentinelAddrs []string `mapstructure:"sentinel_addrs"`
+	ClusterAddrs  []string `mapstructure:"cluster_addrs"`
+}
+
+type ArchiveConfig struct {
+	Dir string `mapstructure:"dir"`
+}
+
+type AdminConfig struct {
+	Addr string     `mapstructure:"addr"`
+	TLS  *TLSConfig `mapstructure:"tls"`
+}
+
+// TLSConfig configures TLS on a listener. When ClientCAFile is set, client
+// certificates signed by one of its CAs are verified, and mapped to client
+// identities via Identities.
+type TLSConfig struct {
+	CertFile          string        `mapstructure:"cert_file"`
+	KeyFile           string        `mapstructure:"key_file"`
+	ClientCAFile      string        `mapstructure:"client_ca_file"`
+	RequireClientCert bool          `mapstructure:"require_client_cert"`
+	Identities        []TLSIdentity `mapstructure:"identity"`
+}
+
+// TLSIdentity maps a client certificate subject, e.g. "CN=indexer,O=Acme",
+// to the client key used for rate limiting, stats and cache control.
+type TLSIdentity struct {
+	Subject string `mapstructure:"subject"`
+	Key     string `mapstructure:"key"`
+}
+
+// JWTConfig authenticates clients with bearer JWTs issued by an OIDC
+// provider, verified against the provider's JWKS.
+type JWTConfig struct {
+	Issuer   string `mapstructure:"issuer"`
+	Audience string `mapstructure:"audience"`
+	JWKSURL  string `mapstructure:"jwks_url"`
+	// RefreshInterval is how often the JWKS is refetched.
+	RefreshInterval time.Duration `mapstructure:"refresh_interval"`
+	// Required rejects requests without a token, instead of identifying
+	// them by API key or IP address.
+	Required bool      `mapstructure:"required"`
+	// DefaultMethods lists the methods requests without a token may call.
+	// Empty allows every method.
+	DefaultMethods []string  `mapstructure:"default_methods"`
+	Rules          []JWTRule `mapstructure:"rule"`
+}
+
+// ExtAuthzConfig authorizes requests with the external policy service at
+// URL, which is POSTed the metadata of each request.
+type ExtAuthzConfig struct {
+	URL     string        `mapstructure:"url"`
+	Timeout time.Duration `mapstructure:"timeout"`
+	// IncludeParams sends the params of each call along with its method.
+	IncludeParams bool `mapstructure:"include_params"`
+	// FailOpen allows requests while the policy service is unavailable,
+	// instead of denying them.
+	FailOpen bool `mapstructure:"fail_open"`
+	// CacheTTL is how long decisions are reused for the same client and
+	// calls.
+	CacheTTL time.Duration `mapstructure:"cache_ttl"`
+}
+
+// JWTRule applies to tokens whose Claim equals or, for list claims such as
+// groups, contains Value. Tokens use the tier and methods of the first rule
+// they match.
+type JWTRule struct {
+	Claim string `mapstructure:"claim"`
+	Value string `mapstructure:"value"`
+	// Tier names the [[rate_limit.key]] whose policy applies to the
+	// matching tokens. Each token keeps a rate limit bucket of its own.
+	Tier string `mapstructure:"tier"`
+	// Methods lists the methods the tokens may call, e.g. eth_call or
+	// eth_*. Empty allows every method.
+	Methods []string `mapstructure:"methods"`
+}
+
+// FeaturesConfig toggles optional subsystems. Disabled subsystems are never
+// constructed, so they don't open connections, files or ports.
+type FeaturesConfig struct {
+	Cache   bool `mapstructure:"cache"`
+	Auditor bool `mapstructure:"auditor"`
+	Admin   bool `mapstructure:"admin"`
+	Metrics bool `mapstructure:"metrics"`
+}
+
+// Enabled returns the names of the enabled features, in config order.
+func (f FeaturesConfig) Enabled() []string {
+	var out []string
+	for _, feature := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"cache", f.Cache},
+		{"auditor", f.Auditor},
+		{"admin", f.Admin},
+		{"metrics", f.Metrics},
+	} {
+		if feature.enabled {
+			out = append(out, feature.name)
+		}
+	}
+	return out
+}
+
+type MetricsConfig struct {
+	File      string        `mapstructure:"file"`
+	RemoteURL string        `mapstructure:"remote_url"`
+	Interval  time.Duration `mapstructure:"interval"`
+	StatsD    *StatsDConfig `mapstructure:"statsd"`
+}
+
+// StatsDConfig sends metrics snapshots to the StatsD server at Addr over
+// UDP. Tags are only sent to DogStatsD.
+type StatsDConfig struct {
+	Addr      string   `mapstructure:"addr"`
+	Prefix    string   `mapstructure:"prefix"`
+	Tags      []string `mapstructure:"tags"`
+	DogStatsD bool     `mapstructure:"dogstatsd"`
+}
+
+// ScorecardConfig configures the periodic per-backend scorecard report.
+type ScorecardConfig struct {
+	File       string        `mapstructure:"file"`
+	WebhookURL string        `mapstructure:"webhook_url"`
+	Interval   time.Duration `mapstructure:"interval"`
+}
+
+// ChaosConfig enables fault injection, for rehearsing failover in staging.
+type ChaosConfig struct {
+	Faults []ChaosFault `mapstructure:"fault"`
+}
+
+// ChaosFault describes the faults injected for a backend, or for all
+// backends if Backend is empty.
+type ChaosFault struct {
+	Backend string `mapstructure:"backend"`
+	// Latency is the maximum random latency added to requests.
+	Latency time.Duration `mapstructure:"latency"`
+	// DropRate is the fraction of responses dropped.
+	DropRate  float64 `mapstructure:"drop_rate"`
+	Unhealthy bool    `mapstructure:"unhealthy"`
+}
+
+// BulkheadConfig limits the concurrent upstream requests per method class.
+// Classes without a limit are unrestricted.
+type BulkheadConfig struct {
+	Reads   int           `mapstructure:"reads"`
+	Logs    int           `mapstructure:"logs"`
+	Traces  int           `mapstructure:"traces"`
+	Sends   int           `mapstructure:"sends"`
+	MaxWait time.Duration `mapstructure:"max_wait"`
+}
+
+// ConcurrencyConfig caps the requests the RPC listener handles at once, in
+// total and per client key. Keys listed in Keys get their own cap instead
+// of MaxPerKey. Zero caps are unlimited.
+type ConcurrencyConfig struct {
+	MaxRequests int              `mapstructure:"max_requests"`
+	MaxPerKey   int              `mapstructure:"max_per_key"`
+	Keys        []ConcurrencyKey `mapstructure:"key"`
+}
+
+type ConcurrencyKey struct {
+	Key         string `mapstructure:"key"`
+	MaxRequests int    `mapstructure:"max_requests"`
+}
+
+// TenantConfig groups client keys into a tenant of a multi-tenant
+// deployment. The tenant's cache entries are namespaced under Prefix, which
+// defaults to tenant:<name>:, and add up to about CacheQuota bytes. Zero
+// quotas are unlimited.
+type TenantConfig struct {
+	Name       string   `mapstructure:"name"`
+	Keys       []string `mapstructure:"keys"`
+	Prefix     string   `mapstructure:"prefix"`
+	CacheQuota int64    `mapstructure:"cache_quota"`
+}
+
+// TenantPrefix returns the prefix of the tenant's cache keys.
+func (t *TenantConfig) TenantPrefix() string {
+	if t.Prefix != "" {
+		return t.Prefix
+	}
+	return "tenant:" + t.Name + ":"
+}
+
+// MemoryCacheConfig keeps the most recently used cache entries in memory, in
+// front of Redis, within a budget of MaxBytes. Entries larger than
+// MaxEntryBytes are only cached in Redis. Expired entries are compacted
+// away every CompactionInterval.
+type MemoryCacheConfig struct {
+	MaxBytes           int64         `mapstructure:"max_bytes"`
+	MaxEntryBytes      int64         `mapstructure:"max_entry_bytes"`
+	CompactionInterval time.Duration `mapstructure:"compaction_interval"`
+}
+
+// WebsocketConfig accepts WebSocket connections on the RPC endpoint.
+// Subscriptions are shared among clients over a single connection to the
+// current backend's ws_url. SendBuffer is the number of messages queued for
+// each client, clients that fall further behind are disconnected. The
+// connections of the listener and of each client key, and the subscriptions
+// of each key, are capped by limits that are unrestricted when zero. Quiet
+// connections are pinged every PingInterval, and closed once they have been
+// quiet for IdleTimeout.
+type WebsocketConfig struct {
+	SendBuffer             int           `mapstructure:"send_buffer"`
+	MaxConnections         int           `mapstructure:"max_connections"`
+	MaxConnectionsPerKey   int           `mapstructure:"max_connections_per_key"`
+	MaxSubscriptionsPerKey int           `mapstructure:"max_subscriptions_per_key"`
+	IdleTimeout            time.Duration `mapstructure:"idle_timeout"`
+	PingInterval           time.Duration `mapstructure:"ping_interval"`
+}
+
+// AdaptiveWeightsConfig spreads requests over the healthy backends of the
+// current tier by weight, and tunes the weights AIMD-style every Interval:
+// backends whose error rate or mean latency exceeded MaxErrorRate or
+// LatencyTarget have their weight multiplied by Decrease, the others have it
+// raised by Increase. Weights stay within Floor and Ceiling.
+type AdaptiveWeightsConfig struct {
+	Interval      time.Duration `mapstructure:"interval"`
+	Floor         float64       `mapstructure:"floor"`
+	Ceiling       float64       `mapstructure:"ceiling"`
+	Increase      float64       `mapstructure:"increase"`
+	Decrease      float64       `mapstructure:"decrease"`
+	LatencyTarget time.Duration `mapstructure:"latency_target"`
+	MaxErrorRate  float64       `mapstructure:"max_error_rate"`
+}
+
+// RetryPolicy configures how failed upstream requests of a method class are
+// retried. Requests are retried on transport errors, non-200 responses and
+// the JSON-RPC error codes in RetryCodes.
+type RetryPolicy struct {
+	MaxAttempts    int           `mapstructure:"max_attempts"`
+	Backoff        string        `mapstructure:"backoff"`
+	InitialBackoff time.Duration `mapstructure:"initial_backoff"`
+	MaxBackoff     time.Duration `mapstructure:"max_backoff"`
+	RetryCodes     []int         `mapstructure:"retry_codes"`
+	// Idempotent requests are retried even if the failed attempt may have
+	// reached the backend. Others are only retried if the backend couldn't
+	// be connected to, or answered with one of RetryCodes. Defaults to true
+	// for every class but sends.
+	Idempotent *bool `mapstructure:"idempotent"`
+}
+
+// ConsulConfig configures backend discovery from a Consul service, and
+// registration of chaind itself when RegisterName is set.
+type ConsulConfig struct {
+	Addr            string        `mapstructure:"addr"`
+	Token           string        `mapstructure:"token"`
+	Service         string        `mapstructure:"service"`
+	Scheme          string        `mapstructure:"scheme"`
+	Path            string        `mapstructure:"path"`
+	HonorHealth     bool          `mapstructure:"honor_health"`
+	Interval        time.Duration `mapstructure:"interval"`
+	RegisterName    string        `mapstructure:"register_name"`
+	RegisterAddress string        `mapstructure:"register_address"`
+}
+
+type CacheControlConfig struct {
+	// PrivilegedKeys may bypass the cache with Cache-Control: no-cache.
+	PrivilegedKeys []string `mapstructure:"privileged_keys"`
+}
+
+type ACLConfig struct {
+	RPC   *ACLRules `mapstructure:"rpc"`
+	Admin *ACLRules `mapstructure:"admin"`
+}
+
+type ACLRules struct {
+	Allow []string `mapstructure:"allow"`
+	Deny  []string `mapstructure:"deny"`
+}
+
+type QuarantineConfig struct {
+	File     string        `mapstructure:"file"`
+	Duration time.Duration `mapstructure:"duration"`
+	Failures int           `mapstructure:"failures"`
+}
+
+// CORSConfig allows browsers on the given origins to call the RPC endpoint.
+// The origin "*" allows any origin.
+type CORSConfig struct {
+	AllowedOrigins []string `mapstructure:"allowed_origins"`
+}
+
+type ReadAfterWriteConfig struct {
+	Window time.Duration `mapstructure:"window"`
+}
+
+// HeaderVerificationConfig anchors the verified header chain at a trusted
+// checkpoint.
+type HeaderVerificationConfig struct {
+	CheckpointNumber uint64 `mapstructure:"checkpoint_number"`
+	CheckpointHash   string `mapstructure:"checkpoint_hash"`
+	// Source names the backend headers are fetched from. Defaults to the
+	// current backend.
+	Source string `mapstructure:"source"`
+	Reject bool   `mapstructure:"reject"`
+}
+
+type TxTrackerConfig struct {
+	WebhookURL   string        `mapstructure:"webhook_url"`
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+	DropAfter    time.Duration `mapstructure:"drop_after"`
+	Retention    time.Duration `mapstructure:"retention"`
+}
+
+// MempoolConfig designates the backends serving mempool queries. Primary
+// serves them while it is healthy, and Secondary takes over otherwise.
+type MempoolConfig struct {
+	Primary   string `mapstructure:"primary"`
+	Secondary string `mapstructure:"secondary"`
+}
+
+// PrewarmConfig configures the connections opened to a backend before
+// traffic fails over to it. Prewarming gives up after Timeout, so that it
+// can't hold up a failover for long.
+type PrewarmConfig struct {
+	Connections int           `mapstructure:"connections"`
+	Timeout     time.Duration `mapstructure:"timeout"`
+}
+
+// BlockIndexConfig configures the in-memory index of the Depth most recent
+// blocks.
+type BlockIndexConfig struct {
+	Depth int `mapstructure:"depth"`
+}
+
+type CoalesceConfig struct {
+	MaxWait time.Duration `mapstructure:"max_wait"`
+}
+
+type EstimateGasConfig struct {
+	Fallback   bool    `mapstructure:"fallback"`
+	Multiplier float64 `mapstructure:"multiplier"`
+}
+
+type RateLimitConfig struct {
+	RateLimitPolicy `mapstructure:",squash"`
+	Keys            []RateLimitKey `mapstructure:"key"`
+	// MethodCosts is the number of tokens charged per call of a method.
+	// Keys such as ots_* set the cost of a whole namespace. When set,
+	// requests are charged per call rather than per HTTP request.
+	MethodCosts map[string]int `mapstructure:"method_costs"`
+}
+
+// EgressConfig caps the response bytes served to each client per UTC day.
+// DailyBytes is the default limit, 0 meaning unlimited, and Keys override
+// it per client key. Clients are warned once they used WarnRatio of their
+// limit, and alerts are POSTed to WebhookURL.
+type EgressConfig struct {
+	DailyBytes int64       `mapstructure:"daily_bytes"`
+	WarnRatio  float64     `mapstructure:"warn_ratio"`
+	WebhookURL string      `mapstructure:"webhook_url"`
+	Keys       []EgressKey `mapstructure:"key"`
+}
+
+type EgressKey struct {
+	Key        string `mapstructure:"key"`
+	DailyBytes int64  `mapstructure:"daily_bytes"`
+}
+
+type RateLimitPolicy struct {
+	Rate      float64       `mapstructure:"rate"`
+	Burst     int           `mapstructure:"burst"`
+	SoftLimit bool          `mapstructure:"soft_limit"`
+	MaxDelay  time.Duration `mapstructure:"max_delay"`
+}
+
+type RateLimitKey struct {
+	RateLimitPolicy `mapstructure:",squash"`
+	Key             string `mapstructure:"key"`
 }
 
 type Backend struct {
@@ -49,20 +486,112 @@ type Backend struct {
 	URL  string          `mapstructure:"url"`
 	Name string          `mapstructure:"name"`
 	Main bool            `mapstructure:"main"`
+	// Tier is the backend's cost tier. Lower tiers are cheaper, e.g.
+	// self-hosted nodes, and are preferred whenever they are healthy.
+	Tier int `mapstructure:"tier"`
+	// CAFile, CertFile and KeyFile configure TLS towards the backend: the
+	// CAs to trust instead of the system's, and a client certificate.
+	CAFile   string `mapstructure:"ca_file"`
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	// Namespaces lists the non-standard JSON-RPC namespaces the backend
+	// serves, e.g. ots for Otterscan. Their methods are only routed to
+	// backends that list them.
+	Namespaces []string `mapstructure:"namespaces"`
+	// Chain and Network identify the network the backend serves, e.g.
+	// ethereum and mainnet. Cache keys are prefixed with them, so that
+	// deployments serving different networks can share a Redis instance.
+	Chain   string `mapstructure:"chain"`
+	Network string `mapstructure:"network"`
+	// Shims translate requests the backend's node implementation doesn't
+	// accept as is.
+	Shims []Shim `mapstructure:"shim"`
+	// WSURL is the backend's WebSocket endpoint. When set, the backend is
+	// only healthy while a newHeads subscription on it receives a head at
+	// least every WSHeadTimeout.
+	WSURL         string        `mapstructure:"ws_url"`
+	WSHeadTimeout time.Duration `mapstructure:"ws_head_timeout"`
+}
+
+// ShimAllMethods is the method of shims that apply to every method without
+// a shim of its own.
+const ShimAllMethods = "*"
+
+// Shim translates the requests for Method before they are sent to a
+// backend: trailing null params are trimmed with TrimNulls, the JSON values
+// in AppendParams are appended to the params, and the method is renamed to
+// Rename.
+type Shim struct {
+	Method       string   `mapstructure:"method"`
+	Rename       string   `mapstructure:"rename"`
+	TrimNulls    bool     `mapstructure:"trim_nulls"`
+	AppendParams []string `mapstructure:"append_params"`
+}
+
+// OptionalNamespaces are the JSON-RPC namespaces that only some backends
+// serve.
+var OptionalNamespaces = []string{"ots", "erigon"}
+
+// CacheKeyPrefix returns the prefix of the cache keys of a backend group,
+// e.g. ethereum:mainnet:, or an empty string if its backends don't declare
+// a chain.
+func CacheKeyPrefix(backends []Backend) string {
+	for _, backend := range backends {
+		if backend.Chain == "" {
+			continue
+		}
+		if backend.Network == "" {
+			return backend.Chain + ":"
+		}
+		return backend.Chain + ":" + backend.Network + ":"
+	}
+	return ""
 }
 
 func init() {
+	setDefaults(viper.GetViper())
+}
+
+func setDefaults(v *viper.Viper) {
 	home := mustExpand(DefaultHome)
-	viper.SetDefault(FlagHome, home)
-	viper.SetDefault(FlagCertPath, "")
-	viper.SetDefault(FlagUseTLS, false)
-	viper.SetDefault(FlagETHURL, "eth")
-	viper.SetDefault(FlagRPCPort, 8080)
+	v.SetDefault(FlagHome, home)
+	v.SetDefault(FlagCertPath, "")
+	v.SetDefault(FlagUseTLS, false)
+	v.SetDefault(FlagETHURL, "eth")
+	v.SetDefault(FlagRPCPort, 8080)
+	v.SetDefault("features.cache", true)
+	v.SetDefault("features.auditor", true)
+	v.SetDefault("features.admin", true)
+	v.SetDefault("features.metrics", true)
+}
+
+func ConfigFilePath() string {
+	return path.Join(viper.GetString(FlagHome), DefaultConfigFile)
+}
+
+// ParseConfig reads a TOML config from r without touching the global config
+// state, e.g. to validate a candidate config before applying it.
+func ParseConfig(r io.Reader) (Config, error) {
+	var cfg Config
+	v := viper.New()
+	setDefaults(v)
+	v.SetConfigType("toml")
+	if err := v.ReadConfig(r); err != nil {
+		return cfg, err
+	}
+	if err := v.Unmarshal(&cfg); err != nil {
+		return cfg, err
+	}
+	if err := expandSecrets(&cfg); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
 }
 
 func ReadConfig(allowDefaults bool) (Config, error) {
 	var cfg Config
-	cfgFile := path.Join(viper.GetString(FlagHome), DefaultConfigFile)
+	cfgFile := ConfigFilePath()
 	if _, err := os.Stat(cfgFile); os.IsNotExist(err) {
 		if allowDefaults {
 			viper.Unmarshal(&cfg)
@@ -79,46 +608,15 @@ func ReadConfig(allowDefaults bool) (Config, error) {
 	if err := viper.Unmarshal(&cfg); err != nil {
 		return cfg, err
 	}
+	if err := expandSecrets(&cfg); err != nil {
+		return cfg, err
+	}
 	viper.Set(FlagHome, mustExpand(viper.GetString(FlagHome)))
 	viper.Set(FlagCertPath, mustExpand(viper.GetString(FlagCertPath)))
 
 	return cfg, nil
 }
 
-func ValidateConfig(cfg *Config) error {
-	if len(cfg.Backends) == 0 {
-		return validationError("must define at least one backend")
-	}
-
-	var hasMainBackend bool
-	for _, backend := range cfg.Backends {
-		if backend.Main && hasMainBackend {
-			return validationError("cannot have more than one main backend")
-		} else if backend.Main {
-			hasMainBackend = true
-		}
-
-		if backend.Type != pkg.EthBackend {
-			return validationError("only Ethereum backends are supported right now")
-		}
-
-		_, err := url.Parse(backend.URL)
-		if err != nil {
-			return validationError(fmt.Sprintf("invalid url: %s", backend.URL))
-		}
-
-		if backend.Name == "" {
-			return validationError("backend name must be defined")
-		}
-	}
-
-	return nil
-}
-
-func validationError(msg string) error {
-	return errors.New(fmt.Sprintf("invalid config: %s", msg))
-}
-
 func mustExpand(path string) string {
 	expanded, err := homedir.Expand(path)
 	if err != nil {
@@ -0,0 +1,141 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const maskedValue = "********"
+
+type Change struct {
+	Key string `json:"key"`
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+}
+
+// Diff returns the settings that differ between two configs, keyed by their
+// dotted config file path (e.g. "backend.0.url"). Secrets are masked, and
+// values expanded from placeholders are shown as written in the config file.
+func Diff(old *Config, new *Config) []Change {
+	oldVals := make(map[string]string)
+	newVals := make(map[string]string)
+	flatten(reflect.ValueOf(old), "", oldVals)
+	flatten(reflect.ValueOf(new), "", newVals)
+
+	var changes []Change
+	for k, v := range oldVals {
+		if nv, ok := newVals[k]; !ok || nv != v {
+			changes = append(changes, Change{
+				Key: k,
+				Old: display(old, k, v),
+				New: display(new, k, nv),
+			})
+		}
+	}
+	for k, v := range newVals {
+		if _, ok := oldVals[k]; !ok {
+			changes = append(changes, Change{
+				Key: k,
+				New: display(new, k, v),
+			})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Key < changes[j].Key
+	})
+	return changes
+}
+
+// Flatten returns every set value in the config keyed by its dotted config
+// file path. Secrets are masked, and values expanded from placeholders are
+// shown as written in the config file.
+func Flatten(cfg *Config) map[string]string {
+	out := make(map[string]string)
+	flatten(reflect.ValueOf(cfg), "", out)
+	for k, v := range out {
+		out[k] = display(cfg, k, v)
+	}
+	return out
+}
+
+// display returns how the value of a key is shown: its template if it was
+// expanded from placeholders, since it may embed e.g. a decrypted API key,
+// or else the value with secrets masked.
+func display(cfg *Config, key string, val string) string {
+	if tmpl, ok := cfg.templates[key]; ok && val != "" {
+		return maskSecret(key, tmpl)
+	}
+
+	return maskSecret(key, val)
+}
+
+func flatten(val reflect.Value, prefix string, out map[string]string) {
+	switch val.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if val.IsNil() {
+			return
+		}
+		flatten(val.Elem(), prefix, out)
+	case reflect.Struct:
+		typ := val.Type()
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+
+			tag := field.Tag.Get("mapstructure")
+			if strings.Contains(tag, "squash") {
+				flatten(val.Field(i), prefix, out)
+				continue
+			}
+			name := strings.Split(tag, ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			flatten(val.Field(i), joinKey(prefix, name), out)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < val.Len(); i++ {
+			flatten(val.Index(i), joinKey(prefix, fmt.Sprint(i)), out)
+		}
+	case reflect.Map:
+		for _, k := range val.MapKeys() {
+			flatten(val.MapIndex(k), joinKey(prefix, fmt.Sprint(k.Interface())), out)
+		}
+	default:
+		if isZero(val) {
+			return
+		}
+		out[prefix] = fmt.Sprint(val.Interface())
+	}
+}
+
+func joinKey(prefix string, name string) string {
+	if prefix == "" {
+		return name
+	}
+
+	return prefix + "." + name
+}
+
+func isZero(val reflect.Value) bool {
+	return reflect.DeepEqual(val.Interface(), reflect.Zero(val.Type()).Interface())
+}
+
+func maskSecret(key string, val string) string {
+	if val == "" {
+		return val
+	}
+
+	parts := strings.Split(key, ".")
+	last := parts[len(parts)-1]
+	if strings.Contains(last, "password") || strings.Contains(last, "secret") {
+		return maskedValue
+	}
+
+	return val
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/kyokan/chaind/pkg"
+)
+
+func testConfig() *Config {
+	return &Config{
+		RPCPort:  8080,
+		LogLevel: "info",
+		RedisConfig: &RedisConfig{
+			URL:      "localhost:6379",
+			Password: "hunter2",
+		},
+		RateLimitConfig: &RateLimitConfig{
+			RateLimitPolicy: RateLimitPolicy{
+				Rate:  10,
+				Burst: 20,
+			},
+		},
+		Backends: []Backend{
+			{
+				Type: pkg.EthBackend,
+				URL:  "http://localhost:8545",
+				Name: "local",
+				Main: true,
+			},
+		},
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	flat := Flatten(testConfig())
+	require.Equal(t, "8080", flat["rpc_port"])
+	require.Equal(t, "localhost:6379", flat["redis.url"])
+	require.Equal(t, maskedValue, flat["redis.password"])
+	require.Equal(t, "10", flat["rate_limit.rate"])
+	require.Equal(t, "http://localhost:8545", flat["backend.0.url"])
+	require.Equal(t, "true", flat["backend.0.main"])
+	_, ok := flat["log_auditor.log_file"]
+	require.False(t, ok)
+}
+
+func TestDiff(t *testing.T) {
+	old := testConfig()
+	new := testConfig()
+	require.Empty(t, Diff(old, new))
+
+	new.LogLevel = "debug"
+	new.RateLimitConfig.MaxDelay = time.Second
+	new.RedisConfig.Password = "hunter3"
+	new.Backends = append(new.Backends, Backend{
+		Type: pkg.EthBackend,
+		URL:  "https://mainnet.infura.io",
+		Name: "infura",
+	})
+
+	changes := Diff(old, new)
+	require.Equal(t, []Change{
+		{Key: "backend.1.name", New: "infura"},
+		{Key: "backend.1.type", New: "ETH"},
+		{Key: "backend.1.url", New: "https://mainnet.infura.io"},
+		{Key: "log_level", Old: "info", New: "debug"},
+		{Key: "rate_limit.max_delay", New: "1s"},
+		{Key: "redis.password", Old: maskedValue, New: maskedValue},
+	}, changes)
+}
+
+func TestFlattenShowsTemplates(t *testing.T) {
+	os.Setenv("CHAIND_TEST_API_KEY", "s3cr3t")
+	defer os.Unsetenv("CHAIND_TEST_API_KEY")
+
+	cfg := testConfig()
+	cfg.Backends[0].URL = "https://mainnet.infura.io/v3/${CHAIND_TEST_API_KEY}"
+	require.NoError(t, expandSecrets(cfg))
+	require.Equal(t, "https://mainnet.infura.io/v3/s3cr3t", cfg.Backends[0].URL)
+
+	flat := Flatten(cfg)
+	require.Equal(t, "https://mainnet.infura.io/v3/${CHAIND_TEST_API_KEY}", flat["backend.0.url"])
+
+	old := testConfig()
+	changes := Diff(old, cfg)
+	require.Equal(t, []Change{
+		{Key: "backend.0.url", Old: "http://localhost:8545", New: "https://mainnet.infura.io/v3/${CHAIND_TEST_API_KEY}"},
+	}, changes)
+}
@@ -0,0 +1,100 @@
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+const DefaultAgeIdentityFile = "age.key"
+
+// EnvAgeIdentity overrides the location of the age identity used to decrypt
+// age secrets.
+const EnvAgeIdentity = "CHAIND_AGE_IDENTITY"
+
+// secretProviders resolve ${<scheme>:<arg>} placeholders. Encrypted values
+// are decrypted with the respective CLI tools so that chaind doesn't need to
+// link against every cloud SDK:
+//
+//	${age:<base64 ciphertext>}                     decrypted with the age identity
+//	${awskms:<base64 ciphertext blob>}             decrypted with AWS KMS
+//	${gcpkms:<key resource>:<base64 ciphertext>}   decrypted with GCP KMS
+var secretProviders = map[string]func(arg string) (string, error){
+	"file":   readSecretFile,
+	"age":    decryptAge,
+	"awskms": decryptAWSKMS,
+	"gcpkms": decryptGCPKMS,
+}
+
+// runCommand runs a command with the given stdin and returns its stdout.
+var runCommand = func(stdin []byte, name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %s: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return out, nil
+}
+
+func decryptAge(arg string) (string, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(arg)
+	if err != nil {
+		return "", fmt.Errorf("invalid age secret: %s", err)
+	}
+
+	identity := os.Getenv(EnvAgeIdentity)
+	if identity == "" {
+		identity = path.Join(viper.GetString(FlagHome), DefaultAgeIdentityFile)
+	}
+	out, err := runCommand(ciphertext, "age", "--decrypt", "-i", mustExpand(identity))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+func decryptAWSKMS(arg string) (string, error) {
+	if _, err := base64.StdEncoding.DecodeString(arg); err != nil {
+		return "", fmt.Errorf("invalid awskms secret: %s", err)
+	}
+
+	out, err := runCommand(nil, "aws", "kms", "decrypt", "--ciphertext-blob", arg, "--output", "text", "--query", "Plaintext")
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(out)))
+	if err != nil {
+		return "", fmt.Errorf("aws returned invalid plaintext: %s", err)
+	}
+
+	return strings.TrimSpace(string(plaintext)), nil
+}
+
+func decryptGCPKMS(arg string) (string, error) {
+	idx := strings.LastIndex(arg, ":")
+	if idx == -1 {
+		return "", fmt.Errorf("gcpkms secret must be of the form <key>:<ciphertext>")
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(arg[idx+1:])
+	if err != nil {
+		return "", fmt.Errorf("invalid gcpkms secret: %s", err)
+	}
+
+	out, err := runCommand(ciphertext, "gcloud", "kms", "decrypt", "--key", arg[:idx], "--ciphertext-file", "-", "--plaintext-file", "-")
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var placeholderRegex = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// ExpandPlaceholders replaces ${NAME} placeholders with the value of the
+// environment variable NAME, ${file:/path} placeholders with the trimmed
+// contents of the file at /path, and encrypted secret placeholders (see
+// secretProviders) with their decrypted value. Unresolvable placeholders are
+// an error rather than being left empty, so that a missing key fails loudly
+// at startup.
+func ExpandPlaceholders(in string) (string, error) {
+	var expandErr error
+	out := placeholderRegex.ReplaceAllStringFunc(in, func(match string) string {
+		name := placeholderRegex.FindStringSubmatch(match)[1]
+		val, err := resolvePlaceholder(name)
+		if err != nil && expandErr == nil {
+			expandErr = err
+		}
+		return val
+	})
+	if expandErr != nil {
+		return "", expandErr
+	}
+
+	return out, nil
+}
+
+func resolvePlaceholder(name string) (string, error) {
+	if idx := strings.Index(name, ":"); idx != -1 {
+		if provider, ok := secretProviders[name[:idx]]; ok {
+			return provider(name[idx+1:])
+		}
+	}
+
+	if name == "" {
+		return "", fmt.Errorf("empty placeholder")
+	}
+	val, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+
+	return val, nil
+}
+
+func readSecretFile(name string) (string, error) {
+	file := mustExpand(name)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file %s: %s", file, err)
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// expandSecrets resolves placeholders in the config values that may hold
+// credentials. The templates of the expanded values are remembered, so that
+// Flatten and Diff can show them instead of the secrets.
+func expandSecrets(cfg *Config) error {
+	if err := expandBackendURLs(cfg); err != nil {
+		return err
+	}
+
+	if cfg.RedisConfig != nil {
+		expanded, err := expandField(cfg, "redis.password", cfg.RedisConfig.Password)
+		if err != nil {
+			return fmt.Errorf("invalid redis password: %s", err)
+		}
+		cfg.RedisConfig.Password = expanded
+	}
+
+	return nil
+}
+
+func expandBackendURLs(cfg *Config) error {
+	for i := range cfg.Backends {
+		backend := &cfg.Backends[i]
+		expanded, err := expandField(cfg, fmt.Sprintf("backend.%d.url", i), backend.URL)
+		if err != nil {
+			return fmt.Errorf("invalid url for backend %s: %s", backend.Name, err)
+		}
+		backend.URL = expanded
+		expanded, err = expandField(cfg, fmt.Sprintf("backend.%d.ws_url", i), backend.WSURL)
+		if err != nil {
+			return fmt.Errorf("invalid ws url for backend %s: %s", backend.Name, err)
+		}
+		backend.WSURL = expanded
+	}
+
+	return nil
+}
+
+// expandField expands the placeholders in the value of the given config
+// key, and records the key's template if it had any.
+func expandField(cfg *Config, key string, val string) (string, error) {
+	expanded, err := ExpandPlaceholders(val)
+	if err != nil || expanded == val {
+		return expanded, err
+	}
+
+	if cfg.templates == nil {
+		cfg.templates = make(map[string]string)
+	}
+	cfg.templates[key] = val
+	return expanded, nil
+}
@@ -0,0 +1,85 @@
+package config
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandPlaceholders(t *testing.T) {
+	os.Setenv("CHAIND_TEST_KEY", "abc123")
+	defer os.Unsetenv("CHAIND_TEST_KEY")
+
+	f, err := ioutil.TempFile("", "chaind-secret")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("def456\n")
+	f.Close()
+
+	out, err := ExpandPlaceholders("https://mainnet.infura.io/v3/${CHAIND_TEST_KEY}")
+	require.NoError(t, err)
+	require.Equal(t, "https://mainnet.infura.io/v3/abc123", out)
+
+	out, err = ExpandPlaceholders("https://eth.example.com/${file:" + f.Name() + "}/rpc")
+	require.NoError(t, err)
+	require.Equal(t, "https://eth.example.com/def456/rpc", out)
+
+	out, err = ExpandPlaceholders("http://localhost:8545")
+	require.NoError(t, err)
+	require.Equal(t, "http://localhost:8545", out)
+
+	_, err = ExpandPlaceholders("https://mainnet.infura.io/v3/${CHAIND_TEST_MISSING}")
+	require.Error(t, err)
+	_, err = ExpandPlaceholders("https://eth.example.com/${file:/does/not/exist}")
+	require.Error(t, err)
+}
+
+func TestExpandEncryptedPlaceholders(t *testing.T) {
+	origRun := runCommand
+	defer func() {
+		runCommand = origRun
+	}()
+
+	var gotName string
+	var gotArgs []string
+	var gotStdin []byte
+	runCommand = func(stdin []byte, name string, args ...string) ([]byte, error) {
+		gotName = name
+		gotArgs = args
+		gotStdin = stdin
+		switch name {
+		case "aws":
+			return []byte(base64.StdEncoding.EncodeToString([]byte("kms-secret")) + "\n"), nil
+		default:
+			return []byte("decrypted\n"), nil
+		}
+	}
+
+	os.Setenv(EnvAgeIdentity, "/tmp/identity")
+	defer os.Unsetenv(EnvAgeIdentity)
+	out, err := ExpandPlaceholders("redis-${age:" + base64.StdEncoding.EncodeToString([]byte("ciphertext")) + "}")
+	require.NoError(t, err)
+	require.Equal(t, "redis-decrypted", out)
+	require.Equal(t, "age", gotName)
+	require.Equal(t, []string{"--decrypt", "-i", "/tmp/identity"}, gotArgs)
+	require.Equal(t, "ciphertext", string(gotStdin))
+
+	out, err = ExpandPlaceholders("${awskms:Y2lwaGVydGV4dA==}")
+	require.NoError(t, err)
+	require.Equal(t, "kms-secret", out)
+	require.Equal(t, "aws", gotName)
+
+	key := "projects/p/locations/global/keyRings/r/cryptoKeys/k"
+	out, err = ExpandPlaceholders("${gcpkms:" + key + ":Y2lwaGVydGV4dA==}")
+	require.NoError(t, err)
+	require.Equal(t, "decrypted", out)
+	require.Equal(t, "gcloud", gotName)
+	require.Contains(t, gotArgs, key)
+	require.Equal(t, "ciphertext", string(gotStdin))
+
+	_, err = ExpandPlaceholders("${age:not base64!}")
+	require.Error(t, err)
+}
@@ -0,0 +1,682 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kyokan/chaind/pkg"
+)
+
+// maxBlockIndexDepth bounds the block index, which holds full blocks in
+// memory.
+const maxBlockIndexDepth = 1024
+
+// Validation lists the problems found in a config. Errors keep chaind from
+// starting, while warnings flag settings that are likely mistakes but don't
+// prevent it from running.
+type Validation struct {
+	Errors   []string `json:"errors"`
+	Warnings []string `json:"warnings"`
+}
+
+// Validate checks the config in two phases: first every section on its own,
+// then the sections against each other and the environment, e.g. whether
+// the files chaind writes to are writable. Unlike ValidateConfig, it reports
+// every problem rather than the first.
+func Validate(cfg *Config) *Validation {
+	v := new(Validation)
+	v.checkFields(cfg)
+	v.checkCrossFields(cfg)
+	return v
+}
+
+// ValidateConfig returns an error listing every error found by Validate, or
+// nil if there are none. Warnings are ignored.
+func ValidateConfig(cfg *Config) error {
+	return Validate(cfg).Err()
+}
+
+// Err returns an error listing the validation errors, or nil if there are
+// none.
+func (v *Validation) Err() error {
+	switch len(v.Errors) {
+	case 0:
+		return nil
+	case 1:
+		return validationError(v.Errors[0])
+	}
+
+	return validationError(fmt.Sprintf("%d problems:\n  - %s", len(v.Errors), strings.Join(v.Errors, "\n  - ")))
+}
+
+func (v *Validation) errorf(format string, args ...interface{}) {
+	v.Errors = append(v.Errors, fmt.Sprintf(format, args...))
+}
+
+func (v *Validation) warnf(format string, args ...interface{}) {
+	v.Warnings = append(v.Warnings, fmt.Sprintf(format, args...))
+}
+
+func (v *Validation) checkFields(cfg *Config) {
+	discovers := cfg.ConsulConfig != nil && cfg.ConsulConfig.Service != ""
+	if len(cfg.Backends) == 0 && !discovers {
+		v.errorf("must define at least one backend")
+	}
+
+	var hasMainBackend bool
+	for _, backend := range cfg.Backends {
+		if backend.Main && hasMainBackend {
+			v.errorf("cannot have more than one main backend")
+		} else if backend.Main {
+			hasMainBackend = true
+		}
+
+		if backend.Type != pkg.EthBackend {
+			v.errorf("only Ethereum backends are supported right now")
+		}
+
+		if _, err := url.Parse(backend.URL); err != nil {
+			v.errorf("invalid url: %s", backend.URL)
+		}
+
+		if backend.Name == "" {
+			v.errorf("backend name must be defined")
+		}
+
+		if backend.Tier < 0 {
+			v.errorf("backend tier cannot be negative")
+		}
+
+		if (backend.CertFile == "") != (backend.KeyFile == "") {
+			v.errorf("backend cert file and key file must be defined together")
+		}
+
+		for _, ns := range backend.Namespaces {
+			if !isOptionalNamespace(ns) {
+				v.errorf("unknown backend namespace %s, must be one of %s", ns, strings.Join(OptionalNamespaces, ", "))
+			}
+		}
+
+		if backend.Network != "" && backend.Chain == "" {
+			v.errorf("backend network requires a chain")
+		}
+
+		if backend.WSURL != "" {
+			if u, err := url.Parse(backend.WSURL); err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+				v.errorf("invalid ws url: %s", backend.WSURL)
+			}
+		} else if backend.WSHeadTimeout != 0 {
+			v.errorf("backend %s ws_head_timeout requires a ws_url", backend.Name)
+		}
+		if backend.WSHeadTimeout < 0 {
+			v.errorf("backend %s ws_head_timeout cannot be negative", backend.Name)
+		}
+
+		shimmed := make(map[string]bool)
+		for _, shim := range backend.Shims {
+			if shim.Method == "" {
+				v.errorf("backend %s shim method must be defined", backend.Name)
+				continue
+			}
+			if shimmed[shim.Method] {
+				v.errorf("backend %s has more than one shim for %s", backend.Name, shim.Method)
+			}
+			shimmed[shim.Method] = true
+			if shim.Method == ShimAllMethods && shim.Rename != "" {
+				v.errorf("backend %s can't rename all methods", backend.Name)
+			}
+			for _, param := range shim.AppendParams {
+				if !json.Valid([]byte(param)) {
+					v.errorf("backend %s shim for %s appends invalid JSON: %s", backend.Name, shim.Method, param)
+				}
+			}
+		}
+	}
+
+	if cfg.RateLimitConfig != nil {
+		v.checkRateLimitPolicy(&cfg.RateLimitConfig.RateLimitPolicy)
+		for _, key := range cfg.RateLimitConfig.Keys {
+			if key.Key == "" {
+				v.errorf("rate limit key must be defined")
+			}
+			v.checkRateLimitPolicy(&key.RateLimitPolicy)
+		}
+		for _, cost := range cfg.RateLimitConfig.MethodCosts {
+			if cost < 0 {
+				v.errorf("rate limit method costs cannot be negative")
+				break
+			}
+		}
+	}
+
+	if cfg.MetricsConfig != nil {
+		statsd := cfg.MetricsConfig.StatsD
+		if cfg.MetricsConfig.File == "" && cfg.MetricsConfig.RemoteURL == "" && statsd == nil {
+			v.errorf("metrics must define a file, a remote url or a statsd server")
+		}
+		if statsd != nil {
+			if _, _, err := net.SplitHostPort(statsd.Addr); err != nil {
+				v.errorf("invalid statsd addr: %s", statsd.Addr)
+			}
+			if len(statsd.Tags) > 0 && !statsd.DogStatsD {
+				v.errorf("statsd tags require dogstatsd")
+			}
+		}
+		if cfg.MetricsConfig.Interval < 0 {
+			v.errorf("metrics interval cannot be negative")
+		}
+	}
+
+	switch cfg.StartupPolicy {
+	case "", StartupPolicyDegrade, StartupPolicyFailFast, StartupPolicyWait:
+	default:
+		v.errorf("invalid startup policy: %s", cfg.StartupPolicy)
+	}
+
+	v.checkCIDRs(cfg.TrustedProxies)
+
+	if cfg.ACLConfig != nil {
+		for _, rules := range []*ACLRules{cfg.ACLConfig.RPC, cfg.ACLConfig.Admin} {
+			if rules != nil {
+				v.checkCIDRs(append(rules.Allow, rules.Deny...))
+			}
+		}
+	}
+
+	if cfg.QuarantineConfig != nil {
+		if cfg.QuarantineConfig.File == "" {
+			v.errorf("quarantine file must be defined")
+		}
+		if cfg.QuarantineConfig.Duration < 0 {
+			v.errorf("quarantine duration cannot be negative")
+		}
+		if cfg.QuarantineConfig.Failures < 0 {
+			v.errorf("quarantine failures cannot be negative")
+		}
+	}
+
+	if cfg.RequestTimeout < 0 {
+		v.errorf("request timeout cannot be negative")
+	}
+
+	if cfg.LogFormat != "" && cfg.LogFormat != "logfmt" && cfg.LogFormat != "json" {
+		v.errorf("log format must be logfmt or json")
+	}
+
+	if cfg.ReadAfterWrite != nil && cfg.ReadAfterWrite.Window < 0 {
+		v.errorf("read after write window cannot be negative")
+	}
+
+	if cfg.HeaderVerification != nil {
+		hv := cfg.HeaderVerification
+		if !isBlockHash(hv.CheckpointHash) {
+			v.errorf("header verification checkpoint hash must be a 32 byte hex string")
+		}
+		if hv.Source != "" && !hasBackend(cfg.Backends, hv.Source) {
+			v.errorf("header verification source %s is not a backend", hv.Source)
+		}
+	}
+
+	if cfg.MempoolConfig != nil {
+		mp := cfg.MempoolConfig
+		if mp.Primary == "" {
+			v.errorf("mempool primary must be defined")
+		} else if !hasBackend(cfg.Backends, mp.Primary) {
+			v.errorf("mempool primary %s is not a backend", mp.Primary)
+		}
+		if mp.Secondary != "" && !hasBackend(cfg.Backends, mp.Secondary) {
+			v.errorf("mempool secondary %s is not a backend", mp.Secondary)
+		}
+	}
+
+	if cfg.PrewarmConfig != nil && (cfg.PrewarmConfig.Connections < 0 || cfg.PrewarmConfig.Timeout < 0) {
+		v.errorf("prewarm connections and timeout cannot be negative")
+	}
+
+	if cfg.BlockIndex != nil && (cfg.BlockIndex.Depth < 0 || cfg.BlockIndex.Depth > maxBlockIndexDepth) {
+		v.errorf("block index depth must be between 0 and %d", maxBlockIndexDepth)
+	}
+
+	if cfg.EgressConfig != nil {
+		eg := cfg.EgressConfig
+		if eg.DailyBytes < 0 {
+			v.errorf("egress daily bytes cannot be negative")
+		}
+		if eg.WarnRatio < 0 || eg.WarnRatio > 1 {
+			v.errorf("egress warn ratio must be between 0 and 1")
+		}
+		if eg.WebhookURL != "" {
+			if _, err := url.Parse(eg.WebhookURL); err != nil {
+				v.errorf("invalid egress webhook url")
+			}
+		}
+		for _, key := range eg.Keys {
+			if key.Key == "" {
+				v.errorf("egress key must be defined")
+			}
+			if key.DailyBytes < 0 {
+				v.errorf("egress daily bytes cannot be negative")
+			}
+		}
+	}
+
+	if cfg.TxTrackerConfig != nil {
+		tt := cfg.TxTrackerConfig
+		if tt.PollInterval < 0 || tt.DropAfter < 0 || tt.Retention < 0 {
+			v.errorf("tx tracker durations cannot be negative")
+		}
+		if tt.WebhookURL != "" {
+			if _, err := url.Parse(tt.WebhookURL); err != nil {
+				v.errorf("invalid tx tracker webhook url")
+			}
+		}
+	}
+
+	v.checkRedis(cfg.RedisConfig)
+
+	for class, policy := range cfg.RetryConfig {
+		switch class {
+		case "reads", "logs", "traces", "sends":
+		default:
+			v.errorf("invalid retry method class: %s", class)
+		}
+		switch policy.Backoff {
+		case "", BackoffConstant, BackoffExponential:
+		default:
+			v.errorf("invalid retry backoff: %s", policy.Backoff)
+		}
+		if policy.MaxAttempts < 0 || policy.InitialBackoff < 0 || policy.MaxBackoff < 0 {
+			v.errorf("retry attempts and backoffs cannot be negative")
+		}
+	}
+
+	if cfg.ScorecardConfig != nil {
+		if cfg.ScorecardConfig.File == "" && cfg.ScorecardConfig.WebhookURL == "" {
+			v.errorf("scorecard must define a file or a webhook url")
+		}
+		if cfg.ScorecardConfig.Interval < 0 {
+			v.errorf("scorecard interval cannot be negative")
+		}
+	}
+
+	if cfg.CORSConfig != nil && len(cfg.CORSConfig.AllowedOrigins) == 0 {
+		v.errorf("cors must define at least one allowed origin")
+	}
+
+	if cfg.CoalesceConfig != nil && cfg.CoalesceConfig.MaxWait < 0 {
+		v.errorf("coalesce max wait cannot be negative")
+	}
+
+	if cfg.ConsulConfig != nil {
+		if cfg.ConsulConfig.Service == "" && cfg.ConsulConfig.RegisterName == "" {
+			v.errorf("consul must define a service or a register name")
+		}
+		if cfg.ConsulConfig.Interval < 0 {
+			v.errorf("consul interval cannot be negative")
+		}
+	}
+
+	v.checkTLS(cfg.TLSConfig)
+	if cfg.AdminConfig != nil {
+		v.checkTLS(cfg.AdminConfig.TLS)
+	}
+
+	if cfg.ChaosConfig != nil {
+		v.checkChaosFaults(cfg.ChaosConfig.Faults)
+	}
+
+	if cfg.BulkheadConfig != nil {
+		bh := cfg.BulkheadConfig
+		if bh.Reads < 0 || bh.Logs < 0 || bh.Traces < 0 || bh.Sends < 0 {
+			v.errorf("bulkhead limits cannot be negative")
+		}
+		if bh.MaxWait < 0 {
+			v.errorf("bulkhead max wait cannot be negative")
+		}
+	}
+
+	if cfg.ExtAuthz != nil {
+		if u, err := url.Parse(cfg.ExtAuthz.URL); err != nil || u.Host == "" {
+			v.errorf("invalid ext_authz url: %s", cfg.ExtAuthz.URL)
+		}
+		if cfg.ExtAuthz.Timeout < 0 {
+			v.errorf("ext_authz timeout cannot be negative")
+		}
+		if cfg.ExtAuthz.CacheTTL < 0 {
+			v.errorf("ext_authz cache_ttl cannot be negative")
+		}
+	}
+
+	if cfg.Concurrency != nil {
+		if cfg.Concurrency.MaxRequests < 0 || cfg.Concurrency.MaxPerKey < 0 {
+			v.errorf("concurrency limits cannot be negative")
+		}
+		for _, key := range cfg.Concurrency.Keys {
+			if key.Key == "" {
+				v.errorf("concurrency key must be defined")
+			}
+			if key.MaxRequests < 0 {
+				v.errorf("concurrency limits cannot be negative")
+			}
+		}
+	}
+
+	tenantNames := make(map[string]bool)
+	tenantPrefixes := make(map[string]bool)
+	tenantKeys := make(map[string]string)
+	for _, tenant := range cfg.Tenants {
+		if tenant.Name == "" {
+			v.errorf("tenant name must be defined")
+		} else if tenantNames[tenant.Name] {
+			v.errorf("duplicate tenant %s", tenant.Name)
+		}
+		tenantNames[tenant.Name] = true
+		if prefix := tenant.TenantPrefix(); tenantPrefixes[prefix] {
+			v.errorf("duplicate tenant prefix %s", prefix)
+		} else {
+			tenantPrefixes[prefix] = true
+		}
+		if len(tenant.Keys) == 0 {
+			v.errorf("tenant %s must define keys", tenant.Name)
+		}
+		for _, key := range tenant.Keys {
+			if other, ok := tenantKeys[key]; ok {
+				v.errorf("key %s belongs to tenants %s and %s", key, other, tenant.Name)
+			}
+			tenantKeys[key] = tenant.Name
+		}
+		if tenant.CacheQuota < 0 {
+			v.errorf("tenant %s cache quota cannot be negative", tenant.Name)
+		}
+	}
+
+	if cfg.MemoryCache != nil {
+		mc := cfg.MemoryCache
+		if mc.MaxBytes <= 0 {
+			v.errorf("memory cache max_bytes must be positive")
+		}
+		if mc.MaxEntryBytes < 0 || mc.MaxEntryBytes > mc.MaxBytes {
+			v.errorf("memory cache max_entry_bytes must be between 0 and max_bytes")
+		}
+		if mc.CompactionInterval < 0 {
+			v.errorf("memory cache compaction_interval cannot be negative")
+		}
+	}
+
+	if cfg.AdaptiveWeights != nil {
+		aw := cfg.AdaptiveWeights
+		if aw.Interval < 0 || aw.LatencyTarget < 0 {
+			v.errorf("adaptive weights durations cannot be negative")
+		}
+		if aw.Floor < 0 || aw.Ceiling < 0 || aw.Increase < 0 {
+			v.errorf("adaptive weights cannot be negative")
+		}
+		if aw.Ceiling != 0 && aw.Ceiling < aw.Floor {
+			v.errorf("adaptive weights ceiling must be at least the floor")
+		}
+		if aw.Decrease < 0 || aw.Decrease >= 1 {
+			v.errorf("adaptive weights decrease must be between 0 and 1")
+		}
+		if aw.MaxErrorRate < 0 || aw.MaxErrorRate > 1 {
+			v.errorf("adaptive weights max error rate must be between 0 and 1")
+		}
+	}
+
+	if cfg.WebsocketConfig != nil {
+		ws := cfg.WebsocketConfig
+		if ws.SendBuffer < 0 {
+			v.errorf("websocket send_buffer cannot be negative")
+		}
+		if ws.MaxConnections < 0 || ws.MaxConnectionsPerKey < 0 || ws.MaxSubscriptionsPerKey < 0 {
+			v.errorf("websocket limits cannot be negative")
+		}
+		if ws.IdleTimeout < 0 || ws.PingInterval < 0 {
+			v.errorf("websocket timeouts cannot be negative")
+		} else if ws.IdleTimeout > 0 && ws.PingInterval > 0 && ws.PingInterval >= ws.IdleTimeout {
+			v.errorf("websocket ping_interval must be shorter than idle_timeout")
+		}
+		if ws.MaxConnections > 0 && ws.MaxConnectionsPerKey > ws.MaxConnections {
+			v.warnf("websocket max_connections_per_key exceeds max_connections")
+		}
+		hasWSURL := false
+		for _, backend := range cfg.Backends {
+			if backend.WSURL != "" {
+				hasWSURL = true
+			}
+		}
+		if !hasWSURL {
+			v.warnf("[websocket] subscriptions will fail, since no backend has a ws_url")
+		}
+	}
+
+	if cfg.EstimateGas != nil && cfg.EstimateGas.Multiplier != 0 && cfg.EstimateGas.Multiplier < 1 {
+		v.errorf("estimate gas multiplier must be at least 1")
+	}
+
+	if cfg.JWTConfig != nil {
+		jwt := cfg.JWTConfig
+		if jwt.Issuer == "" || jwt.Audience == "" || jwt.JWKSURL == "" {
+			v.errorf("jwt issuer, audience and jwks url must be defined")
+		}
+		if _, err := url.Parse(jwt.JWKSURL); err != nil {
+			v.errorf("invalid jwt jwks url: %s", jwt.JWKSURL)
+		}
+		if jwt.RefreshInterval < 0 {
+			v.errorf("jwt refresh interval cannot be negative")
+		}
+		var restricted bool
+		for _, rule := range jwt.Rules {
+			if rule.Claim == "" || rule.Value == "" {
+				v.errorf("jwt rule claim and value must be defined")
+			}
+			if rule.Tier != "" && !hasRateLimitKey(cfg.RateLimitConfig, rule.Tier) {
+				v.warnf("jwt rule tier %s names no [[rate_limit.key]], so its tokens use the default rate limit", rule.Tier)
+			}
+			restricted = restricted || len(rule.Methods) > 0
+		}
+		if restricted && !jwt.Required && len(jwt.DefaultMethods) == 0 {
+			v.warnf("jwt rules restrict methods, but requests without a token may call every method; set required or default_methods")
+		}
+	}
+}
+
+// checkCrossFields checks settings that are only wrong in combination, or
+// in the environment chaind runs in.
+func (v *Validation) checkCrossFields(cfg *Config) {
+	if cfg.UseTLS && cfg.CertPath == "" && cfg.TLSConfig == nil {
+		v.errorf("use_tls requires a cert_path or a [tls] stanza")
+	}
+
+	if cfg.Features.Auditor {
+		if cfg.LogAuditorConfig == nil || cfg.LogAuditorConfig.LogFile == "" {
+			v.errorf("the auditor feature requires a [log_auditor] log file")
+		} else if err := checkWritable(cfg.LogAuditorConfig.LogFile); err != nil {
+			v.errorf("log auditor log file %s is not writable: %v", cfg.LogAuditorConfig.LogFile, err)
+		}
+		if cfg.LogAuditorConfig != nil && cfg.LogAuditorConfig.RetentionDays < 0 {
+			v.errorf("log auditor retention_days cannot be negative")
+		}
+	} else if cfg.LogAuditorConfig != nil {
+		v.warnf("[log_auditor] is ignored, since the auditor feature is disabled")
+	}
+
+	// a backend group serves a single network, since its cache keys share
+	// a prefix
+	for _, backend := range cfg.Backends {
+		if backend.Chain != cfg.Backends[0].Chain || backend.Network != cfg.Backends[0].Network {
+			v.errorf("backends %s and %s serve different chains or networks", cfg.Backends[0].Name, backend.Name)
+			break
+		}
+	}
+
+	if cfg.Features.Cache && cfg.RedisConfig == nil {
+		v.errorf("the cache feature requires a [redis] stanza")
+	} else if !cfg.Features.Cache && cfg.RedisConfig != nil {
+		v.warnf("[redis] is ignored, since the cache feature is disabled")
+	}
+	if !cfg.Features.Cache && cfg.MemoryCache != nil {
+		v.warnf("[memory_cache] is ignored, since the cache feature is disabled")
+	}
+
+	if !cfg.Features.Metrics && cfg.MetricsConfig != nil {
+		v.warnf("[metrics] is ignored, since the metrics feature is disabled")
+	}
+	if !cfg.Features.Admin && cfg.AdminConfig != nil {
+		v.warnf("[admin] is ignored, since the admin feature is disabled")
+	}
+
+	if cfg.ChaosConfig != nil && len(cfg.ChaosConfig.Faults) > 0 {
+		v.warnf("[chaos] injects faults into requests, and shouldn't be used in production")
+	}
+}
+
+func (v *Validation) checkRateLimitPolicy(policy *RateLimitPolicy) {
+	if policy.Rate <= 0 {
+		v.errorf("rate limit rate must be positive")
+	}
+	if policy.Burst < 0 {
+		v.errorf("rate limit burst cannot be negative")
+	}
+	if policy.MaxDelay < 0 {
+		v.errorf("rate limit max delay cannot be negative")
+	}
+}
+
+func ValidateChaosFaults(faults []ChaosFault) error {
+	v := new(Validation)
+	v.checkChaosFaults(faults)
+	return v.Err()
+}
+
+func (v *Validation) checkChaosFaults(faults []ChaosFault) {
+	for _, fault := range faults {
+		if fault.Latency < 0 {
+			v.errorf("chaos latency cannot be negative")
+		}
+		if fault.DropRate < 0 || fault.DropRate > 1 {
+			v.errorf("chaos drop rate must be between 0 and 1")
+		}
+	}
+}
+
+func (v *Validation) checkTLS(cfg *TLSConfig) {
+	if cfg == nil {
+		return
+	}
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		v.errorf("tls cert file and key file must be defined")
+	}
+	if cfg.RequireClientCert && cfg.ClientCAFile == "" {
+		v.errorf("tls client ca file must be defined to require client certs")
+	}
+	for _, identity := range cfg.Identities {
+		if identity.Subject == "" || identity.Key == "" {
+			v.errorf("tls identity subject and key must be defined")
+		}
+	}
+}
+
+func (v *Validation) checkCIDRs(cidrs []string) {
+	for _, cidr := range cidrs {
+		if strings.Contains(cidr, "/") {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				v.errorf("invalid CIDR range: %s", cidr)
+			}
+		} else if net.ParseIP(cidr) == nil {
+			v.errorf("invalid address: %s", cidr)
+		}
+	}
+}
+
+func (v *Validation) checkRedis(cfg *RedisConfig) {
+	if cfg == nil {
+		return
+	}
+	if (cfg.MasterName == "") != (len(cfg.SentinelAddrs) == 0) {
+		v.errorf("redis master name and sentinel addrs must be defined together")
+	}
+	topologies := 0
+	for _, defined := range []bool{cfg.URL != "", cfg.MasterName != "", len(cfg.ClusterAddrs) > 0} {
+		if defined {
+			topologies++
+		}
+	}
+	if topologies > 1 {
+		v.errorf("redis must define only one of url, sentinel addrs or cluster addrs")
+	}
+	if len(cfg.ClusterAddrs) > 0 && cfg.DB != 0 {
+		v.errorf("redis cluster doesn't support selecting a db")
+	}
+}
+
+// checkWritable checks that the file can be appended to, or created if it
+// doesn't exist, without modifying it.
+func checkWritable(file string) error {
+	if _, err := os.Stat(file); err == nil {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	}
+
+	probe, err := ioutil.TempFile(filepath.Dir(file), ".chaind-probe")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+func hasBackend(backends []Backend, name string) bool {
+	for _, backend := range backends {
+		if backend.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func hasRateLimitKey(cfg *RateLimitConfig, key string) bool {
+	if cfg == nil {
+		return false
+	}
+	for _, k := range cfg.Keys {
+		if k.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func isBlockHash(hash string) bool {
+	if len(hash) != 66 || !strings.HasPrefix(hash, "0x") {
+		return false
+	}
+	for _, c := range hash[2:] {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
+
+func isOptionalNamespace(ns string) bool {
+	for _, known := range OptionalNamespaces {
+		if ns == known {
+			return true
+		}
+	}
+	return false
+}
+
+func validationError(msg string) error {
+	return errors.New(fmt.Sprintf("invalid config: %s", msg))
+}
@@ -0,0 +1,279 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kyokan/chaind/pkg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateReportsAllErrors(t *testing.T) {
+	cfg := testConfig()
+	cfg.Features.Cache = true
+	cfg.RequestTimeout = -1
+	cfg.LogFormat = "xml"
+	cfg.Backends[0].Tier = -1
+
+	v := Validate(cfg)
+	require.Equal(t, []string{
+		"backend tier cannot be negative",
+		"request timeout cannot be negative",
+		"log format must be logfmt or json",
+	}, v.Errors)
+	require.Empty(t, v.Warnings)
+	require.Contains(t, v.Err().Error(), "invalid config: 3 problems")
+
+	cfg.RequestTimeout = 0
+	cfg.LogFormat = ""
+	require.EqualError(t, ValidateConfig(cfg), "invalid config: backend tier cannot be negative")
+}
+
+func TestValidateCrossFields(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chaind-config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := testConfig()
+	cfg.UseTLS = true
+	cfg.Features.Auditor = true
+	cfg.LogAuditorConfig = &LogAuditorConfig{
+		LogFile: filepath.Join(dir, "missing", "audit.log"),
+	}
+	v := Validate(cfg)
+	require.Len(t, v.Errors, 2)
+	require.Equal(t, "use_tls requires a cert_path or a [tls] stanza", v.Errors[0])
+	require.Contains(t, v.Errors[1], "is not writable")
+	require.Equal(t, []string{"[redis] is ignored, since the cache feature is disabled"}, v.Warnings)
+
+	cfg.UseTLS = false
+	cfg.LogAuditorConfig.LogFile = filepath.Join(dir, "audit.log")
+	cfg.Features.Cache = true
+	v = Validate(cfg)
+	require.Empty(t, v.Errors)
+	require.Empty(t, v.Warnings)
+	require.NoError(t, v.Err())
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+
+	cfg.RedisConfig = nil
+	require.Equal(t, []string{"the cache feature requires a [redis] stanza"}, Validate(cfg).Errors)
+
+	cfg.Features.Cache = false
+	cfg.LogAuditorConfig.RetentionDays = -1
+	require.Equal(t, []string{"log auditor retention_days cannot be negative"}, Validate(cfg).Errors)
+}
+
+func TestValidateBackendNetworks(t *testing.T) {
+	cfg := testConfig()
+	cfg.Features.Cache = true
+	cfg.Backends[0].Chain = "ethereum"
+	cfg.Backends[0].Network = "mainnet"
+	cfg.Backends = append(cfg.Backends, Backend{
+		Type:    pkg.EthBackend,
+		URL:     "http://localhost:8546",
+		Name:    "sepolia",
+		Chain:   "ethereum",
+		Network: "sepolia",
+	})
+	require.Equal(t, []string{"backends local and sepolia serve different chains or networks"}, Validate(cfg).Errors)
+
+	cfg.Backends[1].Network = "mainnet"
+	require.Empty(t, Validate(cfg).Errors)
+	require.Equal(t, "ethereum:mainnet:", CacheKeyPrefix(cfg.Backends))
+
+	cfg.Backends[0].Chain = ""
+	cfg.Backends[1].Chain = ""
+	require.Contains(t, Validate(cfg).Errors, "backend network requires a chain")
+	require.Equal(t, "", CacheKeyPrefix(cfg.Backends))
+}
+
+func TestValidateMempool(t *testing.T) {
+	cfg := testConfig()
+	cfg.Features.Cache = true
+	cfg.MempoolConfig = &MempoolConfig{Secondary: "missing"}
+	require.Equal(t, []string{
+		"mempool primary must be defined",
+		"mempool secondary missing is not a backend",
+	}, Validate(cfg).Errors)
+
+	cfg.MempoolConfig = &MempoolConfig{Primary: "local"}
+	require.Empty(t, Validate(cfg).Errors)
+}
+
+func TestValidateStatsD(t *testing.T) {
+	cfg := testConfig()
+	cfg.Features.Cache = true
+	cfg.Features.Metrics = true
+	cfg.MetricsConfig = &MetricsConfig{
+		StatsD: &StatsDConfig{Addr: "localhost", Tags: []string{"env:staging"}},
+	}
+	require.Equal(t, []string{
+		"invalid statsd addr: localhost",
+		"statsd tags require dogstatsd",
+	}, Validate(cfg).Errors)
+
+	cfg.MetricsConfig.StatsD = &StatsDConfig{Addr: "localhost:8125", Tags: []string{"env:staging"}, DogStatsD: true}
+	require.Empty(t, Validate(cfg).Errors)
+}
+
+func TestValidateShims(t *testing.T) {
+	cfg := testConfig()
+	cfg.Features.Cache = true
+	cfg.Backends[0].Shims = []Shim{
+		{Rename: "debug_traceTransaction"},
+		{Method: ShimAllMethods, Rename: "eth_call"},
+		{Method: "trace_transaction", AppendParams: []string{"{tracer"}},
+		{Method: "trace_transaction"},
+	}
+	require.Equal(t, []string{
+		"backend local shim method must be defined",
+		"backend local can't rename all methods",
+		"backend local shim for trace_transaction appends invalid JSON: {tracer",
+		"backend local has more than one shim for trace_transaction",
+	}, Validate(cfg).Errors)
+}
+
+func TestValidateExtAuthz(t *testing.T) {
+	cfg := testConfig()
+	cfg.Features.Cache = true
+	cfg.ExtAuthz = &ExtAuthzConfig{URL: "policy:9000", Timeout: -time.Second, CacheTTL: -time.Second}
+	require.Equal(t, []string{
+		"invalid ext_authz url: policy:9000",
+		"ext_authz timeout cannot be negative",
+		"ext_authz cache_ttl cannot be negative",
+	}, Validate(cfg).Errors)
+
+	cfg.ExtAuthz = &ExtAuthzConfig{URL: "http://policy:9000/check"}
+	require.Empty(t, Validate(cfg).Errors)
+}
+
+func TestValidateWSBackends(t *testing.T) {
+	cfg := testConfig()
+	cfg.Features.Cache = true
+	cfg.Backends[0].WSURL = "http://localhost:8546"
+	cfg.Backends[0].WSHeadTimeout = -time.Second
+	require.Equal(t, []string{
+		"invalid ws url: http://localhost:8546",
+		"backend local ws_head_timeout cannot be negative",
+	}, Validate(cfg).Errors)
+
+	cfg.Backends[0].WSURL = ""
+	cfg.Backends[0].WSHeadTimeout = time.Minute
+	require.Equal(t, []string{
+		"backend local ws_head_timeout requires a ws_url",
+	}, Validate(cfg).Errors)
+
+	cfg.Backends[0].WSURL = "wss://localhost:8546"
+	require.Empty(t, Validate(cfg).Errors)
+}
+
+func TestValidateWebsocket(t *testing.T) {
+	cfg := testConfig()
+	cfg.Features.Cache = true
+	cfg.WebsocketConfig = &WebsocketConfig{
+		SendBuffer:           -1,
+		MaxConnections:       10,
+		MaxConnectionsPerKey: 20,
+		IdleTimeout:          time.Minute,
+		PingInterval:         time.Minute,
+	}
+	v := Validate(cfg)
+	require.Equal(t, []string{
+		"websocket send_buffer cannot be negative",
+		"websocket ping_interval must be shorter than idle_timeout",
+	}, v.Errors)
+	require.Equal(t, []string{
+		"websocket max_connections_per_key exceeds max_connections",
+		"[websocket] subscriptions will fail, since no backend has a ws_url",
+	}, v.Warnings)
+
+	cfg.WebsocketConfig = &WebsocketConfig{MaxSubscriptionsPerKey: -1, IdleTimeout: -time.Second}
+	v = Validate(cfg)
+	require.Equal(t, []string{
+		"websocket limits cannot be negative",
+		"websocket timeouts cannot be negative",
+	}, v.Errors)
+
+	cfg.WebsocketConfig = &WebsocketConfig{}
+	cfg.Backends[0].WSURL = "ws://localhost:8546"
+	v = Validate(cfg)
+	require.Empty(t, v.Errors)
+	require.Empty(t, v.Warnings)
+}
+
+func TestValidateAdaptiveWeights(t *testing.T) {
+	cfg := testConfig()
+	cfg.Features.Cache = true
+	cfg.AdaptiveWeights = &AdaptiveWeightsConfig{Floor: 50, Ceiling: 10, Decrease: 2, MaxErrorRate: -1}
+	require.Equal(t, []string{
+		"adaptive weights ceiling must be at least the floor",
+		"adaptive weights decrease must be between 0 and 1",
+		"adaptive weights max error rate must be between 0 and 1",
+	}, Validate(cfg).Errors)
+
+	cfg.AdaptiveWeights = &AdaptiveWeightsConfig{Floor: 5, Decrease: 0.7}
+	require.Empty(t, Validate(cfg).Errors)
+}
+
+func TestValidateTenants(t *testing.T) {
+	cfg := testConfig()
+	cfg.Features.Cache = true
+	cfg.Tenants = []TenantConfig{
+		{Name: "acme", Keys: []string{"k1"}, CacheQuota: -1},
+		{Name: "acme", Keys: []string{"k1"}, Prefix: "tenant:acme:"},
+		{Name: "globex"},
+	}
+	require.Equal(t, []string{
+		"tenant acme cache quota cannot be negative",
+		"duplicate tenant acme",
+		"duplicate tenant prefix tenant:acme:",
+		"key k1 belongs to tenants acme and acme",
+		"tenant globex must define keys",
+	}, Validate(cfg).Errors)
+}
+
+func TestValidateMemoryCache(t *testing.T) {
+	cfg := testConfig()
+	cfg.Features.Cache = true
+	cfg.MemoryCache = &MemoryCacheConfig{MaxEntryBytes: 10, CompactionInterval: -time.Second}
+	require.Equal(t, []string{
+		"memory cache max_bytes must be positive",
+		"memory cache max_entry_bytes must be between 0 and max_bytes",
+		"memory cache compaction_interval cannot be negative",
+	}, Validate(cfg).Errors)
+
+	cfg.MemoryCache = &MemoryCacheConfig{MaxBytes: 1 << 20}
+	require.Empty(t, Validate(cfg).Errors)
+}
+
+func TestValidateJWTRuleTier(t *testing.T) {
+	cfg := testConfig()
+	cfg.Features.Cache = true
+	cfg.JWTConfig = &JWTConfig{
+		Issuer:   "https://issuer.example",
+		Audience: "chaind",
+		JWKSURL:  "https://issuer.example/jwks",
+		Required: true,
+		Rules: []JWTRule{
+			{Claim: "groups", Value: "readers", Tier: "readers"},
+		},
+	}
+	v := Validate(cfg)
+	require.Empty(t, v.Errors)
+	require.Equal(t, []string{"jwt rule tier readers names no [[rate_limit.key]], so its tokens use the default rate limit"}, v.Warnings)
+
+	cfg.RateLimitConfig = &RateLimitConfig{
+		RateLimitPolicy: RateLimitPolicy{Rate: 10, Burst: 10},
+		Keys: []RateLimitKey{
+			{Key: "readers", RateLimitPolicy: RateLimitPolicy{Rate: 100, Burst: 100}},
+		},
+	}
+	v = Validate(cfg)
+	require.Empty(t, v.Errors)
+	require.Empty(t, v.Warnings)
+}
@@ -0,0 +1,82 @@
+// Package errors defines the JSON-RPC error codes chaind returns to
+// clients, so that they can branch on codes rather than parse messages.
+package errors
+
+import (
+	"github.com/kyokan/chaind/pkg/jsonrpc"
+)
+
+const (
+	// MethodBlocked is returned for methods the client isn't allowed to
+	// call, "method not supported" as defined by EIP-1474.
+	MethodBlocked = -32004
+	// RateLimited is returned when a request is rejected by a rate limit,
+	// "limit exceeded" as defined by EIP-1474.
+	RateLimited = -32005
+	// Timeout is returned for requests that exceeded the request timeout.
+	Timeout = -32040
+	// BackendUnavailable is returned when no healthy backend can serve the
+	// request.
+	BackendUnavailable = -32041
+	// Busy is returned when the RPC listener is at its concurrency cap, in
+	// total or for the client, or a call's method class is at its bulkhead
+	// limit.
+	Busy = -32043
+	// BadResponse is returned when the backend's response can't be passed
+	// on: it's malformed, or doesn't match the verified header chain.
+	BadResponse = -32044
+)
+
+var names = map[int]string{
+	MethodBlocked:      "method_blocked",
+	RateLimited:        "rate_limited",
+	Timeout:            "timeout",
+	BackendUnavailable: "backend_unavailable",
+	Busy:               "busy",
+	BadResponse:        "bad_response",
+}
+
+// retryable holds the codes of errors that a retry may not run into, e.g.
+// because it's served by another backend. chaind answers them with status
+// 200 when the request's batch or the backend's response carries them.
+var retryable = map[int]bool{
+	Timeout:            true,
+	BackendUnavailable: true,
+	BadResponse:        true,
+}
+
+// IsRetryable returns whether a request that failed with the given code may
+// be retried as is.
+func IsRetryable(code int) bool {
+	return retryable[code]
+}
+
+// Name returns the machine-readable name of a chaind error code, e.g.
+// rate_limited, or an empty string for other codes.
+func Name(code int) string {
+	return names[code]
+}
+
+// New returns the JSON-RPC error of the given code. The data of chaind
+// errors carries the code's name as chaind_error, along with the given
+// fields.
+func New(code int, msg string, fields map[string]interface{}) *jsonrpc.ErrorData {
+	errData := &jsonrpc.ErrorData{
+		Code:    code,
+		Message: msg,
+	}
+	name := Name(code)
+	if name == "" && len(fields) == 0 {
+		return errData
+	}
+
+	data := make(map[string]interface{}, len(fields)+1)
+	for k, v := range fields {
+		data[k] = v
+	}
+	if name != "" {
+		data["chaind_error"] = name
+	}
+	errData.Data = data
+	return errData
+}
@@ -0,0 +1,27 @@
+package errors
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	out, err := json.Marshal(New(RateLimited, "rate limit exceeded", map[string]interface{}{"retry_after": 1}))
+	require.NoError(t, err)
+	require.Equal(t, `{"code":-32005,"message":"rate limit exceeded","data":{"chaind_error":"rate_limited","retry_after":1}}`, string(out))
+
+	out, err = json.Marshal(New(-32602, "bad request", nil))
+	require.NoError(t, err)
+	require.Equal(t, `{"code":-32602,"message":"bad request"}`, string(out))
+	require.Equal(t, "", Name(-32602))
+}
+
+func TestIsRetryable(t *testing.T) {
+	require.True(t, IsRetryable(BackendUnavailable))
+	require.True(t, IsRetryable(BadResponse))
+	require.True(t, IsRetryable(Timeout))
+	require.False(t, IsRetryable(RateLimited))
+	require.False(t, IsRetryable(-32602))
+}
@@ -0,0 +1,157 @@
+package events
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kyokan/chaind/pkg/config"
+)
+
+type Type string
+
+const (
+	// NewHead is published when the chain head advances. Data is NewHeadData.
+	NewHead Type = "new_head"
+	// Failover is published when traffic moves to another backend. Data is
+	// FailoverData.
+	Failover Type = "failover"
+	// BackendHealth is published when a backend passes or fails a
+	// healthcheck after previously doing the opposite. Data is
+	// BackendHealthData.
+	BackendHealth Type = "backend_health"
+	// CacheInvalidation is published when cache keys are purged. Data is
+	// CacheInvalidationData.
+	CacheInvalidation Type = "cache_invalidation"
+	// ConfigReload is published when a new config is applied. Data is
+	// ConfigReloadData.
+	ConfigReload Type = "config_reload"
+)
+
+// DefaultBufferSize is the number of events buffered per subscription.
+// Events published to a full subscription are dropped, so that a slow
+// subscriber can't hold up the publisher.
+const DefaultBufferSize = 64
+
+type Event struct {
+	Type Type        `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+type NewHeadData struct {
+	Number uint64 `json:"number"`
+}
+
+type FailoverData struct {
+	BackendType string `json:"backend_type"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+}
+
+type BackendHealthData struct {
+	Backend string `json:"backend"`
+	Healthy bool   `json:"healthy"`
+	// Behind is set when the backend became unhealthy because it is syncing
+	// or has fallen behind the chain.
+	Behind bool `json:"behind,omitempty"`
+}
+
+type CacheInvalidationData struct {
+	Keys []string `json:"keys"`
+}
+
+type ConfigReloadData struct {
+	// Changes lists the changed config keys, e.g. "rate_limit.rate".
+	Changes []string `json:"changes"`
+	// Config is the new config. It is not serialized, since it may contain
+	// secrets.
+	Config *config.Config `json:"-"`
+}
+
+// Bus is an in-process publish/subscribe event bus. A nil *Bus is valid,
+// and discards published events.
+type Bus struct {
+	subs map[*Subscription]bool
+	mtx  sync.RWMutex
+}
+
+type Subscription struct {
+	bus     *Bus
+	types   map[Type]bool
+	events  chan Event
+	dropped uint64
+	once    sync.Once
+}
+
+func NewBus() *Bus {
+	return &Bus{
+		subs: make(map[*Subscription]bool),
+	}
+}
+
+// Subscribe returns a subscription to events of the given types, or to all
+// events if no types are given.
+func (b *Bus) Subscribe(types ...Type) *Subscription {
+	sub := &Subscription{
+		bus:    b,
+		types:  make(map[Type]bool),
+		events: make(chan Event, DefaultBufferSize),
+	}
+	for _, t := range types {
+		sub.types[t] = true
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.subs[sub] = true
+	return sub
+}
+
+// Publish delivers an event of the given type to all matching
+// subscriptions without blocking.
+func (b *Bus) Publish(t Type, data interface{}) {
+	if b == nil {
+		return
+	}
+
+	ev := Event{
+		Type: t,
+		Time: time.Now(),
+		Data: data,
+	}
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	for sub := range b.subs {
+		if len(sub.types) > 0 && !sub.types[t] {
+			continue
+		}
+
+		select {
+		case sub.events <- ev:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+// Events returns the channel events are delivered on. It is closed when the
+// subscription is closed.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Dropped returns the number of events dropped because the subscription's
+// buffer was full.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.bus.mtx.Lock()
+		defer s.bus.mtx.Unlock()
+		delete(s.bus.subs, s)
+		close(s.events)
+	})
+}
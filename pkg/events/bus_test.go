@@ -0,0 +1,45 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBus(t *testing.T) {
+	bus := NewBus()
+	all := bus.Subscribe()
+	heads := bus.Subscribe(NewHead)
+
+	bus.Publish(NewHead, NewHeadData{Number: 1})
+	bus.Publish(Failover, FailoverData{From: "local", To: "infura"})
+
+	ev := <-heads.Events()
+	require.Equal(t, NewHead, ev.Type)
+	require.Equal(t, NewHeadData{Number: 1}, ev.Data)
+	require.Len(t, heads.Events(), 0)
+	require.Len(t, all.Events(), 2)
+
+	heads.Close()
+	heads.Close()
+	_, ok := <-heads.Events()
+	require.False(t, ok)
+	bus.Publish(NewHead, NewHeadData{Number: 2})
+	require.Len(t, all.Events(), 3)
+}
+
+func TestBusDropsForSlowSubscribers(t *testing.T) {
+	bus := NewBus()
+	sub := bus.Subscribe()
+	for i := 0; i < DefaultBufferSize+3; i++ {
+		bus.Publish(NewHead, NewHeadData{Number: uint64(i)})
+	}
+
+	require.Len(t, sub.Events(), DefaultBufferSize)
+	require.Equal(t, uint64(3), sub.Dropped())
+}
+
+func TestNilBus(t *testing.T) {
+	var bus *Bus
+	bus.Publish(NewHead, NewHeadData{})
+}
@@ -0,0 +1,32 @@
+package pkg
+
+const (
+	APIKeyHeader      = "X-Api-Key"
+	RequestIDHeader   = "X-Request-Id"
+	CacheStatusHeader = "X-Chaind-Cache"
+	TagHeader         = "X-Chaind-Tag"
+	DecodeHeader      = "X-Chaind-Decode"
+	FieldsHeader      = "X-Chaind-Fields"
+	VerifiedHeader    = "X-Chaind-Verified"
+	DebugHeader       = "X-Chaind-Debug"
+	DebugInfoHeader   = "X-Chaind-Debug-Info"
+
+	RateLimitLimitHeader     = "X-RateLimit-Limit"
+	RateLimitRemainingHeader = "X-RateLimit-Remaining"
+	RateLimitResetHeader     = "X-RateLimit-Reset"
+	RetryAfterHeader         = "Retry-After"
+
+	EgressLimitHeader   = "X-Chaind-Egress-Limit"
+	EgressUsedHeader    = "X-Chaind-Egress-Used"
+	EgressWarningHeader = "X-Chaind-Egress-Warning"
+)
+
+const (
+	CacheHit  = "HIT"
+	CacheMiss = "MISS"
+)
+
+const (
+	VerifiedMatch    = "MATCH"
+	VerifiedMismatch = "MISMATCH"
+)
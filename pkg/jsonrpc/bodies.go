@@ -14,8 +14,9 @@ type ErrorResponse struct {
 }
 
 type ErrorData struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
 }
 
 type Request struct {
@@ -24,7 +25,46 @@ type Request struct {
 	Method  string          `json:"method"`
 	Params  json.RawMessage `json:"params"`
 
-	pather *JSONPather
+	pather       *JSONPather
+	notification bool
+}
+
+// IsNotification returns whether the request has no id member, in which case
+// the client expects no response to it. Requests with a null id are not
+// notifications.
+func (r *Request) IsNotification() bool {
+	return r.notification
+}
+
+func (r *Request) UnmarshalJSON(data []byte) error {
+	type plain Request
+	var fields struct {
+		plain
+		Id json.RawMessage `json:"id"`
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	*r = Request(fields.plain)
+	if fields.Id == nil {
+		r.notification = true
+		return nil
+	}
+	return json.Unmarshal(fields.Id, &r.Id)
+}
+
+// MarshalJSON omits the id of notifications, so that they are forwarded as
+// notifications rather than as requests with a null id.
+func (r Request) MarshalJSON() ([]byte, error) {
+	type plain Request
+	if !r.notification {
+		return json.Marshal(plain(r))
+	}
+	return json.Marshal(struct {
+		Jsonrpc string          `json:"jsonrpc"`
+		Method  string          `json:"method"`
+		Params  json.RawMessage `json:"params"`
+	}{r.Jsonrpc, r.Method, r.Params})
 }
 
 func (r *Request) ParamsPather() (*JSONPather) {
@@ -45,6 +85,7 @@ type Response struct {
 	Jsonrpc string          `json:"jsonrpc"`
 	Id      interface{}     `json:"id"`
 	Result  json.RawMessage `json:"result"`
+	Error   *ErrorData      `json:"error,omitempty"`
 
 	pather *JSONPather
 }
@@ -8,6 +8,13 @@ import (
 	"io/ioutil"
 	)
 
+// Executor executes JSON-RPC calls against a backend. Client implements it,
+// and subsystems that poll backends take an Executor so that their tests can
+// substitute a fake.
+type Executor interface {
+	Execute(method string, params interface{}) (*Response, error)
+}
+
 type Client struct {
 	url    string
 	client *http.Client
@@ -22,6 +29,15 @@ func NewClient(url string, timeout time.Duration) *Client {
 	}
 }
 
+// NewClientWithHTTP creates a client that sends requests with the given
+// HTTP client, e.g. one configured for TLS.
+func NewClientWithHTTP(url string, client *http.Client) *Client {
+	return &Client{
+		url:    url,
+		client: client,
+	}
+}
+
 func (c *Client) Execute(method string, params interface{}) (*Response, error) {
 	if params == nil {
 		params = []interface{}{}
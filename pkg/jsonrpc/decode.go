@@ -0,0 +1,141 @@
+package jsonrpc
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+const DecodedKey = "_decoded"
+
+// numericMethods return a single hex quantity as their result.
+var numericMethods = map[string]bool{
+	"eth_blockNumber":                      true,
+	"eth_chainId":                          true,
+	"eth_estimateGas":                      true,
+	"eth_gasPrice":                         true,
+	"eth_getBalance":                       true,
+	"eth_getBlockTransactionCountByHash":   true,
+	"eth_getBlockTransactionCountByNumber": true,
+	"eth_getTransactionCount":              true,
+	"eth_getUncleCountByBlockHash":         true,
+	"eth_getUncleCountByBlockNumber":       true,
+	"eth_maxPriorityFeePerGas":             true,
+	"net_peerCount":                        true,
+}
+
+// quantityFields are the object fields that hold hex quantities, as opposed
+// to hex data such as hashes and addresses.
+var quantityFields = map[string]bool{
+	"balance":              true,
+	"baseFeePerGas":        true,
+	"blockNumber":          true,
+	"cumulativeGasUsed":    true,
+	"difficulty":           true,
+	"effectiveGasPrice":    true,
+	"gas":                  true,
+	"gasLimit":             true,
+	"gasPrice":             true,
+	"gasUsed":              true,
+	"logIndex":             true,
+	"maxFeePerGas":         true,
+	"maxPriorityFeePerGas": true,
+	"nonce":                true,
+	"number":               true,
+	"size":                 true,
+	"status":               true,
+	"timestamp":            true,
+	"totalDifficulty":      true,
+	"transactionIndex":     true,
+	"type":                 true,
+	"value":                true,
+}
+
+// AddDecodedQuantities returns a copy of the JSON-RPC response body with the
+// hex quantities in its result repeated as decimal strings under
+// DecodedKey. Decimal strings are used since balances overflow JSON numbers.
+// Responses without a result, or whose result has nothing to decode, are
+// returned unchanged.
+func AddDecodedQuantities(method string, body []byte) ([]byte, error) {
+	var res map[string]json.RawMessage
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil, err
+	}
+	rawResult, ok := res["result"]
+	if !ok {
+		return body, nil
+	}
+	var result interface{}
+	if err := json.Unmarshal(rawResult, &result); err != nil {
+		return nil, err
+	}
+
+	var decoded interface{}
+	if str, ok := result.(string); ok {
+		if numericMethods[method] {
+			decoded = decodeQuantity(str)
+		}
+	} else {
+		decoded = decodeFields(result)
+	}
+	if decoded == nil {
+		return body, nil
+	}
+
+	out, err := json.Marshal(decoded)
+	if err != nil {
+		return nil, err
+	}
+	res[DecodedKey] = out
+	return json.Marshal(res)
+}
+
+func decodeFields(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{})
+		for k, field := range v {
+			if str, ok := field.(string); ok {
+				if quantityFields[k] {
+					if dec := decodeQuantity(str); dec != nil {
+						out[k] = dec
+					}
+				}
+				continue
+			}
+			if dec := decodeFields(field); dec != nil {
+				out[k] = dec
+			}
+		}
+		if len(out) == 0 {
+			return nil
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		var any bool
+		for i, elem := range v {
+			out[i] = decodeFields(elem)
+			if out[i] != nil {
+				any = true
+			}
+		}
+		if !any {
+			return nil
+		}
+		return out
+	default:
+		return nil
+	}
+}
+
+func decodeQuantity(hex string) interface{} {
+	if !strings.HasPrefix(hex, "0x") {
+		return nil
+	}
+	b, err := Hex2Big(hex)
+	if err != nil {
+		return nil
+	}
+
+	return b.String()
+}
@@ -0,0 +1,40 @@
+package jsonrpc
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddDecodedQuantities(t *testing.T) {
+	out, err := AddDecodedQuantities("eth_getBalance", []byte(`{"jsonrpc":"2.0","id":1,"result":"0xde0b6b3a7640000"}`))
+	require.NoError(t, err)
+	var res map[string]interface{}
+	require.NoError(t, json.Unmarshal(out, &res))
+	require.Equal(t, "0xde0b6b3a7640000", res["result"])
+	require.Equal(t, "1000000000000000000", res[DecodedKey])
+
+	out, err = AddDecodedQuantities("eth_getTransactionReceipt", []byte(`{"jsonrpc":"2.0","id":1,"result":{"blockNumber":"0x10","transactionHash":"0x12","gasUsed":"0x5208","logs":[{"logIndex":"0x1","data":"0x00"}]}}`))
+	require.NoError(t, err)
+	res = nil
+	require.NoError(t, json.Unmarshal(out, &res))
+	require.Equal(t, map[string]interface{}{
+		"blockNumber": "16",
+		"gasUsed":     "21000",
+		"logs": []interface{}{
+			map[string]interface{}{"logIndex": "1"},
+		},
+	}, res[DecodedKey])
+
+	// hex data isn't a quantity
+	in := []byte(`{"jsonrpc":"2.0","id":1,"result":"0x1234"}`)
+	out, err = AddDecodedQuantities("eth_call", in)
+	require.NoError(t, err)
+	require.Equal(t, in, out)
+
+	in = []byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"boom"}}`)
+	out, err = AddDecodedQuantities("eth_getBalance", in)
+	require.NoError(t, err)
+	require.Equal(t, in, out)
+}
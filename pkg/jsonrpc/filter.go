@@ -0,0 +1,91 @@
+package jsonrpc
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+type fieldTree map[string]fieldTree
+
+// FilterResultFields returns a copy of the JSON-RPC response body whose
+// result only contains the given fields. Nested fields are selected with
+// dots, e.g. "transactions.hash". When the result is an array, the filter is
+// applied to each of its elements. Results that aren't objects or arrays,
+// and responses without a result, are returned unchanged.
+func FilterResultFields(body []byte, fields []string) ([]byte, error) {
+	var res map[string]json.RawMessage
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil, err
+	}
+	rawResult, ok := res["result"]
+	if !ok {
+		return body, nil
+	}
+	var result interface{}
+	if err := json.Unmarshal(rawResult, &result); err != nil {
+		return nil, err
+	}
+
+	out, err := json.Marshal(filterFields(result, buildFieldTree(fields)))
+	if err != nil {
+		return nil, err
+	}
+	res["result"] = out
+	return json.Marshal(res)
+}
+
+// ParseFields parses a comma-separated field list.
+func ParseFields(header string) []string {
+	var fields []string
+	for _, field := range strings.Split(header, ",") {
+		field = strings.TrimSpace(field)
+		if field != "" {
+			fields = append(fields, field)
+		}
+	}
+
+	return fields
+}
+
+func buildFieldTree(fields []string) fieldTree {
+	tree := make(fieldTree)
+	for _, field := range fields {
+		node := tree
+		for _, part := range strings.Split(field, ".") {
+			child, ok := node[part]
+			if !ok {
+				child = make(fieldTree)
+				node[part] = child
+			}
+			node = child
+		}
+	}
+
+	return tree
+}
+
+func filterFields(val interface{}, tree fieldTree) interface{} {
+	// an empty tree selects the whole value
+	if len(tree) == 0 {
+		return val
+	}
+
+	switch v := val.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{})
+		for k, subtree := range tree {
+			if field, ok := v[k]; ok {
+				out[k] = filterFields(field, subtree)
+			}
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, elem := range v {
+			out[i] = filterFields(elem, tree)
+		}
+		return out
+	default:
+		return val
+	}
+}
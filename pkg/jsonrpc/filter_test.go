@@ -0,0 +1,41 @@
+package jsonrpc
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterResultFields(t *testing.T) {
+	block := []byte(`{"jsonrpc":"2.0","id":1,"result":{"hash":"0x1","number":"0x2","timestamp":"0x3","miner":"0x4","transactions":[{"hash":"0xa","input":"0xdead"},"0xb"]}}`)
+	out, err := FilterResultFields(block, ParseFields("hash, number,transactions.hash"))
+	require.NoError(t, err)
+
+	var res map[string]interface{}
+	require.NoError(t, json.Unmarshal(out, &res))
+	require.Equal(t, float64(1), res["id"])
+	require.Equal(t, map[string]interface{}{
+		"hash":   "0x1",
+		"number": "0x2",
+		"transactions": []interface{}{
+			map[string]interface{}{"hash": "0xa"},
+			"0xb",
+		},
+	}, res["result"])
+
+	logs := []byte(`{"jsonrpc":"2.0","id":1,"result":[{"address":"0x1","data":"0x2"},{"address":"0x3","data":"0x4"}]}`)
+	out, err = FilterResultFields(logs, []string{"address"})
+	require.NoError(t, err)
+	res = nil
+	require.NoError(t, json.Unmarshal(out, &res))
+	require.Equal(t, []interface{}{
+		map[string]interface{}{"address": "0x1"},
+		map[string]interface{}{"address": "0x3"},
+	}, res["result"])
+
+	errRes := []byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"boom"}}`)
+	out, err = FilterResultFields(errRes, []string{"hash"})
+	require.NoError(t, err)
+	require.Equal(t, errRes, out)
+}
@@ -0,0 +1,180 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+type paramKind int
+
+const (
+	kindOther paramKind = iota
+	kindData
+	kindQuantity
+	kindBlockTag
+	kindCall
+	kindFilter
+)
+
+// paramSchemas lists the kinds of the positional params of the methods
+// whose params are normalized.
+var paramSchemas = map[string][]paramKind{
+	"eth_getBalance":                          {kindData, kindBlockTag},
+	"eth_getCode":                             {kindData, kindBlockTag},
+	"eth_getTransactionCount":                 {kindData, kindBlockTag},
+	"eth_getStorageAt":                        {kindData, kindQuantity, kindBlockTag},
+	"eth_getBlockByNumber":                    {kindBlockTag},
+	"eth_getBlockByHash":                      {kindData},
+	"eth_getBlockTransactionCountByNumber":    {kindBlockTag},
+	"eth_getBlockTransactionCountByHash":      {kindData},
+	"eth_getTransactionByHash":                {kindData},
+	"eth_getTransactionByBlockNumberAndIndex": {kindBlockTag, kindQuantity},
+	"eth_getTransactionByBlockHashAndIndex":   {kindData, kindQuantity},
+	"eth_getTransactionReceipt":               {kindData},
+	"eth_getUncleByBlockNumberAndIndex":       {kindBlockTag, kindQuantity},
+	"eth_getUncleByBlockHashAndIndex":         {kindData, kindQuantity},
+	"eth_call":                                {kindCall, kindBlockTag},
+	"eth_estimateGas":                         {kindCall, kindBlockTag},
+	"eth_getLogs":                             {kindFilter},
+	"trace_transaction":                       {kindData},
+	"trace_block":                             {kindBlockTag},
+	"ots_getBlockDetails":                     {kindBlockTag},
+	"ots_getBlockDetailsByHash":               {kindData},
+}
+
+var callFields = map[string]paramKind{
+	"from":     kindData,
+	"to":       kindData,
+	"data":     kindData,
+	"input":    kindData,
+	"gas":      kindQuantity,
+	"gasPrice": kindQuantity,
+	"value":    kindQuantity,
+	"nonce":    kindQuantity,
+}
+
+var logFilterFields = map[string]paramKind{
+	"fromBlock": kindBlockTag,
+	"toBlock":   kindBlockTag,
+	"address":   kindData,
+	"topics":    kindData,
+	"blockHash": kindData,
+}
+
+// Normalized returns a copy of the request whose params are rewritten into
+// a canonical form, so that semantically identical requests can share cache
+// keys: hex data such as addresses and hashes is lowercased, quantities lose
+// their leading zeros, and "earliest" becomes block 0x0. Params of unknown
+// methods, or that don't match the method's schema, are left as is, and JSON
+// numbers keep their digits.
+//
+// The other block tags, such as "latest" and "finalized", are left as is:
+// they name different blocks over time, and resolving them would take the
+// current chain head, which handlers that need it look up themselves.
+func (r *Request) Normalized() *Request {
+	out := &Request{
+		Jsonrpc: r.Jsonrpc,
+		Id:      r.Id,
+		Method:  r.Method,
+		Params:  r.Params,
+
+		notification: r.notification,
+	}
+	schema, ok := paramSchemas[r.Method]
+	if !ok {
+		return out
+	}
+
+	// numbers are decoded as json.Number rather than float64, which would
+	// round large ones
+	dec := json.NewDecoder(bytes.NewReader(r.Params))
+	dec.UseNumber()
+	var params []interface{}
+	if err := dec.Decode(&params); err != nil {
+		return out
+	}
+	for i := range params {
+		if i < len(schema) {
+			params[i] = normalizeValue(schema[i], params[i])
+		}
+	}
+	normalized, err := json.Marshal(params)
+	if err != nil {
+		return out
+	}
+	out.Params = normalized
+	return out
+}
+
+func normalizeValue(kind paramKind, v interface{}) interface{} {
+	switch val := v.(type) {
+	case []interface{}:
+		// lists of data, e.g. log filter addresses and topics
+		for i := range val {
+			val[i] = normalizeValue(kind, val[i])
+		}
+		return val
+	case map[string]interface{}:
+		var fields map[string]paramKind
+		switch kind {
+		case kindCall:
+			fields = callFields
+		case kindFilter:
+			fields = logFilterFields
+		default:
+			return val
+		}
+		for k, fieldVal := range val {
+			if fieldKind, ok := fields[k]; ok {
+				val[k] = normalizeValue(fieldKind, fieldVal)
+			}
+		}
+		return val
+	case string:
+		return normalizeString(kind, val)
+	}
+
+	return v
+}
+
+func normalizeString(kind paramKind, s string) string {
+	switch kind {
+	case kindData:
+		if isHex(s) {
+			return strings.ToLower(s)
+		}
+	case kindQuantity:
+		return normalizeQuantity(s)
+	case kindBlockTag:
+		if s == "earliest" {
+			return "0x0"
+		}
+		return normalizeQuantity(s)
+	}
+
+	return s
+}
+
+func normalizeQuantity(s string) string {
+	if !isHex(s) {
+		return s
+	}
+	digits := strings.TrimLeft(strings.ToLower(s[2:]), "0")
+	if digits == "" {
+		digits = "0"
+	}
+	return "0x" + digits
+}
+
+func isHex(s string) bool {
+	if len(s) < 2 || (s[:2] != "0x" && s[:2] != "0X") {
+		return false
+	}
+	for _, c := range s[2:] {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,69 @@
+package jsonrpc
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalized(t *testing.T) {
+	tests := []struct {
+		method   string
+		params   string
+		expected string
+	}{
+		{
+			"eth_getBalance",
+			`["0xAbC0000000000000000000000000000000000001", "0x00Ff"]`,
+			`["0xabc0000000000000000000000000000000000001","0xff"]`,
+		},
+		{
+			"eth_getBlockByNumber",
+			`["earliest", true]`,
+			`["0x0",true]`,
+		},
+		{
+			"eth_getBlockByNumber",
+			`["latest", false]`,
+			`["latest",false]`,
+		},
+		{
+			"eth_call",
+			`[{"to":"0xABCD","data":"0xA9059CBB","value":"0x0000"},"0x01"]`,
+			`[{"data":"0xa9059cbb","to":"0xabcd","value":"0x0"},"0x1"]`,
+		},
+		{
+			"eth_getLogs",
+			`[{"fromBlock":"0x010","address":["0xAB"],"topics":[null,["0xCD"]]}]`,
+			`[{"address":["0xab"],"fromBlock":"0x10","topics":[null,["0xcd"]]}]`,
+		},
+		{
+			"eth_call",
+			`[{"to":"0xABCD","gas":100000000000000000001},"latest"]`,
+			`[{"gas":100000000000000000001,"to":"0xabcd"},"latest"]`,
+		},
+		{
+			"eth_getStorageAt",
+			`["0xAB", 12345678901234567891, "finalized"]`,
+			`["0xab",12345678901234567891,"finalized"]`,
+		},
+		{
+			"eth_sendRawTransaction",
+			`["0xF86C"]`,
+			`["0xF86C"]`,
+		},
+	}
+
+	for _, tt := range tests {
+		req := &Request{
+			Jsonrpc: "2.0",
+			Id:      1,
+			Method:  tt.method,
+			Params:  json.RawMessage(tt.params),
+		}
+		out := req.Normalized()
+		require.Equal(t, tt.expected, string(out.Params))
+		require.Equal(t, req.Id, out.Id)
+	}
+}
@@ -0,0 +1,430 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+// maxSniffDepth bounds the nesting of sniffed values, like encoding/json.
+const maxSniffDepth = 10000
+
+var errCannotSniff = errors.New("request cannot be sniffed")
+
+// Sniffed holds the raw top-level fields of a JSON-RPC request, as slices of
+// the request body. Method holds the method name without its quotes.
+type Sniffed struct {
+	Jsonrpc []byte
+	ID      []byte
+	Method  []byte
+	Params  []byte
+}
+
+// Sniff extracts the fields of a single JSON-RPC request without
+// unmarshaling it, so that hot paths that only need e.g. the method don't
+// pay for a full parse. It returns false if the body is invalid, or uses
+// features the scanner leaves to encoding/json, such as escapes in keys or
+// in the method; callers should then fall back to json.Unmarshal.
+func Sniff(body []byte) (Sniffed, bool) {
+	s := &scanner{data: body}
+	req, ok := s.request()
+	if !ok {
+		return Sniffed{}, false
+	}
+	s.skipWS()
+	return req, s.pos == len(s.data)
+}
+
+// SniffBatch is Sniff for batch requests.
+func SniffBatch(body []byte) ([]Sniffed, bool) {
+	s := &scanner{data: body}
+	s.skipWS()
+	if s.peek() != '[' {
+		return nil, false
+	}
+	s.pos++
+
+	reqs := make([]Sniffed, 0, bytes.Count(body, []byte(`"method"`)))
+	s.skipWS()
+	if s.peek() == ']' {
+		s.pos++
+	} else {
+		for {
+			req, ok := s.request()
+			if !ok {
+				return nil, false
+			}
+			reqs = append(reqs, req)
+			s.skipWS()
+			c := s.peek()
+			s.pos++
+			if c == ']' {
+				break
+			}
+			if c != ',' {
+				return nil, false
+			}
+		}
+	}
+
+	s.skipWS()
+	return reqs, s.pos == len(s.data)
+}
+
+// Request converts the sniffed fields into a Request, as json.Unmarshal
+// would.
+func (s Sniffed) Request() (Request, error) {
+	req := Request{
+		Method: string(s.Method),
+		Params: s.Params,
+	}
+	if s.Jsonrpc != nil {
+		if err := unmarshalSniffedString(s.Jsonrpc, &req.Jsonrpc); err != nil {
+			return req, err
+		}
+	}
+
+	switch {
+	case s.ID == nil:
+		req.notification = true
+	case string(s.ID) == "null":
+	case s.ID[0] == '"' && bytes.IndexByte(s.ID, '\\') == -1:
+		req.Id = string(s.ID[1 : len(s.ID)-1])
+	case s.ID[0] == '-' || (s.ID[0] >= '0' && s.ID[0] <= '9'):
+		id, err := strconv.ParseFloat(string(s.ID), 64)
+		if err != nil {
+			return req, err
+		}
+		req.Id = id
+	default:
+		if err := json.Unmarshal(s.ID, &req.Id); err != nil {
+			return req, err
+		}
+	}
+
+	return req, nil
+}
+
+// ParseRequest parses a single request, sniffing it if possible.
+func ParseRequest(body []byte) (Request, error) {
+	if sniffed, ok := Sniff(body); ok {
+		if req, err := sniffed.Request(); err == nil {
+			return req, nil
+		}
+	}
+
+	var req Request
+	err := json.Unmarshal(body, &req)
+	return req, err
+}
+
+// ParseBatch parses a batch request, sniffing it if possible.
+func ParseBatch(body []byte) ([]Request, error) {
+	if sniffed, ok := SniffBatch(body); ok {
+		reqs := make([]Request, len(sniffed))
+		var err error
+		for i := range sniffed {
+			if reqs[i], err = sniffed[i].Request(); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			return reqs, nil
+		}
+	}
+
+	var reqs []Request
+	err := json.Unmarshal(body, &reqs)
+	return reqs, err
+}
+
+func unmarshalSniffedString(raw []byte, out *string) error {
+	if string(raw) == "null" {
+		return nil
+	}
+	if raw[0] != '"' {
+		return errCannotSniff
+	}
+	if bytes.IndexByte(raw, '\\') == -1 {
+		*out = string(raw[1 : len(raw)-1])
+		return nil
+	}
+	return json.Unmarshal(raw, out)
+}
+
+type scanner struct {
+	data  []byte
+	pos   int
+	depth int
+}
+
+func (s *scanner) peek() byte {
+	if s.pos >= len(s.data) {
+		return 0
+	}
+	return s.data[s.pos]
+}
+
+func (s *scanner) skipWS() {
+	for s.pos < len(s.data) {
+		switch s.data[s.pos] {
+		case ' ', '\t', '\n', '\r':
+			s.pos++
+		default:
+			return
+		}
+	}
+}
+
+// request scans a request object, recording its known fields.
+func (s *scanner) request() (Sniffed, bool) {
+	var req Sniffed
+	ok := s.object(func(key []byte, val []byte) bool {
+		switch string(key) {
+		case "jsonrpc":
+			req.Jsonrpc = val
+		case "id":
+			req.ID = val
+		case "method":
+			if val[0] != '"' || bytes.IndexByte(val, '\\') != -1 {
+				return false
+			}
+			req.Method = val[1 : len(val)-1]
+		case "params":
+			req.Params = val
+		default:
+			// encoding/json matches keys case-insensitively
+			return !foldsToSniffedKey(key)
+		}
+		return true
+	})
+	return req, ok
+}
+
+var sniffedKeys = []string{"jsonrpc", "id", "method", "params"}
+
+func foldsToSniffedKey(key []byte) bool {
+	for _, known := range sniffedKeys {
+		if len(key) != len(known) {
+			continue
+		}
+		match := true
+		for i, c := range key {
+			if c >= 0x80 {
+				// encoding/json also folds some non-ASCII characters
+				return true
+			}
+			if c >= 'A' && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			if c != known[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// object scans an object, calling fn with each key and raw value. Escaped
+// keys aren't supported when fn is set.
+func (s *scanner) object(fn func(key []byte, val []byte) bool) bool {
+	s.skipWS()
+	if s.peek() != '{' {
+		return false
+	}
+	s.pos++
+	s.skipWS()
+	if s.peek() == '}' {
+		s.pos++
+		return true
+	}
+
+	for {
+		s.skipWS()
+		key, ok := s.str()
+		if !ok || (fn != nil && bytes.IndexByte(key, '\\') != -1) {
+			return false
+		}
+		s.skipWS()
+		if s.peek() != ':' {
+			return false
+		}
+		s.pos++
+		val, ok := s.value()
+		if !ok {
+			return false
+		}
+		if fn != nil && !fn(key[1:len(key)-1], val) {
+			return false
+		}
+		s.skipWS()
+		c := s.peek()
+		s.pos++
+		if c == '}' {
+			return true
+		}
+		if c != ',' {
+			return false
+		}
+	}
+}
+
+func (s *scanner) array() bool {
+	s.pos++
+	s.skipWS()
+	if s.peek() == ']' {
+		s.pos++
+		return true
+	}
+
+	for {
+		if _, ok := s.value(); !ok {
+			return false
+		}
+		s.skipWS()
+		c := s.peek()
+		s.pos++
+		if c == ']' {
+			return true
+		}
+		if c != ',' {
+			return false
+		}
+	}
+}
+
+// value scans any JSON value and returns it.
+func (s *scanner) value() ([]byte, bool) {
+	s.skipWS()
+	start := s.pos
+	var ok bool
+	switch c := s.peek(); {
+	case c == '"':
+		_, ok = s.str()
+	case c == '{' || c == '[':
+		s.depth++
+		if s.depth > maxSniffDepth {
+			return nil, false
+		}
+		if c == '{' {
+			ok = s.object(nil)
+		} else {
+			ok = s.array()
+		}
+		s.depth--
+	case c == 't':
+		ok = s.literal("true")
+	case c == 'f':
+		ok = s.literal("false")
+	case c == 'n':
+		ok = s.literal("null")
+	case c == '-' || (c >= '0' && c <= '9'):
+		ok = s.number()
+	}
+	if !ok {
+		return nil, false
+	}
+	return s.data[start:s.pos], true
+}
+
+// str scans a string and returns it, including its quotes.
+func (s *scanner) str() ([]byte, bool) {
+	if s.peek() != '"' {
+		return nil, false
+	}
+	start := s.pos
+	s.pos++
+	for s.pos < len(s.data) {
+		c := s.data[s.pos]
+		switch {
+		case c == '"':
+			s.pos++
+			return s.data[start:s.pos], true
+		case c == '\\':
+			if !s.escape() {
+				return nil, false
+			}
+		case c < 0x20:
+			return nil, false
+		default:
+			s.pos++
+		}
+	}
+	return nil, false
+}
+
+// escape scans an escape sequence in a string.
+func (s *scanner) escape() bool {
+	s.pos++
+	switch s.peek() {
+	case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+		s.pos++
+		return true
+	case 'u':
+		s.pos++
+		for i := 0; i < 4; i++ {
+			if !isHexDigit(s.peek()) {
+				return false
+			}
+			s.pos++
+		}
+		return true
+	}
+	return false
+}
+
+func (s *scanner) literal(lit string) bool {
+	if len(s.data)-s.pos < len(lit) || string(s.data[s.pos:s.pos+len(lit)]) != lit {
+		return false
+	}
+	s.pos += len(lit)
+	return true
+}
+
+func (s *scanner) number() bool {
+	if s.peek() == '-' {
+		s.pos++
+	}
+	switch c := s.peek(); {
+	case c == '0':
+		s.pos++
+	case c >= '1' && c <= '9':
+		s.digits()
+	default:
+		return false
+	}
+	if s.peek() == '.' {
+		s.pos++
+		if !s.digits() {
+			return false
+		}
+	}
+	if c := s.peek(); c == 'e' || c == 'E' {
+		s.pos++
+		if c := s.peek(); c == '+' || c == '-' {
+			s.pos++
+		}
+		if !s.digits() {
+			return false
+		}
+	}
+	return true
+}
+
+// digits scans one or more digits.
+func (s *scanner) digits() bool {
+	start := s.pos
+	for c := s.peek(); c >= '0' && c <= '9'; c = s.peek() {
+		s.pos++
+	}
+	return s.pos > start
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
@@ -0,0 +1,108 @@
+package jsonrpc
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSniff(t *testing.T) {
+	body := []byte(` {"jsonrpc":"2.0","id":7,"method":"eth_getBalance","params":["0xab",{"a":[1,-2.5e3,true,null,"x\"y"]}]} `)
+	sniffed, ok := Sniff(body)
+	require.True(t, ok)
+	require.Equal(t, "eth_getBalance", string(sniffed.Method))
+	require.Equal(t, "7", string(sniffed.ID))
+	require.Equal(t, `["0xab",{"a":[1,-2.5e3,true,null,"x\"y"]}]`, string(sniffed.Params))
+
+	for _, invalid := range []string{
+		``,
+		`{"method":"eth_call"`,
+		`{"method":"eth_call",}`,
+		`{"method":"eth_call"} x`,
+		`{"method":"eth_call","params":[01]}`,
+		`{"method":"eth_call","params":[tru]}`,
+		`{"method":"eth_call","params":["\x"]}`,
+		// left to encoding/json
+		`{"method":"eth_\u0063all"}`,
+		`{"Method":"eth_call"}`,
+	} {
+		_, ok := Sniff([]byte(invalid))
+		require.False(t, ok, invalid)
+	}
+}
+
+func TestParseRequest(t *testing.T) {
+	for _, body := range []string{
+		`{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}`,
+		`{"jsonrpc":"2.0","id":"abc","method":"eth_call","params":[{"to":"0x1"},"latest"]}`,
+		`{"jsonrpc":"2.0","id":null,"method":"eth_call"}`,
+		`{"jsonrpc":"2.0","method":"eth_call"}`,
+		`{"jsonrpc":"2.0","method":"eth_\u0063all"}`,
+		`{"jsonrpc":"2.0","id":{"a":1},"method":"eth_call","extra":{"k\n":1}}`,
+		`{"jsonrpc":"2.0","id":1,"Method":"eth_call"}`,
+		`{"jsonrpc":"2.0","id":1,"method":"eth_\u0063all"}`,
+	} {
+		var expected Request
+		require.NoError(t, json.Unmarshal([]byte(body), &expected))
+		req, err := ParseRequest([]byte(body))
+		require.NoError(t, err)
+		require.Equal(t, expected, req, body)
+	}
+
+	_, err := ParseRequest([]byte(`{"method":`))
+	require.Error(t, err)
+}
+
+func TestNotifications(t *testing.T) {
+	reqs, err := ParseBatch([]byte(`[{"jsonrpc":"2.0","method":"eth_subscribe"},{"jsonrpc":"2.0","id":null,"method":"eth_call"},{"jsonrpc":"2.0","method":"eth_\u0063all","params":[1]}]`))
+	require.NoError(t, err)
+	require.True(t, reqs[0].IsNotification())
+	require.False(t, reqs[1].IsNotification())
+	require.True(t, reqs[2].IsNotification())
+	require.True(t, reqs[2].Normalized().IsNotification())
+
+	// notifications are forwarded without an id, null ids are kept
+	body, err := json.Marshal(&reqs[2])
+	require.NoError(t, err)
+	require.Equal(t, `{"jsonrpc":"2.0","method":"eth_call","params":[1]}`, string(body))
+	body, err = json.Marshal(&reqs[1])
+	require.NoError(t, err)
+	require.Equal(t, `{"jsonrpc":"2.0","id":null,"method":"eth_call","params":null}`, string(body))
+}
+
+func TestParseBatch(t *testing.T) {
+	body := []byte(`[{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"},{"jsonrpc":"2.0","id":2,"method":"eth_chainId","params":[]}]`)
+	var expected []Request
+	require.NoError(t, json.Unmarshal(body, &expected))
+	reqs, err := ParseBatch(body)
+	require.NoError(t, err)
+	require.Equal(t, expected, reqs)
+
+	reqs, err = ParseBatch([]byte(`[]`))
+	require.NoError(t, err)
+	require.Len(t, reqs, 0)
+}
+
+func TestSniffDoesNotAllocate(t *testing.T) {
+	body := []byte(`{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["latest",false]}`)
+	allocs := testing.AllocsPerRun(100, func() {
+		Sniff(body)
+	})
+	require.Equal(t, float64(0), allocs)
+}
+
+func BenchmarkSniff(b *testing.B) {
+	body := []byte(`{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["latest",false]}`)
+	for i := 0; i < b.N; i++ {
+		Sniff(body)
+	}
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+	body := []byte(`{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["latest",false]}`)
+	for i := 0; i < b.N; i++ {
+		var req Request
+		json.Unmarshal(body, &req)
+	}
+}
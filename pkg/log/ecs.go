@@ -0,0 +1,85 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/inconshreveable/log15"
+)
+
+const ecsVersion = "1.6.0"
+
+// ecsFields maps context keys to their Elastic Common Schema fields. Other
+// keys are logged under the chaind namespace.
+var ecsFields = map[string]string{
+	"module":     "log.logger",
+	"path":       "url.path",
+	"status":     "http.response.status_code",
+	"elapsed":    "event.duration",
+	"request_id": "http.request.id",
+	"client":     "client.user.name",
+	"err":        "error.message",
+}
+
+var ecsLevels = map[log15.Lvl]string{
+	log15.LvlCrit:  "critical",
+	log15.LvlError: "error",
+	log15.LvlWarn:  "warning",
+	log15.LvlInfo:  "info",
+	log15.LvlDebug: "debug",
+}
+
+// ECSFormat formats records as JSON lines with Elastic Common Schema fields,
+// so that they can be shipped to Elasticsearch without an ingest pipeline.
+func ECSFormat() log15.Format {
+	return log15.FormatFunc(func(r *log15.Record) []byte {
+		out := map[string]interface{}{
+			"@timestamp":    r.Time.UTC().Format(time.RFC3339Nano),
+			"log.level":     ecsLevels[r.Lvl],
+			"message":       r.Msg,
+			"ecs.version":   ecsVersion,
+			"event.dataset": "chaind.log",
+		}
+		for i := 0; i+1 < len(r.Ctx); i += 2 {
+			k, ok := r.Ctx[i].(string)
+			if !ok {
+				k = fmt.Sprint(r.Ctx[i])
+			}
+			field, ok := ecsFields[k]
+			if !ok {
+				field = "chaind." + k
+			}
+			out[field] = ecsValue(field, r.Ctx[i+1])
+		}
+
+		b, err := json.Marshal(out)
+		if err != nil {
+			b, _ = json.Marshal(map[string]interface{}{
+				"@timestamp":    r.Time.UTC().Format(time.RFC3339Nano),
+				"log.level":     ecsLevels[r.Lvl],
+				"message":       r.Msg,
+				"ecs.version":   ecsVersion,
+				"event.dataset": "chaind.log",
+				"error.message": err.Error(),
+			})
+		}
+		return append(b, '\n')
+	})
+}
+
+func ecsValue(field string, v interface{}) interface{} {
+	switch val := v.(type) {
+	case time.Duration:
+		// ECS durations are in nanoseconds
+		if field == "event.duration" {
+			return val.Nanoseconds()
+		}
+		return val.String()
+	case error:
+		return val.Error()
+	case fmt.Stringer:
+		return val.String()
+	}
+	return v
+}
@@ -0,0 +1,40 @@
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/stretchr/testify/require"
+)
+
+func TestECSFormat(t *testing.T) {
+	r := &log15.Record{
+		Time: time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC),
+		Lvl:  log15.LvlWarn,
+		Msg:  "finished handling request",
+		Ctx: []interface{}{
+			"module", "proxy",
+			"path", "/eth",
+			"status", 200,
+			"elapsed", 1500 * time.Millisecond,
+			"err", errors.New("boom"),
+			"backend", "infura",
+		},
+	}
+
+	var out map[string]interface{}
+	require.NoError(t, json.Unmarshal(ECSFormat().Format(r), &out))
+	require.Equal(t, "2018-01-02T03:04:05Z", out["@timestamp"])
+	require.Equal(t, "warning", out["log.level"])
+	require.Equal(t, "finished handling request", out["message"])
+	require.Equal(t, "chaind.log", out["event.dataset"])
+	require.Equal(t, "proxy", out["log.logger"])
+	require.Equal(t, "/eth", out["url.path"])
+	require.Equal(t, float64(200), out["http.response.status_code"])
+	require.Equal(t, float64(1500000000), out["event.duration"])
+	require.Equal(t, "boom", out["error.message"])
+	require.Equal(t, "infura", out["chaind.backend"])
+}
@@ -4,19 +4,53 @@ import (
 	"github.com/inconshreveable/log15"
 	"os"
 	"context"
+	"sync"
 )
 
 var rootLog = log15.New()
 
 const DefaultLevel = log15.LvlInfo
 const RequestIDKey = "request_id"
+const TagKey = "tag"
+const ClientKey = "client"
+
+const (
+	FormatLogfmt = "logfmt"
+	FormatJSON   = "json"
+)
+
+var (
+	level  = DefaultLevel
+	format = FormatLogfmt
+	mtx    sync.Mutex
+)
 
 func init() {
 	SetLevel(DefaultLevel)
 }
 
-func SetLevel(level log15.Lvl) {
-	rootLog.SetHandler(log15.LvlFilterHandler(level, log15.StreamHandler(os.Stderr, log15.LogfmtFormat())))
+func SetLevel(lvl log15.Lvl) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	level = lvl
+	setHandler()
+}
+
+// SetFormat switches the log output between logfmt and ECS-compatible JSON.
+// Unknown formats fall back to logfmt.
+func SetFormat(fmt string) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	format = fmt
+	setHandler()
+}
+
+func setHandler() {
+	f := log15.LogfmtFormat()
+	if format == FormatJSON {
+		f = ECSFormat()
+	}
+	rootLog.SetHandler(log15.LvlFilterHandler(level, log15.StreamHandler(os.Stderr, f)))
 }
 
 func NewLog(module string) log15.Logger {
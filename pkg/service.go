@@ -3,4 +3,12 @@ package pkg
 type Service interface {
 	Start() error
 	Stop() error
-}
\ No newline at end of file
+}
+
+// FailingService is a Service that can fail after it has started, e.g. when
+// its listener dies. Services implementing it are restarted by the service
+// manager when they report a failure.
+type FailingService interface {
+	Service
+	Failures() <-chan error
+}
@@ -0,0 +1,38 @@
+package version
+
+import (
+	"runtime"
+)
+
+// Version, Commit and BuildDate are set at build time, e.g.
+//
+//	go build -ldflags "-X github.com/kyokan/chaind/pkg/version.Version=v1.2.0"
+//
+// The Makefile sets them from git.
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+// Info describes the build a chaind binary was built from, and the features
+// it runs with.
+type Info struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit"`
+	BuildDate string   `json:"build_date"`
+	GoVersion string   `json:"go_version"`
+	Features  []string `json:"features,omitempty"`
+}
+
+// Get returns the build info. Features are only known once the config has
+// been read, so they are passed in.
+func Get(features []string) Info {
+	return Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+		Features:  features,
+	}
+}